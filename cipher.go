@@ -0,0 +1,128 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/noiseutil"
+)
+
+// Ciphers are negotiated per tunnel. The initiator starts the noise handshake with its most preferred cipher and
+// offers every cipher it supports, the responder tries each cipher it supports to read the handshake and answers with
+// the cipher the tunnel traffic will use.
+
+type nebulaCipher struct {
+	fn noise.CipherFunc
+	// nonce is the byte order of the message counter within the nonce, noise defines it per cipher
+	nonce endianness
+}
+
+var nebulaCiphers = map[string]nebulaCipher{
+	"aes":        {fn: noiseutil.CipherAESGCM, nonce: binary.BigEndian},
+	"chachapoly": {fn: noise.CipherChaChaPoly, nonce: binary.LittleEndian},
+}
+
+// ciphersFromConfig reads `cipher`, which is either a single cipher or a list of ciphers in order of preference
+func ciphersFromConfig(c *config.C) ([]string, error) {
+	var ciphers []string
+	switch v := c.Get("cipher").(type) {
+	case nil:
+		return []string{"aes"}, nil
+	case string:
+		ciphers = []string{v}
+	case []string:
+		ciphers = v
+	case []any:
+		for _, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return nil, fmt.Errorf("cipher was not understood; `%v`, expected a cipher name", e)
+			}
+			ciphers = append(ciphers, s)
+		}
+	default:
+		return nil, fmt.Errorf("cipher was not understood; `%v`, expected a cipher name or a list of cipher names", v)
+	}
+
+	if len(ciphers) == 0 {
+		return nil, fmt.Errorf("cipher must contain at least one cipher")
+	}
+
+	for i, name := range ciphers {
+		if _, ok := nebulaCiphers[name]; !ok {
+			return nil, fmt.Errorf("cipher was not understood; `%s`, expected aes or chachapoly", name)
+		}
+		if slices.Contains(ciphers[:i], name) {
+			return nil, fmt.Errorf("cipher `%s` is listed more than once", name)
+		}
+	}
+
+	return ciphers, nil
+}
+
+// negotiateCipher is used by the responder to pick the first of its own ciphers that the initiator offered
+func negotiateCipher(ours, offered []string) (string, bool) {
+	for _, name := range ours {
+		if slices.Contains(offered, name) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// newNebulaCipherState creates a tunnel cipher state for the named cipher, the name must be in nebulaCiphers
+func newNebulaCipherState(name string, k [32]byte) *NebulaCipherState {
+	nc := nebulaCiphers[name]
+	return &NebulaCipherState{c: nc.fn.Cipher(k), nonce: nc.nonce}
+}
+
+var errHandshakeCipher = errors.New("handshake was not started with this cipher")
+
+// handshakeCipherMatches reports if the first handshake message was read with the cipher the initiator started with.
+// Without a psk the first message can be read with any cipher, so initiators list the cipher they started with first.
+// Older initiators list nothing and can only be told apart by a psk, otherwise our first cipher is assumed.
+func handshakeCipherMatches(ci *ConnectionState, msg []byte) bool {
+	hs := &NebulaHandshake{}
+	if err := hs.Unmarshal(msg); err != nil || hs.Details == nil {
+		// Leave reporting a bad message to the caller
+		return true
+	}
+	return len(hs.Details.Ciphers) == 0 || hs.Details.Ciphers[0] == ci.cipher
+}
+
+// respondCipher is used by the responder to pick the tunnel cipher from the initiators offer and record it in the reply.
+// Older initiators offer nothing and the tunnel keeps the cipher the handshake used.
+func respondCipher(ci *ConnectionState, ours []string, d *NebulaHandshakeDetails) error {
+	if len(d.Ciphers) == 0 {
+		return nil
+	}
+
+	name, ok := negotiateCipher(ours, d.Ciphers)
+	if !ok {
+		return fmt.Errorf("no cipher in common with %v", d.Ciphers)
+	}
+
+	ci.cipher = name
+	d.Cipher = name
+	d.Ciphers = nil
+	return nil
+}
+
+// acceptCipher is used by the initiator to switch to the cipher the responder picked. Older responders pick nothing
+// and the tunnel keeps the cipher the handshake used.
+func acceptCipher(ci *ConnectionState, ours []string, d *NebulaHandshakeDetails) error {
+	if d.Cipher == "" {
+		return nil
+	}
+
+	if !slices.Contains(ours, d.Cipher) {
+		return fmt.Errorf("responder picked cipher `%s` which we do not support", d.Cipher)
+	}
+
+	ci.cipher = d.Cipher
+	return nil
+}
@@ -0,0 +1,124 @@
+package nebula
+
+import (
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ciphersFromConfig(t *testing.T) {
+	c := config.NewC(test.NewLogger())
+
+	ciphers, err := ciphersFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"aes"}, ciphers)
+
+	c.Settings["cipher"] = "chachapoly"
+	ciphers, err = ciphersFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"chachapoly"}, ciphers)
+
+	c.Settings["cipher"] = []any{"chachapoly", "aes"}
+	ciphers, err = ciphersFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"chachapoly", "aes"}, ciphers)
+
+	c.Settings["cipher"] = "des"
+	_, err = ciphersFromConfig(c)
+	require.EqualError(t, err, "cipher was not understood; `des`, expected aes or chachapoly")
+
+	c.Settings["cipher"] = []any{"aes", "aes"}
+	_, err = ciphersFromConfig(c)
+	require.EqualError(t, err, "cipher `aes` is listed more than once")
+
+	c.Settings["cipher"] = []any{}
+	_, err = ciphersFromConfig(c)
+	require.EqualError(t, err, "cipher must contain at least one cipher")
+
+	c.Settings["cipher"] = []any{1}
+	_, err = ciphersFromConfig(c)
+	require.EqualError(t, err, "cipher was not understood; `1`, expected a cipher name")
+}
+
+func Test_negotiateCipher(t *testing.T) {
+	// The responder's order wins
+	name, ok := negotiateCipher([]string{"chachapoly", "aes"}, []string{"aes", "chachapoly"})
+	assert.True(t, ok)
+	assert.Equal(t, "chachapoly", name)
+
+	name, ok = negotiateCipher([]string{"chachapoly", "aes"}, []string{"aes"})
+	assert.True(t, ok)
+	assert.Equal(t, "aes", name)
+
+	_, ok = negotiateCipher([]string{"chachapoly"}, []string{"aes"})
+	assert.False(t, ok)
+}
+
+func Test_respondCipher(t *testing.T) {
+	ci := &ConnectionState{cipher: "aes"}
+	d := &NebulaHandshakeDetails{Ciphers: []string{"aes", "chachapoly"}}
+	require.NoError(t, respondCipher(ci, []string{"chachapoly", "aes"}, d))
+	assert.Equal(t, "chachapoly", ci.cipher)
+	assert.Equal(t, "chachapoly", d.Cipher)
+	assert.Nil(t, d.Ciphers)
+
+	// Older initiators offer nothing and keep the handshake cipher
+	ci = &ConnectionState{cipher: "aes"}
+	d = &NebulaHandshakeDetails{}
+	require.NoError(t, respondCipher(ci, []string{"chachapoly", "aes"}, d))
+	assert.Equal(t, "aes", ci.cipher)
+	assert.Empty(t, d.Cipher)
+
+	d = &NebulaHandshakeDetails{Ciphers: []string{"aes"}}
+	require.EqualError(t, respondCipher(ci, []string{"chachapoly"}, d), "no cipher in common with [aes]")
+}
+
+func Test_acceptCipher(t *testing.T) {
+	ci := &ConnectionState{cipher: "aes"}
+	require.NoError(t, acceptCipher(ci, []string{"aes", "chachapoly"}, &NebulaHandshakeDetails{Cipher: "chachapoly"}))
+	assert.Equal(t, "chachapoly", ci.cipher)
+
+	// Older responders pick nothing
+	ci = &ConnectionState{cipher: "aes"}
+	require.NoError(t, acceptCipher(ci, []string{"aes", "chachapoly"}, &NebulaHandshakeDetails{}))
+	assert.Equal(t, "aes", ci.cipher)
+
+	require.EqualError(t, acceptCipher(ci, []string{"aes"}, &NebulaHandshakeDetails{Cipher: "chachapoly"}), "responder picked cipher `chachapoly` which we do not support")
+	assert.Equal(t, "aes", ci.cipher)
+}
+
+func Test_handshakeCipherMatches(t *testing.T) {
+	msg := func(d *NebulaHandshakeDetails) []byte {
+		b, err := (&NebulaHandshake{Details: d}).Marshal()
+		require.NoError(t, err)
+		return b
+	}
+
+	ci := &ConnectionState{cipher: "aes"}
+	assert.True(t, handshakeCipherMatches(ci, msg(&NebulaHandshakeDetails{Ciphers: []string{"aes", "chachapoly"}})))
+	assert.False(t, handshakeCipherMatches(ci, msg(&NebulaHandshakeDetails{Ciphers: []string{"chachapoly", "aes"}})))
+	assert.True(t, handshakeCipherMatches(ci, msg(&NebulaHandshakeDetails{InitiatorIndex: 1})))
+}
+
+func Test_newNebulaCipherState(t *testing.T) {
+	var k [32]byte
+	nb := make([]byte, 12)
+	for name := range nebulaCiphers {
+		e := newNebulaCipherState(name, k)
+		d := newNebulaCipherState(name, k)
+		out, err := e.EncryptDanger(nil, []byte("ad"), []byte("hello"), 10, nb)
+		require.NoError(t, err)
+		plain, err := d.DecryptDanger(nil, []byte("ad"), out, 10, nb)
+		require.NoError(t, err, name)
+		assert.Equal(t, []byte("hello"), plain)
+	}
+
+	// The same key with a different cipher can not read the traffic
+	out, err := newNebulaCipherState("aes", k).EncryptDanger(nil, []byte("ad"), []byte("hello"), 10, nb)
+	require.NoError(t, err)
+	_, err = newNebulaCipherState("chachapoly", k).DecryptDanger(nil, []byte("ad"), out, 10, nb)
+	require.Error(t, err)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/slackhq/nebula"
+)
+
+// client talks to the control api of a running nebula process over its unix domain socket
+type client struct {
+	socket string
+	hc     *http.Client
+}
+
+func newClient(socket string) *client {
+	return &client{
+		socket: socket,
+		hc: &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		}},
+	}
+}
+
+// call invokes the named control api call with req as the body and decodes the result into res, if not nil
+func (c *client) call(name string, req any, res any) error {
+	if req == nil {
+		req = struct{}{}
+	}
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %s", err)
+	}
+
+	resp, err := c.hc.Post("http://nebula/v1/"+name, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("failed to reach nebula at %s: %s", c.socket, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var ce nebula.ControlError
+		if err := json.NewDecoder(resp.Body).Decode(&ce); err != nil || ce.Error == "" {
+			return fmt.Errorf("%s failed: %s", name, resp.Status)
+		}
+		return fmt.Errorf("%s", ce.Error)
+	}
+
+	if res == nil {
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return fmt.Errorf("failed to decode response: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,616 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/slackhq/nebula"
+	"github.com/slackhq/nebula/cert"
+)
+
+// ctlFlags holds every flag a command may register, -json is available to all commands
+type ctlFlags struct {
+	json      bool
+	byIndex   bool
+	raw       bool
+	localOnly bool
+	address   string
+}
+
+type command struct {
+	name    string
+	summary string
+	args    string
+	flags   func(fs *flag.FlagSet, f *ctlFlags)
+	exec    func(c *client, f *ctlFlags, args []string, out io.Writer) error
+}
+
+// commands mirrors the commands offered by the nebula sshd
+var commands = []*command{
+	{
+		name:    "list-hostmap",
+		summary: "List all known previously connected hosts",
+		flags:   byIndexFlag,
+		exec: func(c *client, f *ctlFlags, args []string, out io.Writer) error {
+			return listHostmap(c, f, false, out)
+		},
+	},
+	{
+		name:    "list-pending-hostmap",
+		summary: "List all handshaking hosts",
+		flags:   byIndexFlag,
+		exec: func(c *client, f *ctlFlags, args []string, out io.Writer) error {
+			return listHostmap(c, f, true, out)
+		},
+	},
+	{
+		name:    "list-lighthouse-addrmap",
+		summary: "List all lighthouse map entries",
+		exec:    listLighthouseAddrmap,
+	},
+	{
+		name:    "list-firewall-rules",
+		summary: "List all firewall rules and the traffic they have matched, counts are kept when firewall.rule_stats is true",
+		exec:    listFirewallRules,
+	},
+	{
+		name:    "reload",
+		summary: "Reloads configuration from disk, same as sending HUP to the process",
+		exec: func(c *client, f *ctlFlags, args []string, out io.Writer) error {
+			return callAndPrint(c, f, out, "ReloadConfig", nil, func(bool) string { return "Reloaded config" })
+		},
+	},
+	{
+		name:    "start-cpu-profile",
+		summary: "Starts a cpu profile and write output to the provided file, ex: `cpu-profile.pb.gz`",
+		args:    "<path>",
+		exec: func(c *client, f *ctlFlags, args []string, out io.Writer) error {
+			return profile(c, f, args, out, "StartCpuProfile", "Started cpu profile, issue stop-cpu-profile to write the output to %s")
+		},
+	},
+	{
+		name:    "stop-cpu-profile",
+		summary: "Stops a cpu profile and writes output to the previously provided file",
+		exec: func(c *client, f *ctlFlags, args []string, out io.Writer) error {
+			return callAndPrint(c, f, out, "StopCpuProfile", nil, func(bool) string {
+				return "If a CPU profile was running it is now stopped"
+			})
+		},
+	},
+	{
+		name:    "save-heap-profile",
+		summary: "Saves a heap profile to the provided path, ex: `heap-profile.pb.gz`",
+		args:    "<path>",
+		exec: func(c *client, f *ctlFlags, args []string, out io.Writer) error {
+			return profile(c, f, args, out, "SaveHeapProfile", "Mem profile created at %s")
+		},
+	},
+	{
+		name:    "mutex-profile-fraction",
+		summary: "Gets or sets runtime.SetMutexProfileFraction",
+		args:    "[rate]",
+		exec: func(c *client, f *ctlFlags, args []string, out io.Writer) error {
+			return setting(c, f, args, out, "MutexProfileFraction", "Mutex profile fraction")
+		},
+	},
+	{
+		name:    "save-mutex-profile",
+		summary: "Saves a mutex profile to the provided path, ex: `mutex-profile.pb.gz`",
+		args:    "<path>",
+		exec: func(c *client, f *ctlFlags, args []string, out io.Writer) error {
+			return profile(c, f, args, out, "SaveMutexProfile", "Mutex profile created at %s")
+		},
+	},
+	{
+		name:    "log-level",
+		summary: "Gets or sets the current log level",
+		args:    "[level]",
+		exec: func(c *client, f *ctlFlags, args []string, out io.Writer) error {
+			return setting(c, f, args, out, "LogLevel", "Log level")
+		},
+	},
+	{
+		name:    "log-format",
+		summary: "Gets or sets the current log format",
+		args:    "[format]",
+		exec: func(c *client, f *ctlFlags, args []string, out io.Writer) error {
+			return setting(c, f, args, out, "LogFormat", "Log format")
+		},
+	},
+	{
+		name:    "version",
+		summary: "Prints the currently running version of nebula",
+		exec: func(c *client, f *ctlFlags, args []string, out io.Writer) error {
+			return callAndPrint(c, f, out, "Version", nil, func(v string) string { return v })
+		},
+	},
+	{
+		name:    "device-info",
+		summary: "Prints information about the network device",
+		exec: func(c *client, f *ctlFlags, args []string, out io.Writer) error {
+			type deviceInfo struct {
+				Name string         `json:"name"`
+				Cidr []netip.Prefix `json:"cidr"`
+			}
+			return callAndPrint(c, f, out, "DeviceInfo", nil, func(d deviceInfo) string {
+				return fmt.Sprintf("name=%v cidr=%v", d.Name, d.Cidr)
+			})
+		},
+	},
+	{
+		name:    "print-cert",
+		summary: "Prints the current certificate being used or the certificate for the provided vpn addr",
+		args:    "[vpn addr]",
+		flags: func(fs *flag.FlagSet, f *ctlFlags) {
+			fs.BoolVar(&f.raw, "raw", false, "raw prints the PEM encoded certificate, not compatible with -json")
+		},
+		exec: printCert,
+	},
+	{
+		name:    "print-tunnel",
+		summary: "Prints details about a tunnel for the provided vpn addr",
+		args:    "<vpn addr>",
+		exec:    printTunnel,
+	},
+	{
+		name:    "print-relays",
+		summary: "Prints details about all relay info",
+		exec:    printRelays,
+	},
+	{
+		name:    "change-remote",
+		summary: "Changes the remote address used in the tunnel for the provided vpn addr",
+		args:    "<vpn addr>",
+		flags: func(fs *flag.FlagSet, f *ctlFlags) {
+			fs.StringVar(&f.address, "address", "", "Required: the new remote address, ip:port")
+		},
+		exec: func(c *client, f *ctlFlags, args []string, out io.Writer) error {
+			req, err := tunnelRequest(f, args)
+			if err != nil {
+				return err
+			}
+			if !req.Addr.IsValid() {
+				return newHelpErrorf("-address is required")
+			}
+			return callAndPrint(c, f, out, "SetRemoteForTunnel", req, func(json.RawMessage) string { return "Changed" })
+		},
+	},
+	{
+		name:    "close-tunnel",
+		summary: "Closes a tunnel for the provided vpn addr",
+		args:    "<vpn addr>",
+		flags: func(fs *flag.FlagSet, f *ctlFlags) {
+			fs.BoolVar(&f.localOnly, "local-only", false, "Disables notifying the remote that the tunnel is shutting down")
+		},
+		exec: func(c *client, f *ctlFlags, args []string, out io.Writer) error {
+			req, err := tunnelRequest(f, args)
+			if err != nil {
+				return err
+			}
+			return callAndPrint(c, f, out, "CloseTunnel", req, func(bool) string { return "Closed" })
+		},
+	},
+	{
+		name:    "create-tunnel",
+		summary: "Creates a tunnel for the provided vpn address, the lighthouses will be queried for real addresses but you can provide one as well",
+		args:    "<vpn addr>",
+		flags: func(fs *flag.FlagSet, f *ctlFlags) {
+			fs.StringVar(&f.address, "address", "", "Optional: a real remote address, ip:port")
+		},
+		exec: func(c *client, f *ctlFlags, args []string, out io.Writer) error {
+			req, err := tunnelRequest(f, args)
+			if err != nil {
+				return err
+			}
+			return callAndPrint(c, f, out, "CreateTunnel", req, func(bool) string { return "Created" })
+		},
+	},
+	{
+		name:    "query-lighthouse",
+		summary: "Query the lighthouses for the provided vpn address, only currently known udp addresses will be printed",
+		args:    "<vpn addr>",
+		exec: func(c *client, f *ctlFlags, args []string, out io.Writer) error {
+			req, err := tunnelRequest(f, args)
+			if err != nil {
+				return err
+			}
+			return callAndTable(c, f, out, "QueryLighthouse", req, func(cm *nebula.CacheMap, tw io.Writer) {
+				fmt.Fprintln(tw, "OWNER\tLEARNED\tREPORTED\tRELAY")
+				if cm == nil {
+					return
+				}
+				for _, owner := range sortedKeys(*cm) {
+					ca := (*cm)[owner]
+					fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", owner, joinList(ca.Learned), joinList(ca.Reported), joinList(ca.Relay))
+				}
+			})
+		},
+	},
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func (cmd *command) newFlagSet() (*flag.FlagSet, *ctlFlags) {
+	f := &ctlFlags{}
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.Usage = func() {}
+	fs.SetOutput(io.Discard)
+	fs.BoolVar(&f.json, "json", false, "Optional: outputs the response as json")
+	if cmd.flags != nil {
+		cmd.flags(fs, f)
+	}
+	return fs, f
+}
+
+func (cmd *command) run(c *client, args []string, out io.Writer) error {
+	fs, f := cmd.newFlagSet()
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return cmd.exec(c, f, fs.Args(), out)
+}
+
+func (cmd *command) help(out io.Writer) {
+	fs, _ := cmd.newFlagSet()
+	fs.SetOutput(out)
+	usage := cmd.name + " <flags>"
+	if cmd.args != "" {
+		usage += " " + cmd.args
+	}
+	fmt.Fprintf(out, "Usage of %s %s: %s\n", os.Args[0], usage, cmd.summary)
+	fs.PrintDefaults()
+}
+
+func byIndexFlag(fs *flag.FlagSet, f *ctlFlags) {
+	fs.BoolVar(&f.byIndex, "by-index", false, "Optional: gets all hosts in the hostmap from the index table")
+}
+
+// callAndPrint invokes a control api call and prints the response, either as json or as the line returned by human
+func callAndPrint[T any](c *client, f *ctlFlags, out io.Writer, name string, req any, human func(T) string) error {
+	var raw json.RawMessage
+	if err := c.call(name, req, &raw); err != nil {
+		return err
+	}
+
+	if f.json {
+		return writeJSON(out, raw)
+	}
+
+	var v T
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return fmt.Errorf("failed to decode response: %s", err)
+	}
+
+	_, err := fmt.Fprintln(out, human(v))
+	return err
+}
+
+// callAndTable is like callAndPrint except the human output is written as a table
+func callAndTable[T any](c *client, f *ctlFlags, out io.Writer, name string, req any, table func(T, io.Writer)) error {
+	var raw json.RawMessage
+	if err := c.call(name, req, &raw); err != nil {
+		return err
+	}
+
+	if f.json {
+		return writeJSON(out, raw)
+	}
+
+	var v T
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return fmt.Errorf("failed to decode response: %s", err)
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	table(v, tw)
+	return tw.Flush()
+}
+
+func writeJSON(out io.Writer, raw json.RawMessage) error {
+	buf := new(bytes.Buffer)
+	if err := json.Indent(buf, raw, "", "    "); err != nil {
+		return err
+	}
+	buf.WriteByte('\n')
+	_, err := out.Write(buf.Bytes())
+	return err
+}
+
+// hostInfo is the client side view of nebula.ControlHostInfo, the certificate is only partially decoded
+type hostInfo struct {
+	VpnAddrs               []netip.Addr     `json:"vpnAddrs"`
+	LocalIndex             uint32           `json:"localIndex"`
+	RemoteIndex            uint32           `json:"remoteIndex"`
+	RemoteAddrs            []netip.AddrPort `json:"remoteAddrs"`
+	Cert                   *certInfo        `json:"cert"`
+	MessageCounter         uint64           `json:"messageCounter"`
+	CurrentRemote          netip.AddrPort   `json:"currentRemote"`
+	CurrentRelaysToMe      []netip.Addr     `json:"currentRelaysToMe"`
+	CurrentRelaysThroughMe []netip.Addr     `json:"currentRelaysThroughMe"`
+	PostQuantum            bool             `json:"postQuantum"`
+	Cipher                 string           `json:"cipher"`
+}
+
+type certInfo struct {
+	Details struct {
+		Name   string   `json:"name"`
+		Groups []string `json:"groups"`
+	} `json:"details"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+func (h hostInfo) name() string {
+	if h.Cert == nil {
+		return ""
+	}
+	return h.Cert.Details.Name
+}
+
+func listHostmap(c *client, f *ctlFlags, pending bool, out io.Writer) error {
+	name := "ListHostmapHosts"
+	if f.byIndex {
+		name = "ListHostmapIndexes"
+	}
+
+	req := nebula.ControlListHostmapRequest{Pending: pending}
+	return callAndTable(c, f, out, name, req, func(hosts []hostInfo, tw io.Writer) {
+		sort.SliceStable(hosts, func(i, j int) bool {
+			if len(hosts[i].VpnAddrs) == 0 || len(hosts[j].VpnAddrs) == 0 {
+				return len(hosts[i].VpnAddrs) < len(hosts[j].VpnAddrs)
+			}
+			return hosts[i].VpnAddrs[0].Compare(hosts[j].VpnAddrs[0]) < 0
+		})
+
+		fmt.Fprintln(tw, "VPN ADDRS\tNAME\tREMOTE\tRELAYS\tLOCAL INDEX\tREMOTE INDEX")
+		for _, h := range hosts {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\n",
+				joinList(h.VpnAddrs), orDash(h.name()), addrPortOrDash(h.CurrentRemote),
+				joinList(h.CurrentRelaysToMe), h.LocalIndex, h.RemoteIndex)
+		}
+	})
+}
+
+func listFirewallRules(c *client, f *ctlFlags, args []string, out io.Writer) error {
+	return callAndTable(c, f, out, "ListFirewallRules", nil, func(rules []nebula.FirewallRuleInfo, tw io.Writer) {
+		fmt.Fprintln(tw, "ID\tACTION\tDIRECTION\tPACKETS\tBYTES\tLAST MATCH\tRULE")
+		for _, r := range rules {
+			lastMatch := "never"
+			if r.LastMatch != nil {
+				lastMatch = r.LastMatch.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\t%s\n", r.ID, r.Action, r.Direction, r.Packets, r.Bytes, lastMatch, r.Rule)
+		}
+	})
+}
+
+func listLighthouseAddrmap(c *client, f *ctlFlags, args []string, out io.Writer) error {
+	type lighthouseInfo struct {
+		VpnAddr string           `json:"vpnAddr"`
+		Addrs   *nebula.CacheMap `json:"addrs"`
+	}
+
+	return callAndTable(c, f, out, "ListLighthouseAddrmap", nil, func(entries []lighthouseInfo, tw io.Writer) {
+		fmt.Fprintln(tw, "VPN ADDR\tLEARNED\tREPORTED\tRELAY")
+		for _, e := range entries {
+			var learned, reported []netip.AddrPort
+			var relay []netip.Addr
+			if e.Addrs != nil {
+				for _, owner := range sortedKeys(*e.Addrs) {
+					ca := (*e.Addrs)[owner]
+					learned = append(learned, ca.Learned...)
+					reported = append(reported, ca.Reported...)
+					relay = append(relay, ca.Relay...)
+				}
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", e.VpnAddr, joinList(learned), joinList(reported), joinList(relay))
+		}
+	})
+}
+
+func printTunnel(c *client, f *ctlFlags, args []string, out io.Writer) error {
+	req, err := tunnelRequest(f, args)
+	if err != nil {
+		return err
+	}
+
+	return callAndTable(c, f, out, "PrintTunnel", req, func(h hostInfo, tw io.Writer) {
+		var groups []string
+		fingerprint := ""
+		if h.Cert != nil {
+			groups = h.Cert.Details.Groups
+			fingerprint = h.Cert.Fingerprint
+		}
+
+		fmt.Fprintf(tw, "VPN addrs:\t%s\n", joinList(h.VpnAddrs))
+		fmt.Fprintf(tw, "Name:\t%s\n", orDash(h.name()))
+		fmt.Fprintf(tw, "Groups:\t%s\n", orDash(strings.Join(groups, ",")))
+		fmt.Fprintf(tw, "Fingerprint:\t%s\n", orDash(fingerprint))
+		fmt.Fprintf(tw, "Current remote:\t%s\n", addrPortOrDash(h.CurrentRemote))
+		fmt.Fprintf(tw, "Remote addrs:\t%s\n", joinList(h.RemoteAddrs))
+		fmt.Fprintf(tw, "Relays to me:\t%s\n", joinList(h.CurrentRelaysToMe))
+		fmt.Fprintf(tw, "Relays through me:\t%s\n", joinList(h.CurrentRelaysThroughMe))
+		fmt.Fprintf(tw, "Local index:\t%d\n", h.LocalIndex)
+		fmt.Fprintf(tw, "Remote index:\t%d\n", h.RemoteIndex)
+		fmt.Fprintf(tw, "Message counter:\t%d\n", h.MessageCounter)
+		fmt.Fprintf(tw, "Post quantum:\t%t\n", h.PostQuantum)
+		fmt.Fprintf(tw, "Cipher:\t%s\n", orDash(h.Cipher))
+	})
+}
+
+func printRelays(c *client, f *ctlFlags, args []string, out io.Writer) error {
+	type relays struct {
+		Relays []struct {
+			NebulaAddr    netip.Addr
+			RelayForAddrs []struct {
+				Type        string
+				State       string
+				PeerAddr    netip.Addr
+				LocalIndex  uint32
+				RemoteIndex uint32
+			}
+		}
+	}
+
+	return callAndTable(c, f, out, "PrintRelays", nil, func(r relays, tw io.Writer) {
+		fmt.Fprintln(tw, "RELAY\tPEER\tTYPE\tSTATE\tLOCAL INDEX\tREMOTE INDEX")
+		for _, relay := range r.Relays {
+			for _, rf := range relay.RelayForAddrs {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\n", relay.NebulaAddr, addrOrDash(rf.PeerAddr),
+					orDash(rf.Type), orDash(rf.State), rf.LocalIndex, rf.RemoteIndex)
+			}
+		}
+	})
+}
+
+func printCert(c *client, f *ctlFlags, args []string, out io.Writer) error {
+	if f.raw && f.json {
+		return newHelpErrorf("-raw is not compatible with -json")
+	}
+
+	var req nebula.ControlTunnelRequest
+	if len(args) > 0 {
+		var err error
+		req, err = tunnelRequest(f, args)
+		if err != nil {
+			return err
+		}
+	}
+
+	var res struct {
+		Cert json.RawMessage `json:"cert"`
+		PEM  string          `json:"pem"`
+	}
+	if err := c.call("PrintCert", req, &res); err != nil {
+		return err
+	}
+
+	if f.json {
+		return writeJSON(out, res.Cert)
+	}
+
+	if f.raw {
+		_, err := io.WriteString(out, res.PEM)
+		return err
+	}
+
+	crt, _, err := cert.UnmarshalCertificateFromPEM([]byte(res.PEM))
+	if err != nil {
+		return fmt.Errorf("error while unmarshaling cert: %s", err)
+	}
+
+	_, err = fmt.Fprintln(out, crt.String())
+	return err
+}
+
+// profile asks nebula to write a profile to the provided path, which is made absolute since nebula may be running
+// from a different working directory
+func profile(c *client, f *ctlFlags, args []string, out io.Writer, name string, msg string) error {
+	if len(args) == 0 {
+		return newHelpErrorf("No path to write profile provided")
+	}
+
+	path, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+
+	return callAndPrint(c, f, out, name, nebula.ControlPathRequest{Path: path}, func(bool) string {
+		return fmt.Sprintf(msg, path)
+	})
+}
+
+// setting gets, or sets if provided in args, a runtime value
+func setting(c *client, f *ctlFlags, args []string, out io.Writer, name string, desc string) error {
+	var req nebula.ControlSettingRequest
+	if len(args) > 0 {
+		req.Value = args[0]
+	}
+
+	return callAndPrint(c, f, out, name, req, func(s nebula.ControlSetting) string {
+		if s.Previous != "" {
+			return fmt.Sprintf("%s is: %s, was: %s", desc, s.Value, s.Previous)
+		}
+		return fmt.Sprintf("%s is: %s", desc, s.Value)
+	})
+}
+
+func tunnelRequest(f *ctlFlags, args []string) (nebula.ControlTunnelRequest, error) {
+	req := nebula.ControlTunnelRequest{LocalOnly: f.localOnly}
+	if len(args) == 0 {
+		return req, newHelpErrorf("No vpn address was provided")
+	}
+
+	vpnAddr, err := netip.ParseAddr(args[0])
+	if err != nil {
+		return req, fmt.Errorf("the provided vpn address could not be parsed: %s", args[0])
+	}
+	req.VpnAddr = vpnAddr
+
+	if f.address != "" {
+		req.Addr, err = netip.ParseAddrPort(f.address)
+		if err != nil {
+			return req, fmt.Errorf("address could not be parsed: %s", f.address)
+		}
+	}
+
+	return req, nil
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func joinList[T fmt.Stringer](v []T) string {
+	if len(v) == 0 {
+		return "-"
+	}
+
+	s := make([]string, len(v))
+	for i := range v {
+		s[i] = v[i].String()
+	}
+	return strings.Join(s, ",")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func addrOrDash(a netip.Addr) string {
+	if !a.IsValid() {
+		return "-"
+	}
+	return a.String()
+}
+
+func addrPortOrDash(a netip.AddrPort) string {
+	if !a.IsValid() {
+		return "-"
+	}
+	return a.String()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/slackhq/nebula"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestServer serves canned control api responses on a unix socket and records the request bodies it receives
+func newTestServer(t *testing.T, responses map[string]string) (*client, func(string) string) {
+	sock := filepath.Join(t.TempDir(), "nebula.sock")
+	ln, err := net.Listen("unix", sock)
+	require.NoError(t, err)
+
+	var lock sync.Mutex
+	requests := map[string]string{}
+	mux := http.NewServeMux()
+	for name, res := range responses {
+		mux.HandleFunc("POST /v1/"+name, func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			lock.Lock()
+			requests[name] = string(b)
+			lock.Unlock()
+			if res == "" {
+				w.WriteHeader(http.StatusNotFound)
+				_ = json.NewEncoder(w).Encode(nebula.ControlError{Error: "could not find tunnel for vpn addr"})
+				return
+			}
+			_, _ = w.Write([]byte(res))
+		})
+	}
+
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+
+	return newClient(sock), func(name string) string {
+		lock.Lock()
+		defer lock.Unlock()
+		return requests[name]
+	}
+}
+
+func Test_listHostmap(t *testing.T) {
+	c, requests := newTestServer(t, map[string]string{
+		"ListHostmapHosts": `[
+			{"vpnAddrs":["10.1.0.3"],"localIndex":3,"remoteIndex":4,"cert":{"details":{"name":"host3"}},"currentRemote":"1.1.1.3:4242","currentRelaysToMe":[]},
+			{"vpnAddrs":["10.1.0.2"],"localIndex":1,"remoteIndex":2,"cert":null,"currentRemote":"","currentRelaysToMe":["10.1.0.1"]}
+		]`,
+	})
+
+	ob := &bytes.Buffer{}
+	require.NoError(t, findCommand("list-pending-hostmap").run(c, []string{}, ob))
+	assert.JSONEq(t, `{"pending":true}`, requests("ListHostmapHosts"))
+	assert.Equal(t,
+		"VPN ADDRS  NAME   REMOTE        RELAYS    LOCAL INDEX  REMOTE INDEX\n"+
+			"10.1.0.2   -      -             10.1.0.1  1            2\n"+
+			"10.1.0.3   host3  1.1.1.3:4242  -         3            4\n",
+		ob.String(),
+	)
+
+	ob.Reset()
+	require.NoError(t, findCommand("list-hostmap").run(c, []string{"--json"}, ob))
+	assert.JSONEq(t, `{"pending":false}`, requests("ListHostmapHosts"))
+	assert.Contains(t, ob.String(), "\n    {\n        \"vpnAddrs\": [\n            \"10.1.0.3\"\n        ],")
+
+	ob.Reset()
+	err := findCommand("list-hostmap").run(c, []string{"-by-index"}, ob)
+	assert.ErrorContains(t, err, "ListHostmapIndexes failed: 404 Not Found")
+}
+
+func Test_listFirewallRules(t *testing.T) {
+	c, _ := newTestServer(t, map[string]string{
+		"ListFirewallRules": `[
+			{"id":"aaaaaaaaaaaa","action":"allow","direction":"incoming","rule":"incoming allow port=22 proto=tcp","packets":3,"bytes":180,"lastMatch":"2024-01-02T03:04:05Z"},
+			{"id":"bbbbbbbbbbbb","action":"deny","direction":"outgoing","rule":"outgoing deny port=any proto=any","packets":0,"bytes":0,"lastMatch":null}
+		]`,
+	})
+
+	ob := &bytes.Buffer{}
+	require.NoError(t, findCommand("list-firewall-rules").run(c, []string{}, ob))
+	assert.Equal(t,
+		"ID            ACTION  DIRECTION  PACKETS  BYTES  LAST MATCH            RULE\n"+
+			"aaaaaaaaaaaa  allow   incoming   3        180    2024-01-02T03:04:05Z  incoming allow port=22 proto=tcp\n"+
+			"bbbbbbbbbbbb  deny    outgoing   0        0      never                 outgoing deny port=any proto=any\n",
+		ob.String(),
+	)
+}
+
+func Test_tunnelCommands(t *testing.T) {
+	c, requests := newTestServer(t, map[string]string{
+		"CloseTunnel":        "",
+		"CreateTunnel":       "true",
+		"SetRemoteForTunnel": `{"vpnAddrs":["10.1.0.2"]}`,
+	})
+
+	ob := &bytes.Buffer{}
+	err := findCommand("close-tunnel").run(c, []string{"-local-only", "10.1.0.2"}, ob)
+	require.EqualError(t, err, "could not find tunnel for vpn addr")
+	assert.JSONEq(t, `{"vpnAddr":"10.1.0.2","addr":"","localOnly":true}`, requests("CloseTunnel"))
+
+	require.NoError(t, findCommand("create-tunnel").run(c, []string{"-address", "1.1.1.1:4242", "10.1.0.2"}, ob))
+	assert.JSONEq(t, `{"vpnAddr":"10.1.0.2","addr":"1.1.1.1:4242","localOnly":false}`, requests("CreateTunnel"))
+	assert.Equal(t, "Created\n", ob.String())
+
+	ob.Reset()
+	err = findCommand("change-remote").run(c, []string{"10.1.0.2"}, ob)
+	assert.EqualError(t, err, "-address is required")
+	assert.IsType(t, &helpError{}, err)
+
+	err = findCommand("print-tunnel").run(c, []string{}, ob)
+	assert.EqualError(t, err, "No vpn address was provided")
+
+	err = findCommand("print-tunnel").run(c, []string{"nope"}, ob)
+	assert.EqualError(t, err, "the provided vpn address could not be parsed: nope")
+	assert.Empty(t, ob.String())
+}
+
+func Test_setting(t *testing.T) {
+	c, requests := newTestServer(t, map[string]string{
+		"LogLevel": `{"value":"debug","previous":"info"}`,
+	})
+
+	ob := &bytes.Buffer{}
+	require.NoError(t, findCommand("log-level").run(c, []string{"debug"}, ob))
+	assert.JSONEq(t, `{"value":"debug"}`, requests("LogLevel"))
+	assert.Equal(t, "Log level is: debug, was: info\n", ob.String())
+}
+
+func Test_commandHelp(t *testing.T) {
+	ob := &bytes.Buffer{}
+	findCommand("close-tunnel").help(ob)
+	assert.Contains(t, ob.String(), "close-tunnel <flags> <vpn addr>: Closes a tunnel for the provided vpn addr\n")
+	assert.Contains(t, ob.String(), "  -json\n")
+	assert.Contains(t, ob.String(), "  -local-only\n")
+}
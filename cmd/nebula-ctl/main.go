@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A version string that can be set with
+//
+//	-ldflags "-X main.Build=SOMEVERSION"
+//
+// at compile-time.
+var Build string
+
+const defaultSocket = "/var/run/nebula.sock"
+
+type helpError struct {
+	s string
+}
+
+func (he *helpError) Error() string {
+	return he.s
+}
+
+func newHelpErrorf(s string, v ...any) error {
+	return &helpError{s: fmt.Sprintf(s, v...)}
+}
+
+func main() {
+	flag.Usage = func() {
+		help("", os.Stderr)
+		os.Exit(1)
+	}
+
+	socket := flag.String("socket", defaultSocket, "Path to the control socket of the running nebula process, see `control.listen`")
+	printVersion := flag.Bool("version", false, "Print version")
+	flagHelp := flag.Bool("help", false, "Print command line usage")
+	flagH := flag.Bool("h", false, "Print command line usage")
+	printUsage := false
+
+	flag.Parse()
+
+	if *flagH || *flagHelp {
+		printUsage = true
+	}
+
+	args := flag.Args()
+
+	if *printVersion {
+		fmt.Printf("Version: %v\n", Build)
+		os.Exit(0)
+	}
+
+	if len(args) < 1 {
+		if printUsage {
+			help("", os.Stderr)
+			os.Exit(0)
+		}
+
+		help("No command was provided", os.Stderr)
+		os.Exit(1)
+	}
+
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		help(fmt.Sprintf("Unknown command: %s", args[0]), os.Stderr)
+		os.Exit(1)
+	}
+
+	if printUsage {
+		handleError(cmd, &helpError{}, os.Stderr)
+		os.Exit(0)
+	}
+
+	err := cmd.run(newClient(*socket), args[1:], os.Stdout)
+	if err != nil {
+		os.Exit(handleError(cmd, err, os.Stderr))
+	}
+}
+
+func handleError(cmd *command, e error, out io.Writer) int {
+	code := 1
+
+	// Handle -help, -h flags properly
+	if e == flag.ErrHelp {
+		code = 0
+		e = &helpError{}
+	} else if e != nil && e.Error() != "" {
+		fmt.Fprintln(out, "Error:", e)
+	}
+
+	switch e.(type) {
+	case *helpError:
+		cmd.help(out)
+	}
+
+	return code
+}
+
+func help(err string, out io.Writer) {
+	if err != "" {
+		fmt.Fprintln(out, "Error:", err)
+		fmt.Fprintln(out, "")
+	}
+
+	fmt.Fprintf(out, "Usage of %s <global flags> <command> <flags> <args>:\n", os.Args[0])
+	fmt.Fprintln(out, "  Global flags:")
+	fmt.Fprintf(out, "    -socket: Path to the control socket of the running nebula process (default %s)\n", defaultSocket)
+	fmt.Fprintln(out, "    -version: Prints the version")
+	fmt.Fprintln(out, "    -h, -help: Prints this help message")
+	fmt.Fprintln(out, "")
+	fmt.Fprintln(out, "  Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "    %s: %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(out, "")
+	fmt.Fprintf(out, "  To see usage for a given command, use %s <command> -h\n", os.Args[0])
+}
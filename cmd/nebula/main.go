@@ -8,6 +8,8 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula"
 	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/overlay"
+	"github.com/slackhq/nebula/service"
 	"github.com/slackhq/nebula/util"
 )
 
@@ -21,6 +23,9 @@ var Build string
 func main() {
 	configPath := flag.String("config", "", "Path to either a file or directory to load configuration from")
 	configTest := flag.Bool("test", false, "Test the config and print the end result. Non zero exit indicates a faulty config")
+	firewallTest := flag.Bool("test-firewall", false, "Evaluate the packet described by the -fw-* flags against the firewall in the config. Exits 0 if allowed, 2 if dropped")
+	fwCheck := nebula.FirewallCheckFlags{}
+	fwCheck.Register(flag.CommandLine, "fw-")
 	printVersion := flag.Bool("version", false, "Print version")
 	printUsage := flag.Bool("help", false, "Print command line usage")
 
@@ -52,6 +57,10 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *firewallTest {
+		os.Exit(testFirewall(l, c, &fwCheck))
+	}
+
 	ctrl, err := nebula.Main(c, *configTest, Build, l, nil)
 	if err != nil {
 		util.LogWithContextIfNeeded("Failed to start", err, l)
@@ -59,10 +68,66 @@ func main() {
 	}
 
 	if !*configTest {
-		ctrl.Start()
+		if _, ok := ctrl.Device().(*overlay.UserDevice); ok {
+			// The userspace network stack starts nebula and is the only way in or out of the overlay
+			if err := startService(l, c, ctrl); err != nil {
+				util.LogWithContextIfNeeded("Failed to start", err, l)
+				os.Exit(1)
+			}
+		} else {
+			if c.Get("forwards") != nil {
+				l.Warn("forwards are only served when tun.user is set")
+			}
+			ctrl.Start()
+		}
 		notifyReady(l)
 		ctrl.ShutdownBlock()
 	}
 
 	os.Exit(0)
 }
+
+func startService(l *logrus.Logger, c *config.C, ctrl *nebula.Control) error {
+	svc, err := service.New(ctrl)
+	if err != nil {
+		return err
+	}
+
+	p, err := service.NewProxyFromConfig(l, c, svc)
+	if err != nil {
+		return err
+	}
+	f, err := service.NewForwarderFromConfig(l, c, svc)
+	if err != nil {
+		return err
+	}
+
+	if p == nil && f == nil {
+		l.Warn("tun.user is set without a proxy or forwards, nothing on this host is connected to the overlay")
+	}
+	return nil
+}
+
+func testFirewall(l *logrus.Logger, c *config.C, ff *nebula.FirewallCheckFlags) int {
+	// Only report problems, the firewall logs every rule it loads
+	l.SetLevel(logrus.ErrorLevel)
+
+	fc, err := ff.Check()
+	if err != nil {
+		fmt.Printf("invalid packet: %s\n", err)
+		return 1
+	}
+
+	res, err := nebula.CheckFirewall(l, c, fc)
+	if err != nil {
+		fmt.Printf("failed to load firewall: %s\n", err)
+		return 1
+	}
+
+	fmt.Println(res)
+	if !res.Allowed {
+		return 2
+	}
+
+	return 0
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -105,6 +106,40 @@ func (c *C) HasChanged(k string) bool {
 		ov = c.get(k, c.oldSettings)
 	}
 
+	return c.differs(k, nv, ov)
+}
+
+// HasChangedExcept is HasChanged for k but ignores changes to the keys directly within k that are listed in except.
+// This lets a section skip work for a sub key that reloads itself separately.
+func (c *C) HasChangedExcept(k string, except ...string) bool {
+	if c.oldSettings == nil {
+		return false
+	}
+
+	// A missing section is treated as empty so adding only an excluded key is not a change
+	without := func(v any) any {
+		if v == nil {
+			return map[string]any{}
+		}
+
+		m, ok := v.(map[string]any)
+		if !ok {
+			return v
+		}
+
+		nm := make(map[string]any, len(m))
+		for mk, mv := range m {
+			if !slices.Contains(except, mk) {
+				nm[mk] = mv
+			}
+		}
+		return nm
+	}
+
+	return c.differs(k, without(c.get(k, c.Settings)), without(c.get(k, c.oldSettings)))
+}
+
+func (c *C) differs(k string, nv, ov any) bool {
 	newVals, err := yaml.Marshal(nv)
 	if err != nil {
 		c.l.WithField("config_path", k).WithError(err).Error("Error while marshaling new config")
@@ -113,6 +113,34 @@ func TestConfig_HasChanged(t *testing.T) {
 	assert.False(t, c.HasChanged(""))
 }
 
+func TestConfig_HasChangedExcept(t *testing.T) {
+	l := test.NewLogger()
+	c := NewC(l)
+	c.Settings["outer"] = map[string]any{"inner": "hi", "skip": "a"}
+	assert.False(t, c.HasChangedExcept("outer", "skip"))
+
+	// Only the excluded key changed
+	c.oldSettings = map[string]any{"outer": map[string]any{"inner": "hi", "skip": "b"}}
+	assert.True(t, c.HasChanged("outer"))
+	assert.False(t, c.HasChangedExcept("outer", "skip"))
+
+	// The excluded key was removed
+	c.oldSettings = map[string]any{"outer": map[string]any{"inner": "hi"}}
+	assert.False(t, c.HasChangedExcept("outer", "skip"))
+
+	// Another key changed as well
+	c.oldSettings = map[string]any{"outer": map[string]any{"inner": "no", "skip": "b"}}
+	assert.True(t, c.HasChangedExcept("outer", "skip"))
+
+	// The section was added
+	c.oldSettings = map[string]any{}
+	assert.True(t, c.HasChangedExcept("outer", "skip"))
+
+	// The section was added with only the excluded key
+	c.Settings["outer"] = map[string]any{"skip": "a"}
+	assert.False(t, c.HasChangedExcept("outer", "skip"))
+}
+
 func TestConfig_ReloadConfig(t *testing.T) {
 	l := test.NewLogger()
 	done := make(chan bool, 1)
@@ -44,8 +44,14 @@ type connectionManager struct {
 	pendingDeletionInterval time.Duration
 	inactivityTimeout       atomic.Int64
 	dropInactive            atomic.Bool
+	rekeyAfter              atomic.Int64
+	rekeyAfterBytes         atomic.Uint64
+	rekeyAfterPackets       atomic.Uint64
 
-	metricsTxPunchy metrics.Counter
+	metricsTxPunchy     metrics.Counter
+	metricsRekeyTime    metrics.Counter
+	metricsRekeyBytes   metrics.Counter
+	metricsRekeyPackets metrics.Counter
 
 	l *logrus.Logger
 }
@@ -58,6 +64,10 @@ func newConnectionManagerFromConfig(l *logrus.Logger, c *config.C, hm *HostMap,
 		relayUsed:       make(map[uint32]struct{}),
 		relayUsedLock:   &sync.RWMutex{},
 		metricsTxPunchy: metrics.GetOrRegisterCounter("messages.tx.punchy", nil),
+
+		metricsRekeyTime:    metrics.GetOrRegisterCounter("connection_manager.rekey.time", nil),
+		metricsRekeyBytes:   metrics.GetOrRegisterCounter("connection_manager.rekey.bytes", nil),
+		metricsRekeyPackets: metrics.GetOrRegisterCounter("connection_manager.rekey.packets", nil),
 	}
 
 	cm.reload(c, true)
@@ -100,12 +110,46 @@ func (cm *connectionManager) reload(c *config.C, initial bool) {
 				Info("Drop inactive setting has changed")
 		}
 	}
+
+	if initial || c.HasChanged("tunnels.rekey_after") {
+		old := cm.getRekeyAfter()
+		cm.rekeyAfter.Store((int64)(c.GetDuration("tunnels.rekey_after", 0)))
+		if !initial {
+			cm.l.WithField("oldDuration", old).
+				WithField("newDuration", cm.getRekeyAfter()).
+				Info("Rekey after has changed")
+		}
+	}
+
+	if initial || c.HasChanged("tunnels.rekey_after_bytes") {
+		old := cm.rekeyAfterBytes.Load()
+		cm.rekeyAfterBytes.Store(uint64(max(c.GetInt("tunnels.rekey_after_bytes", 0), 0)))
+		if !initial {
+			cm.l.WithField("oldBytes", old).
+				WithField("newBytes", cm.rekeyAfterBytes.Load()).
+				Info("Rekey after bytes has changed")
+		}
+	}
+
+	if initial || c.HasChanged("tunnels.rekey_after_packets") {
+		old := cm.rekeyAfterPackets.Load()
+		cm.rekeyAfterPackets.Store(uint64(max(c.GetInt("tunnels.rekey_after_packets", 0), 0)))
+		if !initial {
+			cm.l.WithField("oldPackets", old).
+				WithField("newPackets", cm.rekeyAfterPackets.Load()).
+				Info("Rekey after packets has changed")
+		}
+	}
 }
 
 func (cm *connectionManager) getInactivityTimeout() time.Duration {
 	return (time.Duration)(cm.inactivityTimeout.Load())
 }
 
+func (cm *connectionManager) getRekeyAfter() time.Duration {
+	return (time.Duration)(cm.rekeyAfter.Load())
+}
+
 func (cm *connectionManager) In(h *HostInfo) {
 	h.in.Store(true)
 }
@@ -194,7 +238,7 @@ func (cm *connectionManager) doTrafficCheck(localIndex uint32, p, nb, out []byte
 		cm.migrateRelayUsed(hostinfo, primary)
 
 	case tryRehandshake:
-		cm.tryRehandshake(hostinfo)
+		cm.tryRehandshake(hostinfo, now)
 
 	case sendTestPacket:
 		cm.intf.SendMessageToHostInfo(header.Test, header.TestRequest, hostinfo, p, nb, out)
@@ -527,18 +571,59 @@ func (cm *connectionManager) sendPunch(hostinfo *HostInfo) {
 	}
 }
 
-func (cm *connectionManager) tryRehandshake(hostinfo *HostInfo) {
-	cs := cm.intf.pki.getCertState()
-	curCrt := hostinfo.ConnectionState.myCert
-	myCrt := cs.getCertificate(curCrt.Version())
-	if curCrt.Version() >= cs.initiatingVersion && bytes.Equal(curCrt.Signature(), myCrt.Signature()) == true {
-		// The current tunnel is using the latest certificate and version, no need to rehandshake.
+func (cm *connectionManager) tryRehandshake(hostinfo *HostInfo, now time.Time) {
+	reason, counter := cm.rehandshakeReason(hostinfo, now)
+	if reason == "" {
+		return
+	}
+
+	if cm.intf.handshakeManager.QueryVpnAddr(hostinfo.vpnAddrs[0]) != nil {
+		// A handshake is already in flight, the new tunnel will take over as primary once it completes
 		return
 	}
 
 	cm.l.WithField("vpnAddrs", hostinfo.vpnAddrs).
-		WithField("reason", "local certificate is not current").
+		WithField("reason", reason).
 		Info("Re-handshaking with remote")
 
+	if counter != nil {
+		counter.Inc(1)
+	}
 	cm.intf.handshakeManager.StartHandshake(hostinfo.vpnAddrs[0], nil)
 }
+
+// rehandshakeReason returns why the primary tunnel for a host should be replaced, or an empty string if it should not.
+// The counter returned is the rekey metric to increment, it is nil when the reason is not a rekey.
+func (cm *connectionManager) rehandshakeReason(hostinfo *HostInfo, now time.Time) (string, metrics.Counter) {
+	ci := hostinfo.ConnectionState
+
+	cs := cm.intf.pki.getCertState()
+	curCrt := ci.myCert
+	myCrt := cs.getCertificate(curCrt.Version())
+	if curCrt.Version() < cs.initiatingVersion || !bytes.Equal(curCrt.Signature(), myCrt.Signature()) {
+		return "local certificate is not current", nil
+	}
+
+	if rekeyAfter := cm.getRekeyAfter(); rekeyAfter > 0 {
+		// Give the side that initiated the tunnel a head start so both sides don't rekey at the same time. The
+		// responder still rekeys if the initiator doesn't, which covers hosts that have rekeying disabled.
+		if !ci.initiator {
+			rekeyAfter += rekeyAfter / 10
+		}
+
+		if now.Sub(ci.created) >= rekeyAfter {
+			return "tunnel keys are older than rekey_after", cm.metricsRekeyTime
+		}
+	}
+
+	// Only our sending key is counted, the remote watches its own
+	if limit := cm.rekeyAfterBytes.Load(); limit > 0 && ci.txBytes.Load() >= limit {
+		return "tunnel keys have sent more than rekey_after_bytes", cm.metricsRekeyBytes
+	}
+
+	if limit := cm.rekeyAfterPackets.Load(); limit > 0 && ci.messageCounter.Load() >= limit {
+		return "tunnel keys have sent more than rekey_after_packets", cm.metricsRekeyPackets
+	}
+
+	return "", nil
+}
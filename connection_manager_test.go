@@ -505,3 +505,108 @@ func (d *dummyCert) MarshalJSON() ([]byte, error) {
 func (d *dummyCert) Copy() cert.Certificate {
 	return d
 }
+
+func Test_NewConnectionManager_Rekey(t *testing.T) {
+	l := test.NewLogger()
+	localrange := netip.MustParsePrefix("10.1.1.1/24")
+	vpnAddrs := []netip.Addr{netip.MustParseAddr("172.1.1.2")}
+	preferredRanges := []netip.Prefix{localrange}
+
+	// Very incomplete mock objects
+	hostMap := newHostMap(l)
+	hostMap.preferredRanges.Store(&preferredRanges)
+
+	cs := &CertState{
+		initiatingVersion: cert.Version1,
+		privateKey:        []byte{},
+		v1Cert:            &dummyCert{version: cert.Version1},
+		v1HandshakeBytes:  []byte{},
+	}
+
+	lh := newTestLighthouse()
+	ifce := &Interface{
+		hostMap:          hostMap,
+		inside:           &test.NoopTun{},
+		outside:          &udp.NoopConn{},
+		firewall:         &Firewall{},
+		lightHouse:       lh,
+		pki:              &PKI{},
+		handshakeManager: NewHandshakeManager(l, hostMap, lh, &udp.NoopConn{}, defaultHandshakeConfig),
+		l:                l,
+	}
+	ifce.pki.cs.Store(cs)
+
+	// Create manager
+	conf := config.NewC(l)
+	conf.Settings["tunnels"] = map[string]any{
+		"rekey_after":         "1h",
+		"rekey_after_bytes":   1000,
+		"rekey_after_packets": 100,
+	}
+	punchy := NewPunchyFromConfig(l, conf)
+	nc := newConnectionManagerFromConfig(l, conf, hostMap, punchy)
+	assert.Equal(t, time.Hour, nc.getRekeyAfter())
+	assert.Equal(t, uint64(1000), nc.rekeyAfterBytes.Load())
+	assert.Equal(t, uint64(100), nc.rekeyAfterPackets.Load())
+	nc.intf = ifce
+
+	now := time.Now()
+	hostinfo := &HostInfo{
+		vpnAddrs:      vpnAddrs,
+		localIndexId:  1099,
+		remoteIndexId: 9901,
+	}
+	hostinfo.ConnectionState = &ConnectionState{
+		myCert:    &dummyCert{version: cert.Version1},
+		H:         &noise.HandshakeState{},
+		initiator: true,
+		created:   now,
+	}
+	nc.hostMap.unlockedAddHostInfo(hostinfo, ifce)
+
+	// A fresh tunnel is left alone
+	reason, _ := nc.rehandshakeReason(hostinfo, now)
+	assert.Empty(t, reason)
+
+	// Old keys are replaced by the initiator first
+	reason, counter := nc.rehandshakeReason(hostinfo, now.Add(time.Hour))
+	assert.Equal(t, "tunnel keys are older than rekey_after", reason)
+	assert.Equal(t, nc.metricsRekeyTime, counter)
+
+	hostinfo.ConnectionState.initiator = false
+	reason, _ = nc.rehandshakeReason(hostinfo, now.Add(time.Hour))
+	assert.Empty(t, reason)
+	reason, _ = nc.rehandshakeReason(hostinfo, now.Add(time.Hour+6*time.Minute))
+	assert.Equal(t, "tunnel keys are older than rekey_after", reason)
+
+	// Volume thresholds only count what we sent
+	hostinfo.ConnectionState.txBytes.Store(1000)
+	reason, counter = nc.rehandshakeReason(hostinfo, now)
+	assert.Equal(t, "tunnel keys have sent more than rekey_after_bytes", reason)
+	assert.Equal(t, nc.metricsRekeyBytes, counter)
+
+	hostinfo.ConnectionState.txBytes.Store(0)
+	hostinfo.ConnectionState.messageCounter.Store(100)
+	reason, counter = nc.rehandshakeReason(hostinfo, now)
+	assert.Equal(t, "tunnel keys have sent more than rekey_after_packets", reason)
+	assert.Equal(t, nc.metricsRekeyPackets, counter)
+
+	// A live primary tunnel over a threshold starts a new handshake and keeps serving traffic until it completes
+	before := nc.metricsRekeyPackets.Count()
+	nc.In(hostinfo)
+	nc.doTrafficCheck(hostinfo.localIndexId, []byte(""), make([]byte, 12, 12), make([]byte, mtu), now)
+	assert.NotNil(t, ifce.handshakeManager.QueryVpnAddr(vpnAddrs[0]))
+	assert.Equal(t, hostinfo, nc.hostMap.QueryVpnAddr(vpnAddrs[0]))
+	assert.Equal(t, before+1, nc.metricsRekeyPackets.Count())
+
+	// Only one handshake is counted while it is in flight
+	nc.In(hostinfo)
+	nc.doTrafficCheck(hostinfo.localIndexId, []byte(""), make([]byte, 12, 12), make([]byte, mtu), now)
+	assert.Equal(t, before+1, nc.metricsRekeyPackets.Count())
+
+	// Rekeying can be turned off with a reload
+	require.NoError(t, conf.ReloadConfigString("tunnels: {rekey_after: 0, rekey_after_bytes: 0, rekey_after_packets: 0}"))
+	assert.Equal(t, time.Duration(0), nc.getRekeyAfter())
+	reason, _ = nc.rehandshakeReason(hostinfo, now.Add(time.Hour*24))
+	assert.Empty(t, reason)
+}
@@ -1,11 +1,13 @@
 package nebula
 
 import (
+	"crypto/mlkem"
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/flynn/noise"
 	"github.com/sirupsen/logrus"
@@ -25,9 +27,23 @@ type ConnectionState struct {
 	messageCounter atomic.Uint64
 	window         *Bits
 	writeLock      sync.Mutex
+
+	// created is when this tunnel started handshaking, used to age out the tunnel keys
+	created time.Time
+	// txBytes counts the payload bytes encrypted with eKey
+	txBytes atomic.Uint64
+
+	// kemKey is the initiators ML-KEM key while a post quantum hybrid handshake is in flight
+	kemKey *mlkem.DecapsulationKey768
+	// postQuantum is true when the tunnel keys include an ML-KEM shared secret
+	postQuantum bool
+	// cipher protects the handshake and, once the responder has picked one, the tunnel traffic
+	cipher string
 }
 
-func NewConnectionState(l *logrus.Logger, cs *CertState, crt cert.Certificate, initiator bool, pattern noise.HandshakePattern) (*ConnectionState, error) {
+// NewConnectionState creates the noise handshake state for a new tunnel using the named cipher, psk is mixed into the
+// handshake if it is not empty
+func NewConnectionState(l *logrus.Logger, cs *CertState, crt cert.Certificate, initiator bool, pattern noise.HandshakePattern, psk []byte, cipher string) (*ConnectionState, error) {
 	var dhFunc noise.DHFunc
 	switch crt.Curve() {
 	case cert.Curve_CURVE25519:
@@ -42,12 +58,11 @@ func NewConnectionState(l *logrus.Logger, cs *CertState, crt cert.Certificate, i
 		return nil, fmt.Errorf("invalid curve: %s", crt.Curve())
 	}
 
-	var ncs noise.CipherSuite
-	if cs.cipher == "chachapoly" {
-		ncs = noise.NewCipherSuite(dhFunc, noise.CipherChaChaPoly, noise.HashSHA256)
-	} else {
-		ncs = noise.NewCipherSuite(dhFunc, noiseutil.CipherAESGCM, noise.HashSHA256)
+	nc, ok := nebulaCiphers[cipher]
+	if !ok {
+		return nil, fmt.Errorf("invalid cipher: %s", cipher)
 	}
+	ncs := noise.NewCipherSuite(dhFunc, nc.fn, noise.HashSHA256)
 
 	static := noise.DHKey{Private: cs.privateKey, Public: crt.PublicKey()}
 
@@ -61,8 +76,8 @@ func NewConnectionState(l *logrus.Logger, cs *CertState, crt cert.Certificate, i
 		Pattern:       pattern,
 		Initiator:     initiator,
 		StaticKeypair: static,
-		//NOTE: These should come from CertState (pki.go) when we finally implement it
-		PresharedKey:          []byte{},
+		// An empty PresharedKey leaves the psk out of the handshake
+		PresharedKey:          psk,
 		PresharedKeyPlacement: 0,
 	})
 	if err != nil {
@@ -76,6 +91,8 @@ func NewConnectionState(l *logrus.Logger, cs *CertState, crt cert.Certificate, i
 		initiator: initiator,
 		window:    b,
 		myCert:    crt,
+		created:   time.Now(),
+		cipher:    cipher,
 	}
 	// always start the counter from 2, as packet 1 and packet 2 are handshake packets.
 	ci.messageCounter.Add(2)
@@ -88,6 +105,9 @@ func (cs *ConnectionState) MarshalJSON() ([]byte, error) {
 		"certificate":     cs.peerCert,
 		"initiator":       cs.initiator,
 		"message_counter": cs.messageCounter.Load(),
+		"tx_bytes":        cs.txBytes.Load(),
+		"post_quantum":    cs.postQuantum,
+		"cipher":          cs.cipher,
 	})
 }
 
@@ -35,6 +35,8 @@ type Control struct {
 	dnsStart               func()
 	lighthouseStart        func()
 	connectionManagerStart func(context.Context)
+	controlServerStart     func(*Control)
+	controlServerStop      func()
 }
 
 type ControlHostInfo struct {
@@ -47,6 +49,8 @@ type ControlHostInfo struct {
 	CurrentRemote          netip.AddrPort   `json:"currentRemote"`
 	CurrentRelaysToMe      []netip.Addr     `json:"currentRelaysToMe"`
 	CurrentRelaysThroughMe []netip.Addr     `json:"currentRelaysThroughMe"`
+	PostQuantum            bool             `json:"postQuantum"`
+	Cipher                 string           `json:"cipher"`
 }
 
 // Start actually runs nebula, this is a nonblocking call. To block use Control.ShutdownBlock()
@@ -67,6 +71,9 @@ func (c *Control) Start() {
 	if c.connectionManagerStart != nil {
 		go c.connectionManagerStart(c.ctx)
 	}
+	if c.controlServerStart != nil {
+		c.controlServerStart(c)
+	}
 	if c.lighthouseStart != nil {
 		c.lighthouseStart()
 	}
@@ -84,6 +91,10 @@ func (c *Control) Stop() {
 	// Stop the handshakeManager (and other services), to prevent new tunnels from
 	// being created while we're shutting them all down.
 	c.cancel()
+	// The socket is removed before returning, the process may exit before anything waiting on the context runs
+	if c.controlServerStop != nil {
+		c.controlServerStop()
+	}
 
 	c.CloseAllTunnels(false)
 	if err := c.f.Close(); err != nil {
@@ -274,6 +285,11 @@ func (c *Control) Device() overlay.Device {
 	return c.f.inside
 }
 
+// ListFirewallRules returns the rules of the current firewall, packet counts are only kept when firewall.rule_stats is set
+func (c *Control) ListFirewallRules() []FirewallRuleInfo {
+	return c.f.firewall.ListRules()
+}
+
 func copyHostInfo(h *HostInfo, preferredRanges []netip.Prefix) ControlHostInfo {
 	chi := ControlHostInfo{
 		VpnAddrs:               make([]netip.Addr, len(h.vpnAddrs)),
@@ -291,6 +307,8 @@ func copyHostInfo(h *HostInfo, preferredRanges []netip.Prefix) ControlHostInfo {
 
 	if h.ConnectionState != nil {
 		chi.MessageCounter = h.ConnectionState.messageCounter.Load()
+		chi.PostQuantum = h.ConnectionState.postQuantum
+		chi.Cipher = h.ConnectionState.cipher
 	}
 
 	if c := h.GetCert(); c != nil {
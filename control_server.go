@@ -0,0 +1,437 @@
+package nebula
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+)
+
+// The control server exposes the functions available on Control as a json api over a unix domain socket.
+// Every call is a POST to /v1/<Name> with an optional json body, the response is either the json encoded result
+// or a ControlError along with a non 200 status code.
+
+// ControlListHostmapRequest is the body for the ListHostmapHosts and ListHostmapIndexes calls
+type ControlListHostmapRequest struct {
+	Pending bool `json:"pending"`
+}
+
+// ControlTunnelRequest is the body for all calls that operate on a single tunnel
+type ControlTunnelRequest struct {
+	VpnAddr netip.Addr `json:"vpnAddr"`
+	// Addr is the remote udp address to use, required for SetRemoteForTunnel and optional for CreateTunnel
+	Addr netip.AddrPort `json:"addr"`
+	// LocalOnly is only used by CloseTunnel, if true the remote end will not be notified
+	LocalOnly bool `json:"localOnly"`
+}
+
+// ControlPathRequest is the body for the profiling calls, Path is resolved by the nebula process so it should be absolute
+type ControlPathRequest struct {
+	Path string `json:"path"`
+}
+
+// ControlSettingRequest is the body for calls that get and optionally set a runtime value, ex: LogLevel
+type ControlSettingRequest struct {
+	// Value is the new value, leave empty to only get the current value
+	Value string `json:"value"`
+}
+
+// ControlSetting is returned by calls that get and optionally set a runtime value
+type ControlSetting struct {
+	Value string `json:"value"`
+	// Previous is only set if the value was changed
+	Previous string `json:"previous,omitempty"`
+}
+
+// ControlCert is returned by the PrintCert call
+type ControlCert struct {
+	Cert cert.Certificate `json:"cert"`
+	PEM  string           `json:"pem"`
+}
+
+// ControlError is returned as the body of any failed call
+type ControlError struct {
+	Error string `json:"error"`
+}
+
+type controlServer struct {
+	sync.Mutex
+	l      *logrus.Logger
+	c      *config.C
+	ctrl   *Control
+	listen string
+	server *http.Server
+	// ln is closed along with server, which only closes it once Serve has picked it up
+	ln net.Listener
+	// stopped is set once nebula is shutting down, reloads after it must not listen again
+	stopped bool
+}
+
+// newControlServerFromConfig validates the control config and wires up reloading. Nothing is listening until Start is
+// called with the Control object to serve.
+func newControlServerFromConfig(ctx context.Context, l *logrus.Logger, c *config.C) (*controlServer, error) {
+	if _, err := getControlListen(c); err != nil {
+		return nil, err
+	}
+
+	cs := &controlServer{l: l, c: c}
+
+	c.RegisterReloadCallback(func(c *config.C) {
+		if err := cs.reload(c); err != nil {
+			l.WithError(err).Error("Failed to reconfigure the control server")
+		}
+	})
+
+	go func() {
+		<-ctx.Done()
+		cs.Stop()
+	}()
+
+	return cs, nil
+}
+
+// getControlListen returns the configured socket path or an empty string if the control server is disabled
+func getControlListen(c *config.C) (string, error) {
+	if !c.GetBool("control.enabled", false) {
+		return "", nil
+	}
+
+	listen := c.GetString("control.listen", "")
+	if listen == "" {
+		return "", fmt.Errorf("control.listen must be provided")
+	}
+
+	return listen, nil
+}
+
+// Start begins serving ctrl if the control server is enabled
+func (cs *controlServer) Start(ctrl *Control) {
+	cs.Lock()
+	cs.ctrl = ctrl
+	cs.Unlock()
+
+	if err := cs.reload(cs.c); err != nil {
+		cs.l.WithError(err).Error("Failed to start the control server")
+	}
+}
+
+func (cs *controlServer) reload(c *config.C) error {
+	listen, err := getControlListen(c)
+	if err != nil {
+		return err
+	}
+
+	cs.Lock()
+	defer cs.Unlock()
+
+	if cs.ctrl == nil || cs.stopped {
+		// Not started yet, Start will pick up the current config, or already stopped for good
+		return nil
+	}
+
+	if cs.server != nil && listen == cs.listen {
+		return nil
+	}
+
+	cs.stop()
+	if listen == "" {
+		return nil
+	}
+
+	ln, err := listenControlSocket(listen)
+	if err != nil {
+		return err
+	}
+
+	cs.listen = listen
+	cs.ln = ln
+	cs.server = &http.Server{Handler: cs.handler()}
+
+	cs.l.WithField("controlListener", listen).Info("Starting control server")
+	go func(s *http.Server) {
+		if err := s.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			cs.l.WithError(err).Warn("Control server stopped unexpectedly")
+		}
+	}(cs.server)
+
+	return nil
+}
+
+// Stop closes the server and removes its socket, it is called when nebula shuts down
+func (cs *controlServer) Stop() {
+	cs.Lock()
+	cs.stopped = true
+	cs.stop()
+	cs.Unlock()
+}
+
+// stop closes the active server, if any, which removes the socket. The caller must hold the lock
+func (cs *controlServer) stop() {
+	if cs.server == nil {
+		return
+	}
+
+	if err := cs.server.Close(); err != nil {
+		cs.l.WithError(err).Warn("Failed to close the control server")
+	}
+	// Closing the listener removes the socket
+	_ = cs.ln.Close()
+	cs.ln = nil
+	cs.server = nil
+	cs.listen = ""
+}
+
+// listenControlSocket removes a stale socket left behind by a previous run, if any, and listens on path.
+// The socket is only accessible by the owner of the process.
+func listenControlSocket(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("control.listen %s already exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale control socket: %w", err)
+		}
+	}
+
+	ln, err := listenUnixPrivate(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on control socket: %w", err)
+	}
+
+	return ln, nil
+}
+
+func (cs *controlServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	ctrl := cs.ctrl
+
+	mux.HandleFunc("POST /v1/ListHostmapHosts", controlCall(func(r ControlListHostmapRequest) (any, error) {
+		return ctrl.ListHostmapHosts(r.Pending), nil
+	}))
+
+	mux.HandleFunc("POST /v1/ListHostmapIndexes", controlCall(func(r ControlListHostmapRequest) (any, error) {
+		return ctrl.ListHostmapIndexes(r.Pending), nil
+	}))
+
+	mux.HandleFunc("POST /v1/PrintTunnel", controlCall(func(r ControlTunnelRequest) (any, error) {
+		hi := ctrl.PrintTunnel(r.VpnAddr.Unmap())
+		if hi == nil {
+			return nil, errControlNotFound
+		}
+		return hi, nil
+	}))
+
+	mux.HandleFunc("POST /v1/CloseTunnel", controlCall(func(r ControlTunnelRequest) (any, error) {
+		if !ctrl.CloseTunnel(r.VpnAddr.Unmap(), r.LocalOnly) {
+			return nil, errControlNotFound
+		}
+		return true, nil
+	}))
+
+	mux.HandleFunc("POST /v1/CreateTunnel", controlCall(func(r ControlTunnelRequest) (any, error) {
+		vpnAddr := r.VpnAddr.Unmap()
+		if ctrl.f.hostMap.QueryVpnAddr(vpnAddr) != nil {
+			return nil, errors.New("tunnel already exists")
+		}
+
+		if ctrl.f.handshakeManager.QueryVpnAddr(vpnAddr) != nil {
+			return nil, errors.New("tunnel already handshaking")
+		}
+
+		hostInfo := ctrl.f.handshakeManager.StartHandshake(vpnAddr, nil)
+		if r.Addr.IsValid() {
+			hostInfo.SetRemote(r.Addr)
+		}
+		return true, nil
+	}))
+
+	mux.HandleFunc("POST /v1/QueryLighthouse", controlCall(func(r ControlTunnelRequest) (any, error) {
+		return ctrl.QueryLighthouse(r.VpnAddr.Unmap()), nil
+	}))
+
+	mux.HandleFunc("POST /v1/SetRemoteForTunnel", controlCall(func(r ControlTunnelRequest) (any, error) {
+		if !r.Addr.IsValid() {
+			return nil, errors.New("addr must be provided")
+		}
+
+		hi := ctrl.SetRemoteForTunnel(r.VpnAddr.Unmap(), r.Addr)
+		if hi == nil {
+			return nil, errControlNotFound
+		}
+		return hi, nil
+	}))
+
+	mux.HandleFunc("POST /v1/ReloadConfig", controlCall(func(r struct{}) (any, error) {
+		cs.c.ReloadConfig()
+		return true, nil
+	}))
+
+	mux.HandleFunc("POST /v1/ListLighthouseAddrmap", controlCall(func(r struct{}) (any, error) {
+		return listLighthouseAddrMap(ctrl.f.lightHouse), nil
+	}))
+
+	mux.HandleFunc("POST /v1/ListFirewallRules", controlCall(func(r struct{}) (any, error) {
+		return ctrl.ListFirewallRules(), nil
+	}))
+
+	mux.HandleFunc("POST /v1/PrintRelays", controlCall(func(r struct{}) (any, error) {
+		return listRelays(ctrl.f), nil
+	}))
+
+	mux.HandleFunc("POST /v1/PrintCert", controlCall(func(r ControlTunnelRequest) (any, error) {
+		c := ctrl.f.pki.getCertState().GetDefaultCertificate()
+		if r.VpnAddr.IsValid() {
+			hostInfo := ctrl.f.hostMap.QueryVpnAddr(r.VpnAddr.Unmap())
+			if hostInfo == nil || hostInfo.GetCert() == nil {
+				return nil, errControlNotFound
+			}
+			c = hostInfo.GetCert().Certificate
+		}
+
+		b, err := c.MarshalPEM()
+		if err != nil {
+			return nil, err
+		}
+		return ControlCert{Cert: c.Copy(), PEM: string(b)}, nil
+	}))
+
+	mux.HandleFunc("POST /v1/DeviceInfo", controlCall(func(r struct{}) (any, error) {
+		return getDeviceInfo(ctrl.f), nil
+	}))
+
+	mux.HandleFunc("POST /v1/Version", controlCall(func(r struct{}) (any, error) {
+		return ctrl.f.version, nil
+	}))
+
+	mux.HandleFunc("POST /v1/LogLevel", controlCall(func(r ControlSettingRequest) (any, error) {
+		res := ControlSetting{Value: cs.l.GetLevel().String()}
+		if r.Value == "" {
+			return res, nil
+		}
+
+		level, err := logrus.ParseLevel(r.Value)
+		if err != nil {
+			return nil, fmt.Errorf("unknown log level %s. possible log levels: %s", r.Value, logrus.AllLevels)
+		}
+
+		cs.l.SetLevel(level)
+		res.Previous, res.Value = res.Value, level.String()
+		return res, nil
+	}))
+
+	mux.HandleFunc("POST /v1/LogFormat", controlCall(func(r ControlSettingRequest) (any, error) {
+		res := ControlSetting{Value: logFormatName(cs.l)}
+		if r.Value == "" {
+			return res, nil
+		}
+
+		if err := setLogFormat(cs.l, r.Value); err != nil {
+			return nil, err
+		}
+		res.Previous, res.Value = res.Value, logFormatName(cs.l)
+		return res, nil
+	}))
+
+	mux.HandleFunc("POST /v1/StartCpuProfile", controlCall(func(r ControlPathRequest) (any, error) {
+		if r.Path == "" {
+			return nil, errors.New("path must be provided")
+		}
+		return true, startCpuProfile(r.Path)
+	}))
+
+	mux.HandleFunc("POST /v1/StopCpuProfile", controlCall(func(r struct{}) (any, error) {
+		pprof.StopCPUProfile()
+		return true, nil
+	}))
+
+	mux.HandleFunc("POST /v1/SaveHeapProfile", controlCall(func(r ControlPathRequest) (any, error) {
+		if r.Path == "" {
+			return nil, errors.New("path must be provided")
+		}
+		return true, saveHeapProfile(r.Path)
+	}))
+
+	mux.HandleFunc("POST /v1/SaveMutexProfile", controlCall(func(r ControlPathRequest) (any, error) {
+		if r.Path == "" {
+			return nil, errors.New("path must be provided")
+		}
+		return true, saveMutexProfile(r.Path)
+	}))
+
+	mux.HandleFunc("POST /v1/MutexProfileFraction", controlCall(func(r ControlSettingRequest) (any, error) {
+		if r.Value == "" {
+			return ControlSetting{Value: strconv.Itoa(runtime.SetMutexProfileFraction(-1))}, nil
+		}
+
+		rate, err := strconv.Atoi(r.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate: %s", r.Value)
+		}
+
+		old := runtime.SetMutexProfileFraction(rate)
+		return ControlSetting{Value: strconv.Itoa(rate), Previous: strconv.Itoa(old)}, nil
+	}))
+
+	return mux
+}
+
+// logFormatName returns the name of the current log format as accepted by setLogFormat
+func logFormatName(l *logrus.Logger) string {
+	switch l.Formatter.(type) {
+	case *logrus.JSONFormatter:
+		return "json"
+	case *logrus.TextFormatter:
+		return "text"
+	default:
+		return fmt.Sprintf("%T", l.Formatter)
+	}
+}
+
+var errControlNotFound = errors.New("could not find tunnel for vpn addr")
+
+// controlCall decodes the request body into T, runs fn, and encodes the result or error as the response
+func controlCall[T any](fn func(T) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req T
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			writeControlResponse(w, http.StatusBadRequest, ControlError{Error: fmt.Sprintf("invalid request: %s", err)})
+			return
+		}
+
+		res, err := fn(req)
+		switch {
+		case errors.Is(err, errControlNotFound):
+			writeControlResponse(w, http.StatusNotFound, ControlError{Error: err.Error()})
+		case err != nil:
+			writeControlResponse(w, http.StatusBadRequest, ControlError{Error: err.Error()})
+		default:
+			writeControlResponse(w, http.StatusOK, res)
+		}
+	}
+}
+
+func writeControlResponse(w http.ResponseWriter, status int, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		b, _ = json.Marshal(ControlError{Error: fmt.Sprintf("failed to encode response: %s", err)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(append(b, '\n'))
+}
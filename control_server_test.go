@@ -0,0 +1,145 @@
+package nebula
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestControlServer(t *testing.T) {
+	l := test.NewLogger()
+	hm := newHostMap(l)
+	hm.preferredRanges.Store(&[]netip.Prefix{})
+
+	vpnAddr := netip.MustParseAddr("10.128.0.2")
+	remote := netip.MustParseAddrPort("192.168.1.1:4242")
+	hm.unlockedAddHostInfo(&HostInfo{
+		remote:          remote,
+		remotes:         NewRemoteList([]netip.Addr{vpnAddr}, nil),
+		ConnectionState: &ConnectionState{},
+		remoteIndexId:   200,
+		localIndexId:    201,
+		vpnAddrs:        []netip.Addr{vpnAddr},
+		relayState: RelayState{
+			relays:         nil,
+			relayForByAddr: map[netip.Addr]*Relay{},
+			relayForByIdx:  map[uint32]*Relay{},
+		},
+	}, &Interface{})
+
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &dummyCert{})
+	require.NoError(t, fw.AddRule(true, firewall.ProtoTCP, 22, 22, []string{}, "", netip.Prefix{}, netip.Prefix{}, "", ""))
+
+	ctrl := &Control{
+		f: &Interface{hostMap: hm, firewall: fw},
+		l: l,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sock := filepath.Join(t.TempDir(), "control.sock")
+	c := config.NewC(l)
+	c.Settings["control"] = map[string]any{"enabled": true, "listen": sock}
+
+	cs, err := newControlServerFromConfig(ctx, l, c)
+	require.NoError(t, err)
+	cs.Start(ctrl)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+
+	call := func(name string, body any) (int, []byte) {
+		b, err := json.Marshal(body)
+		require.NoError(t, err)
+		resp, err := client.Post("http://nebula/v1/"+name, "application/json", bytes.NewReader(b))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		out := new(bytes.Buffer)
+		_, err = out.ReadFrom(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, out.Bytes()
+	}
+
+	type hostInfo struct {
+		VpnAddrs      []netip.Addr   `json:"vpnAddrs"`
+		LocalIndex    uint32         `json:"localIndex"`
+		CurrentRemote netip.AddrPort `json:"currentRemote"`
+	}
+
+	status, b := call("ListHostmapHosts", ControlListHostmapRequest{})
+	assert.Equal(t, http.StatusOK, status)
+	var hosts []hostInfo
+	require.NoError(t, json.Unmarshal(b, &hosts))
+	assert.Equal(t, []hostInfo{{VpnAddrs: []netip.Addr{vpnAddr}, LocalIndex: 201, CurrentRemote: remote}}, hosts)
+
+	status, b = call("PrintTunnel", ControlTunnelRequest{VpnAddr: vpnAddr})
+	assert.Equal(t, http.StatusOK, status)
+	var hi hostInfo
+	require.NoError(t, json.Unmarshal(b, &hi))
+	assert.Equal(t, vpnAddr, hi.VpnAddrs[0])
+
+	status, b = call("PrintTunnel", ControlTunnelRequest{VpnAddr: netip.MustParseAddr("10.128.0.3")})
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.JSONEq(t, `{"error":"could not find tunnel for vpn addr"}`, string(b))
+
+	status, _ = call("SetRemoteForTunnel", ControlTunnelRequest{VpnAddr: vpnAddr})
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, b = call("LogLevel", ControlSettingRequest{Value: "debug"})
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"value":"debug","previous":"info"}`, string(b))
+
+	status, _ = call("LogLevel", ControlSettingRequest{Value: "nope"})
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, b = call("ListFirewallRules", nil)
+	assert.Equal(t, http.StatusOK, status)
+	var rules []FirewallRuleInfo
+	require.NoError(t, json.Unmarshal(b, &rules))
+	assert.Equal(t, fw.ListRules(), rules)
+
+	status, _ = call("NotACall", nil)
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// Disabling the server on reload should close the socket
+	c.Settings["control"] = map[string]any{"enabled": false}
+	require.NoError(t, cs.reload(c))
+	_, err = client.Post("http://nebula/v1/ListHostmapHosts", "application/json", nil)
+	assert.Error(t, err)
+	assert.NoFileExists(t, sock)
+
+	// Stopping removes the socket without waiting on the context
+	c.Settings["control"] = map[string]any{"enabled": true, "listen": sock}
+	require.NoError(t, cs.reload(c))
+	require.FileExists(t, sock)
+	cs.Stop()
+	assert.NoFileExists(t, sock)
+
+	// A reload racing with shutdown does not bring the socket back
+	require.NoError(t, cs.reload(c))
+	assert.NoFileExists(t, sock)
+}
+
+func TestControlServer_config(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["control"] = map[string]any{"enabled": true}
+	_, err := newControlServerFromConfig(context.Background(), l, c)
+	require.EqualError(t, err, "control.listen must be provided")
+}
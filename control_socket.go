@@ -0,0 +1,59 @@
+//go:build !windows
+// +build !windows
+
+package nebula
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// privateUnixListener removes the socket it was renamed to when it is closed, the listener it wraps only knows the
+// temporary name it was bound to
+type privateUnixListener struct {
+	*net.UnixListener
+	addr *net.UnixAddr
+}
+
+func (l *privateUnixListener) Addr() net.Addr {
+	return l.addr
+}
+
+func (l *privateUnixListener) Close() error {
+	err := l.UnixListener.Close()
+	if rmErr := os.Remove(l.addr.Name); rmErr != nil && !errors.Is(rmErr, os.ErrNotExist) && err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// listenUnixPrivate listens on path with a socket only the owner of the process can connect to. The socket is bound
+// inside a new directory only the owner can enter, its permissions are set and then it is renamed into place, so it is
+// never reachable by anyone else and nothing else in the process is affected.
+func listenUnixPrivate(path string) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".nebula-control-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "sock")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	ln.SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tmp, 0600); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+
+	return &privateUnixListener{UnixListener: ln, addr: &net.UnixAddr{Name: path, Net: "unix"}}, nil
+}
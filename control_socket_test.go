@@ -0,0 +1,58 @@
+//go:build !windows
+// +build !windows
+
+package nebula
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenControlSocket(t *testing.T) {
+	old := syscall.Umask(0022)
+	defer syscall.Umask(old)
+
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "control.sock")
+	ln, err := listenControlSocket(sock)
+	require.NoError(t, err)
+	fi, err := os.Stat(sock)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	assert.Equal(t, sock, ln.Addr().String())
+
+	// The umask is left alone and the directory the socket was made in is gone
+	assert.Equal(t, 0022, syscall.Umask(0022))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	c, err := net.Dial("unix", sock)
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+
+	// Closing removes the socket
+	require.NoError(t, ln.Close())
+	assert.NoFileExists(t, sock)
+
+	// A socket left behind is replaced, anything else is not
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	require.NoError(t, err)
+	stale.SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+	require.FileExists(t, sock)
+	ln, err = listenControlSocket(sock)
+	require.NoError(t, err)
+	require.NoError(t, ln.Close())
+
+	file := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(file, nil, 0600))
+	_, err = listenControlSocket(file)
+	assert.ErrorContains(t, err, "already exists and is not a socket")
+}
@@ -0,0 +1,8 @@
+package nebula
+
+import "net"
+
+// listenUnixPrivate listens on path, on windows access to the socket follows the directory it is in
+func listenUnixPrivate(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
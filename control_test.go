@@ -48,6 +48,7 @@ func TestControl_GetHostInfoByVpnIp(t *testing.T) {
 		remotes: remotes,
 		ConnectionState: &ConnectionState{
 			peerCert: &cert.CachedCertificate{Certificate: crt},
+			cipher:   "chachapoly",
 		},
 		remoteIndexId: 200,
 		localIndexId:  201,
@@ -97,10 +98,11 @@ func TestControl_GetHostInfoByVpnIp(t *testing.T) {
 		CurrentRemote:          remote1,
 		CurrentRelaysToMe:      []netip.Addr{},
 		CurrentRelaysThroughMe: []netip.Addr{},
+		Cipher:                 "chachapoly",
 	}
 
 	// Make sure we don't have any unexpected fields
-	assertFields(t, []string{"VpnAddrs", "LocalIndex", "RemoteIndex", "RemoteAddrs", "Cert", "MessageCounter", "CurrentRemote", "CurrentRelaysToMe", "CurrentRelaysThroughMe"}, thi)
+	assertFields(t, []string{"VpnAddrs", "LocalIndex", "RemoteIndex", "RemoteAddrs", "Cert", "MessageCounter", "CurrentRemote", "CurrentRelaysToMe", "CurrentRelaysThroughMe", "PostQuantum", "Cipher"}, thi)
 	assert.Equal(t, &expectedInfo, thi)
 	test.AssertDeepCopyEqual(t, &expectedInfo, thi)
 
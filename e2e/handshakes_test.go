@@ -4,6 +4,7 @@
 package e2e
 
 import (
+	"fmt"
 	"net/netip"
 	"slices"
 	"testing"
@@ -1030,6 +1031,69 @@ func TestRehandshaking(t *testing.T) {
 	theirControl.Stop()
 }
 
+func TestRekeying(t *testing.T) {
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version1, cert.Curve_CURVE25519, time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	myControl, myVpnIpNet, myUdpAddr, myConfig := newSimpleServer(cert.Version1, ca, caKey, "me  ", "10.128.0.2/24", m{"tunnels": m{"rekey_after_packets": 10}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(cert.Version1, ca, caKey, "them", "10.128.0.1/24", nil)
+
+	// Put their info in our lighthouse and vice versa
+	myControl.InjectLightHouseAddr(theirVpnIpNet[0].Addr(), theirUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet[0].Addr(), myUdpAddr)
+
+	// Build a router so we don't have to reason who gets which packet
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+
+	t.Log("Stand up a tunnel between me and them")
+	assertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
+	first := myControl.GetHostInfoByVpnAddr(theirVpnIpNet[0].Addr(), false)
+
+	r.Log("Send traffic until the connection manager replaces the tunnel")
+	for {
+		assertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
+		c := myControl.GetHostInfoByVpnAddr(theirVpnIpNet[0].Addr(), false)
+		if c.LocalIndex != first.LocalIndex {
+			break
+		}
+
+		t.Log("Connection manager hasn't ticked yet")
+		time.Sleep(time.Second)
+	}
+
+	r.Log("Turn rekeying off so the new tunnel sticks around")
+	myConfig.Settings["tunnels"] = m{"rekey_after_packets": 0}
+	rc, err := yaml.Marshal(myConfig.Settings)
+	require.NoError(t, err)
+	require.NoError(t, myConfig.ReloadConfigString(string(rc)))
+
+	r.Log("Spin until the old tunnels are gone")
+	for {
+		assertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
+		// A rekey may have started before the reload, wait for it to finish too
+		pending := myControl.GetHostInfoByVpnAddr(theirVpnIpNet[0].Addr(), true)
+		if pending == nil && len(myControl.GetHostmap().Indexes)+len(theirControl.GetHostmap().Indexes) == 2 {
+			break
+		}
+
+		t.Log("Connection manager hasn't ticked yet")
+		time.Sleep(time.Second)
+	}
+
+	c := theirControl.GetHostInfoByVpnAddr(myVpnIpNet[0].Addr(), false)
+	assert.NotEqual(t, first.RemoteIndex, c.LocalIndex)
+	assert.Len(t, myControl.ListHostmapIndexes(false), 1)
+	assert.Len(t, theirControl.ListHostmapIndexes(false), 1)
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl)
+
+	myControl.Stop()
+	theirControl.Stop()
+}
+
 func TestRehandshakingLoser(t *testing.T) {
 	// The purpose of this test is that the race loser renews their certificate and rehandshakes. The final tunnel
 	// Should be the one with the new certificate
@@ -1227,3 +1291,395 @@ func TestV2NonPrimaryWithLighthouse(t *testing.T) {
 	myControl.Stop()
 	theirControl.Stop()
 }
+
+func TestHandshakePSK(t *testing.T) {
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	oldPSK := "the old network secret"
+	newPSK := "the new network secret"
+
+	// They are part way through a rotation, initiating with the new key and still accepting the old one
+	myControl, myVpnIpNet, _, _ := newSimpleServer(cert.Version2, ca, caKey, "me   ", "10.128.0.1/24", m{"handshakes": m{"psk": []string{newPSK}}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(cert.Version2, ca, caKey, "them ", "10.128.0.2/24", m{"handshakes": m{"psk": []string{newPSK, oldPSK}}})
+	otherControl, otherVpnIpNet, otherUdpAddr, _ := newSimpleServer(cert.Version2, ca, caKey, "other", "10.128.0.3/24", m{"handshakes": m{"psk": []string{oldPSK}}})
+
+	myControl.InjectLightHouseAddr(theirVpnIpNet[0].Addr(), theirUdpAddr)
+	myControl.InjectLightHouseAddr(otherVpnIpNet[0].Addr(), otherUdpAddr)
+	otherControl.InjectLightHouseAddr(theirVpnIpNet[0].Addr(), theirUdpAddr)
+
+	myControl.Start()
+	theirControl.Start()
+	otherControl.Start()
+
+	r := router.NewR(t, myControl, theirControl, otherControl)
+	defer r.RenderFlow()
+
+	t.Log("Stand up a tunnel with the psk we share")
+	assertTunnel(t, theirVpnIpNet[0].Addr(), myVpnIpNet[0].Addr(), theirControl, myControl, r)
+
+	t.Log("Stand up a tunnel with the old psk they still accept")
+	assertTunnel(t, theirVpnIpNet[0].Addr(), otherVpnIpNet[0].Addr(), theirControl, otherControl, r)
+
+	t.Log("A host without our psk can not read our handshake")
+	myControl.InjectTunUDPPacket(otherVpnIpNet[0].Addr(), 80, myVpnIpNet[0].Addr(), 80, []byte("Hi from me"))
+	otherControl.InjectUDPPacket(myControl.GetFromUDP(true))
+	assert.Never(t, func() bool { return otherControl.GetFromUDP(false) != nil }, 500*time.Millisecond, 50*time.Millisecond)
+	assert.Nil(t, otherControl.GetHostInfoByVpnAddr(myVpnIpNet[0].Addr(), true))
+	assert.Nil(t, otherControl.GetHostInfoByVpnAddr(myVpnIpNet[0].Addr(), false))
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl, otherControl)
+	myControl.Stop()
+	theirControl.Stop()
+	otherControl.Stop()
+}
+
+func TestHandshakeXX(t *testing.T) {
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(cert.Version2, ca, caKey, "me-secret-name", "10.128.0.1/24", m{"handshakes": m{"pattern": "xx"}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(cert.Version2, ca, caKey, "them-public-name", "10.128.0.2/24", m{"handshakes": m{"accept_xx": true}})
+
+	// Put their info in our lighthouse
+	myControl.InjectLightHouseAddr(theirVpnIpNet[0].Addr(), theirUdpAddr)
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+
+	assertStage := func(p *udp.Packet, counter uint64) {
+		h := &header.H{}
+		require.NoError(t, h.Parse(p.Data))
+		assert.Equal(t, header.Handshake, h.Type)
+		assert.Equal(t, header.HandshakeXXPSK0, h.Subtype)
+		assert.Equal(t, counter, h.MessageCounter)
+		assert.NotContains(t, string(p.Data), "me-secret-name", "my certificate must not be readable on the wire")
+	}
+
+	t.Log("Send a udp packet through to begin standing up the tunnel, this should come out the other side")
+	myControl.InjectTunUDPPacket(theirVpnIpNet[0].Addr(), 80, myVpnIpNet[0].Addr(), 80, []byte("Hi from me"))
+
+	t.Log("Have them consume my stage 1 packet, it does not say who I am")
+	stage1Packet := myControl.GetFromUDP(true)
+	assertStage(stage1Packet, 1)
+	theirControl.InjectUDPPacket(stage1Packet)
+	assert.Nil(t, theirControl.GetHostInfoByVpnAddr(myVpnIpNet[0].Addr(), false), "they should not have a tunnel yet")
+
+	stage2Packet := theirControl.GetFromUDP(true)
+	assertStage(stage2Packet, 2)
+
+	t.Log("A retransmit of my stage 1 packet gets the same stage 2 packet instead of more state")
+	theirControl.InjectUDPPacket(stage1Packet)
+	assert.Equal(t, stage2Packet.Data, theirControl.GetFromUDP(true).Data)
+	assert.Len(t, theirControl.ListHostmapIndexes(true), 1)
+
+	t.Log("Have me consume their stage 2 packet. I have a tunnel now")
+	myControl.InjectUDPPacket(stage2Packet)
+
+	t.Log("Have them consume my stage 3 packet. They have a tunnel now")
+	stage3Packet := myControl.GetFromUDP(true)
+	assertStage(stage3Packet, 3)
+	theirControl.InjectUDPPacket(stage3Packet)
+
+	t.Log("Get that cached packet and make sure it looks right")
+	theirControl.InjectUDPPacket(myControl.GetFromUDP(true))
+	myCachedPacket := theirControl.GetFromTun(true)
+	assertUdpPacket(t, []byte("Hi from me"), myCachedPacket, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), 80, 80)
+
+	t.Log("Make sure our host infos are correct")
+	assertHostInfoPair(t, myUdpAddr, theirUdpAddr, myVpnIpNet, theirVpnIpNet, myControl, theirControl)
+
+	t.Log("Do a bidirectional tunnel test")
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+	assertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
+
+	t.Log("They still start ix handshakes with me")
+	myControl.CloseTunnel(theirVpnIpNet[0].Addr(), true)
+	theirControl.CloseTunnel(myVpnIpNet[0].Addr(), true)
+	theirControl.InjectLightHouseAddr(myVpnIpNet[0].Addr(), myUdpAddr)
+	theirControl.CreateTunnel(myVpnIpNet[0].Addr())
+	ixPacket := theirControl.GetFromUDP(true)
+	h := &header.H{}
+	require.NoError(t, h.Parse(ixPacket.Data))
+	assert.Equal(t, header.HandshakeIXPSK0, h.Subtype)
+	myControl.InjectUDPPacket(ixPacket)
+	theirControl.InjectUDPPacket(myControl.GetFromUDP(true))
+	assertTunnel(t, theirVpnIpNet[0].Addr(), myVpnIpNet[0].Addr(), theirControl, myControl, r)
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl)
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestHandshakeXXFallback(t *testing.T) {
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	myControl, myVpnIpNet, _, _ := newSimpleServer(cert.Version2, ca, caKey, "me    ", "10.128.0.1/24", m{"handshakes": m{"pattern": "xx"}})
+	oldControl, oldVpnIpNet, oldUdpAddr, _ := newSimpleServer(cert.Version2, ca, caKey, "old   ", "10.128.0.2/24", nil)
+	strictControl, strictVpnIpNet, _, _ := newSimpleServer(cert.Version2, ca, caKey, "strict", "10.128.0.3/24", m{"handshakes": m{"pattern": "xx_require"}})
+
+	myControl.InjectLightHouseAddr(oldVpnIpNet[0].Addr(), oldUdpAddr)
+	strictControl.InjectLightHouseAddr(oldVpnIpNet[0].Addr(), oldUdpAddr)
+
+	myControl.Start()
+	oldControl.Start()
+	strictControl.Start()
+
+	t.Log("Fall back to ix with a host that never answers xx")
+	myControl.InjectTunUDPPacket(oldVpnIpNet[0].Addr(), 80, myVpnIpNet[0].Addr(), 80, []byte("Hi from me"))
+	h := &header.H{}
+	for {
+		p := myControl.GetFromUDP(true)
+		require.NoError(t, h.Parse(p.Data))
+		oldControl.InjectUDPPacket(p)
+		if h.Subtype == header.HandshakeIXPSK0 {
+			break
+		}
+		assert.Equal(t, header.HandshakeXXPSK0, h.Subtype)
+	}
+
+	// A host that did not enable handshakes.accept_xx ignores xx like an older version would, so the first thing it
+	// answers is the ix handshake
+	p := oldControl.GetFromUDP(true)
+	require.NoError(t, h.Parse(p.Data))
+	assert.Equal(t, header.HandshakeIXPSK0, h.Subtype)
+	myControl.InjectUDPPacket(p)
+	oldControl.InjectUDPPacket(myControl.GetFromUDP(true))
+	assertUdpPacket(t, []byte("Hi from me"), oldControl.GetFromTun(true), myVpnIpNet[0].Addr(), oldVpnIpNet[0].Addr(), 80, 80)
+
+	t.Log("The next handshake with that host starts with ix instead of waiting for the fall back again")
+	myControl.CloseTunnel(oldVpnIpNet[0].Addr(), true)
+	oldControl.CloseTunnel(myVpnIpNet[0].Addr(), true)
+	myControl.InjectLightHouseAddr(oldVpnIpNet[0].Addr(), oldUdpAddr)
+	myControl.CreateTunnel(oldVpnIpNet[0].Addr())
+	p = myControl.GetFromUDP(true)
+	require.NoError(t, h.Parse(p.Data))
+	assert.Equal(t, header.HandshakeIXPSK0, h.Subtype)
+
+	t.Log("A host that requires xx never reveals itself with ix")
+	strictControl.InjectTunUDPPacket(oldVpnIpNet[0].Addr(), 80, strictVpnIpNet[0].Addr(), 80, []byte("Hi from strict"))
+	tries := 0
+	for p := strictControl.GetFromUDP(true); ; p = strictControl.GetFromUDP(false) {
+		if p == nil {
+			if strictControl.GetHostInfoByVpnAddr(oldVpnIpNet[0].Addr(), true) == nil {
+				// The handshake timed out
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		require.NoError(t, h.Parse(p.Data))
+		assert.Equal(t, header.HandshakeXXPSK0, h.Subtype)
+		tries++
+	}
+	assert.Greater(t, tries, 1)
+
+	myControl.Stop()
+	oldControl.Stop()
+	strictControl.Stop()
+}
+
+func TestHandshakeXXAmplification(t *testing.T) {
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	myControl, myVpnIpNet, _, _ := newSimpleServer(cert.Version2, ca, caKey, "me", "10.128.0.1/24", m{"handshakes": m{"pattern": "xx"}})
+	// A certificate many times larger than mine makes their answer too large to send to an address that is unproven
+	var groups []string
+	for i := range 50 {
+		groups = append(groups, fmt.Sprintf("a-rather-long-group-name-%d", i))
+	}
+	_, _, theirKey, theirPEM := cert_test.NewTestCert(cert.Version2, cert.Curve_CURVE25519, ca, caKey, "them", time.Now(), time.Now().Add(5*time.Minute), []netip.Prefix{netip.MustParsePrefix("10.128.0.2/24")}, nil, groups)
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(cert.Version2, ca, caKey, "them", "10.128.0.2/24", m{"pki": m{"cert": string(theirPEM), "key": string(theirKey)}, "handshakes": m{"accept_xx": true}})
+
+	myControl.InjectLightHouseAddr(theirVpnIpNet[0].Addr(), theirUdpAddr)
+
+	myControl.Start()
+	theirControl.Start()
+
+	t.Log("My first message is answered with a cookie")
+	myControl.InjectTunUDPPacket(theirVpnIpNet[0].Addr(), 80, myVpnIpNet[0].Addr(), 80, []byte("Hi from me"))
+	stage1Packet := myControl.GetFromUDP(true)
+	theirControl.InjectUDPPacket(stage1Packet)
+	p := theirControl.GetFromUDP(true)
+	h := &header.H{}
+	require.NoError(t, h.Parse(p.Data))
+	assert.Equal(t, header.HandshakeCookie, h.Subtype)
+	assert.Less(t, len(p.Data), len(stage1Packet.Data))
+	assert.Empty(t, theirControl.ListHostmapIndexes(true), "they should hold no state for an unproven address")
+
+	t.Log("The handshake completes once I send the cookie back")
+	myControl.InjectUDPPacket(p)
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+	assertUdpPacket(t, []byte("Hi from me"), r.RouteForAllUntilTxTun(theirControl), myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), 80, 80)
+	assertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
+
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestHandshakePostQuantum(t *testing.T) {
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	myControl, myVpnIpNet, _, _ := newSimpleServer(cert.Version2, ca, caKey, "me    ", "10.128.0.1/24", m{"handshakes": m{"post_quantum": true}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(cert.Version2, ca, caKey, "them  ", "10.128.0.2/24", nil)
+	oldControl, oldVpnIpNet, oldUdpAddr, _ := newSimpleServer(cert.Version2, ca, caKey, "old   ", "10.128.0.3/24", nil)
+	strictControl, strictVpnIpNet, strictUdpAddr, _ := newSimpleServer(cert.Version2, ca, caKey, "strict", "10.128.0.4/24", m{"handshakes": m{"post_quantum": "require"}})
+	xxControl, xxVpnIpNet, _, _ := newSimpleServer(cert.Version2, ca, caKey, "xx    ", "10.128.0.5/24", m{"handshakes": m{"pattern": "xx"}})
+
+	myControl.InjectLightHouseAddr(theirVpnIpNet[0].Addr(), theirUdpAddr)
+	myControl.InjectLightHouseAddr(oldVpnIpNet[0].Addr(), oldUdpAddr)
+	theirControl.InjectLightHouseAddr(strictVpnIpNet[0].Addr(), strictUdpAddr)
+	xxControl.InjectLightHouseAddr(strictVpnIpNet[0].Addr(), strictUdpAddr)
+
+	myControl.Start()
+	theirControl.Start()
+	oldControl.Start()
+	strictControl.Start()
+	xxControl.Start()
+
+	r := router.NewR(t, myControl, theirControl, oldControl, strictControl, xxControl)
+	defer r.RenderFlow()
+
+	t.Log("Stand up a hybrid tunnel with a host that does not start them but answers them")
+	assertTunnel(t, theirVpnIpNet[0].Addr(), myVpnIpNet[0].Addr(), theirControl, myControl, r)
+	assert.True(t, myControl.GetHostInfoByVpnAddr(theirVpnIpNet[0].Addr(), false).PostQuantum)
+	assert.True(t, theirControl.GetHostInfoByVpnAddr(myVpnIpNet[0].Addr(), false).PostQuantum)
+
+	t.Log("Fall back to ix with a host that never answers the hybrid handshake")
+	myControl.InjectTunUDPPacket(oldVpnIpNet[0].Addr(), 80, myVpnIpNet[0].Addr(), 80, []byte("Hi from me"))
+	h := &header.H{}
+	for {
+		p := myControl.GetFromUDP(true)
+		require.NoError(t, h.Parse(p.Data))
+		if h.Subtype == header.HandshakeIXPSK0 {
+			oldControl.InjectUDPPacket(p)
+			break
+		}
+		// Drop it like an older version would
+		assert.Equal(t, header.HandshakeIXPSK0MLKEM768, h.Subtype)
+	}
+	myControl.InjectUDPPacket(oldControl.GetFromUDP(true))
+	oldControl.InjectUDPPacket(myControl.GetFromUDP(true))
+	assertUdpPacket(t, []byte("Hi from me"), oldControl.GetFromTun(true), myVpnIpNet[0].Addr(), oldVpnIpNet[0].Addr(), 80, 80)
+	assert.False(t, myControl.GetHostInfoByVpnAddr(oldVpnIpNet[0].Addr(), false).PostQuantum)
+
+	t.Log("The next handshake with that host starts with ix instead of waiting for the fall back again")
+	myControl.CloseTunnel(oldVpnIpNet[0].Addr(), true)
+	oldControl.CloseTunnel(myVpnIpNet[0].Addr(), true)
+	myControl.InjectLightHouseAddr(oldVpnIpNet[0].Addr(), oldUdpAddr)
+	myControl.CreateTunnel(oldVpnIpNet[0].Addr())
+	p := myControl.GetFromUDP(true)
+	require.NoError(t, h.Parse(p.Data))
+	assert.Equal(t, header.HandshakeIXPSK0, h.Subtype)
+	oldControl.InjectUDPPacket(p)
+	myControl.InjectUDPPacket(oldControl.GetFromUDP(true))
+	assertTunnel(t, myVpnIpNet[0].Addr(), oldVpnIpNet[0].Addr(), myControl, oldControl, r)
+
+	t.Log("A host that requires post quantum ignores an ix handshake")
+	theirControl.InjectTunUDPPacket(strictVpnIpNet[0].Addr(), 80, theirVpnIpNet[0].Addr(), 80, []byte("Hi from them"))
+	strictControl.InjectUDPPacket(theirControl.GetFromUDP(true))
+	assert.Never(t, func() bool { return strictControl.GetFromUDP(false) != nil }, 500*time.Millisecond, 50*time.Millisecond)
+	assert.Nil(t, strictControl.GetHostInfoByVpnAddr(theirVpnIpNet[0].Addr(), false))
+
+	t.Log("Or an xx handshake, xx is classical and does not compose with post quantum")
+	xxControl.InjectTunUDPPacket(strictVpnIpNet[0].Addr(), 80, xxVpnIpNet[0].Addr(), 80, []byte("Hi from xx"))
+	p = xxControl.GetFromUDP(true)
+	require.NoError(t, h.Parse(p.Data))
+	assert.Equal(t, header.HandshakeXXPSK0, h.Subtype)
+	strictControl.InjectUDPPacket(p)
+	assert.Never(t, func() bool { return strictControl.GetFromUDP(false) != nil }, 500*time.Millisecond, 50*time.Millisecond)
+	assert.Empty(t, strictControl.ListHostmapIndexes(true))
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl, oldControl, strictControl, xxControl)
+	myControl.Stop()
+	theirControl.Stop()
+	oldControl.Stop()
+	strictControl.Stop()
+	xxControl.Stop()
+}
+
+func TestHandshakeCipherNegotiation(t *testing.T) {
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(cert.Version2, ca, caKey, "me  ", "10.128.0.1/24", m{"cipher": []string{"chachapoly", "aes"}, "handshakes": m{"accept_xx": true}})
+	theirControl, theirVpnIpNet, _, _ := newSimpleServer(cert.Version2, ca, caKey, "them", "10.128.0.2/24", m{"cipher": []string{"aes", "chachapoly"}})
+	aesControl, aesVpnIpNet, _, _ := newSimpleServer(cert.Version2, ca, caKey, "aes ", "10.128.0.3/24", m{"cipher": "aes"})
+	xxControl, xxVpnIpNet, _, _ := newSimpleServer(cert.Version2, ca, caKey, "xx  ", "10.128.0.4/24", m{"cipher": "chachapoly", "handshakes": m{"pattern": "xx"}})
+
+	theirControl.InjectLightHouseAddr(myVpnIpNet[0].Addr(), myUdpAddr)
+	aesControl.InjectLightHouseAddr(myVpnIpNet[0].Addr(), myUdpAddr)
+	xxControl.InjectLightHouseAddr(myVpnIpNet[0].Addr(), myUdpAddr)
+
+	myControl.Start()
+	theirControl.Start()
+	aesControl.Start()
+	xxControl.Start()
+
+	r := router.NewR(t, myControl, theirControl, aesControl, xxControl)
+	defer r.RenderFlow()
+
+	t.Log("The responder picks its preferred cipher from what the initiator offered")
+	assertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
+	assert.Equal(t, "chachapoly", myControl.GetHostInfoByVpnAddr(theirVpnIpNet[0].Addr(), false).Cipher)
+	assert.Equal(t, "chachapoly", theirControl.GetHostInfoByVpnAddr(myVpnIpNet[0].Addr(), false).Cipher)
+
+	t.Log("A host that only supports aes still gets a tunnel")
+	assertTunnel(t, myVpnIpNet[0].Addr(), aesVpnIpNet[0].Addr(), myControl, aesControl, r)
+	assert.Equal(t, "aes", myControl.GetHostInfoByVpnAddr(aesVpnIpNet[0].Addr(), false).Cipher)
+	assert.Equal(t, "aes", aesControl.GetHostInfoByVpnAddr(myVpnIpNet[0].Addr(), false).Cipher)
+
+	t.Log("The xx pattern negotiates the same way")
+	assertTunnel(t, myVpnIpNet[0].Addr(), xxVpnIpNet[0].Addr(), myControl, xxControl, r)
+	assert.Equal(t, "chachapoly", myControl.GetHostInfoByVpnAddr(xxVpnIpNet[0].Addr(), false).Cipher)
+	assert.Equal(t, "chachapoly", xxControl.GetHostInfoByVpnAddr(myVpnIpNet[0].Addr(), false).Cipher)
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl, aesControl, xxControl)
+
+	myControl.Stop()
+	theirControl.Stop()
+	aesControl.Stop()
+	xxControl.Stop()
+}
+
+func TestHandshakeCookie(t *testing.T) {
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	myControl, myVpnIpNet, _, _ := newSimpleServer(cert.Version2, ca, caKey, "me   ", "10.128.0.1/24", nil)
+	otherControl, otherVpnIpNet, _, _ := newSimpleServer(cert.Version2, ca, caKey, "other", "10.128.0.3/24", nil)
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(cert.Version2, ca, caKey, "them ", "10.128.0.2/24", m{"handshakes": m{"cookie_threshold": 1}})
+
+	myControl.InjectLightHouseAddr(theirVpnIpNet[0].Addr(), theirUdpAddr)
+	otherControl.InjectLightHouseAddr(theirVpnIpNet[0].Addr(), theirUdpAddr)
+
+	myControl.Start()
+	otherControl.Start()
+	theirControl.Start()
+
+	r := router.NewR(t, myControl, otherControl, theirControl)
+	defer r.RenderFlow()
+
+	t.Log("The first handshake is within the threshold")
+	assertTunnel(t, theirVpnIpNet[0].Addr(), myVpnIpNet[0].Addr(), theirControl, myControl, r)
+
+	t.Log("The next one has to come back with a cookie")
+	otherControl.InjectTunUDPPacket(theirVpnIpNet[0].Addr(), 80, otherVpnIpNet[0].Addr(), 80, []byte("Hi from other"))
+	h := &header.H{}
+	cookies := 0
+	for {
+		theirControl.InjectUDPPacket(otherControl.GetFromUDP(true))
+		p := theirControl.GetFromUDP(true)
+		require.NoError(t, h.Parse(p.Data))
+		otherControl.InjectUDPPacket(p)
+		if h.Subtype != header.HandshakeCookie {
+			assert.Equal(t, header.HandshakeIXPSK0, h.Subtype)
+			break
+		}
+
+		cookies++
+		require.Less(t, cookies, 5, "never got past the cookie")
+	}
+	assert.NotZero(t, cookies)
+
+	assertUdpPacket(t, []byte("Hi from other"), r.RouteForAllUntilTxTun(theirControl), otherVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), 80, 80)
+	assertTunnel(t, theirVpnIpNet[0].Addr(), otherVpnIpNet[0].Addr(), theirControl, otherControl, r)
+
+	r.RenderHostmaps("Final hostmaps", myControl, otherControl, theirControl)
+
+	myControl.Stop()
+	otherControl.Stop()
+	theirControl.Stop()
+}
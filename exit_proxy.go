@@ -0,0 +1,90 @@
+package nebula
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/exitproxy"
+	"github.com/slackhq/nebula/overlay"
+)
+
+const (
+	defaultExitProxyMaxFlows = 65536
+	// defaultExitProxyTCPTimeout and defaultExitProxyUDPTimeout are the least rfc 5382 and rfc 4787 allow for an idle flow
+	defaultExitProxyTCPTimeout = 2*time.Hour + 4*time.Minute
+	defaultExitProxyUDPTimeout = 2 * time.Minute
+)
+
+// interfaceAddrs is net.InterfaceAddrs, tests replace it
+var interfaceAddrs = net.InterfaceAddrs
+
+// exitProxyConfigFromConfig reads `exit_proxy`, the returned config has no routes when nothing is to be proxied. The
+// addresses of this host's interfaces when it starts are excluded along with its vpn networks. None of the settings are
+// reloadable.
+func exitProxyConfigFromConfig(l *logrus.Logger, c *config.C, cs *CertState) (exitproxy.Config, error) {
+	cfg := exitproxy.Config{
+		Exclude:    slices.Clone(cs.myVpnNetworks),
+		MTU:        c.GetInt("tun.mtu", overlay.DefaultMTU),
+		MaxFlows:   c.GetInt("exit_proxy.max_flows", defaultExitProxyMaxFlows),
+		TCPTimeout: c.GetDuration("exit_proxy.tcp_timeout", defaultExitProxyTCPTimeout),
+		UDPTimeout: c.GetDuration("exit_proxy.udp_timeout", defaultExitProxyUDPTimeout),
+	}
+
+	for i, r := range c.GetStringSlice("exit_proxy.routes", nil) {
+		route, err := netip.ParsePrefix(r)
+		if err != nil {
+			return cfg, fmt.Errorf("entry %v in exit_proxy.routes failed to parse: %v", i+1, err)
+		}
+		cfg.Routes = append(cfg.Routes, route.Masked())
+	}
+	if len(cfg.Routes) == 0 {
+		if c.Get("exit_proxy") != nil {
+			l.Warn("exit_proxy is configured without any exit_proxy.routes, nothing will be proxied")
+		}
+		return cfg, nil
+	}
+
+	if cfg.MaxFlows < 1 {
+		return cfg, fmt.Errorf("exit_proxy.max_flows must be at least 1: %v", cfg.MaxFlows)
+	}
+	if cfg.TCPTimeout <= 0 {
+		return cfg, fmt.Errorf("exit_proxy.tcp_timeout must be positive: %v", cfg.TCPTimeout)
+	}
+	if cfg.UDPTimeout <= 0 {
+		return cfg, fmt.Errorf("exit_proxy.udp_timeout must be positive: %v", cfg.UDPTimeout)
+	}
+
+	// Flows to this host itself would reach services that only listen on its own network
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return cfg, fmt.Errorf("failed to list the interface addresses to exclude from exit_proxy: %w", err)
+	}
+	for _, a := range addrs {
+		if p, err := netip.ParsePrefix(a.String()); err == nil {
+			cfg.Exclude = append(cfg.Exclude, netip.PrefixFrom(p.Addr(), p.Addr().BitLen()))
+		}
+	}
+
+	// The firewall only lets in packets for our vpn networks and the unsafe networks in our certificate
+	unsafeNetworks := cs.GetDefaultCertificate().UnsafeNetworks()
+	for _, route := range cfg.Routes {
+		covered := false
+		for _, n := range unsafeNetworks {
+			if n.Bits() <= route.Bits() && n.Contains(route.Addr()) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			l.WithField("route", route).WithField("unsafeNetworks", unsafeNetworks).
+				Warn("exit_proxy.routes entry is not within the unsafe networks of this host's certificate, the firewall will drop traffic for it")
+		}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,83 @@
+package nebula
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/overlay"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExitProxyConfigFromConfig(t *testing.T) {
+	defer func(f func() ([]net.Addr, error)) { interfaceAddrs = f }(interfaceAddrs)
+	interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{
+			&net.IPNet{IP: net.ParseIP("192.168.1.5"), Mask: net.CIDRMask(24, 32)},
+			&net.IPNet{IP: net.ParseIP("2001:db8::5"), Mask: net.CIDRMask(64, 128)},
+		}, nil
+	}
+
+	l := test.NewLogger()
+	c := config.NewC(l)
+	cs := &CertState{
+		initiatingVersion: cert.Version1,
+		v1Cert:            &dummyCert{version: cert.Version1, unsafeNetworks: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")}},
+		myVpnNetworks:     []netip.Prefix{netip.MustParsePrefix("10.128.0.1/16")},
+	}
+
+	cfg, err := exitProxyConfigFromConfig(l, c, cs)
+	require.NoError(t, err)
+	assert.Empty(t, cfg.Routes)
+
+	c.Settings["exit_proxy"] = m{"routes": []any{"0.0.0.0/0", "192.168.1.5/24"}}
+	cfg, err = exitProxyConfigFromConfig(l, c, cs)
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("192.168.1.0/24")}, cfg.Routes)
+	// The addresses of this host are excluded but not the networks they are in
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.128.0.1/16"),
+		netip.MustParsePrefix("192.168.1.5/32"),
+		netip.MustParsePrefix("2001:db8::5/128"),
+	}, cfg.Exclude)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.128.0.1/16")}, cs.myVpnNetworks)
+	assert.Equal(t, overlay.DefaultMTU, cfg.MTU)
+	assert.Equal(t, defaultExitProxyMaxFlows, cfg.MaxFlows)
+	assert.Equal(t, defaultExitProxyTCPTimeout, cfg.TCPTimeout)
+	assert.Equal(t, defaultExitProxyUDPTimeout, cfg.UDPTimeout)
+
+	c.Settings["tun"] = m{"mtu": 1400}
+	c.Settings["exit_proxy"] = m{"routes": []any{"0.0.0.0/0"}, "max_flows": 10, "tcp_timeout": "1h", "udp_timeout": "30s"}
+	cfg, err = exitProxyConfigFromConfig(l, c, cs)
+	require.NoError(t, err)
+	assert.Equal(t, 1400, cfg.MTU)
+	assert.Equal(t, 10, cfg.MaxFlows)
+	assert.Equal(t, time.Hour, cfg.TCPTimeout)
+	assert.Equal(t, 30*time.Second, cfg.UDPTimeout)
+
+	tests := []struct {
+		proxy m
+		err   string
+	}{
+		{m{"routes": []any{"nope"}}, `entry 1 in exit_proxy.routes failed to parse: netip.ParsePrefix("nope"): no '/'`},
+		{m{"routes": []any{"0.0.0.0/0"}, "max_flows": 0}, "exit_proxy.max_flows must be at least 1: 0"},
+		{m{"routes": []any{"0.0.0.0/0"}, "tcp_timeout": "0s"}, "exit_proxy.tcp_timeout must be positive: 0s"},
+		{m{"routes": []any{"0.0.0.0/0"}, "udp_timeout": "-1s"}, "exit_proxy.udp_timeout must be positive: -1s"},
+	}
+	for _, tt := range tests {
+		c.Settings["exit_proxy"] = tt.proxy
+		_, err := exitProxyConfigFromConfig(l, c, cs)
+		assert.EqualError(t, err, tt.err)
+	}
+
+	interfaceAddrs = func() ([]net.Addr, error) { return nil, errors.New("no interfaces") }
+	c.Settings["exit_proxy"] = m{"routes": []any{"0.0.0.0/0"}}
+	_, err = exitProxyConfigFromConfig(l, c, cs)
+	assert.EqualError(t, err, "failed to list the interface addresses to exclude from exit_proxy: no interfaces")
+}
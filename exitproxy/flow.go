@@ -0,0 +1,108 @@
+package exitproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// flowKey identifies a flow by what the overlay host sent, src is the overlay host and dst is where it was going
+type flowKey struct {
+	proto tcpip.TransportProtocolNumber
+	src   netip.AddrPort
+	dst   netip.AddrPort
+}
+
+func newFlowKey(proto tcpip.TransportProtocolNumber, id stack.TransportEndpointID) flowKey {
+	src, _ := netip.AddrFromSlice(id.RemoteAddress.AsSlice())
+	dst, _ := netip.AddrFromSlice(id.LocalAddress.AsSlice())
+	return flowKey{
+		proto: proto,
+		src:   netip.AddrPortFrom(src, id.RemotePort),
+		dst:   netip.AddrPortFrom(dst, id.LocalPort),
+	}
+}
+
+func (k flowKey) String() string {
+	proto := "udp"
+	if k.proto == tcp.ProtocolNumber {
+		proto = "tcp"
+	}
+	return fmt.Sprintf("%s %s to %s", proto, k.src, k.dst)
+}
+
+// flow is a tracked connection, in is the end of it on the netstack and out is the socket on this host
+type flow struct {
+	key     flowKey
+	timeout time.Duration
+	in      net.Conn
+	out     net.Conn
+	// lastSeen is when data last went through the flow in either direction, in unix nanoseconds
+	lastSeen  atomic.Int64
+	closeOnce sync.Once
+}
+
+func (fl *flow) touch() {
+	fl.lastSeen.Store(time.Now().UnixNano())
+}
+
+func (fl *flow) idle(now time.Time) bool {
+	return now.Sub(time.Unix(0, fl.lastSeen.Load())) >= fl.timeout
+}
+
+func (fl *flow) close() {
+	fl.closeOnce.Do(func() {
+		_ = fl.in.Close()
+		_ = fl.out.Close()
+	})
+}
+
+// relay copies the flow both ways until both directions are done or the flow is closed
+func (fl *flow) relay() {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		fl.copy(fl.out, fl.in)
+	}()
+	go func() {
+		defer wg.Done()
+		fl.copy(fl.in, fl.out)
+	}()
+	wg.Wait()
+}
+
+func (fl *flow) copy(dst, src net.Conn) {
+	// Large enough for any udp datagram
+	buf := make([]byte, 65535)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			fl.touch()
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				fl.close()
+				return
+			}
+		}
+
+		if err != nil {
+			// A tcp flow that ends cleanly is half closed so the other direction can finish, anything else ends both
+			cw, ok := dst.(interface{ CloseWrite() error })
+			if ok && errors.Is(err, io.EOF) {
+				_ = cw.CloseWrite()
+			} else {
+				fl.close()
+			}
+			return
+		}
+	}
+}
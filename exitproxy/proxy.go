@@ -0,0 +1,366 @@
+// Package exitproxy is a per-flow userspace proxy for tcp and udp from the overlay that leaves through this host. Each
+// flow is ended on a userspace network stack and made again from a socket on this host, so it leaves with the address
+// of this host without kernel forwarding or firewall rules. It is not nat or masquerading, packets are not rewritten
+// since the kernel would reset the answers to ports it did not open without firewall rules to stop it. Anything other
+// than tcp and udp, icmp included, is dropped.
+package exitproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gaissmai/bart"
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const nicID = 1
+
+// dialTimeout is how long a tcp flow waits for its destination to answer before it is reset
+const dialTimeout = 10 * time.Second
+
+var ErrUnknownPacket = errors.New("packet is not ipv4 or ipv6")
+
+// defaultExclude are the destinations that are never proxied whatever the routes are. They are the addresses that are
+// never sent anywhere, like loopback and multicast, link local addresses that only mean something on the link of this
+// host, like cloud metadata services, and ipv4 mapped ipv6 addresses that would be dialed as ipv4.
+var defaultExclude = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("255.255.255.255/32"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("::ffff:0:0/96"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+type Config struct {
+	// Routes are the destinations that are proxied
+	Routes []netip.Prefix
+	// Exclude are destinations inside Routes that are never proxied, like the vpn networks and addresses of this host
+	Exclude []netip.Prefix
+	MTU     int
+	// MaxFlows is how many flows can be tracked at once, new flows beyond it are refused
+	MaxFlows int
+	// TCPTimeout and UDPTimeout are how long a flow is kept without a packet in either direction
+	TCPTimeout time.Duration
+	UDPTimeout time.Duration
+}
+
+// Engine proxies the flows of the packets written to it and returns the packets that answer them from Read
+type Engine struct {
+	l      *logrus.Logger
+	cfg    Config
+	routes *bart.Lite
+	// exclude also holds defaultExclude
+	exclude *bart.Lite
+
+	ipstack *stack.Stack
+	linkEP  *channel.Endpoint
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	closed  sync.Once
+
+	mu    sync.Mutex
+	flows map[flowKey]*flow
+
+	metricFlows   metrics.Gauge
+	metricRefused metrics.Counter
+	metricDropped metrics.Counter
+}
+
+func New(l *logrus.Logger, cfg Config) (*Engine, error) {
+	e := &Engine{
+		l:             l,
+		cfg:           cfg,
+		routes:        new(bart.Lite),
+		exclude:       new(bart.Lite),
+		flows:         map[flowKey]*flow{},
+		metricFlows:   metrics.GetOrRegisterGauge("exit_proxy.flows", nil),
+		metricRefused: metrics.GetOrRegisterCounter("exit_proxy.refused.max_flows", nil),
+		metricDropped: metrics.GetOrRegisterCounter("exit_proxy.dropped.protocol", nil),
+	}
+	for _, r := range cfg.Routes {
+		e.routes.Insert(r)
+	}
+	for _, r := range cfg.Exclude {
+		e.exclude.Insert(r)
+	}
+	for _, r := range defaultExclude {
+		e.exclude.Insert(r)
+	}
+
+	e.ipstack = stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	sackEnabledOpt := tcpip.TCPSACKEnabled(true) // TCP SACK is disabled by default
+	if tcpipErr := e.ipstack.SetTransportProtocolOption(tcp.ProtocolNumber, &sackEnabledOpt); tcpipErr != nil {
+		return nil, fmt.Errorf("could not enable TCP SACK: %v", tcpipErr)
+	}
+	e.linkEP = channel.New( /*size*/ 512, uint32(cfg.MTU), "")
+	if tcpipProblem := e.ipstack.CreateNIC(nicID, e.linkEP); tcpipProblem != nil {
+		return nil, fmt.Errorf("could not create netstack NIC: %v", tcpipProblem)
+	}
+
+	// The stack answers for every address it is sent and from every address it answers with
+	if tcpipErr := e.ipstack.SetPromiscuousMode(nicID, true); tcpipErr != nil {
+		return nil, fmt.Errorf("could not enable netstack promiscuous mode: %v", tcpipErr)
+	}
+	if tcpipErr := e.ipstack.SetSpoofing(nicID, true); tcpipErr != nil {
+		return nil, fmt.Errorf("could not enable netstack spoofing: %v", tcpipErr)
+	}
+	ipv4Subnet, _ := tcpip.NewSubnet(tcpip.AddrFrom4([4]byte{}), tcpip.MaskFrom(strings.Repeat("\x00", 4)))
+	ipv6Subnet, _ := tcpip.NewSubnet(tcpip.AddrFrom16([16]byte{}), tcpip.MaskFrom(strings.Repeat("\x00", 16)))
+	e.ipstack.SetRouteTable([]tcpip.Route{
+		{Destination: ipv4Subnet, NIC: nicID},
+		{Destination: ipv6Subnet, NIC: nicID},
+	})
+
+	const tcpReceiveBufferSize = 0
+	const maxInFlightConnectionAttempts = 1024
+	tcpFwd := tcp.NewForwarder(e.ipstack, tcpReceiveBufferSize, maxInFlightConnectionAttempts, e.handleTCP)
+	e.ipstack.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpFwd.HandlePacket)
+	udpFwd := udp.NewForwarder(e.ipstack, e.handleUDP)
+	e.ipstack.SetTransportProtocolHandler(udp.ProtocolNumber, udpFwd.HandlePacket)
+
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+	e.wg.Add(1)
+	go e.expire()
+
+	return e, nil
+}
+
+// Handles reports whether packets to addr are proxied. An ipv4 mapped address is held to the excludes of the ipv4
+// address it stands for as well.
+func (e *Engine) Handles(addr netip.Addr) bool {
+	return e.routes.Contains(addr) && !e.exclude.Contains(addr) && !e.exclude.Contains(addr.Unmap())
+}
+
+// Write takes a packet from the overlay whose destination the engine Handles. Only tcp and udp are proxied, every
+// other packet is dropped.
+func (e *Engine) Write(packet []byte) (int, error) {
+	var proto tcpip.NetworkProtocolNumber
+	var transport tcpip.TransportProtocolNumber
+	switch {
+	case len(packet) >= header.IPv4MinimumSize && header.IPVersion(packet) == header.IPv4Version:
+		proto = header.IPv4ProtocolNumber
+		transport = header.IPv4(packet).TransportProtocol()
+	case len(packet) >= header.IPv6MinimumSize && header.IPVersion(packet) == header.IPv6Version:
+		proto = header.IPv6ProtocolNumber
+		transport = header.IPv6(packet).TransportProtocol()
+	default:
+		return 0, ErrUnknownPacket
+	}
+
+	// The stack would answer anything else itself, pings included, for hosts that may not exist
+	if transport != tcp.ProtocolNumber && transport != udp.ProtocolNumber {
+		e.metricDropped.Inc(1)
+		return len(packet), nil
+	}
+
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(bytes.Clone(packet)),
+	})
+	e.linkEP.InjectInbound(proto, pkt)
+	pkt.DecRef()
+	return len(packet), nil
+}
+
+// Read blocks until there is a packet to send back to the overlay, it returns os.ErrClosed once the engine is closed
+func (e *Engine) Read(b []byte) (int, error) {
+	for {
+		if e.ctx.Err() != nil {
+			return 0, os.ErrClosed
+		}
+		pkt := e.linkEP.ReadContext(e.ctx)
+		if pkt == nil {
+			continue
+		}
+
+		view := pkt.ToView()
+		n := copy(b, view.AsSlice())
+		view.Release()
+		pkt.DecRef()
+		return n, nil
+	}
+}
+
+// Close ends every flow and stops the engine
+func (e *Engine) Close() error {
+	e.closed.Do(func() {
+		e.cancel()
+
+		e.mu.Lock()
+		flows := e.flows
+		e.flows = map[flowKey]*flow{}
+		e.metricFlows.Update(0)
+		e.mu.Unlock()
+		for _, fl := range flows {
+			fl.close()
+		}
+
+		e.wg.Wait()
+		// This closes linkEP as well
+		e.ipstack.Close()
+	})
+	return nil
+}
+
+func (e *Engine) handleTCP(r *tcp.ForwarderRequest) {
+	key := newFlowKey(tcp.ProtocolNumber, r.ID())
+	if !e.admit(key) {
+		r.Complete(true)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(e.ctx, dialTimeout)
+	var d net.Dialer
+	out, err := d.DialContext(ctx, "tcp", key.dst.String())
+	cancel()
+	if err != nil {
+		e.l.WithError(err).WithField("flow", key).Debug("Failed to dial proxied flow destination")
+		r.Complete(true)
+		return
+	}
+
+	var wq waiter.Queue
+	ep, tcpipErr := r.CreateEndpoint(&wq)
+	if tcpipErr != nil {
+		e.l.WithField("flow", key).WithField("error", tcpipErr).Debug("Failed to accept proxied flow")
+		_ = out.Close()
+		r.Complete(true)
+		return
+	}
+	r.Complete(false)
+
+	e.add(&flow{key: key, timeout: e.cfg.TCPTimeout, in: gonet.NewTCPConn(&wq, ep), out: out})
+}
+
+// handleUDP is called for the first packet of a flow while the stack is processing it, so it must not block
+func (e *Engine) handleUDP(r *udp.ForwarderRequest) {
+	key := newFlowKey(udp.ProtocolNumber, r.ID())
+	if !e.admit(key) {
+		return
+	}
+
+	out, err := net.Dial("udp", key.dst.String())
+	if err != nil {
+		e.l.WithError(err).WithField("flow", key).Debug("Failed to dial proxied flow destination")
+		return
+	}
+
+	var wq waiter.Queue
+	ep, tcpipErr := r.CreateEndpoint(&wq)
+	if tcpipErr != nil {
+		e.l.WithField("flow", key).WithField("error", tcpipErr).Debug("Failed to accept proxied flow")
+		_ = out.Close()
+		return
+	}
+
+	e.add(&flow{key: key, timeout: e.cfg.UDPTimeout, in: gonet.NewUDPConn(&wq, ep), out: out})
+}
+
+// admit reports whether there is room for a new flow. Flows being dialed are not counted, so the table can briefly
+// hold a few more than MaxFlows.
+func (e *Engine) admit(key flowKey) bool {
+	e.mu.Lock()
+	n := len(e.flows)
+	e.mu.Unlock()
+
+	if e.ctx.Err() != nil {
+		return false
+	}
+	if n >= e.cfg.MaxFlows {
+		e.metricRefused.Inc(1)
+		e.l.WithField("flow", key).WithField("maxFlows", e.cfg.MaxFlows).Debug("Refused proxied flow, the flow table is full")
+		return false
+	}
+	return true
+}
+
+// add tracks fl and starts relaying it, a flow it replaces is closed
+func (e *Engine) add(fl *flow) {
+	fl.touch()
+
+	e.mu.Lock()
+	if e.ctx.Err() != nil {
+		e.mu.Unlock()
+		fl.close()
+		return
+	}
+	old := e.flows[fl.key]
+	e.flows[fl.key] = fl
+	e.metricFlows.Update(int64(len(e.flows)))
+	e.mu.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+
+	go func() {
+		fl.relay()
+		e.remove(fl)
+	}()
+}
+
+func (e *Engine) remove(fl *flow) {
+	e.mu.Lock()
+	if e.flows[fl.key] == fl {
+		delete(e.flows, fl.key)
+		e.metricFlows.Update(int64(len(e.flows)))
+	}
+	e.mu.Unlock()
+	fl.close()
+}
+
+// expire closes flows that have been idle for longer than their timeout until the engine is closed
+func (e *Engine) expire() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case now := <-ticker.C:
+			var idle []*flow
+			e.mu.Lock()
+			for _, fl := range e.flows {
+				if fl.idle(now) {
+					idle = append(idle, fl)
+				}
+			}
+			e.mu.Unlock()
+
+			for _, fl := range idle {
+				e.l.WithField("flow", fl.key).Debug("Proxied flow timed out")
+				e.remove(fl)
+			}
+		}
+	}
+}
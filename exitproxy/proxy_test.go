@@ -0,0 +1,246 @@
+package exitproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+// testConfig proxies everything
+func testConfig() Config {
+	return Config{
+		Routes:     []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")},
+		Exclude:    []netip.Prefix{netip.MustParsePrefix("10.128.0.0/16")},
+		MTU:        1300,
+		MaxFlows:   10,
+		TCPTimeout: time.Minute,
+		UDPTimeout: time.Minute,
+	}
+}
+
+func TestEngine_Handles(t *testing.T) {
+	e, err := New(test.NewLogger(), testConfig())
+	require.NoError(t, err)
+	defer e.Close()
+
+	assert.True(t, e.Handles(netip.MustParseAddr("1.1.1.1")))
+	assert.True(t, e.Handles(netip.MustParseAddr("2001:db8::1")))
+	assert.False(t, e.Handles(netip.MustParseAddr("10.128.0.1")), "excluded")
+	assert.False(t, e.Handles(netip.MustParseAddr("127.0.0.1")), "loopback")
+	assert.False(t, e.Handles(netip.MustParseAddr("::1")), "loopback")
+	assert.False(t, e.Handles(netip.MustParseAddr("224.0.0.1")), "multicast")
+	assert.False(t, e.Handles(netip.MustParseAddr("255.255.255.255")), "broadcast")
+	assert.False(t, e.Handles(netip.MustParseAddr("169.254.169.254")), "link local")
+	assert.False(t, e.Handles(netip.MustParseAddr("fe80::1")), "link local")
+	assert.False(t, e.Handles(netip.MustParseAddr("::ffff:1.1.1.1")), "ipv4 mapped")
+	assert.False(t, e.Handles(netip.MustParseAddr("::ffff:127.0.0.1")), "ipv4 mapped loopback")
+	assert.False(t, e.Handles(netip.MustParseAddr("::ffff:10.128.0.1")), "ipv4 mapped excluded")
+
+	cfg := testConfig()
+	cfg.Routes = []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")}
+	e2, err := New(test.NewLogger(), cfg)
+	require.NoError(t, err)
+	defer e2.Close()
+	assert.True(t, e2.Handles(netip.MustParseAddr("192.168.1.1")))
+	assert.False(t, e2.Handles(netip.MustParseAddr("1.1.1.1")))
+}
+
+func TestEngine_Write(t *testing.T) {
+	e, err := New(test.NewLogger(), testConfig())
+	require.NoError(t, err)
+	defer e.Close()
+
+	_, err = e.Write([]byte{0x10, 0, 0})
+	assert.ErrorIs(t, err, ErrUnknownPacket)
+
+	// Pings are dropped rather than answered by the engine
+	ping := make([]byte, header.IPv4MinimumSize+header.ICMPv4MinimumSize)
+	header.IPv4(ping).Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(ping)),
+		TTL:         64,
+		Protocol:    uint8(header.ICMPv4ProtocolNumber),
+		SrcAddr:     tcpip.AddrFrom4([4]byte{10, 128, 0, 2}),
+		DstAddr:     tcpip.AddrFrom4([4]byte{1, 1, 1, 1}),
+	})
+	dropped := e.metricDropped.Count()
+	n, err := e.Write(ping)
+	require.NoError(t, err)
+	assert.Equal(t, len(ping), n)
+	assert.Equal(t, dropped+1, e.metricDropped.Count())
+}
+
+func TestEngine(t *testing.T) {
+	host := hostAddr(t)
+
+	cfg := testConfig()
+	cfg.MaxFlows = 2
+	cfg.UDPTimeout = time.Second
+	e, err := New(test.NewLogger(), cfg)
+	require.NoError(t, err)
+	defer e.Close()
+	peer := newPeer(t, e)
+
+	tcpLn, err := net.Listen("tcp", netip.AddrPortFrom(host, 0).String())
+	require.NoError(t, err)
+	defer tcpLn.Close()
+	go func() {
+		for {
+			c, err := tcpLn.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+
+	udpConn, err := net.ListenPacket("udp", netip.AddrPortFrom(host, 0).String())
+	require.NoError(t, err)
+	defer udpConn.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := udpConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = udpConn.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tcpAddr := tcpLn.Addr().(*net.TCPAddr).AddrPort()
+	udpAddr := udpConn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	// A flow the size of many packets makes it through and back
+	tc, err := gonet.DialContextTCP(ctx, peer, fullAddr(tcpAddr), ipv4.ProtocolNumber)
+	require.NoError(t, err)
+	defer tc.Close()
+	msg := bytes.Repeat([]byte("nebula"), 10000)
+	go func() { _, _ = tc.Write(msg) }()
+	got := make([]byte, len(msg))
+	require.NoError(t, tc.SetReadDeadline(time.Now().Add(10*time.Second)))
+	_, err = io.ReadFull(tc, got)
+	require.NoError(t, err)
+	assert.Equal(t, msg, got)
+
+	// The echo server sees the flow from this host
+	uc, err := gonet.DialUDP(peer, nil, &tcpip.FullAddress{NIC: nicID, Addr: fullAddr(udpAddr).Addr, Port: udpAddr.Port()}, ipv4.ProtocolNumber)
+	require.NoError(t, err)
+	_, err = uc.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 1500)
+	require.NoError(t, uc.SetReadDeadline(time.Now().Add(10*time.Second)))
+	n, err := uc.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+	assert.Equal(t, int64(2), e.metricFlows.Value())
+
+	// The table is full so a new flow is reset
+	refused := e.metricRefused.Count()
+	_, err = gonet.DialContextTCP(ctx, peer, fullAddr(tcpAddr), ipv4.ProtocolNumber)
+	assert.Error(t, err)
+	assert.Equal(t, refused+1, e.metricRefused.Count())
+
+	// The idle udp flow is expired, which makes room again
+	assert.Eventually(t, func() bool { return e.metricFlows.Value() == 1 }, 5*time.Second, 100*time.Millisecond)
+	tc2, err := gonet.DialContextTCP(ctx, peer, fullAddr(tcpAddr), ipv4.ProtocolNumber)
+	require.NoError(t, err)
+	_ = tc2.Close()
+
+	// Closing the engine ends the flows left and wakes a reader
+	require.NoError(t, e.Close())
+	assert.Empty(t, e.flows)
+	_, err = e.Read(buf)
+	assert.ErrorIs(t, err, os.ErrClosed)
+}
+
+// hostAddr returns an ipv4 address of this host that is not loopback, which the engine will proxy to
+func hostAddr(t *testing.T) netip.Addr {
+	addrs, err := net.InterfaceAddrs()
+	require.NoError(t, err)
+	for _, a := range addrs {
+		if p, err := netip.ParsePrefix(a.String()); err == nil && p.Addr().Is4() && !p.Addr().IsLoopback() {
+			return p.Addr()
+		}
+	}
+	t.Skip("no ipv4 address outside of loopback")
+	return netip.Addr{}
+}
+
+// newPeer makes a netstack for 10.128.0.2 that plays the overlay host sending through the engine
+func newPeer(t *testing.T, e *Engine) *stack.Stack {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	linkEP := channel.New(512, 1300, "")
+	require.Nil(t, s.CreateNIC(nicID, linkEP))
+	require.Nil(t, s.AddProtocolAddress(nicID, tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddrFrom4([4]byte{10, 128, 0, 2}).WithPrefix(),
+	}, stack.AddressProperties{}))
+	subnet, _ := tcpip.NewSubnet(tcpip.AddrFrom4([4]byte{}), tcpip.MaskFrom("\x00\x00\x00\x00"))
+	s.SetRouteTable([]tcpip.Route{{Destination: subnet, NIC: nicID}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		s.Close()
+	})
+
+	go func() {
+		for {
+			pkt := linkEP.ReadContext(ctx)
+			if pkt == nil {
+				if ctx.Err() != nil {
+					return
+				}
+				continue
+			}
+			view := pkt.ToView()
+			_, _ = e.Write(view.AsSlice())
+			view.Release()
+			pkt.DecRef()
+		}
+	}()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, err := e.Read(buf)
+			if err != nil {
+				return
+			}
+			pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(bytes.Clone(buf[:n]))})
+			linkEP.InjectInbound(ipv4.ProtocolNumber, pkt)
+			pkt.DecRef()
+		}
+	}()
+
+	return s
+}
+
+func fullAddr(ap netip.AddrPort) tcpip.FullAddress {
+	return tcpip.FullAddress{NIC: nicID, Addr: tcpip.AddrFromSlice(ap.Addr().AsSlice()), Port: ap.Port()}
+}
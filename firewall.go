@@ -8,6 +8,7 @@ import (
 	"hash/fnv"
 	"net/netip"
 	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -23,6 +24,8 @@ import (
 
 type FirewallInterface interface {
 	AddRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, addr, localAddr netip.Prefix, caName string, caSha string) error
+	AddDenyRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, addr, localAddr netip.Prefix, caName string, caSha string) error
+	AddScheduledRule(schedule *firewallSchedule, deny bool, incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, addr, localAddr netip.Prefix, caName string, caSha string) error
 }
 
 type conn struct {
@@ -33,6 +36,13 @@ type conn struct {
 	// fields pack for free after the uint32 above
 	incoming     bool
 	rulesVersion uint16
+
+	// rule is the rule that allowed this connection
+	rule *firewallRuleStats
+
+	// windowEnd is when the schedule of the rule that allowed this connection closes or a scheduled deny rule opens,
+	// in unix nanoseconds. The connection is validated against the rules again after it. Zero if neither will happen.
+	windowEnd int64
 }
 
 // TODO: need conntrack max tracked connections handling
@@ -42,6 +52,10 @@ type Firewall struct {
 	InRules  *FirewallTable
 	OutRules *FirewallTable
 
+	// Deny rules are checked before the allow rules above, a packet matching a deny rule is always dropped
+	InDenyRules  *FirewallTable
+	OutDenyRules *FirewallTable
+
 	InSendReject  bool
 	OutSendReject bool
 
@@ -62,9 +76,21 @@ type Firewall struct {
 	rules        string
 	rulesVersion uint16
 
+	// ruleStats holds the identity and hit counters of every rule, in the order they were added.
+	// ruleStatsByID indexes the same entries by id, identical rules share an entry.
+	ruleStats     []*firewallRuleStats
+	ruleStatsByID map[string]*firewallRuleStats
+	// denySchedules are the schedules of every scheduled deny rule, tracked connections are checked again when one opens
+	denySchedules []*firewallSchedule
+
+	// countRules is set by firewall.rule_stats, rules are always listed but their traffic is only counted when set
+	countRules bool
+
 	defaultLocalCIDRAny bool
-	incomingMetrics     firewallMetrics
-	outgoingMetrics     firewallMetrics
+	// flowLog is shared by every firewall built on reload, see flowLogger
+	flowLog         *flowLogger
+	incomingMetrics firewallMetrics
+	outgoingMetrics firewallMetrics
 
 	l *logrus.Logger
 }
@@ -73,6 +99,7 @@ type firewallMetrics struct {
 	droppedLocalAddr  metrics.Counter
 	droppedRemoteAddr metrics.Counter
 	droppedNoRule     metrics.Counter
+	droppedDenyRule   metrics.Counter
 }
 
 type FirewallConntrack struct {
@@ -88,6 +115,7 @@ type FirewallTable struct {
 	TCP      firewallPort
 	UDP      firewallPort
 	ICMP     firewallPort
+	ICMPv6   firewallPort
 	AnyProto firewallPort
 }
 
@@ -96,6 +124,7 @@ func newFirewallTable() *FirewallTable {
 		TCP:      firewallPort{},
 		UDP:      firewallPort{},
 		ICMP:     firewallPort{},
+		ICMPv6:   firewallPort{},
 		AnyProto: firewallPort{},
 	}
 }
@@ -112,6 +141,10 @@ type FirewallRule struct {
 	Hosts  map[string]*firewallLocalCIDR
 	Groups []*firewallGroups
 	CIDR   *bart.Table[*firewallLocalCIDR]
+
+	// Scheduled holds a rule tree for each schedule, they are only checked while their schedule is active
+	Scheduled []*FirewallRule
+	schedule  *firewallSchedule
 }
 
 type firewallGroups struct {
@@ -125,7 +158,90 @@ type firewallPort map[int32]*FirewallCA
 
 type firewallLocalCIDR struct {
 	Any       bool
-	LocalCIDR *bart.Lite
+	LocalCIDR *bart.Table[*firewallRuleStats]
+
+	// anyRule is the first rule that set Any
+	anyRule *firewallRuleStats
+}
+
+// firewallRuleStats identifies a rule added to the firewall and counts the traffic it has admitted.
+// The id is derived from the rule contents so it is stable across reloads and restarts.
+type firewallRuleStats struct {
+	id       string
+	incoming bool
+	deny     bool
+	schedule *firewallSchedule
+	rule     string
+	stats    firewall.RuleStats
+	// credits are the stats of every rule that ends at the same place in the rule tree as this one, they are all
+	// credited when it matches
+	credits firewall.RuleCounters
+}
+
+// windowEnd returns when the rule stops matching packets it matched at t in unix nanoseconds, zero if it has no schedule
+func (rs *firewallRuleStats) windowEnd(t time.Time) int64 {
+	if rs == nil || rs.schedule == nil {
+		return 0
+	}
+
+	end := rs.schedule.closes(t)
+	if end.IsZero() {
+		return 0
+	}
+
+	return end.UnixNano()
+}
+
+// connWindowEnd returns when a connection allowed by rs at now has to be checked against the rules again, see
+// conn.windowEnd
+func (f *Firewall) connWindowEnd(rs *firewallRuleStats, now time.Time) int64 {
+	end := rs.windowEnd(now)
+	for _, s := range f.denySchedules {
+		if o := s.opens(now); !o.IsZero() && (end == 0 || o.UnixNano() < end) {
+			end = o.UnixNano()
+		}
+	}
+
+	return end
+}
+
+// sharedWith returns a stand in for rs that also credits o, for a place in the rule tree that both rules end at. The
+// stand in keeps the identity of rs.
+func (rs *firewallRuleStats) sharedWith(o *firewallRuleStats) *firewallRuleStats {
+	for _, c := range rs.credits {
+		if c == &o.stats {
+			return rs
+		}
+	}
+
+	shared := &firewallRuleStats{
+		id:       rs.id,
+		incoming: rs.incoming,
+		deny:     rs.deny,
+		schedule: rs.schedule,
+		rule:     rs.rule,
+		credits:  append(slices.Clip(rs.credits), &o.stats),
+	}
+	return shared
+}
+
+// counters returns the hit counters to credit for a match of rs, nil if there is no rule or rules are not counted
+func (f *Firewall) counters(rs *firewallRuleStats) firewall.RuleCounters {
+	if rs == nil || !f.countRules {
+		return nil
+	}
+	return rs.credits
+}
+
+// FirewallRuleInfo describes a firewall rule and the traffic it has admitted
+type FirewallRuleInfo struct {
+	ID        string     `json:"id"`
+	Action    string     `json:"action"`
+	Direction string     `json:"direction"`
+	Rule      string     `json:"rule"`
+	Packets   uint64     `json:"packets"`
+	Bytes     uint64     `json:"bytes"`
+	LastMatch *time.Time `json:"lastMatch"`
 }
 
 // NewFirewall creates a new Firewall object. A TimerWheel is created for you from the provided timeouts.
@@ -169,23 +285,28 @@ func NewFirewall(l *logrus.Logger, tcpTimeout, UDPTimeout, defaultTimeout time.D
 		},
 		InRules:           newFirewallTable(),
 		OutRules:          newFirewallTable(),
+		InDenyRules:       newFirewallTable(),
+		OutDenyRules:      newFirewallTable(),
 		TCPTimeout:        tcpTimeout,
 		UDPTimeout:        UDPTimeout,
 		DefaultTimeout:    defaultTimeout,
 		routableNetworks:  routableNetworks,
 		assignedNetworks:  assignedNetworks,
 		hasUnsafeNetworks: hasUnsafeNetworks,
+		ruleStatsByID:     map[string]*firewallRuleStats{},
 		l:                 l,
 
 		incomingMetrics: firewallMetrics{
 			droppedLocalAddr:  metrics.GetOrRegisterCounter("firewall.incoming.dropped.local_addr", nil),
 			droppedRemoteAddr: metrics.GetOrRegisterCounter("firewall.incoming.dropped.remote_addr", nil),
 			droppedNoRule:     metrics.GetOrRegisterCounter("firewall.incoming.dropped.no_rule", nil),
+			droppedDenyRule:   metrics.GetOrRegisterCounter("firewall.incoming.dropped.deny_rule", nil),
 		},
 		outgoingMetrics: firewallMetrics{
 			droppedLocalAddr:  metrics.GetOrRegisterCounter("firewall.outgoing.dropped.local_addr", nil),
 			droppedRemoteAddr: metrics.GetOrRegisterCounter("firewall.outgoing.dropped.remote_addr", nil),
 			droppedNoRule:     metrics.GetOrRegisterCounter("firewall.outgoing.dropped.no_rule", nil),
+			droppedDenyRule:   metrics.GetOrRegisterCounter("firewall.outgoing.dropped.deny_rule", nil),
 		},
 	}
 }
@@ -210,6 +331,7 @@ func NewFirewallFromConfig(l *logrus.Logger, cs *CertState, c *config.C) (*Firew
 	)
 
 	fw.defaultLocalCIDRAny = c.GetBool("firewall.default_local_cidr_any", false)
+	fw.countRules = c.GetBool("firewall.rule_stats", false)
 
 	inboundAction := c.GetString("firewall.inbound_action", "drop")
 	switch inboundAction {
@@ -248,6 +370,20 @@ func NewFirewallFromConfig(l *logrus.Logger, cs *CertState, c *config.C) (*Firew
 
 // AddRule properly creates the in memory rule structure for a firewall table.
 func (f *Firewall) AddRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip, localIp netip.Prefix, caName string, caSha string) error {
+	return f.addRule(false, nil, incoming, proto, startPort, endPort, groups, host, ip, localIp, caName, caSha)
+}
+
+// AddDenyRule is AddRule for the deny tables. Packets that match a deny rule are dropped even when an allow rule matches.
+func (f *Firewall) AddDenyRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip, localIp netip.Prefix, caName string, caSha string) error {
+	return f.addRule(true, nil, incoming, proto, startPort, endPort, groups, host, ip, localIp, caName, caSha)
+}
+
+// AddScheduledRule adds an allow or deny rule that only matches while the schedule is active.
+func (f *Firewall) AddScheduledRule(schedule *firewallSchedule, deny bool, incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip, localIp netip.Prefix, caName string, caSha string) error {
+	return f.addRule(deny, schedule, incoming, proto, startPort, endPort, groups, host, ip, localIp, caName, caSha)
+}
+
+func (f *Firewall) addRule(deny bool, schedule *firewallSchedule, incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip, localIp netip.Prefix, caName string, caSha string) error {
 	// Under gomobile, stringing a nil pointer with fmt causes an abort in debug mode for iOS
 	// https://github.com/golang/go/issues/14131
 	sIp := ""
@@ -264,13 +400,33 @@ func (f *Firewall) AddRule(incoming bool, proto uint8, startPort int32, endPort
 		"incoming: %v, proto: %v, startPort: %v, endPort: %v, groups: %v, host: %v, ip: %v, localIp: %v, caName: %v, caSha: %s",
 		incoming, proto, startPort, endPort, groups, host, sIp, lIp, caName, caSha,
 	)
+
+	action := "allow"
+	if deny {
+		// Allow rules keep the original format so their hash is unchanged
+		action = "deny"
+		ruleString = "deny, " + ruleString
+	}
+
+	desc := describeRule(proto, startPort, endPort, groups, host, sIp, lIp, caName, caSha)
+	sSchedule := ""
+	if schedule != nil {
+		sSchedule = schedule.String()
+		ruleString += ", schedule: " + sSchedule
+		desc += ", schedule: " + sSchedule
+	}
 	f.rules += ruleString + "\n"
 
 	direction := "incoming"
 	if !incoming {
 		direction = "outgoing"
 	}
-	f.l.WithField("firewallRule", m{"direction": direction, "proto": proto, "startPort": startPort, "endPort": endPort, "groups": groups, "host": host, "ip": sIp, "localIp": lIp, "caName": caName, "caSha": caSha}).
+
+	rs := f.addRuleStats(ruleString, incoming, deny, schedule, desc)
+	if deny && schedule != nil {
+		f.denySchedules = append(f.denySchedules, schedule)
+	}
+	f.l.WithField("firewallRule", m{"id": rs.id, "action": action, "direction": direction, "proto": proto, "startPort": startPort, "endPort": endPort, "groups": groups, "host": host, "ip": sIp, "localIp": lIp, "caName": caName, "caSha": caSha, "schedule": sSchedule}).
 		Info("Firewall rule added")
 
 	var (
@@ -278,9 +434,14 @@ func (f *Firewall) AddRule(incoming bool, proto uint8, startPort int32, endPort
 		fp firewallPort
 	)
 
-	if incoming {
+	switch {
+	case deny && incoming:
+		ft = f.InDenyRules
+	case deny:
+		ft = f.OutDenyRules
+	case incoming:
 		ft = f.InRules
-	} else {
+	default:
 		ft = f.OutRules
 	}
 
@@ -289,15 +450,159 @@ func (f *Firewall) AddRule(incoming bool, proto uint8, startPort int32, endPort
 		fp = ft.TCP
 	case firewall.ProtoUDP:
 		fp = ft.UDP
-	case firewall.ProtoICMP, firewall.ProtoICMPv6:
+	case firewall.ProtoICMP:
+		if startPort == endPort && (startPort == firewall.PortAny || startPort == firewall.PortFragment) {
+			// Rules that do not pick an icmp type apply to both icmp and icmpv6
+			if err := ft.ICMPv6.addRule(f, startPort, endPort, groups, host, ip, localIp, caName, caSha, rs); err != nil {
+				return err
+			}
+		}
 		fp = ft.ICMP
+	case firewall.ProtoICMPv6:
+		fp = ft.ICMPv6
 	case firewall.ProtoAny:
 		fp = ft.AnyProto
 	default:
 		return fmt.Errorf("unknown protocol %v", proto)
 	}
 
-	return fp.addRule(f, startPort, endPort, groups, host, ip, localIp, caName, caSha)
+	return fp.addRule(f, startPort, endPort, groups, host, ip, localIp, caName, caSha, rs)
+}
+
+// addRuleStats returns the stats entry for the rule described by ruleString, creating it if this is a new rule
+func (f *Firewall) addRuleStats(ruleString string, incoming bool, deny bool, schedule *firewallSchedule, desc string) *firewallRuleStats {
+	sum := sha256.Sum256([]byte(ruleString))
+	id := hex.EncodeToString(sum[:6])
+
+	if rs, ok := f.ruleStatsByID[id]; ok {
+		return rs
+	}
+
+	rs := &firewallRuleStats{
+		id:       id,
+		incoming: incoming,
+		deny:     deny,
+		schedule: schedule,
+		rule:     desc,
+	}
+	rs.credits = firewall.RuleCounters{&rs.stats}
+	f.ruleStats = append(f.ruleStats, rs)
+	f.ruleStatsByID[id] = rs
+	return rs
+}
+
+// describeRule formats a rule in a human friendly way, using the config file names
+func describeRule(proto uint8, startPort, endPort int32, groups []string, host, ip, localIp, caName, caSha string) string {
+	var sb strings.Builder
+
+	switch proto {
+	case firewall.ProtoAny:
+		sb.WriteString("proto: any")
+	case firewall.ProtoTCP:
+		sb.WriteString("proto: tcp")
+	case firewall.ProtoUDP:
+		sb.WriteString("proto: udp")
+	case firewall.ProtoICMP:
+		sb.WriteString("proto: icmp")
+	case firewall.ProtoICMPv6:
+		sb.WriteString("proto: icmpv6")
+	default:
+		fmt.Fprintf(&sb, "proto: %v", proto)
+	}
+
+	switch {
+	case startPort == firewall.PortAny:
+		sb.WriteString(", port: any")
+	case startPort == firewall.PortFragment:
+		sb.WriteString(", port: fragment")
+	case startPort >= firewall.PortICMP:
+		fmt.Fprintf(&sb, ", type: %v", uint8((startPort-firewall.PortICMP)>>8))
+		if startPort == endPort {
+			fmt.Fprintf(&sb, ", code: %v", uint8(startPort))
+		} else {
+			sb.WriteString(", code: any")
+		}
+	case startPort == endPort:
+		fmt.Fprintf(&sb, ", port: %v", startPort)
+	default:
+		fmt.Fprintf(&sb, ", port: %v-%v", startPort, endPort)
+	}
+
+	if len(groups) > 0 {
+		fmt.Fprintf(&sb, ", groups: %v", groups)
+	}
+	if host != "" {
+		sb.WriteString(", host: " + host)
+	}
+	if ip != "" {
+		sb.WriteString(", cidr: " + ip)
+	}
+	if localIp != "" {
+		sb.WriteString(", local_cidr: " + localIp)
+	}
+	if caName != "" {
+		sb.WriteString(", ca_name: " + caName)
+	}
+	if caSha != "" {
+		sb.WriteString(", ca_sha: " + caSha)
+	}
+
+	return sb.String()
+}
+
+// ListRules returns every rule in the firewall along with the traffic it has admitted
+func (f *Firewall) ListRules() []FirewallRuleInfo {
+	rules := make([]FirewallRuleInfo, len(f.ruleStats))
+	for i, rs := range f.ruleStats {
+		rules[i] = rs.info()
+	}
+
+	return rules
+}
+
+func (rs *firewallRuleStats) info() FirewallRuleInfo {
+	ri := FirewallRuleInfo{
+		ID:        rs.id,
+		Action:    "allow",
+		Direction: "outgoing",
+		Rule:      rs.rule,
+		Packets:   rs.stats.Packets(),
+		Bytes:     rs.stats.Bytes(),
+	}
+
+	if rs.incoming {
+		ri.Direction = "incoming"
+	}
+
+	if rs.deny {
+		ri.Action = "deny"
+	}
+
+	if t := rs.stats.LastMatch(); !t.IsZero() {
+		ri.LastMatch = &t
+	}
+
+	return ri
+}
+
+// inheritRuleStats carries the counters of rules that are unchanged over from the firewall being replaced and
+// stops reporting metrics for rules that are gone
+func (f *Firewall) inheritRuleStats(old *Firewall) {
+	for _, ors := range old.ruleStats {
+		if rs, ok := f.ruleStatsByID[ors.id]; ok {
+			rs.stats.Add(&ors.stats)
+			continue
+		}
+
+		for _, n := range ruleMetricNames(ors.id) {
+			metrics.Unregister(n)
+		}
+	}
+}
+
+func ruleMetricNames(id string) [3]string {
+	p := "firewall.rules." + id
+	return [3]string{p + ".packets", p + ".bytes", p + ".last_match"}
 }
 
 // GetRuleHash returns a hash representation of all inbound and outbound rules
@@ -336,32 +641,81 @@ func AddFirewallRulesFromConfig(l *logrus.Logger, inbound bool, c *config.C, fw
 		return fmt.Errorf("%s failed to parse, should be an array of rules", table)
 	}
 
+	defs, err := newFirewallDefinitionsFromConfig(c)
+	if err != nil {
+		return err
+	}
+
 	for i, t := range rs {
-		var groups []string
-		r, err := convertRule(l, t, table, i)
+		cr, err := convertRule(l, t, table, i)
 		if err != nil {
 			return fmt.Errorf("%s rule #%v; %s", table, i, err)
 		}
 
-		if r.Code != "" && r.Port != "" {
-			return fmt.Errorf("%s rule #%v; only one of port or code should be provided", table, i)
+		// Named definitions can expand a single rule from the config into many
+		expanded, err := defs.expand(cr)
+		if err != nil {
+			return fmt.Errorf("%s rule #%v; %s", table, i, err)
 		}
 
-		if r.Host == "" && len(r.Groups) == 0 && r.Group == "" && r.Cidr == "" && r.LocalCidr == "" && r.CAName == "" && r.CASha == "" {
-			return fmt.Errorf("%s rule #%v; at least one of host, group, cidr, local_cidr, ca_name, or ca_sha must be provided", table, i)
+		for _, r := range expanded {
+			if err := addFirewallRuleFromConfig(inbound, table, i, r, fw); err != nil {
+				return err
+			}
 		}
+	}
+
+	return nil
+}
+
+// addFirewallRuleFromConfig validates a single rule from the config and adds it to the firewall
+func addFirewallRuleFromConfig(inbound bool, table string, i int, r rule, fw FirewallInterface) error {
+	var err error
+	var groups []string
 
-		if len(r.Groups) > 0 {
-			groups = r.Groups
+	if r.Code != "" && r.Port != "" {
+		return fmt.Errorf("%s rule #%v; only one of port or code should be provided", table, i)
+	}
+
+	if r.Host == "" && len(r.Groups) == 0 && r.Group == "" && r.Cidr == "" && r.LocalCidr == "" && r.CAName == "" && r.CASha == "" {
+		return fmt.Errorf("%s rule #%v; at least one of host, group, cidr, local_cidr, ca_name, or ca_sha must be provided", table, i)
+	}
+
+	if len(r.Groups) > 0 {
+		groups = r.Groups
+	}
+
+	if r.Group != "" {
+		// Check if we have both groups and group provided in the rule config
+		if len(groups) > 0 {
+			return fmt.Errorf("%s rule #%v; only one of group or groups should be defined, both provided", table, i)
 		}
 
-		if r.Group != "" {
-			// Check if we have both groups and group provided in the rule config
-			if len(groups) > 0 {
-				return fmt.Errorf("%s rule #%v; only one of group or groups should be defined, both provided", table, i)
-			}
+		groups = []string{r.Group}
+	}
 
-			groups = []string{r.Group}
+	isICMP := r.Proto == "icmp" || r.Proto == "icmpv6"
+	if r.Type != "" && !isICMP {
+		return fmt.Errorf("%s rule #%v; type is only valid with proto icmp or icmpv6", table, i)
+	}
+
+	// When type is provided on an icmp rule, type and code select the icmp messages. On other rules code is an alias for
+	// port, an icmp rule without a type can only use port to match fragments or nothing at all.
+	var icmpRanges []icmpRange
+	var startPort, endPort int32
+	if r.Type != "" {
+		if r.Port != "" && r.Port != "any" {
+			return fmt.Errorf("%s rule #%v; port can not be used with type or code", table, i)
+		}
+
+		icmpRanges, err = parseICMP(r.Proto, r.Type, r.Code)
+		if err != nil {
+			return fmt.Errorf("%s rule #%v; %s", table, i, err)
+		}
+
+	} else {
+		if isICMP && r.Code != "" {
+			return fmt.Errorf("%s rule #%v; code can not be used without type on icmp rules", table, i)
 		}
 
 		var sPort, errPort string
@@ -373,97 +727,227 @@ func AddFirewallRulesFromConfig(l *logrus.Logger, inbound bool, c *config.C, fw
 			sPort = r.Port
 		}
 
-		startPort, endPort, err := parsePort(sPort)
+		startPort, endPort, err = parsePort(sPort)
 		if err != nil {
 			return fmt.Errorf("%s rule #%v; %s %s", table, i, errPort, err)
 		}
 
-		var proto uint8
-		switch r.Proto {
-		case "any":
-			proto = firewall.ProtoAny
-		case "tcp":
-			proto = firewall.ProtoTCP
-		case "udp":
-			proto = firewall.ProtoUDP
-		case "icmp":
-			proto = firewall.ProtoICMP
-		default:
-			return fmt.Errorf("%s rule #%v; proto was not understood; `%s`", table, i, r.Proto)
+		// Icmp has no ports, a port number could never match
+		if isICMP && (startPort != endPort || (startPort != firewall.PortAny && startPort != firewall.PortFragment)) {
+			return fmt.Errorf("%s rule #%v; port must be any or fragment on icmp rules, use type and code to select icmp messages", table, i)
 		}
+	}
 
-		var cidr netip.Prefix
-		if r.Cidr != "" {
-			cidr, err = netip.ParsePrefix(r.Cidr)
-			if err != nil {
-				return fmt.Errorf("%s rule #%v; cidr did not parse; %s", table, i, err)
-			}
+	var proto uint8
+	switch r.Proto {
+	case "any":
+		proto = firewall.ProtoAny
+	case "tcp":
+		proto = firewall.ProtoTCP
+	case "udp":
+		proto = firewall.ProtoUDP
+	case "icmp":
+		proto = firewall.ProtoICMP
+	case "icmpv6":
+		proto = firewall.ProtoICMPv6
+	default:
+		return fmt.Errorf("%s rule #%v; proto was not understood; `%s`", table, i, r.Proto)
+	}
+
+	var cidr netip.Prefix
+	if r.Cidr != "" {
+		cidr, err = netip.ParsePrefix(r.Cidr)
+		if err != nil {
+			return fmt.Errorf("%s rule #%v; cidr did not parse; %s", table, i, err)
+		}
+	}
+
+	var localCidr netip.Prefix
+	if r.LocalCidr != "" {
+		localCidr, err = netip.ParsePrefix(r.LocalCidr)
+		if err != nil {
+			return fmt.Errorf("%s rule #%v; local_cidr did not parse; %s", table, i, err)
+		}
+	}
+
+	addRule := fw.AddRule
+	switch r.Action {
+	case "", "allow":
+	case "deny":
+		addRule = fw.AddDenyRule
+	default:
+		return fmt.Errorf("%s rule #%v; action was not understood; `%s`, expected allow or deny", table, i, r.Action)
+	}
+
+	if r.Schedule != nil {
+		deny := r.Action == "deny"
+		addRule = func(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, addr, localAddr netip.Prefix, caName string, caSha string) error {
+			return fw.AddScheduledRule(r.Schedule, deny, incoming, proto, startPort, endPort, groups, host, addr, localAddr, caName, caSha)
 		}
+	}
 
-		var localCidr netip.Prefix
-		if r.LocalCidr != "" {
-			localCidr, err = netip.ParsePrefix(r.LocalCidr)
+	if icmpRanges != nil {
+		for _, ir := range icmpRanges {
+			err = addRule(inbound, ir.proto, ir.start, ir.end, groups, r.Host, cidr, localCidr, r.CAName, r.CASha)
 			if err != nil {
-				return fmt.Errorf("%s rule #%v; local_cidr did not parse; %s", table, i, err)
+				return fmt.Errorf("%s rule #%v; `%s`", table, i, err)
 			}
 		}
+		return nil
+	}
+
+	err = addRule(inbound, proto, startPort, endPort, groups, r.Host, cidr, localCidr, r.CAName, r.CASha)
+	if err != nil {
+		return fmt.Errorf("%s rule #%v; `%s`", table, i, err)
+	}
+
+	return nil
+}
+
+// icmpRange is the set of firewall ports selected by an icmp rule for a single protocol
+type icmpRange struct {
+	proto uint8
+	start int32
+	end   int32
+}
 
-		err = fw.AddRule(inbound, proto, startPort, endPort, groups, r.Host, cidr, localCidr, r.CAName, r.CASha)
+// parseICMP converts the type and code of an icmp or icmpv6 rule into firewall port ranges.
+// A named type on an icmp rule applies to icmpv6 as well when both families define it.
+func parseICMP(proto string, sType string, sCode string) ([]icmpRange, error) {
+	anyCode := sCode == "" || sCode == "any"
+	var code uint8
+	if !anyCode {
+		c, err := strconv.ParseUint(sCode, 10, 8)
 		if err != nil {
-			return fmt.Errorf("%s rule #%v; `%s`", table, i, err)
+			return nil, fmt.Errorf("code was not a number between 0 and 255; `%s`", sCode)
 		}
+		code = uint8(c)
 	}
 
-	return nil
+	if sType == "any" {
+		if !anyCode {
+			return nil, errors.New("code can not be used with type any")
+		}
+
+		if proto == "icmpv6" {
+			return []icmpRange{{proto: firewall.ProtoICMPv6, start: firewall.PortAny, end: firewall.PortAny}}, nil
+		}
+		return []icmpRange{{proto: firewall.ProtoICMP, start: firewall.PortAny, end: firewall.PortAny}}, nil
+	}
+
+	toRange := func(p uint8, t uint8) icmpRange {
+		if anyCode {
+			return icmpRange{proto: p, start: firewall.ICMPPort(t, 0), end: firewall.ICMPPort(t, 255)}
+		}
+		return icmpRange{proto: p, start: firewall.ICMPPort(t, code), end: firewall.ICMPPort(t, code)}
+	}
+
+	if t, err := strconv.ParseUint(sType, 10, 8); err == nil {
+		if proto == "icmpv6" {
+			return []icmpRange{toRange(firewall.ProtoICMPv6, uint8(t))}, nil
+		}
+		return []icmpRange{toRange(firewall.ProtoICMP, uint8(t))}, nil
+	}
+
+	var ranges []icmpRange
+	if proto == "icmp" {
+		if t, ok := firewall.ICMPTypes[sType]; ok {
+			ranges = append(ranges, toRange(firewall.ProtoICMP, t))
+		}
+	}
+
+	if t, ok := firewall.ICMPv6Types[sType]; ok {
+		ranges = append(ranges, toRange(firewall.ProtoICMPv6, t))
+	}
+
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("type was not a number between 0 and 255 or a known %s type name; `%s`", proto, sType)
+	}
+
+	return ranges, nil
 }
 
 var ErrInvalidRemoteIP = errors.New("remote IP is not in remote certificate subnets")
 var ErrInvalidLocalIP = errors.New("local IP is not in list of handled local IPs")
 var ErrNoMatchingRule = errors.New("no matching rule in firewall table")
+var ErrDeniedByRule = errors.New("matched a deny rule in firewall table")
 
 // Drop returns an error if the packet should be dropped, explaining why. It
 // returns nil if the packet should not be dropped.
 func (f *Firewall) Drop(fp firewall.Packet, incoming bool, h *HostInfo, caPool *cert.CAPool, localCache firewall.ConntrackCache) error {
+	return f.drop(fp, incoming, h, caPool, localCache, 0)
+}
+
+// drop is Drop for a packet of packetLen bytes, which is only used to count the bytes admitted by each rule
+func (f *Firewall) drop(fp firewall.Packet, incoming bool, h *HostInfo, caPool *cert.CAPool, localCache firewall.ConntrackCache, packetLen int) error {
 	// Check if we spoke to this tuple, if we did then allow this packet
-	if f.inConns(fp, h, caPool, localCache) {
+	if f.inConns(fp, h, caPool, localCache, packetLen) {
 		return nil
 	}
 
+	rs, err := f.match(fp, incoming, h, caPool)
+	if err != nil {
+		m := f.metrics(incoming)
+		switch err {
+		case ErrInvalidRemoteIP:
+			m.droppedRemoteAddr.Inc(1)
+		case ErrInvalidLocalIP:
+			m.droppedLocalAddr.Inc(1)
+		case ErrDeniedByRule:
+			m.droppedDenyRule.Inc(1)
+			f.counters(rs).HitAt(packetLen, time.Now())
+		default:
+			m.droppedNoRule.Inc(1)
+		}
+
+		f.flowLog.log(fp, incoming, h, err, rs)
+		return err
+	}
+
+	// We always want to conntrack since it is a faster operation
+	f.addConn(fp, incoming, rs, packetLen)
+	f.flowLog.log(fp, incoming, h, nil, rs)
+
+	return nil
+}
+
+// match evaluates a packet that is not in conntrack against the rules. It returns the rule that allowed the packet,
+// or the deny rule that dropped it, and has no side effects.
+func (f *Firewall) match(fp firewall.Packet, incoming bool, h *HostInfo, caPool *cert.CAPool) (*firewallRuleStats, error) {
 	// Make sure remote address matches nebula certificate
 	if h.networks != nil {
 		if !h.networks.Contains(fp.RemoteAddr) {
-			f.metrics(incoming).droppedRemoteAddr.Inc(1)
-			return ErrInvalidRemoteIP
+			return nil, ErrInvalidRemoteIP
 		}
 	} else {
 		// Simple case: Certificate has one address and no unsafe networks
 		if h.vpnAddrs[0] != fp.RemoteAddr {
-			f.metrics(incoming).droppedRemoteAddr.Inc(1)
-			return ErrInvalidRemoteIP
+			return nil, ErrInvalidRemoteIP
 		}
 	}
 
 	// Make sure we are supposed to be handling this local ip address
 	if !f.routableNetworks.Contains(fp.LocalAddr) {
-		f.metrics(incoming).droppedLocalAddr.Inc(1)
-		return ErrInvalidLocalIP
+		return nil, ErrInvalidLocalIP
 	}
 
-	table := f.OutRules
+	table, denyTable := f.OutRules, f.OutDenyRules
 	if incoming {
-		table = f.InRules
+		table, denyTable = f.InRules, f.InDenyRules
 	}
 
-	// We now know which firewall table to check against
-	if !table.match(fp, incoming, h.ConnectionState.peerCert, caPool) {
-		f.metrics(incoming).droppedNoRule.Inc(1)
-		return ErrNoMatchingRule
+	// Deny rules win over any allow rule
+	if rs, ok := denyTable.matchRule(fp, incoming, h.ConnectionState.peerCert, caPool); ok {
+		return rs, ErrDeniedByRule
 	}
 
-	// We always want to conntrack since it is a faster operation
-	f.addConn(fp, incoming)
+	// We now know which firewall table to check against
+	rs, ok := table.matchRule(fp, incoming, h.ConnectionState.peerCert, caPool)
+	if !ok {
+		return nil, ErrNoMatchingRule
+	}
 
-	return nil
+	return rs, nil
 }
 
 func (f *Firewall) metrics(incoming bool) firewallMetrics {
@@ -488,11 +972,28 @@ func (f *Firewall) EmitStats() {
 	metrics.GetOrRegisterGauge("firewall.conntrack.count", nil).Update(int64(conntrackCount))
 	metrics.GetOrRegisterGauge("firewall.rules.version", nil).Update(int64(f.rulesVersion))
 	metrics.GetOrRegisterGauge("firewall.rules.hash", nil).Update(int64(f.GetRuleHashFNV()))
+
+	if !f.countRules {
+		return
+	}
+	for _, rs := range f.ruleStats {
+		names := ruleMetricNames(rs.id)
+		metrics.GetOrRegisterGauge(names[0], nil).Update(int64(rs.stats.Packets()))
+		metrics.GetOrRegisterGauge(names[1], nil).Update(int64(rs.stats.Bytes()))
+		var lastMatch int64
+		if t := rs.stats.LastMatch(); !t.IsZero() {
+			lastMatch = t.Unix()
+		}
+		metrics.GetOrRegisterGauge(names[2], nil).Update(lastMatch)
+	}
 }
 
-func (f *Firewall) inConns(fp firewall.Packet, h *HostInfo, caPool *cert.CAPool, localCache firewall.ConntrackCache) bool {
+func (f *Firewall) inConns(fp firewall.Packet, h *HostInfo, caPool *cert.CAPool, localCache firewall.ConntrackCache, packetLen int) bool {
+	key := fp.ConntrackKey()
 	if localCache != nil {
-		if _, ok := localCache[fp]; ok {
+		// An entry past its window falls through so the conntrack entry is checked against the rules again
+		if ce, ok := localCache[key]; ok && (ce.WindowEnd == 0 || time.Now().UnixNano() < ce.WindowEnd) {
+			ce.Rules.Hit(packetLen)
 			return true
 		}
 	}
@@ -505,32 +1006,37 @@ func (f *Firewall) inConns(fp firewall.Packet, h *HostInfo, caPool *cert.CAPool,
 		f.evict(ep)
 	}
 
-	c, ok := conntrack.Conns[fp]
+	c, ok := conntrack.Conns[key]
 
 	if !ok {
 		conntrack.Unlock()
 		return false
 	}
 
-	if c.rulesVersion != f.rulesVersion {
-		// This conntrack entry was for an older rule set, validate
-		// it still passes with the current rule set
-		table := f.OutRules
+	now := time.Now()
+	windowClosed := c.windowEnd != 0 && now.UnixNano() >= c.windowEnd
+	if c.rulesVersion != f.rulesVersion || windowClosed {
+		// This conntrack entry was for an older rule set, the schedule of its rule closed, or a scheduled deny rule
+		// opened, validate it still passes with the current rule set
+		table, denyTable := f.OutRules, f.OutDenyRules
 		if c.incoming {
-			table = f.InRules
+			table, denyTable = f.InRules, f.InDenyRules
 		}
 
-		// We now know which firewall table to check against
-		if !table.match(fp, c.incoming, h.ConnectionState.peerCert, caPool) {
+		// We now know which firewall table to check against, a deny rule tears down the connection
+		_, denied := denyTable.matchRule(key, c.incoming, h.ConnectionState.peerCert, caPool)
+		rs, ok := table.matchRule(key, c.incoming, h.ConnectionState.peerCert, caPool)
+		if denied || !ok {
 			if f.l.Level >= logrus.DebugLevel {
 				h.logger(f.l).
 					WithField("fwPacket", fp).
 					WithField("incoming", c.incoming).
 					WithField("rulesVersion", f.rulesVersion).
 					WithField("oldRulesVersion", c.rulesVersion).
+					WithField("windowClosed", windowClosed).
 					Debugln("dropping old conntrack entry, does not match new ruleset")
 			}
-			delete(conntrack.Conns, fp)
+			delete(conntrack.Conns, key)
 			conntrack.Unlock()
 			return false
 		}
@@ -545,27 +1051,32 @@ func (f *Firewall) inConns(fp firewall.Packet, h *HostInfo, caPool *cert.CAPool,
 		}
 
 		c.rulesVersion = f.rulesVersion
+		c.rule = rs
+		c.windowEnd = f.connWindowEnd(rs, now)
 	}
 
 	switch fp.Protocol {
 	case firewall.ProtoTCP:
-		c.Expires = time.Now().Add(f.TCPTimeout)
+		c.Expires = now.Add(f.TCPTimeout)
 	case firewall.ProtoUDP:
-		c.Expires = time.Now().Add(f.UDPTimeout)
+		c.Expires = now.Add(f.UDPTimeout)
 	default:
-		c.Expires = time.Now().Add(f.DefaultTimeout)
+		c.Expires = now.Add(f.DefaultTimeout)
 	}
 
+	rc := f.counters(c.rule)
+	windowEnd := c.windowEnd
 	conntrack.Unlock()
 
+	rc.HitAt(packetLen, now)
 	if localCache != nil {
-		localCache[fp] = struct{}{}
+		localCache[key] = firewall.ConntrackCacheEntry{Rules: rc, WindowEnd: windowEnd}
 	}
 
 	return true
 }
 
-func (f *Firewall) addConn(fp firewall.Packet, incoming bool) {
+func (f *Firewall) addConn(fp firewall.Packet, incoming bool, rs *firewallRuleStats, packetLen int) {
 	var timeout time.Duration
 	c := &conn{}
 
@@ -578,20 +1089,26 @@ func (f *Firewall) addConn(fp firewall.Packet, incoming bool) {
 		timeout = f.DefaultTimeout
 	}
 
+	key := fp.ConntrackKey()
 	conntrack := f.Conntrack
 	conntrack.Lock()
-	if _, ok := conntrack.Conns[fp]; !ok {
+	if _, ok := conntrack.Conns[key]; !ok {
 		conntrack.TimerWheel.Advance(time.Now())
-		conntrack.TimerWheel.Add(fp, timeout)
+		conntrack.TimerWheel.Add(key, timeout)
 	}
 
 	// Record which rulesVersion allowed this connection, so we can retest after
 	// firewall reload
+	now := time.Now()
 	c.incoming = incoming
 	c.rulesVersion = f.rulesVersion
-	c.Expires = time.Now().Add(timeout)
-	conntrack.Conns[fp] = c
+	c.rule = rs
+	c.windowEnd = f.connWindowEnd(rs, now)
+	c.Expires = now.Add(timeout)
+	conntrack.Conns[key] = c
 	conntrack.Unlock()
+
+	f.counters(rs).HitAt(packetLen, now)
 }
 
 // Evict checks if a conntrack entry has expired, if so it is removed, if not it is re-added to the wheel
@@ -618,29 +1135,31 @@ func (f *Firewall) evict(p firewall.Packet) {
 }
 
 func (ft *FirewallTable) match(p firewall.Packet, incoming bool, c *cert.CachedCertificate, caPool *cert.CAPool) bool {
-	if ft.AnyProto.match(p, incoming, c, caPool) {
-		return true
+	_, ok := ft.matchRule(p, incoming, c, caPool)
+	return ok
+}
+
+// matchRule is match but also returns the stats of the rule that allowed the packet
+func (ft *FirewallTable) matchRule(p firewall.Packet, incoming bool, c *cert.CachedCertificate, caPool *cert.CAPool) (*firewallRuleStats, bool) {
+	if rs, ok := ft.AnyProto.match(p, incoming, c, caPool); ok {
+		return rs, true
 	}
 
 	switch p.Protocol {
 	case firewall.ProtoTCP:
-		if ft.TCP.match(p, incoming, c, caPool) {
-			return true
-		}
+		return ft.TCP.match(p, incoming, c, caPool)
 	case firewall.ProtoUDP:
-		if ft.UDP.match(p, incoming, c, caPool) {
-			return true
-		}
-	case firewall.ProtoICMP, firewall.ProtoICMPv6:
-		if ft.ICMP.match(p, incoming, c, caPool) {
-			return true
-		}
+		return ft.UDP.match(p, incoming, c, caPool)
+	case firewall.ProtoICMP:
+		return ft.ICMP.match(p, incoming, c, caPool)
+	case firewall.ProtoICMPv6:
+		return ft.ICMPv6.match(p, incoming, c, caPool)
 	}
 
-	return false
+	return nil, false
 }
 
-func (fp firewallPort) addRule(f *Firewall, startPort int32, endPort int32, groups []string, host string, ip, localIp netip.Prefix, caName string, caSha string) error {
+func (fp firewallPort) addRule(f *Firewall, startPort int32, endPort int32, groups []string, host string, ip, localIp netip.Prefix, caName string, caSha string, rs *firewallRuleStats) error {
 	if startPort > endPort {
 		return fmt.Errorf("start port was lower than end port")
 	}
@@ -653,7 +1172,7 @@ func (fp firewallPort) addRule(f *Firewall, startPort int32, endPort int32, grou
 			}
 		}
 
-		if err := fp[i].addRule(f, groups, host, ip, localIp, caName, caSha); err != nil {
+		if err := fp[i].addRule(f, groups, host, ip, localIp, caName, caSha, rs); err != nil {
 			return err
 		}
 	}
@@ -661,30 +1180,32 @@ func (fp firewallPort) addRule(f *Firewall, startPort int32, endPort int32, grou
 	return nil
 }
 
-func (fp firewallPort) match(p firewall.Packet, incoming bool, c *cert.CachedCertificate, caPool *cert.CAPool) bool {
+func (fp firewallPort) match(p firewall.Packet, incoming bool, c *cert.CachedCertificate, caPool *cert.CAPool) (*firewallRuleStats, bool) {
 	// We don't have any allowed ports, bail
 	if fp == nil {
-		return false
+		return nil, false
 	}
 
 	var port int32
 
 	if p.Fragment {
 		port = firewall.PortFragment
+	} else if p.Protocol == firewall.ProtoICMP || p.Protocol == firewall.ProtoICMPv6 {
+		port = firewall.ICMPPort(p.ICMPType, p.ICMPCode)
 	} else if incoming {
 		port = int32(p.LocalPort)
 	} else {
 		port = int32(p.RemotePort)
 	}
 
-	if fp[port].match(p, c, caPool) {
-		return true
+	if rs, ok := fp[port].match(p, c, caPool); ok {
+		return rs, true
 	}
 
 	return fp[firewall.PortAny].match(p, c, caPool)
 }
 
-func (fc *FirewallCA) addRule(f *Firewall, groups []string, host string, ip, localIp netip.Prefix, caName, caSha string) error {
+func (fc *FirewallCA) addRule(f *Firewall, groups []string, host string, ip, localIp netip.Prefix, caName, caSha string, rs *firewallRuleStats) error {
 	fr := func() *FirewallRule {
 		return &FirewallRule{
 			Hosts:  make(map[string]*firewallLocalCIDR),
@@ -698,14 +1219,14 @@ func (fc *FirewallCA) addRule(f *Firewall, groups []string, host string, ip, loc
 			fc.Any = fr()
 		}
 
-		return fc.Any.addRule(f, groups, host, ip, localIp)
+		return fc.Any.addRule(f, groups, host, ip, localIp, rs)
 	}
 
 	if caSha != "" {
 		if _, ok := fc.CAShas[caSha]; !ok {
 			fc.CAShas[caSha] = fr()
 		}
-		err := fc.CAShas[caSha].addRule(f, groups, host, ip, localIp)
+		err := fc.CAShas[caSha].addRule(f, groups, host, ip, localIp, rs)
 		if err != nil {
 			return err
 		}
@@ -715,7 +1236,7 @@ func (fc *FirewallCA) addRule(f *Firewall, groups []string, host string, ip, loc
 		if _, ok := fc.CANames[caName]; !ok {
 			fc.CANames[caName] = fr()
 		}
-		err := fc.CANames[caName].addRule(f, groups, host, ip, localIp)
+		err := fc.CANames[caName].addRule(f, groups, host, ip, localIp, rs)
 		if err != nil {
 			return err
 		}
@@ -724,47 +1245,70 @@ func (fc *FirewallCA) addRule(f *Firewall, groups []string, host string, ip, loc
 	return nil
 }
 
-func (fc *FirewallCA) match(p firewall.Packet, c *cert.CachedCertificate, caPool *cert.CAPool) bool {
+func (fc *FirewallCA) match(p firewall.Packet, c *cert.CachedCertificate, caPool *cert.CAPool) (*firewallRuleStats, bool) {
 	if fc == nil {
-		return false
+		return nil, false
 	}
 
-	if fc.Any.match(p, c) {
-		return true
+	if rs, ok := fc.Any.match(p, c); ok {
+		return rs, true
 	}
 
 	if t, ok := fc.CAShas[c.Certificate.Issuer()]; ok {
-		if t.match(p, c) {
-			return true
+		if rs, ok := t.match(p, c); ok {
+			return rs, true
 		}
 	}
 
 	s, err := caPool.GetCAForCert(c.Certificate)
 	if err != nil {
-		return false
+		return nil, false
 	}
 
 	return fc.CANames[s.Certificate.Name()].match(p, c)
 }
 
-func (fr *FirewallRule) addRule(f *Firewall, groups []string, host string, ip, localCIDR netip.Prefix) error {
+func (fr *FirewallRule) addRule(f *Firewall, groups []string, host string, ip, localCIDR netip.Prefix, rs *firewallRuleStats) error {
 	flc := func() *firewallLocalCIDR {
 		return &firewallLocalCIDR{
-			LocalCIDR: new(bart.Lite),
+			LocalCIDR: new(bart.Table[*firewallRuleStats]),
 		}
 	}
 
+	// Scheduled rules get their own tree so they never share a match with a rule that is always active
+	if rs != nil && rs.schedule != nil && fr.schedule == nil {
+		var sfr *FirewallRule
+		for _, v := range fr.Scheduled {
+			if v.schedule == rs.schedule {
+				sfr = v
+				break
+			}
+		}
+
+		if sfr == nil {
+			sfr = &FirewallRule{
+				Hosts:    make(map[string]*firewallLocalCIDR),
+				Groups:   make([]*firewallGroups, 0),
+				CIDR:     new(bart.Table[*firewallLocalCIDR]),
+				schedule: rs.schedule,
+			}
+			fr.Scheduled = append(fr.Scheduled, sfr)
+		}
+
+		return sfr.addRule(f, groups, host, ip, localCIDR, rs)
+	}
+
 	if fr.isAny(groups, host, ip) {
 		if fr.Any == nil {
 			fr.Any = flc()
 		}
 
-		return fr.Any.addRule(f, localCIDR)
+		return fr.Any.addRule(f, localCIDR, rs)
 	}
 
 	if len(groups) > 0 {
 		nlc := flc()
-		err := nlc.addRule(f, localCIDR)
+		err := nlc.addRule(f, localCIDR, rs)
 		if err != nil {
 			return err
 		}
@@ -780,7 +1324,7 @@ func (fr *FirewallRule) addRule(f *Firewall, groups []string, host string, ip, l
 		if nlc == nil {
 			nlc = flc()
 		}
-		err := nlc.addRule(f, localCIDR)
+		err := nlc.addRule(f, localCIDR, rs)
 		if err != nil {
 			return err
 		}
@@ -792,7 +1336,7 @@ func (fr *FirewallRule) addRule(f *Firewall, groups []string, host string, ip, l
 		if nlc == nil {
 			nlc = flc()
 		}
-		err := nlc.addRule(f, localCIDR)
+		err := nlc.addRule(f, localCIDR, rs)
 		if err != nil {
 			return err
 		}
@@ -824,14 +1368,14 @@ func (fr *FirewallRule) isAny(groups []string, host string, ip netip.Prefix) boo
 	return false
 }
 
-func (fr *FirewallRule) match(p firewall.Packet, c *cert.CachedCertificate) bool {
+func (fr *FirewallRule) match(p firewall.Packet, c *cert.CachedCertificate) (*firewallRuleStats, bool) {
 	if fr == nil {
-		return false
+		return nil, false
 	}
 
 	// Shortcut path for if groups, hosts, or cidr contained an `any`
-	if fr.Any.match(p, c) {
-		return true
+	if rs, ok := fr.Any.match(p, c); ok {
+		return rs, true
 	}
 
 	// Need any of group, host, or cidr to match
@@ -847,64 +1391,100 @@ func (fr *FirewallRule) match(p firewall.Packet, c *cert.CachedCertificate) bool
 			found = true
 		}
 
-		if found && sg.LocalCIDR.match(p, c) {
-			return true
+		if found {
+			if rs, ok := sg.LocalCIDR.match(p, c); ok {
+				return rs, true
+			}
 		}
 	}
 
 	if fr.Hosts != nil {
 		if flc, ok := fr.Hosts[c.Certificate.Name()]; ok {
-			if flc.match(p, c) {
-				return true
+			if rs, ok := flc.match(p, c); ok {
+				return rs, true
 			}
 		}
 	}
 
 	for _, v := range fr.CIDR.Supernets(netip.PrefixFrom(p.RemoteAddr, p.RemoteAddr.BitLen())) {
-		if v.match(p, c) {
-			return true
+		if rs, ok := v.match(p, c); ok {
+			return rs, true
 		}
 	}
 
-	return false
+	if len(fr.Scheduled) > 0 {
+		now := time.Now()
+		for _, sfr := range fr.Scheduled {
+			if !sfr.schedule.active(now) {
+				continue
+			}
+
+			if rs, ok := sfr.match(p, c); ok {
+				return rs, true
+			}
+		}
+	}
+
+	return nil, false
 }
 
-func (flc *firewallLocalCIDR) addRule(f *Firewall, localIp netip.Prefix) error {
+func (flc *firewallLocalCIDR) addRule(f *Firewall, localIp netip.Prefix, rs *firewallRuleStats) error {
 	if !localIp.IsValid() {
-		if !f.hasUnsafeNetworks || f.defaultLocalCIDRAny {
-			flc.Any = true
+		// A deny rule without a local cidr must also cover the unsafe networks, which allow rules only reach by naming them
+		if !f.hasUnsafeNetworks || f.defaultLocalCIDRAny || rs != nil && rs.deny {
+			flc.setAny(rs)
 			return nil
 		}
 
 		for _, network := range f.assignedNetworks {
-			flc.LocalCIDR.Insert(network)
+			flc.insert(network, rs)
 		}
 		return nil
 
 	} else if localIp.Bits() == 0 {
-		flc.Any = true
+		flc.setAny(rs)
 		return nil
 	}
 
-	flc.LocalCIDR.Insert(localIp)
+	flc.insert(localIp, rs)
 	return nil
 }
 
-func (flc *firewallLocalCIDR) match(p firewall.Packet, c *cert.CachedCertificate) bool {
+// setAny marks the local cidr as any, every rule to do so is credited with the matches
+func (flc *firewallLocalCIDR) setAny(rs *firewallRuleStats) {
+	if !flc.Any {
+		flc.Any = true
+		flc.anyRule = rs
+	} else if flc.anyRule != nil && rs != nil {
+		flc.anyRule = flc.anyRule.sharedWith(rs)
+	}
+}
+
+// insert adds the local cidr, every rule to add a cidr is credited with its matches
+func (flc *firewallLocalCIDR) insert(localIp netip.Prefix, rs *firewallRuleStats) {
+	if existing, ok := flc.LocalCIDR.Get(localIp); !ok {
+		flc.LocalCIDR.Insert(localIp, rs)
+	} else if existing != nil && rs != nil {
+		flc.LocalCIDR.Insert(localIp, existing.sharedWith(rs))
+	}
+}
+
+func (flc *firewallLocalCIDR) match(p firewall.Packet, c *cert.CachedCertificate) (*firewallRuleStats, bool) {
 	if flc == nil {
-		return false
+		return nil, false
 	}
 
 	if flc.Any {
-		return true
+		return flc.anyRule, true
 	}
 
-	return flc.LocalCIDR.Contains(p.LocalAddr)
+	return flc.LocalCIDR.Lookup(p.LocalAddr)
 }
 
 type rule struct {
 	Port      string
 	Code      string
+	Type      string
 	Proto     string
 	Host      string
 	Group     string
@@ -913,6 +1493,8 @@ type rule struct {
 	LocalCidr string
 	CAName    string
 	CASha     string
+	Action    string
+	Schedule  *firewallSchedule
 }
 
 func convertRule(l *logrus.Logger, p any, table string, i int) (rule, error) {
@@ -933,12 +1515,22 @@ func convertRule(l *logrus.Logger, p any, table string, i int) (rule, error) {
 
 	r.Port = toString("port", m)
 	r.Code = toString("code", m)
+	r.Type = toString("type", m)
 	r.Proto = toString("proto", m)
 	r.Host = toString("host", m)
 	r.Cidr = toString("cidr", m)
 	r.LocalCidr = toString("local_cidr", m)
 	r.CAName = toString("ca_name", m)
 	r.CASha = toString("ca_sha", m)
+	r.Action = toString("action", m)
+
+	if v, ok := m["schedule"]; ok {
+		s, err := newFirewallScheduleFromConfig(v)
+		if err != nil {
+			return r, err
+		}
+		r.Schedule = s
+	}
 
 	// Make sure group isn't an array
 	if v, ok := m["group"].([]any); ok {
@@ -9,7 +9,15 @@ import (
 
 // ConntrackCache is used as a local routine cache to know if a given flow
 // has been seen in the conntrack table.
-type ConntrackCache map[Packet]struct{}
+type ConntrackCache map[Packet]ConntrackCacheEntry
+
+// ConntrackCacheEntry is what a routine remembers about a flow in the conntrack table
+type ConntrackCacheEntry struct {
+	// Rules are the stats of the rules credited with the flow, nil when rules are not counted
+	Rules RuleCounters
+	// WindowEnd is when the flow has to be checked against the rules again in unix nanoseconds, zero for never
+	WindowEnd int64
+}
 
 type ConntrackCacheTicker struct {
 	cacheV    uint64
@@ -0,0 +1,67 @@
+package firewall
+
+// PortICMP is added to the ICMP type and code to produce the value used in place of a port when matching ICMP packets,
+// it keeps the ICMP space clear of PortAny and PortFragment.
+const PortICMP = 1 << 16
+
+const (
+	ICMPEchoReply     = 0
+	ICMPEchoRequest   = 8
+	ICMPv6EchoRequest = 128
+	ICMPv6EchoReply   = 129
+)
+
+// ICMPTypes maps the ICMP type names understood by the firewall to their number
+var ICMPTypes = map[string]uint8{
+	"echo-reply":              ICMPEchoReply,
+	"destination-unreachable": 3,
+	"source-quench":           4,
+	"redirect":                5,
+	"echo-request":            ICMPEchoRequest,
+	"router-advertisement":    9,
+	"router-solicitation":     10,
+	"time-exceeded":           11,
+	"parameter-problem":       12,
+	"timestamp-request":       13,
+	"timestamp-reply":         14,
+}
+
+// ICMPv6Types maps the ICMPv6 type names understood by the firewall to their number
+var ICMPv6Types = map[string]uint8{
+	"destination-unreachable":   1,
+	"packet-too-big":            2,
+	"time-exceeded":             3,
+	"parameter-problem":         4,
+	"echo-request":              ICMPv6EchoRequest,
+	"echo-reply":                ICMPv6EchoReply,
+	"multicast-listener-query":  130,
+	"multicast-listener-report": 131,
+	"multicast-listener-done":   132,
+	"router-solicitation":       133,
+	"router-advertisement":      134,
+	"neighbor-solicitation":     135,
+	"neighbor-advertisement":    136,
+	"redirect":                  137,
+}
+
+// ICMPPort returns the value used in place of a port when matching an ICMP type and code against the firewall rules
+func ICMPPort(icmpType, icmpCode uint8) int32 {
+	return PortICMP + int32(icmpType)<<8 + int32(icmpCode)
+}
+
+// ConntrackKey returns the packet used to track this flow in the conntrack table. ICMP echo replies are tracked as
+// their request so a ping that was allowed in one direction can be answered.
+func (fp Packet) ConntrackKey() Packet {
+	switch fp.Protocol {
+	case ProtoICMP:
+		if fp.ICMPType == ICMPEchoReply {
+			fp.ICMPType = ICMPEchoRequest
+		}
+	case ProtoICMPv6:
+		if fp.ICMPType == ICMPv6EchoReply {
+			fp.ICMPType = ICMPv6EchoRequest
+		}
+	}
+
+	return fp
+}
@@ -26,6 +26,9 @@ type Packet struct {
 	RemotePort uint16
 	Protocol   uint8
 	Fragment   bool
+	// ICMPType and ICMPCode are only set for ICMP and ICMPv6 packets that are not fragments
+	ICMPType uint8
+	ICMPCode uint8
 }
 
 func (fp *Packet) Copy() *Packet {
@@ -36,6 +39,8 @@ func (fp *Packet) Copy() *Packet {
 		RemotePort: fp.RemotePort,
 		Protocol:   fp.Protocol,
 		Fragment:   fp.Fragment,
+		ICMPType:   fp.ICMPType,
+		ICMPCode:   fp.ICMPCode,
 	}
 }
 
@@ -46,17 +51,27 @@ func (fp Packet) MarshalJSON() ([]byte, error) {
 		proto = "tcp"
 	case ProtoICMP:
 		proto = "icmp"
+	case ProtoICMPv6:
+		proto = "icmpv6"
 	case ProtoUDP:
 		proto = "udp"
 	default:
 		proto = fmt.Sprintf("unknown %v", fp.Protocol)
 	}
-	return json.Marshal(m{
+
+	out := m{
 		"LocalAddr":  fp.LocalAddr.String(),
 		"RemoteAddr": fp.RemoteAddr.String(),
 		"LocalPort":  fp.LocalPort,
 		"RemotePort": fp.RemotePort,
 		"Protocol":   proto,
 		"Fragment":   fp.Fragment,
-	})
+	}
+
+	if fp.Protocol == ProtoICMP || fp.Protocol == ProtoICMPv6 {
+		out["ICMPType"] = fp.ICMPType
+		out["ICMPCode"] = fp.ICMPCode
+	}
+
+	return json.Marshal(out)
 }
@@ -0,0 +1,94 @@
+package firewall
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// RuleStats counts the traffic admitted by a firewall rule, it is safe for concurrent use.
+// A nil *RuleStats is valid and counts nothing.
+type RuleStats struct {
+	packets   atomic.Uint64
+	bytes     atomic.Uint64
+	lastMatch atomic.Int64
+}
+
+// Hit records a packet of n bytes, without touching the last match time.
+// This is the hot path used by the per routine conntrack cache.
+func (rs *RuleStats) Hit(n int) {
+	if rs == nil {
+		return
+	}
+
+	rs.packets.Add(1)
+	rs.bytes.Add(uint64(n))
+}
+
+// HitAt records a packet of n bytes that was matched at t
+func (rs *RuleStats) HitAt(n int, t time.Time) {
+	if rs == nil {
+		return
+	}
+
+	rs.Hit(n)
+	rs.lastMatch.Store(t.UnixNano())
+}
+
+// RuleCounters are the stats of every rule credited with a match, a nil RuleCounters counts nothing
+type RuleCounters []*RuleStats
+
+// Hit records a packet of n bytes against every rule, without touching the last match time
+func (rc RuleCounters) Hit(n int) {
+	for _, rs := range rc {
+		rs.Hit(n)
+	}
+}
+
+// HitAt records a packet of n bytes that was matched at t against every rule
+func (rc RuleCounters) HitAt(n int, t time.Time) {
+	for _, rs := range rc {
+		rs.HitAt(n, t)
+	}
+}
+
+// Packets returns the number of packets that have been admitted
+func (rs *RuleStats) Packets() uint64 {
+	if rs == nil {
+		return 0
+	}
+	return rs.packets.Load()
+}
+
+// Bytes returns the number of bytes that have been admitted
+func (rs *RuleStats) Bytes() uint64 {
+	if rs == nil {
+		return 0
+	}
+	return rs.bytes.Load()
+}
+
+// LastMatch returns the last time a packet was admitted, it is the zero time if there has not been a match
+func (rs *RuleStats) LastMatch() time.Time {
+	if rs == nil {
+		return time.Time{}
+	}
+
+	v := rs.lastMatch.Load()
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, v)
+}
+
+// Add folds the counts of o into rs, keeping the most recent last match time
+func (rs *RuleStats) Add(o *RuleStats) {
+	if rs == nil || o == nil {
+		return
+	}
+
+	rs.packets.Add(o.packets.Load())
+	rs.bytes.Add(o.bytes.Load())
+	if v := o.lastMatch.Load(); v > rs.lastMatch.Load() {
+		rs.lastMatch.Store(v)
+	}
+}
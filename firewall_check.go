@@ -0,0 +1,351 @@
+package nebula
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+)
+
+// FirewallCheck describes a packet to evaluate against the firewall rules without sending it
+type FirewallCheck struct {
+	Incoming bool
+	Packet   firewall.Packet
+
+	// Peer is the certificate of the host on the other end of the tunnel
+	Peer cert.Certificate
+}
+
+// FirewallCheckResult is the decision the firewall would make for a FirewallCheck
+type FirewallCheckResult struct {
+	Allowed bool              `json:"allowed"`
+	Reason  string            `json:"reason,omitempty"`
+	Rule    *FirewallRuleInfo `json:"rule,omitempty"`
+}
+
+func (r *FirewallCheckResult) String() string {
+	decision := "dropped"
+	if r.Allowed {
+		decision = "allowed"
+	}
+
+	switch {
+	case r.Rule != nil && r.Allowed:
+		return fmt.Sprintf("%s by %s rule %s: %s", decision, r.Rule.Direction, r.Rule.ID, r.Rule.Rule)
+	case r.Rule != nil:
+		return fmt.Sprintf("%s by %s deny rule %s: %s", decision, r.Rule.Direction, r.Rule.ID, r.Rule.Rule)
+	default:
+		return fmt.Sprintf("%s: %s", decision, r.Reason)
+	}
+}
+
+// Check evaluates a packet against the rules the same way Drop does. Conntrack, rule counters, metrics, and the
+// flow log are neither consulted nor updated. The peer certificate is trusted as is, it is not verified against caPool.
+func (f *Firewall) Check(fc FirewallCheck, caPool *cert.CAPool) FirewallCheckResult {
+	c := &cert.CachedCertificate{
+		Certificate:    fc.Peer,
+		InvertedGroups: make(map[string]struct{}),
+	}
+
+	for _, g := range fc.Peer.Groups() {
+		c.InvertedGroups[g] = struct{}{}
+	}
+
+	h := &HostInfo{ConnectionState: &ConnectionState{peerCert: c}}
+	for _, n := range fc.Peer.Networks() {
+		h.vpnAddrs = append(h.vpnAddrs, n.Addr())
+	}
+	h.buildNetworks(fc.Peer.Networks(), fc.Peer.UnsafeNetworks())
+
+	rs, err := f.match(fc.Packet, fc.Incoming, h, caPool)
+	res := FirewallCheckResult{Allowed: err == nil}
+	if err != nil {
+		res.Reason = err.Error()
+	}
+
+	if rs != nil {
+		info := rs.info()
+		res.Rule = &info
+	}
+
+	return res
+}
+
+// CheckFirewall loads the certificate and firewall from the config and evaluates fc against the rules.
+// The flow log is not opened.
+func CheckFirewall(l *logrus.Logger, c *config.C, fc FirewallCheck) (*FirewallCheckResult, error) {
+	cs, err := newCertStateFromConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	caPool, err := loadCAPoolFromConfig(l, c)
+	if err != nil {
+		return nil, err
+	}
+
+	fw, err := NewFirewallFromConfig(l, cs, c)
+	if err != nil {
+		return nil, fmt.Errorf("error while loading firewall rules: %w", err)
+	}
+
+	res := fw.Check(fc, caPool)
+	return &res, nil
+}
+
+// FirewallCheckFlags are the command line flags that describe a FirewallCheck, they are shared by
+// `nebula -test-firewall` and the test-firewall sshd command.
+type FirewallCheckFlags struct {
+	Direction  string
+	Proto      string
+	Local      string
+	Remote     string
+	ICMPType   string
+	ICMPCode   int
+	Fragment   bool
+	PeerCert   string
+	PeerName   string
+	PeerGroups string
+	// PeerNetworks defaults to the remote address
+	PeerNetworks       string
+	PeerUnsafeNetworks string
+}
+
+// Register adds the flags to fs, each flag name is prefixed with prefix
+func (ff *FirewallCheckFlags) Register(fs *flag.FlagSet, prefix string) {
+	fs.StringVar(&ff.Direction, prefix+"direction", "in", "Direction of the packet, in to this host or out to the peer")
+	fs.StringVar(&ff.Proto, prefix+"proto", "tcp", "Protocol of the packet, one of tcp, udp, icmp, or icmpv6")
+	fs.StringVar(&ff.Local, prefix+"local", "", "The `address:port` on this host, ie 10.1.0.1:80")
+	fs.StringVar(&ff.Remote, prefix+"remote", "", "The `address:port` on the peer, ie 10.1.0.2:55555")
+	fs.StringVar(&ff.ICMPType, prefix+"icmp-type", "echo-request", "ICMP type name or number, for proto icmp or icmpv6")
+	fs.IntVar(&ff.ICMPCode, prefix+"icmp-code", 0, "ICMP code, for proto icmp or icmpv6")
+	fs.BoolVar(&ff.Fragment, prefix+"fragment", false, "The packet is a second or later fragment")
+	fs.StringVar(&ff.PeerCert, prefix+"peer-cert", "", "Path to the certificate of the peer, required to match ca_name or ca_sha rules")
+	fs.StringVar(&ff.PeerName, prefix+"peer-name", "peer", "Name of the peer, when -"+prefix+"peer-cert is not provided")
+	fs.StringVar(&ff.PeerGroups, prefix+"peer-groups", "", "Comma separated groups of the peer, when -"+prefix+"peer-cert is not provided")
+	fs.StringVar(&ff.PeerNetworks, prefix+"peer-networks", "", "Comma separated networks of the peer, when -"+prefix+"peer-cert is not provided. Defaults to the remote address")
+	fs.StringVar(&ff.PeerUnsafeNetworks, prefix+"peer-unsafe-networks", "", "Comma separated unsafe networks of the peer, when -"+prefix+"peer-cert is not provided")
+}
+
+// Check builds the FirewallCheck described by the flags
+func (ff *FirewallCheckFlags) Check() (FirewallCheck, error) {
+	fp, incoming, err := ff.packet()
+	if err != nil {
+		return FirewallCheck{}, err
+	}
+
+	peer, err := ff.peer(fp.RemoteAddr)
+	if err != nil {
+		return FirewallCheck{}, err
+	}
+
+	return FirewallCheck{Incoming: incoming, Packet: fp, Peer: peer}, nil
+}
+
+// packet builds the packet to check and its direction from the flags
+func (ff *FirewallCheckFlags) packet() (firewall.Packet, bool, error) {
+	var fp firewall.Packet
+	var incoming bool
+
+	switch ff.Direction {
+	case "in":
+		incoming = true
+	case "out":
+	default:
+		return fp, false, fmt.Errorf("direction was not understood; `%s`, expected in or out", ff.Direction)
+	}
+
+	local, err := parseCheckAddr(ff.Local)
+	if err != nil {
+		return fp, false, fmt.Errorf("local %s", err)
+	}
+
+	remote, err := parseCheckAddr(ff.Remote)
+	if err != nil {
+		return fp, false, fmt.Errorf("remote %s", err)
+	}
+
+	if local.Addr().Is4() != remote.Addr().Is4() {
+		return fp, false, errors.New("local and remote must be the same ip version")
+	}
+
+	fp.LocalAddr = local.Addr()
+	fp.LocalPort = local.Port()
+	fp.RemoteAddr = remote.Addr()
+	fp.RemotePort = remote.Port()
+	fp.Fragment = ff.Fragment
+
+	var types map[string]uint8
+	switch ff.Proto {
+	case "tcp":
+		fp.Protocol = firewall.ProtoTCP
+	case "udp":
+		fp.Protocol = firewall.ProtoUDP
+	case "icmp":
+		fp.Protocol = firewall.ProtoICMP
+		types = firewall.ICMPTypes
+		if !fp.RemoteAddr.Is4() {
+			fp.Protocol = firewall.ProtoICMPv6
+			types = firewall.ICMPv6Types
+		}
+	case "icmpv6":
+		fp.Protocol = firewall.ProtoICMPv6
+		types = firewall.ICMPv6Types
+	default:
+		return fp, false, fmt.Errorf("proto was not understood; `%s`", ff.Proto)
+	}
+
+	if types != nil {
+		// The firewall ignores ports for icmp
+		fp.LocalPort, fp.RemotePort = 0, 0
+
+		t, ok := types[ff.ICMPType]
+		if !ok {
+			n, err := strconv.ParseUint(ff.ICMPType, 10, 8)
+			if err != nil {
+				return fp, false, fmt.Errorf("icmp-type was not a number between 0 and 255 or a known type name; `%s`", ff.ICMPType)
+			}
+			t = uint8(n)
+		}
+
+		if ff.ICMPCode < 0 || ff.ICMPCode > 255 {
+			return fp, false, fmt.Errorf("icmp-code was not a number between 0 and 255; `%v`", ff.ICMPCode)
+		}
+
+		fp.ICMPType = t
+		fp.ICMPCode = uint8(ff.ICMPCode)
+	}
+
+	return fp, incoming, nil
+}
+
+// peer loads the peer certificate, or creates one from the peer name, groups, and networks.
+// A created certificate is signed by a throwaway CA.
+func (ff *FirewallCheckFlags) peer(remote netip.Addr) (cert.Certificate, error) {
+	if ff.PeerCert != "" {
+		b, err := os.ReadFile(ff.PeerCert)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read peer-cert file %s: %s", ff.PeerCert, err)
+		}
+
+		c, _, err := cert.UnmarshalCertificateFromPEM(b)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse peer-cert file %s: %s", ff.PeerCert, err)
+		}
+
+		return c, nil
+	}
+
+	networks, err := parseCheckPrefixes(ff.PeerNetworks)
+	if err != nil {
+		return nil, fmt.Errorf("peer-networks %s", err)
+	}
+
+	if len(networks) == 0 {
+		networks = []netip.Prefix{netip.PrefixFrom(remote, remote.BitLen())}
+	}
+
+	unsafeNetworks, err := parseCheckPrefixes(ff.PeerUnsafeNetworks)
+	if err != nil {
+		return nil, fmt.Errorf("peer-unsafe-networks %s", err)
+	}
+
+	var groups []string
+	for _, g := range strings.Split(ff.PeerGroups, ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			groups = append(groups, g)
+		}
+	}
+
+	return newFirewallCheckPeer(ff.PeerName, groups, networks, unsafeNetworks)
+}
+
+func parseCheckAddr(s string) (netip.AddrPort, error) {
+	if s == "" {
+		return netip.AddrPort{}, errors.New("is required")
+	}
+
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap, nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("was not an address or address:port; `%s`", s)
+	}
+
+	return netip.AddrPortFrom(addr, 0), nil
+}
+
+func parseCheckPrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("did not parse; %s", err)
+		}
+		prefixes = append(prefixes, p)
+	}
+
+	return prefixes, nil
+}
+
+// newFirewallCheckPeer creates a certificate with the provided details signed by a throwaway CA
+func newFirewallCheckPeer(name string, groups []string, networks, unsafeNetworks []netip.Prefix) (cert.Certificate, error) {
+	caPub, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	ca, err := (&cert.TBSCertificate{
+		Version:   cert.Version2,
+		Name:      "firewall check",
+		IsCA:      true,
+		NotBefore: now.Add(-time.Minute),
+		NotAfter:  now.Add(time.Hour),
+		PublicKey: caPub,
+		Curve:     cert.Curve_CURVE25519,
+	}).Sign(nil, cert.Curve_CURVE25519, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	pub := make([]byte, 32)
+	if _, err := rand.Read(pub); err != nil {
+		return nil, err
+	}
+
+	c, err := (&cert.TBSCertificate{
+		Version:        cert.Version2,
+		Name:           name,
+		Networks:       networks,
+		UnsafeNetworks: unsafeNetworks,
+		Groups:         groups,
+		NotBefore:      now.Add(-time.Minute),
+		NotAfter:       now.Add(time.Hour - time.Minute),
+		PublicKey:      pub,
+		Curve:          cert.Curve_CURVE25519,
+	}).Sign(ca, cert.Curve_CURVE25519, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not create a peer certificate: %w", err)
+	}
+
+	return c, nil
+}
@@ -0,0 +1,120 @@
+package nebula
+
+import (
+	"flag"
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirewall_Check(t *testing.T) {
+	l := test.NewLogger()
+	network := netip.MustParsePrefix("10.1.0.1/24")
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[string]any{
+		"outbound": []any{map[string]any{"proto": "any", "port": "any", "host": "any"}},
+		"inbound": []any{
+			map[string]any{"proto": "tcp", "port": "22", "group": "contractors", "action": "deny"},
+			map[string]any{"proto": "tcp", "port": "any", "group": "web"},
+			map[string]any{"proto": "icmp", "type": "echo-request", "host": "any"},
+		},
+	}
+	cs, err := newCertState(cert.Version2, nil, &dummyCert{networks: []netip.Prefix{network}}, false, cert.Curve_CURVE25519, nil)
+	require.NoError(t, err)
+	fw, err := NewFirewallFromConfig(l, cs, conf)
+	require.NoError(t, err)
+	cp := cert.NewCAPool()
+
+	check := func(args ...string) FirewallCheckResult {
+		ff := FirewallCheckFlags{}
+		fs := flag.NewFlagSet("", flag.ContinueOnError)
+		ff.Register(fs, "")
+		require.NoError(t, fs.Parse(args))
+
+		fc, err := ff.Check()
+		require.NoError(t, err)
+		return fw.Check(fc, cp)
+	}
+
+	res := check("-local", "10.1.0.1:80", "-remote", "10.1.0.2:5555", "-peer-groups", "web")
+	assert.True(t, res.Allowed)
+	require.NotNil(t, res.Rule)
+	assert.Equal(t, "proto: tcp, port: any, groups: [web]", res.Rule.Rule)
+	assert.Equal(t, "allowed by incoming rule "+res.Rule.ID+": proto: tcp, port: any, groups: [web]", res.String())
+
+	res = check("-local", "10.1.0.1:22", "-remote", "10.1.0.2:5555", "-peer-groups", "web, contractors")
+	assert.False(t, res.Allowed)
+	assert.Equal(t, ErrDeniedByRule.Error(), res.Reason)
+	require.NotNil(t, res.Rule)
+	assert.Equal(t, "deny", res.Rule.Action)
+
+	res = check("-local", "10.1.0.1:80", "-remote", "10.1.0.2:5555")
+	assert.Equal(t, FirewallCheckResult{Reason: ErrNoMatchingRule.Error()}, res)
+	assert.Equal(t, "dropped: no matching rule in firewall table", res.String())
+
+	res = check("-proto", "icmp", "-local", "10.1.0.1", "-remote", "10.1.0.2")
+	assert.True(t, res.Allowed)
+
+	res = check("-proto", "icmp", "-icmp-type", "echo-reply", "-local", "10.1.0.1", "-remote", "10.1.0.2")
+	assert.False(t, res.Allowed)
+
+	// The remote address must belong to the peer
+	res = check("-local", "10.1.0.1:80", "-remote", "10.1.0.3:5555", "-peer-groups", "web", "-peer-networks", "10.1.0.2/24")
+	assert.Equal(t, ErrInvalidRemoteIP.Error(), res.Reason)
+
+	res = check("-local", "10.1.0.1:80", "-remote", "192.168.0.3:5555", "-peer-groups", "web", "-peer-networks", "10.1.0.2/24", "-peer-unsafe-networks", "192.168.0.0/24")
+	assert.True(t, res.Allowed)
+
+	res = check("-direction", "out", "-proto", "udp", "-local", "10.1.0.1", "-remote", "10.1.0.2:53")
+	assert.True(t, res.Allowed)
+
+	// Nothing was recorded
+	assert.Empty(t, fw.Conntrack.Conns)
+	for _, r := range fw.ListRules() {
+		assert.Zero(t, r.Packets)
+	}
+}
+
+func TestFirewallCheckFlags_packet(t *testing.T) {
+	tests := []struct {
+		ff  FirewallCheckFlags
+		err string
+	}{
+		{FirewallCheckFlags{Direction: "up"}, "direction was not understood; `up`, expected in or out"},
+		{FirewallCheckFlags{Direction: "in"}, "local is required"},
+		{FirewallCheckFlags{Direction: "in", Local: "10.1.0.1", Remote: "host2"}, "remote was not an address or address:port; `host2`"},
+		{FirewallCheckFlags{Direction: "in", Local: "10.1.0.1", Remote: "fd00::1"}, "local and remote must be the same ip version"},
+		{FirewallCheckFlags{Direction: "in", Local: "10.1.0.1", Remote: "10.1.0.2", Proto: "sctp"}, "proto was not understood; `sctp`"},
+		{FirewallCheckFlags{Direction: "in", Local: "10.1.0.1", Remote: "10.1.0.2", Proto: "icmp", ICMPType: "ping"}, "icmp-type was not a number between 0 and 255 or a known type name; `ping`"},
+	}
+
+	for _, tt := range tests {
+		_, _, err := tt.ff.packet()
+		require.EqualError(t, err, tt.err)
+	}
+
+	ff := FirewallCheckFlags{Direction: "out", Local: "[fd00::1]:80", Remote: "fd00::2", Proto: "icmp", ICMPType: "echo-request", ICMPCode: 3}
+	fp, incoming, err := ff.packet()
+	require.NoError(t, err)
+	assert.False(t, incoming)
+	assert.Equal(t, firewall.Packet{
+		LocalAddr:  netip.MustParseAddr("fd00::1"),
+		RemoteAddr: netip.MustParseAddr("fd00::2"),
+		Protocol:   firewall.ProtoICMPv6,
+		ICMPType:   firewall.ICMPv6EchoRequest,
+		ICMPCode:   3,
+	}, fp)
+
+	peer, err := (&FirewallCheckFlags{PeerName: "host2", PeerGroups: "a,b"}).peer(fp.RemoteAddr)
+	require.NoError(t, err)
+	assert.Equal(t, "host2", peer.Name())
+	assert.Equal(t, []string{"a", "b"}, peer.Groups())
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("fd00::2/128")}, peer.Networks())
+}
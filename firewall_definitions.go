@@ -0,0 +1,206 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/slackhq/nebula/config"
+)
+
+// firewallDefinitions are named lists of ports, cidrs, hosts, and groups that firewall rules can reference with
+// `$name` instead of repeating the values. A rule that references a definition is expanded into one rule per value,
+// except within `groups` where the values are all required so they replace the reference in the same rule.
+type firewallDefinitions struct {
+	ports  map[string][]string
+	cidrs  map[string][]string
+	hosts  map[string][]string
+	groups map[string][]string
+}
+
+func newFirewallDefinitionsFromConfig(c *config.C) (*firewallDefinitions, error) {
+	d := &firewallDefinitions{
+		ports:  map[string][]string{},
+		cidrs:  map[string][]string{},
+		hosts:  map[string][]string{},
+		groups: map[string][]string{},
+	}
+
+	r := c.Get("firewall.definitions")
+	if r == nil {
+		return d, nil
+	}
+
+	defs, ok := r.(map[string]any)
+	if !ok {
+		return nil, errors.New("firewall.definitions failed to parse, should be a map of definition types")
+	}
+
+	// Sorted so that errors are reported consistently
+	for _, kind := range sortedDefinitionKeys(defs) {
+		var target map[string][]string
+		var validate func(string) error
+
+		switch kind {
+		case "ports":
+			target = d.ports
+			validate = func(v string) error {
+				if _, _, err := parsePort(v); err != nil {
+					return fmt.Errorf("port %s", err)
+				}
+				return nil
+			}
+		case "cidrs":
+			target = d.cidrs
+			validate = func(v string) error {
+				if _, err := netip.ParsePrefix(v); err != nil {
+					return fmt.Errorf("cidr did not parse; %s", err)
+				}
+				return nil
+			}
+		case "hosts":
+			target = d.hosts
+		case "groups":
+			target = d.groups
+		default:
+			return nil, fmt.Errorf("firewall.definitions.%s is not a known definition type, expected ports, cidrs, hosts, or groups", kind)
+		}
+
+		named, ok := defs[kind].(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("firewall.definitions.%s failed to parse, should be a map of names to values", kind)
+		}
+
+		for _, name := range sortedDefinitionKeys(named) {
+			key := "firewall.definitions." + kind + "." + name
+
+			var values []string
+			switch v := named[name].(type) {
+			case []any:
+				for _, iv := range v {
+					values = append(values, fmt.Sprintf("%v", iv))
+				}
+			default:
+				values = []string{fmt.Sprintf("%v", v)}
+			}
+
+			if len(values) == 0 {
+				return nil, fmt.Errorf("%s must contain at least one value", key)
+			}
+
+			for _, v := range values {
+				if v == "" {
+					return nil, fmt.Errorf("%s contains an empty value", key)
+				}
+
+				if strings.HasPrefix(v, "$") {
+					return nil, fmt.Errorf("%s can not reference another definition; `%s`", key, v)
+				}
+
+				if validate != nil {
+					if err := validate(v); err != nil {
+						return nil, fmt.Errorf("%s; %s", key, err)
+					}
+				}
+			}
+
+			target[name] = values
+		}
+	}
+
+	return d, nil
+}
+
+// expand replaces definition references in the rule with their values, returning every combination as a rule
+func (d *firewallDefinitions) expand(r rule) ([]rule, error) {
+	rules := []rule{r}
+
+	var err error
+	expand := func(field string, defs map[string][]string, get func(*rule) *string) {
+		if err == nil {
+			rules, err = expandDefinition(rules, field, defs, get)
+		}
+	}
+
+	expand("port", d.ports, func(r *rule) *string { return &r.Port })
+	expand("cidr", d.cidrs, func(r *rule) *string { return &r.Cidr })
+	expand("local_cidr", d.cidrs, func(r *rule) *string { return &r.LocalCidr })
+	expand("host", d.hosts, func(r *rule) *string { return &r.Host })
+	if err != nil {
+		return nil, err
+	}
+
+	// A rule per value would allow any one of the groups while groups requires all of them, only groups may reference
+	// a definition so it always means the same thing
+	if strings.HasPrefix(r.Group, "$") {
+		return nil, fmt.Errorf("group can not reference a definition, use groups to require every group in it; `%s`", r.Group)
+	}
+
+	// groups are AND'd together, splitting them into a rule per value would allow any one of them instead
+	for i := range rules {
+		rules[i].Groups, err = d.expandGroups(rules[i].Groups)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return rules, nil
+}
+
+// expandGroups replaces references in a groups list with every value of the definition
+func (d *firewallDefinitions) expandGroups(groups []string) ([]string, error) {
+	var out []string
+	for _, g := range groups {
+		name, ok := strings.CutPrefix(g, "$")
+		if !ok {
+			out = append(out, g)
+			continue
+		}
+
+		values, ok := d.groups[name]
+		if !ok {
+			return nil, fmt.Errorf("groups references an unknown definition; `$%s`", name)
+		}
+		out = append(out, values...)
+	}
+
+	return out, nil
+}
+
+func expandDefinition(rules []rule, field string, defs map[string][]string, get func(*rule) *string) ([]rule, error) {
+	var out []rule
+	for _, r := range rules {
+		name, ok := strings.CutPrefix(*get(&r), "$")
+		if !ok {
+			out = append(out, r)
+			continue
+		}
+
+		values, ok := defs[name]
+		if !ok {
+			return nil, fmt.Errorf("%s references an unknown definition; `$%s`", field, name)
+		}
+
+		for _, v := range values {
+			nr := r
+			nr.Groups = slices.Clone(r.Groups)
+			*get(&nr) = v
+			out = append(out, nr)
+		}
+	}
+
+	return out, nil
+}
+
+// sortedDefinitionKeys returns the keys of a definitions map in order
+func sortedDefinitionKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,162 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFirewallDefinitionsFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	tests := []struct {
+		defs any
+		err  string
+	}{
+		{
+			defs: "nope",
+			err:  "firewall.definitions failed to parse, should be a map of definition types",
+		},
+		{
+			defs: map[string]any{"protos": map[string]any{"a": "tcp"}},
+			err:  "firewall.definitions.protos is not a known definition type, expected ports, cidrs, hosts, or groups",
+		},
+		{
+			defs: map[string]any{"ports": []any{80}},
+			err:  "firewall.definitions.ports failed to parse, should be a map of names to values",
+		},
+		{
+			defs: map[string]any{"ports": map[string]any{"web": []any{80, "http"}}},
+			err:  "firewall.definitions.ports.web; port was not a number; `http`",
+		},
+		{
+			defs: map[string]any{"cidrs": map[string]any{"office": []any{"10.0.0.0/33"}}},
+			err:  "firewall.definitions.cidrs.office; cidr did not parse; netip.ParsePrefix(\"10.0.0.0/33\"): prefix length out of range",
+		},
+		{
+			defs: map[string]any{"groups": map[string]any{"ops": []any{}}},
+			err:  "firewall.definitions.groups.ops must contain at least one value",
+		},
+		{
+			defs: map[string]any{"hosts": map[string]any{"all": []any{"$bastions"}}},
+			err:  "firewall.definitions.hosts.all can not reference another definition; `$bastions`",
+		},
+	}
+
+	for _, tt := range tests {
+		c := config.NewC(l)
+		c.Settings["firewall"] = map[string]any{"definitions": tt.defs}
+		_, err := newFirewallDefinitionsFromConfig(c)
+		require.EqualError(t, err, tt.err)
+	}
+
+	c := config.NewC(l)
+	c.Settings["firewall"] = map[string]any{"definitions": map[string]any{
+		"ports":  map[string]any{"web": []any{80, 443, "8000-8080"}, "ssh": 22},
+		"cidrs":  map[string]any{"office": []any{"10.0.0.0/8", "fd00::/8"}},
+		"hosts":  map[string]any{"bastions": []any{"b1", "b2"}},
+		"groups": map[string]any{"ops": []any{"sre", "oncall"}},
+	}}
+	d, err := newFirewallDefinitionsFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"80", "443", "8000-8080"}, d.ports["web"])
+	assert.Equal(t, []string{"22"}, d.ports["ssh"])
+	assert.Equal(t, []string{"10.0.0.0/8", "fd00::/8"}, d.cidrs["office"])
+	assert.Equal(t, []string{"b1", "b2"}, d.hosts["bastions"])
+	assert.Equal(t, []string{"sre", "oncall"}, d.groups["ops"])
+}
+
+func TestAddFirewallRulesFromConfig_definitions(t *testing.T) {
+	l := test.NewLogger()
+	defs := map[string]any{
+		"ports":  map[string]any{"web": []any{80, 443}},
+		"cidrs":  map[string]any{"office": []any{"10.0.0.0/8", "fd00::/8"}},
+		"groups": map[string]any{"ops": []any{"sre", "oncall"}},
+	}
+
+	conf := config.NewC(l)
+	mf := &mockFirewall{}
+	conf.Settings["firewall"] = map[string]any{
+		"definitions": defs,
+		"inbound": []any{
+			map[string]any{"port": "$web", "proto": "tcp", "cidr": "$office"},
+			map[string]any{"port": "22", "proto": "tcp", "groups": []any{"$ops", "laptop"}},
+		},
+	}
+	require.NoError(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+
+	office4 := netip.MustParsePrefix("10.0.0.0/8")
+	office6 := netip.MustParsePrefix("fd00::/8")
+	assert.Equal(t, []addRuleCall{
+		{incoming: true, proto: firewall.ProtoTCP, startPort: 80, endPort: 80, ip: office4},
+		{incoming: true, proto: firewall.ProtoTCP, startPort: 80, endPort: 80, ip: office6},
+		{incoming: true, proto: firewall.ProtoTCP, startPort: 443, endPort: 443, ip: office4},
+		{incoming: true, proto: firewall.ProtoTCP, startPort: 443, endPort: 443, ip: office6},
+		{incoming: true, proto: firewall.ProtoTCP, startPort: 22, endPort: 22, groups: []string{"sre", "oncall", "laptop"}},
+	}, mf.calls)
+
+	// Only groups can reference a group definition
+	conf = config.NewC(l)
+	conf.Settings["firewall"] = map[string]any{
+		"definitions": defs,
+		"inbound":     []any{map[string]any{"port": "any", "proto": "any", "group": "$ops"}},
+	}
+	require.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, &mockFirewall{}), "firewall.inbound rule #0; group can not reference a definition, use groups to require every group in it; `$ops`")
+
+	// Unknown references are an error
+	conf = config.NewC(l)
+	conf.Settings["firewall"] = map[string]any{
+		"definitions": defs,
+		"outbound":    []any{map[string]any{"port": "any", "proto": "any", "host": "$bastions"}},
+	}
+	require.EqualError(t, AddFirewallRulesFromConfig(l, false, conf, &mockFirewall{}), "firewall.outbound rule #0; host references an unknown definition; `$bastions`")
+
+	conf.Settings["firewall"] = map[string]any{
+		"definitions": defs,
+		"outbound":    []any{map[string]any{"port": "any", "proto": "any", "groups": []any{"laptop", "$admins"}}},
+	}
+	require.EqualError(t, AddFirewallRulesFromConfig(l, false, conf, &mockFirewall{}), "firewall.outbound rule #0; groups references an unknown definition; `$admins`")
+}
+
+func TestFirewall_definitionGroupsAreAnded(t *testing.T) {
+	l := test.NewLogger()
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[string]any{
+		"definitions": map[string]any{"groups": map[string]any{"ops": []any{"sre", "oncall"}}},
+		"inbound":     []any{map[string]any{"port": "any", "proto": "any", "groups": []any{"$ops", "laptop"}}},
+	}
+	cs, err := newCertState(cert.Version2, nil, &dummyCert{networks: []netip.Prefix{netip.MustParsePrefix("10.0.0.1/24")}}, false, cert.Curve_CURVE25519, nil)
+	require.NoError(t, err)
+	fw, err := NewFirewallFromConfig(l, cs, conf)
+	require.NoError(t, err)
+
+	p := firewall.Packet{
+		LocalAddr:  netip.MustParseAddr("10.0.0.1"),
+		RemoteAddr: netip.MustParseAddr("10.0.0.2"),
+		LocalPort:  22,
+		RemotePort: 4000,
+		Protocol:   firewall.ProtoTCP,
+	}
+	peer := func(groups ...string) *HostInfo {
+		inverted := map[string]struct{}{}
+		for _, g := range groups {
+			inverted[g] = struct{}{}
+		}
+		c := &dummyCert{name: "peer", networks: []netip.Prefix{netip.MustParsePrefix("10.0.0.2/24")}, groups: groups}
+		h := &HostInfo{
+			ConnectionState: &ConnectionState{peerCert: &cert.CachedCertificate{Certificate: c, InvertedGroups: inverted}},
+			vpnAddrs:        []netip.Addr{p.RemoteAddr},
+		}
+		h.buildNetworks(c.Networks(), c.UnsafeNetworks())
+		return h
+	}
+
+	// Only one of the groups from the definition is not enough
+	assert.ErrorIs(t, fw.Drop(p, true, peer("sre", "laptop"), cert.NewCAPool(), nil), ErrNoMatchingRule)
+	assert.NoError(t, fw.Drop(p, true, peer("sre", "oncall", "laptop"), cert.NewCAPool(), nil))
+}
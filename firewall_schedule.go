@@ -0,0 +1,273 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const minutesPerDay = 24 * 60
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+// firewallSchedule limits when a firewall rule matches. A rule with a schedule only matches while the schedule is active,
+// connections it allowed are checked against the rules again once the window they were allowed in closes.
+type firewallSchedule struct {
+	// window is true when days or a time of day were provided
+	window bool
+	days   [7]bool
+	// start and end are minutes since midnight, end is exclusive. A window with end before start runs past midnight and
+	// belongs to the day it started on.
+	start int
+	end   int
+	loc   *time.Location
+
+	notBefore time.Time
+	notAfter  time.Time
+}
+
+// newFirewallScheduleFromConfig parses the `schedule` key of a firewall rule
+func newFirewallScheduleFromConfig(v any) (*firewallSchedule, error) {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, errors.New("schedule should be a map")
+	}
+
+	s := &firewallSchedule{end: minutesPerDay, loc: time.Local}
+	var err error
+
+	for k := range m {
+		switch k {
+		case "days", "start", "end", "timezone", "not_before", "not_after":
+		default:
+			return nil, fmt.Errorf("schedule.%s is not a known schedule option", k)
+		}
+	}
+
+	if d, ok := m["days"]; ok {
+		var days []any
+		switch dv := d.(type) {
+		case []any:
+			days = dv
+		default:
+			days = []any{dv}
+		}
+
+		if len(days) == 0 {
+			return nil, errors.New("schedule.days must contain at least one day")
+		}
+
+		for _, day := range days {
+			wd, ok := weekdayNames[strings.ToLower(fmt.Sprintf("%v", day))]
+			if !ok {
+				return nil, fmt.Errorf("schedule.days contained an unknown day; `%v`", day)
+			}
+			s.days[wd] = true
+		}
+		s.window = true
+
+	} else {
+		s.days = [7]bool{true, true, true, true, true, true, true}
+	}
+
+	if v, ok := m["start"]; ok {
+		s.start, err = parseTimeOfDay(fmt.Sprintf("%v", v))
+		if err != nil || s.start == minutesPerDay {
+			return nil, fmt.Errorf("schedule.start was not a time of day between 00:00 and 23:59; `%v`", v)
+		}
+		s.window = true
+	}
+
+	if v, ok := m["end"]; ok {
+		s.end, err = parseTimeOfDay(fmt.Sprintf("%v", v))
+		if err != nil {
+			return nil, fmt.Errorf("schedule.end was not a time of day between 00:00 and 24:00; `%v`", v)
+		}
+		s.window = true
+	}
+
+	if s.start == s.end {
+		return nil, errors.New("schedule.start and schedule.end can not be the same")
+	}
+
+	if v, ok := m["timezone"]; ok {
+		s.loc, err = time.LoadLocation(fmt.Sprintf("%v", v))
+		if err != nil {
+			return nil, fmt.Errorf("schedule.timezone was not understood; %s", err)
+		}
+	}
+
+	s.notBefore, err = parseScheduleTimestamp(m, "not_before")
+	if err != nil {
+		return nil, err
+	}
+
+	s.notAfter, err = parseScheduleTimestamp(m, "not_after")
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.notBefore.IsZero() && !s.notAfter.IsZero() && !s.notBefore.Before(s.notAfter) {
+		return nil, errors.New("schedule.not_before must be before schedule.not_after")
+	}
+
+	if !s.window && s.notBefore.IsZero() && s.notAfter.IsZero() {
+		return nil, errors.New("schedule must have at least one of days, start, end, not_before, or not_after")
+	}
+
+	return s, nil
+}
+
+// parseTimeOfDay parses `HH:MM` into minutes since midnight, `24:00` is allowed to mean the end of the day
+func parseTimeOfDay(s string) (int, error) {
+	hs, ms, ok := strings.Cut(s, ":")
+	if !ok || len(ms) != 2 {
+		return 0, errors.New("expected HH:MM")
+	}
+
+	h, err := strconv.Atoi(hs)
+	if err != nil {
+		return 0, err
+	}
+
+	m, err := strconv.Atoi(ms)
+	if err != nil {
+		return 0, err
+	}
+
+	if h < 0 || m < 0 || m > 59 || h*60+m > minutesPerDay {
+		return 0, errors.New("out of range")
+	}
+
+	return h*60 + m, nil
+}
+
+func parseScheduleTimestamp(m map[string]any, k string) (time.Time, error) {
+	v, ok := m[k]
+	if !ok {
+		return time.Time{}, nil
+	}
+
+	// yaml will have already decoded unquoted timestamps
+	if t, ok := v.(time.Time); ok {
+		return t, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, fmt.Sprintf("%v", v))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("schedule.%s was not an RFC3339 timestamp; `%v`", k, v)
+	}
+
+	return t, nil
+}
+
+// active returns true if the schedule allows the rule to match at t
+func (s *firewallSchedule) active(t time.Time) bool {
+	if !s.notBefore.IsZero() && t.Before(s.notBefore) {
+		return false
+	}
+
+	if !s.notAfter.IsZero() && !t.Before(s.notAfter) {
+		return false
+	}
+
+	if !s.window {
+		return true
+	}
+
+	lt := t.In(s.loc)
+	m := lt.Hour()*60 + lt.Minute()
+	wd := lt.Weekday()
+
+	if s.start < s.end {
+		return s.days[wd] && m >= s.start && m < s.end
+	}
+
+	// The window runs past midnight
+	return (s.days[wd] && m >= s.start) || (s.days[(wd+6)%7] && m < s.end)
+}
+
+// closes returns when the window that is active at t ends, a zero time means it never does.
+// The result is only meaningful if the schedule is active at t.
+func (s *firewallSchedule) closes(t time.Time) time.Time {
+	var end time.Time
+
+	if s.window {
+		lt := t.In(s.loc)
+		y, mo, d := lt.Date()
+		if s.start > s.end && lt.Hour()*60+lt.Minute() >= s.start {
+			// The window runs past midnight and ends tomorrow
+			d++
+		}
+		end = time.Date(y, mo, d, s.end/60, s.end%60, 0, 0, s.loc)
+	}
+
+	if !s.notAfter.IsZero() && (end.IsZero() || s.notAfter.Before(end)) {
+		end = s.notAfter
+	}
+
+	return end
+}
+
+// opens returns the first time after t that the schedule goes from inactive to active, a zero time means it never does
+func (s *firewallSchedule) opens(t time.Time) time.Time {
+	from := t
+	if !s.notBefore.IsZero() && s.notBefore.After(t) {
+		if s.active(s.notBefore) {
+			return s.notBefore
+		}
+		from = s.notBefore
+	}
+
+	if !s.window {
+		return time.Time{}
+	}
+
+	// Every day of the week is looked at once, an active day whose window continues from the day before is not an opening
+	lt := from.In(s.loc)
+	y, mo, d := lt.Date()
+	for i := 0; i <= 7; i++ {
+		start := time.Date(y, mo, d+i, s.start/60, s.start%60, 0, 0, s.loc)
+		if start.After(from) && s.active(start) && !s.active(start.Add(-time.Nanosecond)) {
+			return start
+		}
+	}
+
+	return time.Time{}
+}
+
+func (s *firewallSchedule) String() string {
+	var parts []string
+
+	if s.window {
+		var days []string
+		for wd, ok := range s.days {
+			if ok {
+				days = append(days, strings.ToLower(time.Weekday(wd).String()[:3]))
+			}
+		}
+
+		parts = append(parts, fmt.Sprintf("days: %s, time: %02d:%02d-%02d:%02d %s",
+			strings.Join(days, ","), s.start/60, s.start%60, s.end/60, s.end%60, s.loc))
+	}
+
+	if !s.notBefore.IsZero() {
+		parts = append(parts, "not_before: "+s.notBefore.Format(time.RFC3339))
+	}
+
+	if !s.notAfter.IsZero() {
+		parts = append(parts, "not_after: "+s.notAfter.Format(time.RFC3339))
+	}
+
+	return strings.Join(parts, ", ")
+}
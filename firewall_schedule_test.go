@@ -0,0 +1,157 @@
+package nebula
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFirewallScheduleFromConfig(t *testing.T) {
+	tests := []struct {
+		schedule map[string]any
+		err      string
+	}{
+		{map[string]any{}, "schedule must have at least one of days, start, end, not_before, or not_after"},
+		{map[string]any{"day": "mon"}, "schedule.day is not a known schedule option"},
+		{map[string]any{"days": []any{}}, "schedule.days must contain at least one day"},
+		{map[string]any{"days": []any{"mon", "funday"}}, "schedule.days contained an unknown day; `funday`"},
+		{map[string]any{"start": "9"}, "schedule.start was not a time of day between 00:00 and 23:59; `9`"},
+		{map[string]any{"start": "24:00"}, "schedule.start was not a time of day between 00:00 and 23:59; `24:00`"},
+		{map[string]any{"end": "12:60"}, "schedule.end was not a time of day between 00:00 and 24:00; `12:60`"},
+		{map[string]any{"start": "10:00", "end": "10:00"}, "schedule.start and schedule.end can not be the same"},
+		{map[string]any{"days": "mon", "timezone": "Mars/Olympus"}, "schedule.timezone was not understood; unknown time zone Mars/Olympus"},
+		{map[string]any{"not_after": "tomorrow"}, "schedule.not_after was not an RFC3339 timestamp; `tomorrow`"},
+		{map[string]any{"not_before": "2026-01-02T00:00:00Z", "not_after": "2026-01-01T00:00:00Z"}, "schedule.not_before must be before schedule.not_after"},
+	}
+
+	for _, tt := range tests {
+		_, err := newFirewallScheduleFromConfig(tt.schedule)
+		require.EqualError(t, err, tt.err)
+	}
+
+	s, err := newFirewallScheduleFromConfig(map[string]any{
+		"days":       []any{"Monday", "fri"},
+		"start":      "22:00",
+		"end":        "06:30",
+		"timezone":   "UTC",
+		"not_before": time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		"not_after":  "2026-07-01T00:00:00Z",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "days: mon,fri, time: 22:00-06:30 UTC, not_before: 2026-01-01T00:00:00Z, not_after: 2026-07-01T00:00:00Z", s.String())
+}
+
+func TestFirewallSchedule_active(t *testing.T) {
+	business, err := newFirewallScheduleFromConfig(map[string]any{
+		"days":     []any{"mon", "tue", "wed", "thu", "fri"},
+		"start":    "09:00",
+		"end":      "17:00",
+		"timezone": "UTC",
+	})
+	require.NoError(t, err)
+
+	// 2026-03-02 is a monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 3, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	assert.False(t, business.active(at(2, 8, 59)))
+	assert.True(t, business.active(at(2, 9, 0)))
+	assert.True(t, business.active(at(2, 16, 59)))
+	assert.False(t, business.active(at(2, 17, 0)))
+	assert.False(t, business.active(at(7, 12, 0)))
+	assert.Equal(t, at(2, 17, 0), business.closes(at(2, 12, 0)))
+
+	// Timezones are honored
+	assert.True(t, business.active(time.Date(2026, 3, 2, 4, 0, 0, 0, time.FixedZone("test", -5*60*60))))
+
+	// An overnight window belongs to the day it starts on
+	overnight, err := newFirewallScheduleFromConfig(map[string]any{
+		"days":     "fri",
+		"start":    "22:00",
+		"end":      "02:00",
+		"timezone": "UTC",
+	})
+	require.NoError(t, err)
+
+	assert.False(t, overnight.active(at(6, 1, 0)))
+	assert.True(t, overnight.active(at(6, 23, 0)))
+	assert.True(t, overnight.active(at(7, 1, 59)))
+	assert.False(t, overnight.active(at(7, 2, 0)))
+	assert.False(t, overnight.active(at(7, 23, 0)))
+	assert.Equal(t, at(7, 2, 0), overnight.closes(at(6, 23, 0)))
+	assert.Equal(t, at(7, 2, 0), overnight.closes(at(7, 1, 0)))
+
+	// Whole days end at midnight
+	weekend, err := newFirewallScheduleFromConfig(map[string]any{"days": []any{"sat", "sun"}, "timezone": "UTC"})
+	require.NoError(t, err)
+	assert.True(t, weekend.active(at(7, 0, 0)))
+	assert.True(t, weekend.active(at(8, 23, 59)))
+	assert.False(t, weekend.active(at(9, 0, 0)))
+	assert.Equal(t, at(8, 0, 0), weekend.closes(at(7, 12, 0)))
+
+	// not_before and not_after bound the schedule, the earliest end wins
+	bounded, err := newFirewallScheduleFromConfig(map[string]any{
+		"start":      "09:00",
+		"end":        "17:00",
+		"timezone":   "UTC",
+		"not_before": "2026-03-02T10:00:00Z",
+		"not_after":  "2026-03-03T12:00:00Z",
+	})
+	require.NoError(t, err)
+	assert.False(t, bounded.active(at(2, 9, 30)))
+	assert.True(t, bounded.active(at(2, 10, 0)))
+	assert.Equal(t, at(2, 17, 0), bounded.closes(at(2, 10, 0)))
+	assert.Equal(t, at(3, 12, 0), bounded.closes(at(3, 10, 0)))
+	assert.False(t, bounded.active(at(3, 12, 0)))
+
+	// Without a window only not_after ends the schedule
+	until, err := newFirewallScheduleFromConfig(map[string]any{"not_before": "2026-03-02T10:00:00Z"})
+	require.NoError(t, err)
+	assert.True(t, until.active(at(9, 0, 0)))
+	assert.True(t, until.closes(at(9, 0, 0)).IsZero())
+}
+
+func TestFirewallSchedule_opens(t *testing.T) {
+	// 2026-03-02 is a monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 3, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	business, err := newFirewallScheduleFromConfig(map[string]any{
+		"days":     []any{"mon", "tue", "wed", "thu", "fri"},
+		"start":    "09:00",
+		"end":      "17:00",
+		"timezone": "UTC",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, at(2, 9, 0), business.opens(at(2, 8, 0)))
+	assert.Equal(t, at(3, 9, 0), business.opens(at(2, 9, 0)), "an open window opens again the next day")
+	assert.Equal(t, at(9, 9, 0), business.opens(at(6, 18, 0)), "the weekend is skipped")
+
+	// Consecutive whole days are a single opening
+	weekend, err := newFirewallScheduleFromConfig(map[string]any{"days": []any{"sat", "sun"}, "timezone": "UTC"})
+	require.NoError(t, err)
+	assert.Equal(t, at(14, 0, 0), weekend.opens(at(7, 12, 0)))
+
+	// not_before delays the first opening, which may be in the middle of a window
+	bounded, err := newFirewallScheduleFromConfig(map[string]any{
+		"start":      "09:00",
+		"end":        "17:00",
+		"timezone":   "UTC",
+		"not_before": "2026-03-02T10:00:00Z",
+		"not_after":  "2026-03-03T12:00:00Z",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, at(2, 10, 0), bounded.opens(at(1, 0, 0)))
+	assert.Equal(t, at(3, 9, 0), bounded.opens(at(2, 12, 0)))
+	assert.True(t, bounded.opens(at(3, 10, 0)).IsZero(), "not_after comes before the next window")
+
+	// Without a window only not_before opens the schedule
+	until, err := newFirewallScheduleFromConfig(map[string]any{"not_before": "2026-03-02T10:00:00Z"})
+	require.NoError(t, err)
+	assert.Equal(t, at(2, 10, 0), until.opens(at(1, 0, 0)))
+	assert.True(t, until.opens(at(3, 0, 0)).IsZero())
+}
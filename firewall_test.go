@@ -304,12 +304,12 @@ func BenchmarkFirewallTable_match(b *testing.B) {
 	}
 
 	pfix := netip.MustParsePrefix("172.1.1.1/32")
-	_ = ft.TCP.addRule(f, 10, 10, []string{"good-group"}, "good-host", pfix, netip.Prefix{}, "", "")
-	_ = ft.TCP.addRule(f, 100, 100, []string{"good-group"}, "good-host", netip.Prefix{}, pfix, "", "")
+	_ = ft.TCP.addRule(f, 10, 10, []string{"good-group"}, "good-host", pfix, netip.Prefix{}, "", "", nil)
+	_ = ft.TCP.addRule(f, 100, 100, []string{"good-group"}, "good-host", netip.Prefix{}, pfix, "", "", nil)
 
 	pfix6 := netip.MustParsePrefix("fd11::11/128")
-	_ = ft.TCP.addRule(f, 10, 10, []string{"good-group"}, "good-host", pfix6, netip.Prefix{}, "", "")
-	_ = ft.TCP.addRule(f, 100, 100, []string{"good-group"}, "good-host", netip.Prefix{}, pfix6, "", "")
+	_ = ft.TCP.addRule(f, 10, 10, []string{"good-group"}, "good-host", pfix6, netip.Prefix{}, "", "", nil)
+	_ = ft.TCP.addRule(f, 100, 100, []string{"good-group"}, "good-host", netip.Prefix{}, pfix6, "", "", nil)
 	cp := cert.NewCAPool()
 
 	b.Run("fail on proto", func(b *testing.B) {
@@ -692,6 +692,261 @@ func TestFirewall_DropConntrackReload(t *testing.T) {
 	assert.Equal(t, fw.Drop(p, false, &h, cp, nil), ErrNoMatchingRule)
 }
 
+func TestFirewall_DropDenyRule(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	p := firewall.Packet{
+		LocalAddr:  netip.MustParseAddr("1.2.3.4"),
+		RemoteAddr: netip.MustParseAddr("1.2.3.5"),
+		LocalPort:  10,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoUDP,
+		Fragment:   false,
+	}
+	network := netip.MustParsePrefix("1.2.3.4/24")
+
+	c := cert.CachedCertificate{
+		Certificate: &dummyCert{
+			name:     "host1",
+			networks: []netip.Prefix{netip.MustParsePrefix("1.2.3.5/24")},
+			groups:   []string{"default-group"},
+			issuer:   "signer-shasum",
+		},
+		InvertedGroups: map[string]struct{}{"default-group": {}},
+	}
+	h := HostInfo{
+		ConnectionState: &ConnectionState{
+			peerCert: &c,
+		},
+		vpnAddrs: []netip.Addr{p.RemoteAddr},
+	}
+	h.buildNetworks(c.Certificate.Networks(), c.Certificate.UnsafeNetworks())
+
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &dummyCert{networks: []netip.Prefix{network}})
+	require.NoError(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"any"}, "", netip.Prefix{}, netip.Prefix{}, "", ""))
+	require.NoError(t, fw.AddDenyRule(true, firewall.ProtoUDP, 10, 10, nil, "host1", netip.Prefix{}, netip.Prefix{}, "", ""))
+	fw.countRules = true
+	cp := cert.NewCAPool()
+
+	// The deny rule wins over the allow any rule
+	assert.Equal(t, ErrDeniedByRule, fw.drop(p, true, &h, cp, nil, 100))
+	p.LocalPort = 11
+	require.NoError(t, fw.drop(p, true, &h, cp, nil, 100))
+
+	rules := fw.ListRules()
+	require.Len(t, rules, 2)
+	assert.Equal(t, "allow", rules[0].Action)
+	assert.Equal(t, uint64(1), rules[0].Packets)
+	assert.Equal(t, "deny", rules[1].Action)
+	assert.Equal(t, uint64(1), rules[1].Packets)
+	assert.Equal(t, uint64(100), rules[1].Bytes)
+
+	// Deny rules hash differently than the same allow rule
+	fw2 := NewFirewall(l, time.Second, time.Minute, time.Hour, &dummyCert{networks: []netip.Prefix{network}})
+	require.NoError(t, fw2.AddRule(true, firewall.ProtoUDP, 10, 10, nil, "host1", netip.Prefix{}, netip.Prefix{}, "", ""))
+	assert.NotEqual(t, rules[1].ID, fw2.ListRules()[0].ID)
+
+	// Reloading with a deny rule tears down an existing flow
+	p.LocalPort = 12
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil))
+	require.NoError(t, fw.Drop(p, false, &h, cp, nil))
+
+	oldFw := fw
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &dummyCert{networks: []netip.Prefix{network}})
+	require.NoError(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, []string{"any"}, "", netip.Prefix{}, netip.Prefix{}, "", ""))
+	require.NoError(t, fw.AddDenyRule(true, firewall.ProtoUDP, 12, 12, nil, "host1", netip.Prefix{}, netip.Prefix{}, "", ""))
+	fw.Conntrack = oldFw.Conntrack
+	fw.rulesVersion = oldFw.rulesVersion + 1
+
+	// The outbound reply is no longer tracked and there is no outbound rule
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, false, &h, cp, nil))
+	fw.Conntrack.Lock()
+	_, ok := fw.Conntrack.Conns[p]
+	fw.Conntrack.Unlock()
+	assert.False(t, ok)
+}
+
+func TestFirewall_DropDenyRuleUnsafeNetworks(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	c := cert.CachedCertificate{
+		Certificate: &dummyCert{
+			name:     "host1",
+			networks: []netip.Prefix{netip.MustParsePrefix("1.2.3.5/24")},
+		},
+	}
+	h := HostInfo{
+		ConnectionState: &ConnectionState{
+			peerCert: &c,
+		},
+		vpnAddrs: []netip.Addr{netip.MustParseAddr("1.2.3.5")},
+	}
+	h.buildNetworks(c.Certificate.Networks(), c.Certificate.UnsafeNetworks())
+
+	// This host routes 198.51.100.0/24 for the overlay
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &dummyCert{
+		networks:       []netip.Prefix{netip.MustParsePrefix("1.2.3.4/24")},
+		unsafeNetworks: []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")},
+	})
+	require.NoError(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, nil, "any", netip.Prefix{}, netip.MustParsePrefix("0.0.0.0/0"), "", ""))
+	require.NoError(t, fw.AddDenyRule(true, firewall.ProtoTCP, 22, 22, nil, "host1", netip.Prefix{}, netip.Prefix{}, "", ""))
+	cp := cert.NewCAPool()
+
+	p := firewall.Packet{
+		LocalAddr:  netip.MustParseAddr("198.51.100.10"),
+		RemoteAddr: netip.MustParseAddr("1.2.3.5"),
+		LocalPort:  22,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoTCP,
+	}
+
+	// The deny rule applies to the unsafe network even though the allow rule had to name it
+	assert.Equal(t, ErrDeniedByRule, fw.Drop(p, true, &h, cp, nil))
+	p.LocalAddr = netip.MustParseAddr("1.2.3.4")
+	assert.Equal(t, ErrDeniedByRule, fw.Drop(p, true, &h, cp, nil))
+	p.LocalPort = 80
+	assert.NoError(t, fw.Drop(p, true, &h, cp, nil))
+}
+
+func TestFirewall_DropScheduled(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	p := firewall.Packet{
+		LocalAddr:  netip.MustParseAddr("1.2.3.4"),
+		RemoteAddr: netip.MustParseAddr("1.2.3.5"),
+		LocalPort:  10,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoUDP,
+		Fragment:   false,
+	}
+	network := netip.MustParsePrefix("1.2.3.4/24")
+
+	c := cert.CachedCertificate{
+		Certificate: &dummyCert{
+			name:     "host1",
+			networks: []netip.Prefix{netip.MustParsePrefix("1.2.3.5/24")},
+			groups:   []string{"default-group"},
+			issuer:   "signer-shasum",
+		},
+		InvertedGroups: map[string]struct{}{"default-group": {}},
+	}
+	h := HostInfo{
+		ConnectionState: &ConnectionState{
+			peerCert: &c,
+		},
+		vpnAddrs: []netip.Addr{p.RemoteAddr},
+	}
+	h.buildNetworks(c.Certificate.Networks(), c.Certificate.UnsafeNetworks())
+
+	now := time.Now()
+	open := &firewallSchedule{notBefore: now.Add(-time.Hour), notAfter: now.Add(time.Hour)}
+	closed := &firewallSchedule{notAfter: now.Add(-time.Hour)}
+
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &dummyCert{networks: []netip.Prefix{network}})
+	require.NoError(t, fw.AddScheduledRule(open, false, true, firewall.ProtoUDP, 10, 10, nil, "host1", netip.Prefix{}, netip.Prefix{}, "", ""))
+	require.NoError(t, fw.AddScheduledRule(closed, false, true, firewall.ProtoUDP, 11, 11, nil, "host1", netip.Prefix{}, netip.Prefix{}, "", ""))
+	require.NoError(t, fw.AddScheduledRule(closed, true, true, firewall.ProtoUDP, 10, 10, nil, "any", netip.Prefix{}, netip.Prefix{}, "", ""))
+	cp := cert.NewCAPool()
+
+	// Only the rule with an active schedule matches
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil))
+	p.LocalPort = 11
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, true, &h, cp, nil))
+	assert.Contains(t, fw.ListRules()[0].Rule, ", schedule: not_before: ")
+
+	// The conntrack entry remembers when the window closes
+	p.LocalPort = 10
+	fw.Conntrack.Lock()
+	ct := fw.Conntrack.Conns[p]
+	fw.Conntrack.Unlock()
+	require.NotNil(t, ct)
+	assert.Equal(t, open.notAfter.UnixNano(), ct.windowEnd)
+
+	// Allow outbound because conntrack
+	require.NoError(t, fw.Drop(p, false, &h, cp, nil))
+
+	// Once the window closes the entry is checked again and removed
+	open.notAfter = now.Add(-time.Minute)
+	fw.Conntrack.Lock()
+	ct.windowEnd = open.notAfter.UnixNano()
+	fw.Conntrack.Unlock()
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, false, &h, cp, nil))
+	fw.Conntrack.Lock()
+	_, ok := fw.Conntrack.Conns[p]
+	fw.Conntrack.Unlock()
+	assert.False(t, ok)
+
+	// A routine's cached entry does not outlive the window either
+	open.notAfter = now.Add(time.Hour)
+	localCache := firewall.ConntrackCache{}
+	require.NoError(t, fw.Drop(p, true, &h, cp, localCache))
+	require.NoError(t, fw.Drop(p, true, &h, cp, localCache))
+	assert.Equal(t, open.notAfter.UnixNano(), localCache[p].WindowEnd)
+
+	open.notAfter = now.Add(-time.Minute)
+	fw.Conntrack.Lock()
+	fw.Conntrack.Conns[p].windowEnd = open.notAfter.UnixNano()
+	fw.Conntrack.Unlock()
+	localCache[p] = firewall.ConntrackCacheEntry{WindowEnd: open.notAfter.UnixNano()}
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(p, true, &h, cp, localCache))
+}
+
+func TestFirewall_DropScheduledDeny(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	p := firewall.Packet{
+		LocalAddr:  netip.MustParseAddr("1.2.3.4"),
+		RemoteAddr: netip.MustParseAddr("1.2.3.5"),
+		LocalPort:  10,
+		RemotePort: 90,
+		Protocol:   firewall.ProtoUDP,
+	}
+	c := cert.CachedCertificate{
+		Certificate: &dummyCert{
+			name:     "host1",
+			networks: []netip.Prefix{netip.MustParsePrefix("1.2.3.5/24")},
+		},
+	}
+	h := HostInfo{
+		ConnectionState: &ConnectionState{
+			peerCert: &c,
+		},
+		vpnAddrs: []netip.Addr{p.RemoteAddr},
+	}
+	h.buildNetworks(c.Certificate.Networks(), c.Certificate.UnsafeNetworks())
+
+	now := time.Now()
+	later := &firewallSchedule{notBefore: now.Add(time.Hour)}
+
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &dummyCert{networks: []netip.Prefix{netip.MustParsePrefix("1.2.3.4/24")}})
+	require.NoError(t, fw.AddRule(true, firewall.ProtoUDP, 10, 10, nil, "host1", netip.Prefix{}, netip.Prefix{}, "", ""))
+	require.NoError(t, fw.AddScheduledRule(later, true, true, firewall.ProtoUDP, 10, 10, nil, "host1", netip.Prefix{}, netip.Prefix{}, "", ""))
+	cp := cert.NewCAPool()
+
+	// The deny rule is not active yet, the connection is checked again when it opens
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil))
+	fw.Conntrack.Lock()
+	ct := fw.Conntrack.Conns[p]
+	fw.Conntrack.Unlock()
+	require.NotNil(t, ct)
+	assert.Equal(t, later.notBefore.UnixNano(), ct.windowEnd)
+
+	// Once the deny rule opens the established connection is dropped
+	later.notBefore = now.Add(-time.Minute)
+	fw.Conntrack.Lock()
+	ct.windowEnd = later.notBefore.UnixNano()
+	fw.Conntrack.Unlock()
+	assert.Equal(t, ErrDeniedByRule, fw.Drop(p, true, &h, cp, nil))
+}
+
 func TestFirewall_DropIPSpoofing(t *testing.T) {
 	l := test.NewLogger()
 	ob := &bytes.Buffer{}
@@ -927,9 +1182,28 @@ func TestAddFirewallRulesFromConfig(t *testing.T) {
 	// Test adding icmp rule
 	conf = config.NewC(l)
 	mf = &mockFirewall{}
-	conf.Settings["firewall"] = map[string]any{"outbound": []any{map[string]any{"port": "1", "proto": "icmp", "host": "a"}}}
+	conf.Settings["firewall"] = map[string]any{"outbound": []any{map[string]any{"port": "any", "proto": "icmp", "host": "a"}}}
+	require.NoError(t, AddFirewallRulesFromConfig(l, false, conf, mf))
+	assert.Equal(t, addRuleCall{incoming: false, proto: firewall.ProtoICMP, startPort: firewall.PortAny, endPort: firewall.PortAny, groups: nil, host: "a", ip: netip.Prefix{}, localIp: netip.Prefix{}}, mf.lastCall)
+
+	// Test adding icmp type and code rules
+	conf = config.NewC(l)
+	mf = &mockFirewall{}
+	conf.Settings["firewall"] = map[string]any{"outbound": []any{map[string]any{"type": "5", "code": "1", "proto": "icmp", "host": "a"}}}
 	require.NoError(t, AddFirewallRulesFromConfig(l, false, conf, mf))
-	assert.Equal(t, addRuleCall{incoming: false, proto: firewall.ProtoICMP, startPort: 1, endPort: 1, groups: nil, host: "a", ip: netip.Prefix{}, localIp: netip.Prefix{}}, mf.lastCall)
+	assert.Equal(t, addRuleCall{incoming: false, proto: firewall.ProtoICMP, startPort: firewall.ICMPPort(5, 1), endPort: firewall.ICMPPort(5, 1), groups: nil, host: "a", ip: netip.Prefix{}, localIp: netip.Prefix{}}, mf.lastCall)
+
+	conf = config.NewC(l)
+	mf = &mockFirewall{}
+	conf.Settings["firewall"] = map[string]any{"outbound": []any{map[string]any{"type": "packet-too-big", "proto": "icmpv6", "host": "a"}}}
+	require.NoError(t, AddFirewallRulesFromConfig(l, false, conf, mf))
+	assert.Equal(t, addRuleCall{incoming: false, proto: firewall.ProtoICMPv6, startPort: firewall.ICMPPort(2, 0), endPort: firewall.ICMPPort(2, 255), groups: nil, host: "a", ip: netip.Prefix{}, localIp: netip.Prefix{}}, mf.lastCall)
+
+	conf = config.NewC(l)
+	mf = &mockFirewall{}
+	conf.Settings["firewall"] = map[string]any{"outbound": []any{map[string]any{"type": "any", "proto": "icmpv6", "host": "a"}}}
+	require.NoError(t, AddFirewallRulesFromConfig(l, false, conf, mf))
+	assert.Equal(t, addRuleCall{incoming: false, proto: firewall.ProtoICMPv6, startPort: firewall.PortAny, endPort: firewall.PortAny, groups: nil, host: "a", ip: netip.Prefix{}, localIp: netip.Prefix{}}, mf.lastCall)
 
 	// Test adding any rule
 	conf = config.NewC(l)
@@ -1003,6 +1277,38 @@ func TestAddFirewallRulesFromConfig(t *testing.T) {
 	require.NoError(t, AddFirewallRulesFromConfig(l, true, conf, mf))
 	assert.Equal(t, addRuleCall{incoming: true, proto: firewall.ProtoAny, startPort: 1, endPort: 1, groups: []string{"a", "b"}, ip: netip.Prefix{}, localIp: netip.Prefix{}}, mf.lastCall)
 
+	// Test deny rules
+	conf = config.NewC(l)
+	mf = &mockFirewall{}
+	conf.Settings["firewall"] = map[string]any{"inbound": []any{map[string]any{"port": "1", "proto": "any", "host": "a", "action": "deny"}}}
+	require.NoError(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, addRuleCall{incoming: true, proto: firewall.ProtoAny, startPort: 1, endPort: 1, host: "a", deny: true}, mf.lastCall)
+
+	conf = config.NewC(l)
+	mf = &mockFirewall{}
+	conf.Settings["firewall"] = map[string]any{"inbound": []any{map[string]any{"port": "1", "proto": "any", "host": "a", "action": "allow"}}}
+	require.NoError(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, addRuleCall{incoming: true, proto: firewall.ProtoAny, startPort: 1, endPort: 1, host: "a"}, mf.lastCall)
+
+	conf = config.NewC(l)
+	mf = &mockFirewall{}
+	conf.Settings["firewall"] = map[string]any{"inbound": []any{map[string]any{"port": "1", "proto": "any", "host": "a", "action": "reject"}}}
+	require.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; action was not understood; `reject`, expected allow or deny")
+
+	// Test scheduled rules
+	conf = config.NewC(l)
+	mf = &mockFirewall{}
+	conf.Settings["firewall"] = map[string]any{"inbound": []any{map[string]any{"port": "1", "proto": "any", "host": "a", "action": "deny", "schedule": map[string]any{"days": []any{"sat", "sun"}}}}}
+	require.NoError(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	require.NotNil(t, mf.lastCall.schedule)
+	assert.Equal(t, "days: sun,sat, time: 00:00-24:00 Local", mf.lastCall.schedule.String())
+	assert.True(t, mf.lastCall.deny)
+
+	conf = config.NewC(l)
+	mf = &mockFirewall{}
+	conf.Settings["firewall"] = map[string]any{"inbound": []any{map[string]any{"port": "1", "proto": "any", "host": "a", "schedule": map[string]any{"days": "someday"}}}}
+	require.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; schedule.days contained an unknown day; `someday`")
+
 	// Test Add error
 	conf = config.NewC(l)
 	mf = &mockFirewall{}
@@ -1011,6 +1317,261 @@ func TestAddFirewallRulesFromConfig(t *testing.T) {
 	require.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; `test error`")
 }
 
+func TestAddFirewallRulesFromConfig_icmpErrors(t *testing.T) {
+	l := test.NewLogger()
+	tests := []struct {
+		rule map[string]any
+		err  string
+	}{
+		{
+			rule: map[string]any{"type": "8", "proto": "tcp", "host": "a"},
+			err:  "firewall.inbound rule #0; type is only valid with proto icmp or icmpv6",
+		},
+		{
+			rule: map[string]any{"type": "8", "port": "1", "proto": "icmp", "host": "a"},
+			err:  "firewall.inbound rule #0; port can not be used with type or code",
+		},
+		{
+			rule: map[string]any{"type": "any", "code": "1", "proto": "icmp", "host": "a"},
+			err:  "firewall.inbound rule #0; code can not be used with type any",
+		},
+		{
+			rule: map[string]any{"type": "8", "code": "256", "proto": "icmp", "host": "a"},
+			err:  "firewall.inbound rule #0; code was not a number between 0 and 255; `256`",
+		},
+		{
+			rule: map[string]any{"code": "3", "proto": "icmp", "host": "a"},
+			err:  "firewall.inbound rule #0; code can not be used without type on icmp rules",
+		},
+		{
+			rule: map[string]any{"code": "0", "proto": "icmpv6", "host": "a"},
+			err:  "firewall.inbound rule #0; code can not be used without type on icmp rules",
+		},
+		{
+			rule: map[string]any{"port": "80", "proto": "icmp", "host": "a"},
+			err:  "firewall.inbound rule #0; port must be any or fragment on icmp rules, use type and code to select icmp messages",
+		},
+		{
+			rule: map[string]any{"port": "1-10", "proto": "icmpv6", "host": "a"},
+			err:  "firewall.inbound rule #0; port must be any or fragment on icmp rules, use type and code to select icmp messages",
+		},
+		{
+			rule: map[string]any{"port": "any", "proto": "icmp", "host": "a"},
+			err:  "",
+		},
+		{
+			rule: map[string]any{"port": "fragment", "proto": "icmp", "host": "a"},
+			err:  "",
+		},
+		{
+			rule: map[string]any{"type": "neighbor-solicitation", "proto": "icmp", "host": "a"},
+			err:  "",
+		},
+		{
+			rule: map[string]any{"type": "source-quench", "proto": "icmpv6", "host": "a"},
+			err:  "firewall.inbound rule #0; type was not a number between 0 and 255 or a known icmpv6 type name; `source-quench`",
+		},
+	}
+
+	for _, tt := range tests {
+		conf := config.NewC(l)
+		conf.Settings["firewall"] = map[string]any{"inbound": []any{tt.rule}}
+		err := AddFirewallRulesFromConfig(l, true, conf, &mockFirewall{})
+		if tt.err == "" {
+			require.NoError(t, err)
+		} else {
+			require.EqualError(t, err, tt.err)
+		}
+	}
+}
+
+func TestFirewall_DropICMP(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	network := netip.MustParsePrefix("1.2.3.4/24")
+	c := cert.CachedCertificate{
+		Certificate: &dummyCert{
+			name:     "host1",
+			networks: []netip.Prefix{network},
+		},
+		InvertedGroups: map[string]struct{}{"default-group": {}},
+	}
+	h := HostInfo{
+		ConnectionState: &ConnectionState{
+			peerCert: &c,
+		},
+		vpnAddrs: []netip.Addr{network.Addr()},
+	}
+	h.buildNetworks(c.Certificate.Networks(), c.Certificate.UnsafeNetworks())
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[string]any{
+		"outbound": []any{map[string]any{"proto": "any", "port": "any", "host": "any"}},
+		"inbound": []any{
+			map[string]any{"proto": "icmp", "type": "echo-request", "host": "any"},
+			map[string]any{"proto": "icmp", "type": "destination-unreachable", "code": "4", "host": "any"},
+		},
+	}
+	cs, err := newCertState(cert.Version2, nil, &dummyCert{networks: []netip.Prefix{network}}, false, cert.Curve_CURVE25519, nil)
+	require.NoError(t, err)
+	fw, err := NewFirewallFromConfig(l, cs, conf)
+	require.NoError(t, err)
+	cp := cert.NewCAPool()
+
+	p := firewall.Packet{
+		LocalAddr:  netip.MustParseAddr("1.2.3.4"),
+		RemoteAddr: netip.MustParseAddr("1.2.3.4"),
+		Protocol:   firewall.ProtoICMP,
+		ICMPType:   firewall.ICMPEchoRequest,
+	}
+
+	// echo request is allowed
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil))
+
+	// redirect is not
+	p.ICMPType = 5
+	require.ErrorIs(t, fw.Drop(p, true, &h, cp, nil), ErrNoMatchingRule)
+
+	// only the selected code is allowed
+	p.ICMPType = 3
+	p.ICMPCode = 4
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil))
+	p.ICMPCode = 1
+	require.ErrorIs(t, fw.Drop(p, true, &h, cp, nil), ErrNoMatchingRule)
+
+	// echo-request applies to icmpv6 as well
+	p.Protocol = firewall.ProtoICMPv6
+	p.ICMPType = firewall.ICMPv6EchoRequest
+	p.ICMPCode = 0
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil))
+	p.ICMPType = 1
+	require.ErrorIs(t, fw.Drop(p, true, &h, cp, nil), ErrNoMatchingRule)
+
+	// an echo reply is allowed back in after we send an echo request
+	resetConntrack(fw)
+	p.Protocol = firewall.ProtoICMP
+	p.ICMPType = firewall.ICMPEchoReply
+	require.ErrorIs(t, fw.Drop(p, true, &h, cp, nil), ErrNoMatchingRule)
+	p.ICMPType = firewall.ICMPEchoRequest
+	require.NoError(t, fw.Drop(p, false, &h, cp, nil))
+	p.ICMPType = firewall.ICMPEchoReply
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil))
+}
+
+func TestFirewall_RuleStats(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	network := netip.MustParsePrefix("1.2.3.4/24")
+	c := cert.CachedCertificate{
+		Certificate: &dummyCert{
+			name:     "host1",
+			networks: []netip.Prefix{network},
+		},
+		InvertedGroups: map[string]struct{}{"default-group": {}},
+	}
+	h := HostInfo{
+		ConnectionState: &ConnectionState{
+			peerCert: &c,
+		},
+		vpnAddrs: []netip.Addr{network.Addr()},
+	}
+	h.buildNetworks(c.Certificate.Networks(), c.Certificate.UnsafeNetworks())
+	cp := cert.NewCAPool()
+
+	newFw := func() *Firewall {
+		fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c.Certificate)
+		require.NoError(t, fw.AddRule(true, firewall.ProtoTCP, 80, 80, []string{}, "any", netip.Prefix{}, netip.Prefix{}, "", ""))
+		require.NoError(t, fw.AddRule(true, firewall.ProtoTCP, 10, 100, []string{"default-group"}, "", netip.Prefix{}, netip.Prefix{}, "", ""))
+		require.NoError(t, fw.AddRule(false, firewall.ProtoICMP, firewall.ICMPPort(8, 0), firewall.ICMPPort(8, 255), nil, "", netip.MustParsePrefix("10.0.0.0/8"), netip.Prefix{}, "", ""))
+		fw.countRules = true
+		return fw
+	}
+	fw := newFw()
+
+	rules := fw.ListRules()
+	require.Len(t, rules, 3)
+	assert.Len(t, rules[0].ID, 12)
+	assert.Equal(t, "incoming", rules[0].Direction)
+	assert.Equal(t, "proto: tcp, port: 80, host: any", rules[0].Rule)
+	assert.Equal(t, "proto: tcp, port: 10-100, groups: [default-group]", rules[1].Rule)
+	assert.Equal(t, "outgoing", rules[2].Direction)
+	assert.Equal(t, "proto: icmp, type: 8, code: any, cidr: 10.0.0.0/8", rules[2].Rule)
+	assert.Nil(t, rules[0].LastMatch)
+
+	// Ids are stable
+	assert.Equal(t, rules[1].ID, newFw().ListRules()[1].ID)
+
+	// The first rule to match is credited, for the first packet and the conntrack hits after
+	p := firewall.Packet{
+		LocalAddr:  netip.MustParseAddr("1.2.3.4"),
+		RemoteAddr: netip.MustParseAddr("1.2.3.4"),
+		LocalPort:  80,
+		RemotePort: 4000,
+		Protocol:   firewall.ProtoTCP,
+	}
+	require.NoError(t, fw.drop(p, true, &h, cp, nil, 100))
+	require.NoError(t, fw.drop(p, true, &h, cp, nil, 50))
+
+	localCache := firewall.ConntrackCache{}
+	p.LocalPort = 90
+	require.NoError(t, fw.drop(p, true, &h, cp, localCache, 10))
+	require.NoError(t, fw.drop(p, true, &h, cp, localCache, 10))
+	require.NoError(t, fw.drop(p, true, &h, cp, localCache, 10))
+
+	p.LocalPort = 200
+	require.ErrorIs(t, fw.drop(p, true, &h, cp, nil, 10), ErrNoMatchingRule)
+
+	rules = fw.ListRules()
+	assert.Equal(t, uint64(2), rules[0].Packets)
+	assert.Equal(t, uint64(150), rules[0].Bytes)
+	assert.NotNil(t, rules[0].LastMatch)
+	assert.Equal(t, uint64(3), rules[1].Packets)
+	assert.Equal(t, uint64(30), rules[1].Bytes)
+	assert.Equal(t, uint64(0), rules[2].Packets)
+
+	// A reload keeps the counts of unchanged rules
+	fw2 := NewFirewall(l, time.Second, time.Minute, time.Hour, c.Certificate)
+	require.NoError(t, fw2.AddRule(true, firewall.ProtoTCP, 80, 80, []string{}, "any", netip.Prefix{}, netip.Prefix{}, "", ""))
+	fw2.countRules = true
+	fw2.inheritRuleStats(fw)
+
+	rules = fw2.ListRules()
+	require.Len(t, rules, 1)
+	assert.Equal(t, uint64(2), rules[0].Packets)
+	assert.Equal(t, uint64(150), rules[0].Bytes)
+
+	// Rules that end at the same place in the rule tree are all credited
+	fw3 := NewFirewall(l, time.Second, time.Minute, time.Hour, c.Certificate)
+	require.NoError(t, fw3.AddRule(true, firewall.ProtoTCP, 80, 80, []string{}, "any", netip.Prefix{}, netip.Prefix{}, "", ""))
+	require.NoError(t, fw3.AddRule(true, firewall.ProtoTCP, 1, 1000, []string{}, "any", netip.Prefix{}, netip.Prefix{}, "", ""))
+	require.NoError(t, fw3.AddRule(true, firewall.ProtoTCP, 1, 1000, []string{}, "", netip.Prefix{}, netip.MustParsePrefix("1.2.3.4/32"), "", ""))
+	require.NoError(t, fw3.AddRule(true, firewall.ProtoTCP, 80, 80, []string{}, "", netip.Prefix{}, netip.MustParsePrefix("1.2.3.4/32"), "", ""))
+	fw3.countRules = true
+	p.LocalPort = 80
+	require.NoError(t, fw3.drop(p, true, &h, cp, nil, 10))
+	p.LocalPort = 81
+	require.NoError(t, fw3.drop(p, true, &h, cp, nil, 10))
+	rules = fw3.ListRules()
+	assert.Equal(t, uint64(1), rules[0].Packets)
+	assert.Equal(t, uint64(2), rules[1].Packets)
+	assert.Equal(t, uint64(0), rules[2].Packets, "a host any rule is found before a local_cidr rule")
+	assert.Equal(t, uint64(0), rules[3].Packets)
+
+	// Without firewall.rule_stats rules are listed but nothing is counted, conntrack cache hits included
+	fw4 := newFw()
+	fw4.countRules = false
+	p.LocalPort = 80
+	require.NoError(t, fw4.drop(p, true, &h, cp, localCache, 10))
+	require.NoError(t, fw4.drop(p, true, &h, cp, localCache, 10))
+	for _, r := range fw4.ListRules() {
+		assert.Equal(t, uint64(0), r.Packets)
+	}
+}
+
 func TestFirewall_convertRule(t *testing.T) {
 	l := test.NewLogger()
 	ob := &bytes.Buffer{}
@@ -1045,6 +1606,26 @@ func TestFirewall_convertRule(t *testing.T) {
 	r, err = convertRule(l, c, "test", 1)
 	require.NoError(t, err)
 	assert.Equal(t, "group1", r.Group)
+	assert.Nil(t, r.Schedule)
+
+	// Make sure a schedule is parsed
+	c = map[string]any{
+		"group":    "group1",
+		"schedule": map[string]any{"start": "09:00", "end": "17:00", "timezone": "UTC"},
+	}
+
+	r, err = convertRule(l, c, "test", 1)
+	require.NoError(t, err)
+	require.NotNil(t, r.Schedule)
+	assert.Equal(t, "days: sun,mon,tue,wed,thu,fri,sat, time: 09:00-17:00 UTC", r.Schedule.String())
+
+	c = map[string]any{
+		"group":    "group1",
+		"schedule": "weekdays",
+	}
+
+	_, err = convertRule(l, c, "test", 1)
+	require.EqualError(t, err, "schedule should be a map")
 }
 
 type addRuleCall struct {
@@ -1058,14 +1639,32 @@ type addRuleCall struct {
 	localIp   netip.Prefix
 	caName    string
 	caSha     string
+	deny      bool
+	schedule  *firewallSchedule
 }
 
 type mockFirewall struct {
 	lastCall       addRuleCall
+	calls          []addRuleCall
 	nextCallReturn error
 }
 
 func (mf *mockFirewall) AddRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip netip.Prefix, localIp netip.Prefix, caName string, caSha string) error {
+	return mf.addRule(false, incoming, proto, startPort, endPort, groups, host, ip, localIp, caName, caSha)
+}
+
+func (mf *mockFirewall) AddDenyRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip netip.Prefix, localIp netip.Prefix, caName string, caSha string) error {
+	return mf.addRule(true, incoming, proto, startPort, endPort, groups, host, ip, localIp, caName, caSha)
+}
+
+func (mf *mockFirewall) AddScheduledRule(schedule *firewallSchedule, deny bool, incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip netip.Prefix, localIp netip.Prefix, caName string, caSha string) error {
+	err := mf.addRule(deny, incoming, proto, startPort, endPort, groups, host, ip, localIp, caName, caSha)
+	mf.lastCall.schedule = schedule
+	mf.calls[len(mf.calls)-1].schedule = schedule
+	return err
+}
+
+func (mf *mockFirewall) addRule(deny bool, incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip netip.Prefix, localIp netip.Prefix, caName string, caSha string) error {
 	mf.lastCall = addRuleCall{
 		incoming:  incoming,
 		proto:     proto,
@@ -1077,7 +1676,9 @@ func (mf *mockFirewall) AddRule(incoming bool, proto uint8, startPort int32, end
 		localIp:   localIp,
 		caName:    caName,
 		caSha:     caSha,
+		deny:      deny,
 	}
+	mf.calls = append(mf.calls, mf.lastCall)
 
 	err := mf.nextCallReturn
 	mf.nextCallReturn = nil
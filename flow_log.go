@@ -0,0 +1,350 @@
+package nebula
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+)
+
+// flowLogger holds the flow log for the life of the process. Each firewall built on reload is handed the same
+// flowLogger and the sink is only replaced when firewall.flow_log itself changes. A nil *flowLogger records nothing.
+type flowLogger struct {
+	current atomic.Pointer[flowLog]
+	l       *logrus.Logger
+}
+
+// flowLogQueueSize is how many events can wait for the writer before new ones are dropped
+const flowLogQueueSize = 1024
+
+// flowLog writes a json line for every firewall decision it is configured to record. Events are sampled and
+// rate limited so it is safe to leave enabled. A nil *flowLog records nothing.
+//
+// The routines that make firewall decisions only queue events, a single writer routine started by open writes them
+// out so a slow file or syslog never holds up packets. Events that do not fit in the queue are dropped and counted.
+type flowLog struct {
+	// running is set while the writer routine is taking events
+	running atomic.Bool
+	events  chan []byte
+	// stop ends the writer routine, which closes done once it has written what was queued and closed the sink
+	stop     chan struct{}
+	done     chan struct{}
+	closeErr error
+	closing  sync.Once
+
+	output    string
+	path      string
+	syslogTag string
+
+	accept bool
+	drop   bool
+
+	// sampleRate records 1 out of every sampleRate events
+	sampleRate uint64
+	seen       atomic.Uint64
+
+	// limit is guarded by limitLock, a nil limit does not rate limit
+	limitLock sync.Mutex
+	limit     *tokenBucket
+
+	written     metrics.Counter
+	rateLimited metrics.Counter
+	queueFull   metrics.Counter
+	errors      metrics.Counter
+
+	l *logrus.Logger
+}
+
+// flowLogEvent is the json line written for a firewall decision
+type flowLogEvent struct {
+	Time         time.Time       `json:"time"`
+	Decision     string          `json:"decision"`
+	Direction    string          `json:"direction"`
+	Reason       string          `json:"reason,omitempty"`
+	RuleID       string          `json:"ruleId,omitempty"`
+	Rule         string          `json:"rule,omitempty"`
+	Packet       firewall.Packet `json:"packet"`
+	PeerName     string          `json:"peerName,omitempty"`
+	PeerGroups   []string        `json:"peerGroups,omitempty"`
+	PeerVpnAddrs []netip.Addr    `json:"peerVpnAddrs,omitempty"`
+}
+
+func newFlowLoggerFromConfig(l *logrus.Logger, c *config.C) (*flowLogger, error) {
+	fl, err := newFlowLogFromConfig(l, c)
+	if err != nil {
+		return nil, err
+	}
+
+	flg := &flowLogger{l: l}
+	flg.current.Store(fl)
+	return flg, nil
+}
+
+// start opens the sink. Nothing is opened before this so a config test does not create files or connect to syslog.
+func (flg *flowLogger) start() error {
+	if flg == nil {
+		return nil
+	}
+
+	return flg.current.Load().open()
+}
+
+// reload replaces the sink when firewall.flow_log has changed, the previous sink is kept if the new one fails
+func (flg *flowLogger) reload(c *config.C) {
+	if !c.HasChanged("firewall.flow_log") {
+		return
+	}
+
+	fl, err := newFlowLogFromConfig(flg.l, c)
+	if err == nil {
+		err = fl.open()
+	}
+	if err != nil {
+		flg.l.WithError(err).Error("Error while reloading the firewall flow log, the previous settings are still in use")
+		return
+	}
+
+	// Routines that loaded the old flow log before the swap find it closed and write nothing
+	if err := flg.current.Swap(fl).Close(); err != nil {
+		flg.l.WithError(err).Error("Failed to close the previous firewall flow log")
+	}
+	flg.l.WithField("enabled", fl != nil).Info("Firewall flow log reloaded")
+}
+
+func (flg *flowLogger) log(fp firewall.Packet, incoming bool, h *HostInfo, reason error, rule *firewallRuleStats) {
+	if flg == nil {
+		return
+	}
+
+	flg.current.Load().log(fp, incoming, h, reason, rule)
+}
+
+func (flg *flowLogger) Close() error {
+	if flg == nil {
+		return nil
+	}
+
+	return flg.current.Swap(nil).Close()
+}
+
+func newFlowLogFromConfig(l *logrus.Logger, c *config.C) (*flowLog, error) {
+	if !c.GetBool("firewall.flow_log.enabled", false) {
+		return nil, nil
+	}
+
+	fl := &flowLog{
+		sampleRate:  uint64(c.GetInt("firewall.flow_log.sample_rate", 1)),
+		written:     metrics.GetOrRegisterCounter("firewall.flow_log.written", nil),
+		rateLimited: metrics.GetOrRegisterCounter("firewall.flow_log.rate_limited", nil),
+		queueFull:   metrics.GetOrRegisterCounter("firewall.flow_log.queue_full", nil),
+		errors:      metrics.GetOrRegisterCounter("firewall.flow_log.errors", nil),
+		l:           l,
+	}
+
+	if fl.sampleRate < 1 {
+		return nil, fmt.Errorf("firewall.flow_log.sample_rate must be 1 or greater")
+	}
+
+	for _, d := range c.GetStringSlice("firewall.flow_log.decisions", []string{"drop"}) {
+		switch d {
+		case "accept":
+			fl.accept = true
+		case "drop":
+			fl.drop = true
+		default:
+			return nil, fmt.Errorf("firewall.flow_log.decisions contains an unknown decision `%s`, expected accept or drop", d)
+		}
+	}
+
+	rateLimit := c.GetInt("firewall.flow_log.rate_limit", 100)
+	if rateLimit < 0 {
+		return nil, fmt.Errorf("firewall.flow_log.rate_limit must be 0 or greater")
+	}
+
+	if rateLimit > 0 {
+		burst := c.GetInt("firewall.flow_log.burst", rateLimit)
+		if burst < 1 {
+			return nil, fmt.Errorf("firewall.flow_log.burst must be 1 or greater")
+		}
+		fl.limit = newTokenBucket(float64(rateLimit), float64(burst))
+	}
+
+	fl.output = c.GetString("firewall.flow_log.output", "file")
+	switch fl.output {
+	case "file":
+		fl.path = c.GetString("firewall.flow_log.path", "")
+		if fl.path == "" {
+			return nil, errors.New("firewall.flow_log.path must be provided when the output is file")
+		}
+
+	case "syslog":
+		if fl.limit == nil {
+			return nil, errors.New("firewall.flow_log.rate_limit must be 1 or greater when the output is syslog")
+		}
+		fl.syslogTag = c.GetString("firewall.flow_log.syslog_tag", "nebula-flows")
+
+	default:
+		return nil, fmt.Errorf("firewall.flow_log.output was not understood; `%s`, expected file or syslog", fl.output)
+	}
+
+	return fl, nil
+}
+
+// open opens the file or connects to syslog and starts the writer routine, a flow log is only opened once
+func (fl *flowLog) open() error {
+	if fl == nil {
+		return nil
+	}
+
+	var w io.WriteCloser
+	var err error
+	switch fl.output {
+	case "file":
+		w, err = os.OpenFile(fl.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open firewall.flow_log.path: %w", err)
+		}
+
+	case "syslog":
+		w, err = newFlowLogSyslog(fl.syslogTag)
+		if err != nil {
+			return fmt.Errorf("failed to connect to syslog: %w", err)
+		}
+	}
+
+	fl.events = make(chan []byte, flowLogQueueSize)
+	fl.stop = make(chan struct{})
+	fl.done = make(chan struct{})
+	fl.running.Store(true)
+	go fl.run(w)
+	return nil
+}
+
+// run writes queued events to w until the flow log is closed, then writes whatever is still queued and closes w
+func (fl *flowLog) run(w io.WriteCloser) {
+	defer close(fl.done)
+
+	for {
+		select {
+		case b := <-fl.events:
+			fl.write(w, b)
+		case <-fl.stop:
+			for {
+				select {
+				case b := <-fl.events:
+					fl.write(w, b)
+				default:
+					fl.closeErr = w.Close()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (fl *flowLog) write(w io.Writer, b []byte) {
+	if _, err := w.Write(b); err != nil {
+		fl.errors.Inc(1)
+		fl.l.WithError(err).Debug("Failed to write to the firewall flow log")
+		return
+	}
+
+	fl.written.Inc(1)
+}
+
+// log records the firewall decision for a packet, reason is nil when the packet was accepted by rule
+func (fl *flowLog) log(fp firewall.Packet, incoming bool, h *HostInfo, reason error, rule *firewallRuleStats) {
+	if fl == nil {
+		return
+	}
+
+	if reason == nil && !fl.accept || reason != nil && !fl.drop {
+		return
+	}
+
+	if fl.sampleRate > 1 && fl.seen.Add(1)%fl.sampleRate != 0 {
+		return
+	}
+
+	if !fl.running.Load() {
+		return
+	}
+
+	now := time.Now()
+	if fl.limit != nil {
+		fl.limitLock.Lock()
+		ok := fl.limit.take(now)
+		fl.limitLock.Unlock()
+		if !ok {
+			fl.rateLimited.Inc(1)
+			return
+		}
+	}
+
+	ev := flowLogEvent{
+		Time:      now,
+		Decision:  "accept",
+		Direction: "outgoing",
+		Packet:    fp,
+	}
+
+	if incoming {
+		ev.Direction = "incoming"
+	}
+
+	if reason != nil {
+		ev.Decision = "drop"
+		ev.Reason = reason.Error()
+	}
+
+	if rule != nil {
+		ev.RuleID = rule.id
+		ev.Rule = rule.rule
+	}
+
+	if h != nil {
+		ev.PeerVpnAddrs = h.vpnAddrs
+		if h.ConnectionState != nil && h.ConnectionState.peerCert != nil {
+			ev.PeerName = h.ConnectionState.peerCert.Certificate.Name()
+			ev.PeerGroups = h.ConnectionState.peerCert.Certificate.Groups()
+		}
+	}
+
+	b, err := json.Marshal(ev)
+	if err != nil {
+		fl.errors.Inc(1)
+		fl.l.WithError(err).Debug("Failed to encode a firewall flow log event")
+		return
+	}
+
+	// The queue is never closed, an event queued while the flow log is being closed is simply never written
+	select {
+	case fl.events <- append(b, '\n'):
+	default:
+		fl.queueFull.Inc(1)
+	}
+}
+
+// Close stops taking events, waits for the ones already queued to be written and closes the sink
+func (fl *flowLog) Close() error {
+	if fl == nil || fl.stop == nil {
+		return nil
+	}
+
+	fl.closing.Do(func() {
+		fl.running.Store(false)
+		close(fl.stop)
+		<-fl.done
+	})
+	return fl.closeErr
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+// +build !windows
+
+package nebula
+
+import (
+	"io"
+	"log/syslog"
+)
+
+func newFlowLogSyslog(tag string) (io.WriteCloser, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+}
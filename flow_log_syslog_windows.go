@@ -0,0 +1,10 @@
+package nebula
+
+import (
+	"errors"
+	"io"
+)
+
+func newFlowLogSyslog(string) (io.WriteCloser, error) {
+	return nil, errors.New("syslog is not supported on windows")
+}
@@ -0,0 +1,290 @@
+package nebula
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFlowLogFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	fl, err := newFlowLogFromConfig(l, c)
+	require.NoError(t, err)
+	assert.Nil(t, fl)
+
+	c.Settings["firewall"] = map[string]any{"flow_log": map[string]any{"enabled": true}}
+	_, err = newFlowLogFromConfig(l, c)
+	require.EqualError(t, err, "firewall.flow_log.path must be provided when the output is file")
+
+	c.Settings["firewall"] = map[string]any{"flow_log": map[string]any{"enabled": true, "output": "nope"}}
+	_, err = newFlowLogFromConfig(l, c)
+	require.EqualError(t, err, "firewall.flow_log.output was not understood; `nope`, expected file or syslog")
+
+	c.Settings["firewall"] = map[string]any{"flow_log": map[string]any{"enabled": true, "decisions": []any{"reject"}}}
+	_, err = newFlowLogFromConfig(l, c)
+	require.EqualError(t, err, "firewall.flow_log.decisions contains an unknown decision `reject`, expected accept or drop")
+
+	c.Settings["firewall"] = map[string]any{"flow_log": map[string]any{"enabled": true, "sample_rate": 0}}
+	_, err = newFlowLogFromConfig(l, c)
+	require.EqualError(t, err, "firewall.flow_log.sample_rate must be 1 or greater")
+
+	c.Settings["firewall"] = map[string]any{"flow_log": map[string]any{"enabled": true, "output": "syslog", "rate_limit": 0}}
+	_, err = newFlowLogFromConfig(l, c)
+	require.EqualError(t, err, "firewall.flow_log.rate_limit must be 1 or greater when the output is syslog")
+
+	path := filepath.Join(t.TempDir(), "flows.log")
+	c.Settings["firewall"] = map[string]any{"flow_log": map[string]any{"enabled": true, "path": path, "rate_limit": 10, "burst": 2}}
+	fl, err = newFlowLogFromConfig(l, c)
+	require.NoError(t, err)
+	defer fl.Close()
+	assert.NoFileExists(t, path, "the sink is not opened until the flow log is started")
+	require.NoError(t, fl.open())
+	assert.FileExists(t, path)
+	assert.True(t, fl.drop)
+	assert.False(t, fl.accept)
+	assert.Equal(t, uint64(1), fl.sampleRate)
+	assert.Equal(t, float64(10), fl.limit.rate)
+	assert.Equal(t, float64(2), fl.limit.burst)
+}
+
+func TestFirewall_flowLog(t *testing.T) {
+	l := test.NewLogger()
+	path := filepath.Join(t.TempDir(), "flows.log")
+
+	network := netip.MustParsePrefix("1.2.3.4/24")
+	c := cert.CachedCertificate{
+		Certificate: &dummyCert{
+			name:     "host1",
+			networks: []netip.Prefix{network},
+			groups:   []string{"default-group"},
+		},
+		InvertedGroups: map[string]struct{}{"default-group": {}},
+	}
+	h := HostInfo{
+		ConnectionState: &ConnectionState{
+			peerCert: &c,
+		},
+		vpnAddrs: []netip.Addr{network.Addr()},
+	}
+	h.buildNetworks(c.Certificate.Networks(), c.Certificate.UnsafeNetworks())
+	cp := cert.NewCAPool()
+
+	conf := config.NewC(l)
+	conf.Settings["firewall"] = map[string]any{
+		"inbound": []any{map[string]any{"proto": "tcp", "port": "80", "host": "any"}},
+		"flow_log": map[string]any{
+			"enabled":    true,
+			"path":       path,
+			"decisions":  []any{"accept", "drop"},
+			"rate_limit": 0,
+		},
+	}
+	cs, err := newCertState(cert.Version2, nil, &dummyCert{networks: []netip.Prefix{network}}, false, cert.Curve_CURVE25519, nil)
+	require.NoError(t, err)
+	fw, err := NewFirewallFromConfig(l, cs, conf)
+	require.NoError(t, err)
+	fw.flowLog, err = newFlowLoggerFromConfig(l, conf)
+	require.NoError(t, err)
+	require.NoError(t, fw.flowLog.start())
+
+	p := firewall.Packet{
+		LocalAddr:  netip.MustParseAddr("1.2.3.4"),
+		RemoteAddr: netip.MustParseAddr("1.2.3.4"),
+		LocalPort:  80,
+		RemotePort: 4000,
+		Protocol:   firewall.ProtoTCP,
+	}
+
+	// A new flow is logged, the conntrack hit after it is not
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil))
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil))
+
+	p.LocalPort = 81
+	require.ErrorIs(t, fw.Drop(p, true, &h, cp, nil), ErrNoMatchingRule)
+	require.NoError(t, fw.flowLog.Close())
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var events []map[string]any
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var ev map[string]any
+		require.NoError(t, json.Unmarshal(s.Bytes(), &ev))
+		events = append(events, ev)
+	}
+	require.Len(t, events, 2)
+
+	assert.Equal(t, "accept", events[0]["decision"])
+	assert.Equal(t, "incoming", events[0]["direction"])
+	assert.Equal(t, fw.ListRules()[0].ID, events[0]["ruleId"])
+	assert.Equal(t, "proto: tcp, port: 80, host: any", events[0]["rule"])
+	assert.Equal(t, "host1", events[0]["peerName"])
+	assert.Equal(t, []any{"default-group"}, events[0]["peerGroups"])
+	assert.Equal(t, []any{"1.2.3.4"}, events[0]["peerVpnAddrs"])
+	assert.Equal(t, map[string]any{
+		"LocalAddr":  "1.2.3.4",
+		"RemoteAddr": "1.2.3.4",
+		"LocalPort":  float64(80),
+		"RemotePort": float64(4000),
+		"Protocol":   "tcp",
+		"Fragment":   false,
+	}, events[0]["packet"])
+
+	assert.Equal(t, "drop", events[1]["decision"])
+	assert.Equal(t, ErrNoMatchingRule.Error(), events[1]["reason"])
+	assert.NotContains(t, events[1], "ruleId")
+}
+
+func TestFlowLog_sampling(t *testing.T) {
+	l := test.NewLogger()
+	path := filepath.Join(t.TempDir(), "flows.log")
+	c := config.NewC(l)
+	c.Settings["firewall"] = map[string]any{"flow_log": map[string]any{"enabled": true, "path": path, "sample_rate": 3, "rate_limit": 2}}
+	fl, err := newFlowLogFromConfig(l, c)
+	require.NoError(t, err)
+	require.NoError(t, fl.open())
+
+	rateLimited := fl.rateLimited.Count()
+	for i := 0; i < 12; i++ {
+		fl.log(firewall.Packet{}, true, nil, ErrNoMatchingRule, nil)
+	}
+
+	// 4 events are sampled, the burst lets 2 of them through
+	assert.Equal(t, int64(2), fl.rateLimited.Count()-rateLimited)
+	require.NoError(t, fl.Close())
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 2, bytes.Count(b, []byte("\n")))
+}
+
+func TestFlowLog_queueFull(t *testing.T) {
+	l := test.NewLogger()
+	path := filepath.Join(t.TempDir(), "flows.log")
+	c := config.NewC(l)
+	c.Settings["firewall"] = map[string]any{"flow_log": map[string]any{"enabled": true, "path": path, "rate_limit": 0}}
+	fl, err := newFlowLogFromConfig(l, c)
+	require.NoError(t, err)
+
+	// Without a writer taking events the queue fills up and the rest are dropped instead of blocking
+	fl.events = make(chan []byte, 2)
+	fl.running.Store(true)
+	queueFull := fl.queueFull.Count()
+	for i := 0; i < 5; i++ {
+		fl.log(firewall.Packet{}, true, nil, ErrNoMatchingRule, nil)
+	}
+	assert.Len(t, fl.events, 2)
+	assert.Equal(t, int64(3), fl.queueFull.Count()-queueFull)
+}
+
+func TestFlowLogger_reload(t *testing.T) {
+	l := test.NewLogger()
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.log")
+	second := filepath.Join(dir, "second.log")
+
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("firewall: {flow_log: {enabled: true, path: "+first+"}}"))
+	flg, err := newFlowLoggerFromConfig(l, c)
+	require.NoError(t, err)
+	require.NoError(t, flg.start())
+	old := flg.current.Load()
+
+	// A bad change keeps the flow log that is in use
+	require.NoError(t, c.ReloadConfigString("firewall: {flow_log: {enabled: true, output: nope}}"))
+	flg.reload(c)
+	assert.Same(t, old, flg.current.Load())
+
+	// A new path opens the new file and closes the old one, the old flow log quietly writes nothing after that
+	require.NoError(t, c.ReloadConfigString("firewall: {flow_log: {enabled: true, path: "+second+"}}"))
+	flg.reload(c)
+	assert.NotSame(t, old, flg.current.Load())
+	assert.FileExists(t, second)
+	old.log(firewall.Packet{}, true, nil, ErrNoMatchingRule, nil)
+	flg.log(firewall.Packet{}, true, nil, ErrNoMatchingRule, nil)
+	b, err := os.ReadFile(first)
+	require.NoError(t, err)
+	assert.Empty(t, b)
+	assert.Eventually(t, func() bool {
+		b, err := os.ReadFile(second)
+		return err == nil && bytes.Count(b, []byte("\n")) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// Disabling leaves nothing to write to
+	require.NoError(t, c.ReloadConfigString("firewall: {flow_log: {enabled: false}}"))
+	flg.reload(c)
+	assert.Nil(t, flg.current.Load())
+	require.NoError(t, flg.Close())
+}
+
+func TestInterface_reloadFirewall_flowLog(t *testing.T) {
+	l := test.NewLogger()
+	path := filepath.Join(t.TempDir(), "flows.log")
+	network := netip.MustParsePrefix("1.2.3.4/24")
+	cs, err := newCertState(cert.Version2, nil, &dummyCert{networks: []netip.Prefix{network}}, false, cert.Curve_CURVE25519, nil)
+	require.NoError(t, err)
+	pki := &PKI{l: l}
+	pki.cs.Store(cs)
+
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("firewall: {inbound: [{proto: any, port: any, host: any}]}"))
+	fw, err := NewFirewallFromConfig(l, cs, c)
+	require.NoError(t, err)
+	fw.flowLog, err = newFlowLoggerFromConfig(l, c)
+	require.NoError(t, err)
+	ifce := &Interface{l: l, pki: pki, firewall: fw}
+
+	// Changing only the flow log leaves the firewall and its conntrack alone
+	require.NoError(t, c.ReloadConfigString("firewall: {inbound: [{proto: any, port: any, host: any}], flow_log: {enabled: true, path: "+path+"}}"))
+	ifce.reloadFirewall(c)
+	fw.flowLog.reload(c)
+	assert.Same(t, fw, ifce.firewall)
+	assert.NotNil(t, fw.flowLog.current.Load())
+
+	// A rule change builds a new firewall that keeps the same flow log
+	require.NoError(t, c.ReloadConfigString("firewall: {inbound: [{proto: tcp, port: any, host: any}], flow_log: {enabled: true, path: "+path+"}}"))
+	ifce.reloadFirewall(c)
+	assert.NotSame(t, fw, ifce.firewall)
+	assert.Equal(t, fw.rulesVersion+1, ifce.firewall.rulesVersion)
+	assert.Same(t, fw.flowLog, ifce.firewall.flowLog)
+	require.NoError(t, ifce.firewall.flowLog.Close())
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	tb := newTokenBucket(2, 3)
+
+	// The bucket starts full
+	assert.True(t, tb.take(now))
+	assert.True(t, tb.take(now))
+	assert.True(t, tb.take(now))
+	assert.False(t, tb.take(now))
+
+	// Refills at rate per second
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, tb.take(now))
+	assert.False(t, tb.take(now))
+
+	// But never more than burst
+	now = now.Add(time.Minute)
+	assert.True(t, tb.take(now))
+	assert.True(t, tb.take(now))
+	assert.True(t, tb.take(now))
+	assert.False(t, tb.take(now))
+}
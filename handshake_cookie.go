@@ -0,0 +1,158 @@
+package nebula
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/header"
+)
+
+// Handshake cookies protect responders from floods of first handshake messages. Reading a first message is cheap, the
+// certificate verification and DH that follow are not. Once first messages arrive faster than the configured threshold
+// the responder stops doing that work for initiators that have not proven they can receive packets at their source
+// address. Those initiators are sent a cookie, which is a MAC of their address, and are answered once they repeat the
+// handshake with it. The responder keeps no state for the challenge.
+
+// cookieRotation is how often the cookie secret changes, cookies made with the previous secret are still accepted
+const cookieRotation = 2 * time.Minute
+
+type handshakeCookies struct {
+	sync.Mutex
+
+	// limit is the rate of first messages we handle without a cookie, a nil limit never asks for a cookie
+	limit   *tokenBucket
+	secrets [2][32]byte
+	rotated time.Time
+
+	metricSent     metrics.Counter
+	metricAccepted metrics.Counter
+}
+
+func newHandshakeCookies(threshold int) *handshakeCookies {
+	hc := &handshakeCookies{
+		metricSent:     metrics.GetOrRegisterCounter("handshake_manager.cookie.sent", nil),
+		metricAccepted: metrics.GetOrRegisterCounter("handshake_manager.cookie.accepted", nil),
+	}
+
+	if threshold > 0 {
+		hc.limit = newTokenBucket(float64(threshold), float64(threshold))
+	}
+
+	return hc
+}
+
+// check decides if a first handshake message from addr may be handled. If not the cookie to send back is returned.
+// A required cookie is asked for no matter the rate of first messages.
+func (hc *handshakeCookies) check(addr netip.AddrPort, cookie uint64, now time.Time, required bool) (uint64, bool) {
+	if !addr.IsValid() {
+		// Relayed handshakes arrive over an authenticated tunnel and there is no address to send a cookie to
+		return 0, true
+	}
+
+	if hc.limit == nil && !required {
+		return 0, true
+	}
+
+	hc.Lock()
+	defer hc.Unlock()
+
+	if now.Sub(hc.rotated) >= cookieRotation {
+		hc.secrets[1] = hc.secrets[0]
+		_, _ = rand.Read(hc.secrets[0][:])
+		hc.rotated = now
+	}
+
+	if cookie != 0 && (cookie == makeCookie(hc.secrets[0], addr) || cookie == makeCookie(hc.secrets[1], addr)) {
+		hc.metricAccepted.Inc(1)
+		return 0, true
+	}
+
+	if !required && hc.limit.take(now) {
+		return 0, true
+	}
+
+	hc.metricSent.Inc(1)
+	return makeCookie(hc.secrets[0], addr), false
+}
+
+func makeCookie(secret [32]byte, addr netip.AddrPort) uint64 {
+	mac := hmac.New(sha256.New, secret[:])
+	b, _ := addr.MarshalBinary()
+	mac.Write(b)
+	// 0 means no cookie in the handshake
+	return binary.BigEndian.Uint64(mac.Sum(nil)) | 1
+}
+
+// admitStage1 is called by the responder once it has read a first handshake message. It returns false and sends the
+// initiator a cookie when the message should not be handled. Set requireCookie when the answer would be much larger
+// than the message, a cookie is small and proves the initiator is at addr before we send more.
+func (hm *HandshakeManager) admitStage1(addr netip.AddrPort, d *NebulaHandshakeDetails, requireCookie bool) bool {
+	cookie, ok := hm.cookies.check(addr, d.Cookie, time.Now(), requireCookie)
+	if ok {
+		return true
+	}
+
+	reply := header.Encode(make([]byte, header.Len, header.Len+8), header.Version, header.Handshake, header.HandshakeCookie, d.InitiatorIndex, 2)
+	reply = binary.BigEndian.AppendUint64(reply, cookie)
+
+	hm.messageMetrics.Tx(header.Handshake, header.HandshakeCookie, 1)
+	err := hm.outside.WriteTo(reply, addr)
+	if err != nil {
+		hm.l.WithError(err).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 1, "style": "cookie"}).Error("Failed to send handshake cookie")
+	} else if hm.l.Level >= logrus.DebugLevel {
+		hm.l.WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 1, "style": "cookie"}).Debug("Handshake cookie sent")
+	}
+
+	return false
+}
+
+// handleCookie is called by the initiator when a responder asks for a cookie. The next attempt starts over with a
+// new first message that carries the cookie and is only sent to the remote that asked. One cookie is taken per
+// handshake so a forged cookie can not keep restarting it.
+func (hm *HandshakeManager) handleCookie(addr netip.AddrPort, packet []byte, h *header.H) {
+	if len(packet) < header.Len+8 {
+		return
+	}
+
+	hh := hm.queryIndex(h.RemoteIndex)
+	if hh == nil {
+		return
+	}
+
+	hh.Lock()
+	defer hh.Unlock()
+
+	ci := hh.hostinfo.ConnectionState
+	if !hh.ready || ci == nil || !ci.initiator || hh.hostinfo.remoteIndexId != 0 || !slices.Contains(hh.lastRemotes, addr) {
+		// Not an answer to a first message we sent
+		return
+	}
+
+	if hh.cookieAddr.IsValid() {
+		// We already restarted for a cookie
+		return
+	}
+
+	hh.hostinfo.logger(hm.l).WithField("udpAddr", addr).
+		WithField("handshake", m{"stage": 1, "style": header.SubTypeName(header.Handshake, hh.style)}).
+		Info("Responder asked for a handshake cookie")
+
+	// Forget the index that went with the first attempt, stage 0 will allocate a new one
+	hm.Lock()
+	delete(hm.indexes, hh.hostinfo.localIndexId)
+	hm.Unlock()
+
+	hh.cookie = binary.BigEndian.Uint64(packet[header.Len:])
+	hh.cookieAddr = addr
+	hh.ready = false
+}
@@ -0,0 +1,121 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandshakeCookies_check(t *testing.T) {
+	addr := netip.MustParseAddrPort("1.2.3.4:4242")
+	other := netip.MustParseAddrPort("1.2.3.4:4243")
+	now := time.Now()
+
+	// Disabled never asks for a cookie
+	hc := newHandshakeCookies(0)
+	for range 10 {
+		_, ok := hc.check(addr, 0, now, false)
+		assert.True(t, ok)
+	}
+
+	hc = newHandshakeCookies(2)
+	_, ok := hc.check(addr, 0, now, false)
+	assert.True(t, ok)
+	_, ok = hc.check(addr, 0, now, false)
+	assert.True(t, ok)
+
+	// Over the threshold a cookie is handed out
+	cookie, ok := hc.check(addr, 0, now, false)
+	assert.False(t, ok)
+	assert.NotZero(t, cookie)
+
+	// A wrong cookie gets the right one back
+	again, ok := hc.check(addr, cookie+2, now, false)
+	assert.False(t, ok)
+	assert.Equal(t, cookie, again)
+
+	// The cookie only works for the address it was given to
+	_, ok = hc.check(other, cookie, now, false)
+	assert.False(t, ok)
+	_, ok = hc.check(addr, cookie, now, false)
+	assert.True(t, ok)
+
+	// Relayed handshakes have no address and are always handled
+	_, ok = hc.check(netip.AddrPort{}, 0, now, false)
+	assert.True(t, ok)
+
+	// Cookies survive one rotation of the secret but not two
+	now = now.Add(cookieRotation)
+	_, ok = hc.check(addr, cookie, now, false)
+	assert.True(t, ok)
+	now = now.Add(cookieRotation)
+	hc.limit = newTokenBucket(1, 1)
+	hc.limit.take(now)
+	_, ok = hc.check(addr, cookie, now, false)
+	assert.False(t, ok)
+}
+
+func TestHandshakeCookies_checkRequired(t *testing.T) {
+	addr := netip.MustParseAddrPort("1.2.3.4:4242")
+	now := time.Now()
+
+	// A required cookie is asked for even when cookies are disabled or under the threshold
+	for _, threshold := range []int{0, 10} {
+		hc := newHandshakeCookies(threshold)
+		cookie, ok := hc.check(addr, 0, now, true)
+		assert.False(t, ok)
+		assert.NotZero(t, cookie)
+
+		_, ok = hc.check(addr, cookie, now, true)
+		assert.True(t, ok)
+
+		// Relayed handshakes have no address to prove
+		_, ok = hc.check(netip.AddrPort{}, 0, now, true)
+		assert.True(t, ok)
+	}
+}
+
+func TestHandshakeManager_handleCookie(t *testing.T) {
+	l := test.NewLogger()
+	hm := NewHandshakeManager(l, newHostMap(l), newTestLighthouse(), &udp.NoopConn{}, defaultHandshakeConfig)
+	a := netip.MustParseAddrPort("1.2.3.4:4242")
+	b := netip.MustParseAddrPort("1.2.3.5:4242")
+
+	hh := &HandshakeHostInfo{
+		hostinfo:    &HostInfo{localIndexId: 10, ConnectionState: &ConnectionState{initiator: true}},
+		ready:       true,
+		lastRemotes: []netip.AddrPort{a, b},
+	}
+	hm.indexes[10] = hh
+
+	cookie := func(addr netip.AddrPort, c uint64) {
+		p := header.Encode(make([]byte, header.Len), header.Version, header.Handshake, header.HandshakeCookie, 10, 2)
+		hm.handleCookie(addr, binary.BigEndian.AppendUint64(p, c), &header.H{RemoteIndex: 10})
+	}
+
+	// A remote we did not send the first message to can not restart the handshake
+	cookie(netip.MustParseAddrPort("1.2.3.6:4242"), 1)
+	assert.True(t, hh.ready)
+	assert.Zero(t, hh.cookie)
+
+	cookie(a, 3)
+	assert.False(t, hh.ready)
+	assert.Equal(t, uint64(3), hh.cookie)
+	assert.Equal(t, a, hh.cookieAddr)
+	assert.NotContains(t, hm.indexes, uint32(10))
+
+	// The next attempt only goes to a, and no remote gets to restart it again
+	hm.indexes[10] = hh
+	hh.ready = true
+	cookie(a, 5)
+	cookie(b, 7)
+	assert.True(t, hh.ready)
+	assert.Equal(t, uint64(3), hh.cookie)
+	assert.Equal(t, a, hh.cookieAddr)
+}
@@ -0,0 +1,93 @@
+package nebula
+
+import (
+	"crypto/hkdf"
+	"crypto/mlkem"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/config"
+)
+
+// The post quantum hybrid handshake is an IX handshake that also carries an ML-KEM-768 exchange. The initiator sends
+// an encapsulation key in stage 1, the responder answers with a ciphertext in stage 2. The shared secret is mixed
+// into both transport keys so recorded traffic stays private unless both the DH and ML-KEM are broken.
+//
+// The encapsulation key and ciphertext make stage 1 about 1300 bytes and stage 2 about 1250 bytes before the
+// certificate is added, so hosts with large certificates send handshakes that the underlay fragments. There is no xx
+// flavor, require mode only answers hybrid ix which means xx handshakes are ignored.
+
+type postQuantumMode int
+
+const (
+	// postQuantumOff never starts a hybrid handshake but still answers them
+	postQuantumOff postQuantumMode = iota
+	// postQuantumPrefer starts hybrid handshakes and falls back to ix for hosts that do not answer
+	postQuantumPrefer
+	// postQuantumRequire only starts and answers hybrid handshakes
+	postQuantumRequire
+)
+
+// hybridKeyInfo binds the transport keys derived from the ML-KEM shared secret to their direction
+const (
+	hybridKeyInfoI2R = "nebula hybrid initiator to responder"
+	hybridKeyInfoR2I = "nebula hybrid responder to initiator"
+)
+
+var errNoKemCiphertext = errors.New("handshake did not contain a kem ciphertext")
+
+// postQuantumModeFromConfig reads `handshakes.post_quantum`
+func postQuantumModeFromConfig(c *config.C) (postQuantumMode, error) {
+	switch v := c.GetString("handshakes.post_quantum", "false"); v {
+	case "false":
+		return postQuantumOff, nil
+	case "true":
+		return postQuantumPrefer, nil
+	case "require":
+		return postQuantumRequire, nil
+	default:
+		return postQuantumOff, fmt.Errorf("handshakes.post_quantum was not understood; `%s`, expected true, false, or require", v)
+	}
+}
+
+// hybridCipherStates replaces the noise transport keys with keys derived from both the noise keys and the ML-KEM
+// shared secret. The handshake hash salts the derivation so the result is bound to this handshake.
+func (cs *ConnectionState) hybridCipherStates(i2r, r2i *noise.CipherState, secret []byte) (eKey, dKey *NebulaCipherState, err error) {
+	binding := cs.H.ChannelBinding()
+	mix := func(k *noise.CipherState, info string) (*NebulaCipherState, error) {
+		nk := k.UnsafeKey()
+		key, err := hkdf.Key(sha256.New, append(nk[:], secret...), binding, info, 32)
+		if err != nil {
+			return nil, err
+		}
+		return newNebulaCipherState(cs.cipher, [32]byte(key)), nil
+	}
+
+	i, err := mix(i2r, hybridKeyInfoI2R)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r, err := mix(r2i, hybridKeyInfoR2I)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if cs.initiator {
+		return i, r, nil
+	}
+	return r, i, nil
+}
+
+// encapsulateHybrid is used by the responder to answer the initiators encapsulation key
+func encapsulateHybrid(ek []byte) (secret, ciphertext []byte, err error) {
+	k, err := mlkem.NewEncapsulationKey768(ek)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	secret, ciphertext = k.Encapsulate()
+	return secret, ciphertext, nil
+}
@@ -0,0 +1,93 @@
+package nebula
+
+import (
+	"crypto/mlkem"
+	"crypto/rand"
+	"testing"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_postQuantumModeFromConfig(t *testing.T) {
+	c := config.NewC(test.NewLogger())
+	mode, err := postQuantumModeFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, postQuantumOff, mode)
+
+	c.Settings["handshakes"] = map[string]any{"post_quantum": true}
+	mode, err = postQuantumModeFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, postQuantumPrefer, mode)
+
+	c.Settings["handshakes"] = map[string]any{"post_quantum": "require"}
+	mode, err = postQuantumModeFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, postQuantumRequire, mode)
+
+	c.Settings["handshakes"] = map[string]any{"post_quantum": "maybe"}
+	_, err = postQuantumModeFromConfig(c)
+	require.EqualError(t, err, "handshakes.post_quantum was not understood; `maybe`, expected true, false, or require")
+}
+
+func TestConnectionState_hybridCipherStates(t *testing.T) {
+	suite := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+	newState := func(initiator bool) *ConnectionState {
+		hs, err := noise.NewHandshakeState(noise.Config{CipherSuite: suite, Random: rand.Reader, Pattern: noise.HandshakeNN, Initiator: initiator})
+		require.NoError(t, err)
+		return &ConnectionState{H: hs, cipher: "chachapoly", initiator: initiator}
+	}
+
+	initiator := newState(true)
+	responder := newState(false)
+
+	msg, _, _, err := initiator.H.WriteMessage(nil, nil)
+	require.NoError(t, err)
+	_, _, _, err = responder.H.ReadMessage(nil, msg)
+	require.NoError(t, err)
+	msg, ri2r, rr2i, err := responder.H.WriteMessage(nil, nil)
+	require.NoError(t, err)
+	_, ii2r, ir2i, err := initiator.H.ReadMessage(nil, msg)
+	require.NoError(t, err)
+
+	dk, err := mlkem.GenerateKey768()
+	require.NoError(t, err)
+	kem, ct, err := encapsulateHybrid(dk.EncapsulationKey().Bytes())
+	require.NoError(t, err)
+	decapsulated, err := dk.Decapsulate(ct)
+	require.NoError(t, err)
+	assert.Equal(t, kem, decapsulated)
+
+	iE, iD, err := initiator.hybridCipherStates(ii2r, ir2i, kem)
+	require.NoError(t, err)
+	rE, rD, err := responder.hybridCipherStates(ri2r, rr2i, kem)
+	require.NoError(t, err)
+
+	nb := make([]byte, 12)
+	out, err := iE.EncryptDanger(nil, []byte("ad"), []byte("to the responder"), 3, nb)
+	require.NoError(t, err)
+	plain, err := rD.DecryptDanger(nil, []byte("ad"), out, 3, nb)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("to the responder"), plain)
+
+	out, err = rE.EncryptDanger(nil, []byte("ad"), []byte("to the initiator"), 3, nb)
+	require.NoError(t, err)
+	plain, err = iD.DecryptDanger(nil, []byte("ad"), out, 3, nb)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("to the initiator"), plain)
+
+	// The plain noise keys can not read hybrid traffic
+	_, err = NewNebulaCipherState(rr2i, "chachapoly").DecryptDanger(nil, []byte("ad"), out, 3, nb)
+	require.Error(t, err)
+
+	// Neither can keys mixed with a different secret
+	other, _, err := initiator.hybridCipherStates(ii2r, ir2i, make([]byte, 32))
+	require.NoError(t, err)
+	out, err = other.EncryptDanger(nil, []byte("ad"), []byte("to the responder"), 4, nb)
+	require.NoError(t, err)
+	_, err = rD.DecryptDanger(nil, []byte("ad"), out, 4, nb)
+	require.Error(t, err)
+}
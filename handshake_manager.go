@@ -4,16 +4,20 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"net/netip"
 	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/udp"
 )
@@ -23,6 +27,9 @@ const (
 	DefaultHandshakeRetries       = 10
 	DefaultHandshakeTriggerBuffer = 64
 	DefaultUseRelays              = true
+
+	// fallbackMemory is how long we start with ix for a host that only answered ix after a fall back
+	fallbackMemory = time.Hour
 )
 
 var (
@@ -39,6 +46,19 @@ type HandshakeConfig struct {
 	retries       int64
 	triggerBuffer int
 	useRelays     bool
+	// pattern is the noise handshake style used when we start a handshake, HandshakeIXPSK0 or HandshakeXXPSK0
+	pattern header.MessageSubType
+	// ixFallback tries hosts that have not answered an xx handshake with ix for the second half of the retries
+	ixFallback bool
+	// acceptXX answers xx handshakes from hosts we do not share a psk with, see handshakes.accept_xx
+	acceptXX bool
+	// postQuantum controls the use of the ML-KEM hybrid handshake
+	postQuantum postQuantumMode
+	// cookieThreshold is the rate of first handshake messages per second we handle before asking for cookies
+	cookieThreshold int
+	// limits is the rate of handshake messages we handle from a single udp address or vpn address when we start,
+	// reloads replace it in HandshakeManager.limits
+	limits *messageLimits
 
 	messageMetrics *MessageMetrics
 }
@@ -55,11 +75,23 @@ type HandshakeManager struct {
 	outside                udp.Conn
 	config                 HandshakeConfig
 	OutboundHandshakeTimer *LockingTimerWheel[netip.Addr]
-	messageMetrics         *MessageMetrics
-	metricInitiated        metrics.Counter
-	metricTimedOut         metrics.Counter
-	f                      *Interface
-	l                      *logrus.Logger
+	// responderTimer expires the pending state we hold for xx handshakes that never sent their final message
+	responderTimer *LockingTimerWheel[uint32]
+	// xxFirstMessages finds the pending state for an xx first message we answered by a digest of the message
+	xxFirstMessages map[[sha256.Size]byte]*HandshakeHostInfo
+	// fallbacks holds when we stop starting with ix for hosts that did not answer the hybrid or xx handshake
+	fallbacks        map[netip.Addr]time.Time
+	messageMetrics   *MessageMetrics
+	metricInitiated  metrics.Counter
+	metricTimedOut   metrics.Counter
+	metricFallback   metrics.Counter
+	metricIXFallback metrics.Counter
+	// cookies asks initiators to prove their address when we are flooded with handshakes
+	cookies *handshakeCookies
+	// limits holds the current handshakes.rate_limit
+	limits atomic.Pointer[messageLimits]
+	f      *Interface
+	l      *logrus.Logger
 
 	// can be used to trigger outbound handshake for the given vpnIp
 	trigger chan netip.Addr
@@ -68,11 +100,17 @@ type HandshakeManager struct {
 type HandshakeHostInfo struct {
 	sync.Mutex
 
-	startTime   time.Time        // Time that we first started trying with this handshake
-	ready       bool             // Is the handshake ready
-	counter     int64            // How many attempts have we made so far
-	lastRemotes []netip.AddrPort // Remotes that we sent to during the previous attempt
-	packetStore []*cachedPacket  // A set of packets to be transmitted once the handshake completes
+	startTime   time.Time             // Time that we first started trying with this handshake
+	ready       bool                  // Is the handshake ready
+	counter     int64                 // How many attempts have we made so far
+	lastRemotes []netip.AddrPort      // Remotes that we sent to during the previous attempt
+	packetStore []*cachedPacket       // A set of packets to be transmitted once the handshake completes
+	style       header.MessageSubType // The noise handshake style in use, HandshakeIXPSK0 or HandshakeXXPSK0
+	cookie      uint64                // The cookie the responder asked us to send, 0 if none
+	cookieAddr  netip.AddrPort        // The remote that sent the cookie, the only one we send to once we have it
+	fellBack    bool                  // We gave up on the hybrid or xx handshake and fell back to ix
+
+	firstMessage [sha256.Size]byte // Digest of the xx first message we answered as the responder
 
 	hostinfo *HostInfo
 }
@@ -103,20 +141,60 @@ func (hh *HandshakeHostInfo) cachePacket(l *logrus.Logger, t header.MessageType,
 }
 
 func NewHandshakeManager(l *logrus.Logger, mainHostMap *HostMap, lightHouse *LightHouse, outside udp.Conn, config HandshakeConfig) *HandshakeManager {
-	return &HandshakeManager{
+	hm := &HandshakeManager{
 		vpnIps:                 map[netip.Addr]*HandshakeHostInfo{},
 		indexes:                map[uint32]*HandshakeHostInfo{},
+		xxFirstMessages:        map[[sha256.Size]byte]*HandshakeHostInfo{},
+		fallbacks:              map[netip.Addr]time.Time{},
 		mainHostMap:            mainHostMap,
 		lightHouse:             lightHouse,
 		outside:                outside,
 		config:                 config,
 		trigger:                make(chan netip.Addr, config.triggerBuffer),
 		OutboundHandshakeTimer: NewLockingTimerWheel[netip.Addr](config.tryInterval, hsTimeout(config.retries, config.tryInterval)),
+		responderTimer:         NewLockingTimerWheel[uint32](config.tryInterval, hsTimeout(config.retries, config.tryInterval)),
 		messageMetrics:         config.messageMetrics,
+		cookies:                newHandshakeCookies(config.cookieThreshold),
 		metricInitiated:        metrics.GetOrRegisterCounter("handshake_manager.initiated", nil),
 		metricTimedOut:         metrics.GetOrRegisterCounter("handshake_manager.timed_out", nil),
+		metricFallback:         metrics.GetOrRegisterCounter("handshake_manager.post_quantum_fallback", nil),
+		metricIXFallback:       metrics.GetOrRegisterCounter("handshake_manager.xx_fallback", nil),
 		l:                      l,
 	}
+	hm.limits.Store(config.limits)
+
+	return hm
+}
+
+// reloadLimits replaces the handshake rate limits when `handshakes.rate_limit` changes, sources start over with a
+// full bucket
+func (hm *HandshakeManager) reloadLimits(c *config.C) {
+	if !c.HasChanged("handshakes.rate_limit") {
+		return
+	}
+
+	ml, err := newMessageLimitsFromConfig(c, "handshakes.rate_limit", "handshake_manager.rate_limit")
+	if err != nil {
+		hm.l.WithError(err).Error("Failed to reload handshakes.rate_limit")
+		return
+	}
+
+	hm.limits.Store(ml)
+	hm.l.Info("handshakes.rate_limit has changed")
+}
+
+// answered reports if packet is a first handshake message we already completed a tunnel with vpnAddr for
+func (hm *HandshakeManager) answered(vpnAddr netip.Addr, packet []byte) bool {
+	hm.mainHostMap.RLock()
+	defer hm.mainHostMap.RUnlock()
+
+	for hostinfo := hm.mainHostMap.Hosts[vpnAddr]; hostinfo != nil; hostinfo = hostinfo.next {
+		if bytes.Equal(hostinfo.HandshakePacket[0], packet) {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (hm *HandshakeManager) Run(ctx context.Context) {
@@ -144,8 +222,20 @@ func (hm *HandshakeManager) HandleIncoming(addr netip.AddrPort, via *ViaSender,
 		}
 	}
 
+	if !hm.limits.Load().allowUdpAddr(addr, time.Now()) {
+		hm.l.WithField("udpAddr", addr).WithField("handshake", m{"style": h.SubTypeName()}).
+			Debug("handshakes.rate_limit exceeded, ignoring handshake message")
+		return
+	}
+
+	if hm.config.postQuantum == postQuantumRequire && h.Subtype != header.HandshakeIXPSK0MLKEM768 && h.Subtype != header.HandshakeCookie {
+		hm.l.WithField("udpAddr", addr).WithField("handshake", m{"style": h.SubTypeName()}).
+			Debug("handshakes.post_quantum is required, ignoring classical handshake")
+		return
+	}
+
 	switch h.Subtype {
-	case header.HandshakeIXPSK0:
+	case header.HandshakeIXPSK0, header.HandshakeIXPSK0MLKEM768:
 		switch h.MessageCounter {
 		case 1:
 			ixHandshakeStage1(hm.f, addr, via, packet, h)
@@ -157,6 +247,36 @@ func (hm *HandshakeManager) HandleIncoming(addr netip.AddrPort, via *ViaSender,
 				hm.DeleteHostInfo(newHostinfo.hostinfo)
 			}
 		}
+
+	case header.HandshakeXXPSK0:
+		switch h.MessageCounter {
+		case 1:
+			// Anyone can send a first xx message without a certificate and we answer it with ours, only do that when
+			// asked to or when the psk already keeps strangers out
+			if !hm.config.acceptXX && !hm.f.pki.getCertState().requiresPSK() {
+				hm.l.WithField("udpAddr", addr).WithField("handshake", m{"stage": 1, "style": "xx_psk0"}).
+					Debug("handshakes.accept_xx is not enabled, ignoring handshake message")
+				return
+			}
+			xxHandshakeStage1(hm.f, addr, via, packet, h)
+
+		case 2:
+			newHostinfo := hm.queryIndex(h.RemoteIndex)
+			tearDown := xxHandshakeStage2(hm.f, addr, via, newHostinfo, packet, h)
+			if tearDown && newHostinfo != nil {
+				hm.DeleteHostInfo(newHostinfo.hostinfo)
+			}
+
+		case 3:
+			newHostinfo := hm.queryIndex(h.RemoteIndex)
+			tearDown := xxHandshakeStage3(hm.f, addr, via, newHostinfo, packet, h)
+			if tearDown && newHostinfo != nil {
+				hm.DeleteHostInfo(newHostinfo.hostinfo)
+			}
+		}
+
+	case header.HandshakeCookie:
+		hm.handleCookie(addr, packet, h)
 	}
 }
 
@@ -169,6 +289,39 @@ func (hm *HandshakeManager) NextOutboundHandshakeTimerTick(now time.Time) {
 		}
 		hm.handleOutbound(vpnIp, false)
 	}
+
+	hm.responderTimer.Advance(now)
+	for {
+		index, has := hm.responderTimer.Purge()
+		if !has {
+			break
+		}
+		hm.expireResponder(index)
+	}
+}
+
+// expireResponder removes the pending state for an xx handshake we responded to if it never completed
+func (hm *HandshakeManager) expireResponder(index uint32) {
+	hh := hm.queryIndex(index)
+	if hh == nil {
+		return
+	}
+
+	hh.Lock()
+	defer hh.Unlock()
+
+	ci := hh.hostinfo.ConnectionState
+	if hh.style != header.HandshakeXXPSK0 || ci == nil || ci.initiator || len(hh.hostinfo.vpnAddrs) > 0 {
+		// The index belongs to something else now
+		return
+	}
+
+	if hm.l.Level >= logrus.DebugLevel {
+		hh.hostinfo.logger(hm.l).WithField("handshake", m{"stage": 3, "style": "xx_psk0"}).
+			WithField("durationNs", time.Since(hh.startTime).Nanoseconds()).
+			Debug("Handshake timed out waiting for the final message")
+	}
+	hm.DeleteHostInfo(hh.hostinfo)
 }
 
 func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered bool) {
@@ -180,12 +333,13 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 	defer hh.Unlock()
 
 	hostinfo := hh.hostinfo
+	style := header.SubTypeName(header.Handshake, hh.style)
 	// If we are out of time, clean up
 	if hh.counter >= hm.config.retries {
 		hh.hostinfo.logger(hm.l).WithField("udpAddrs", hh.hostinfo.remotes.CopyAddrs(hm.mainHostMap.GetPreferredRanges())).
 			WithField("initiatorIndex", hh.hostinfo.localIndexId).
 			WithField("remoteIndex", hh.hostinfo.remoteIndexId).
-			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+			WithField("handshake", m{"stage": 1, "style": style}).
 			WithField("durationNs", time.Since(hh.startTime).Nanoseconds()).
 			Info("Handshake timed out")
 		hm.metricTimedOut.Inc(1)
@@ -196,9 +350,51 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 	// Increment the counter to increase our delay, linear backoff
 	hh.counter++
 
+	// Hosts that do not understand the hybrid handshake never answer it, fall back to ix for the second half of our tries
+	if hh.style == header.HandshakeIXPSK0MLKEM768 && hm.config.postQuantum == postQuantumPrefer && hh.counter > hm.config.retries/2 {
+		hostinfo.logger(hm.l).WithField("handshake", m{"stage": 1, "style": style}).
+			Info("No answer to the post quantum handshake, falling back to ix")
+		hm.metricFallback.Inc(1)
+
+		// Forget the index that went with the hybrid attempt, stage 0 will allocate a new one
+		hm.Lock()
+		delete(hm.indexes, hostinfo.localIndexId)
+		hm.Unlock()
+
+		hh.style = header.HandshakeIXPSK0
+		hh.ready = false
+		hh.fellBack = true
+		style = header.SubTypeName(header.Handshake, hh.style)
+	}
+
+	// Older hosts do not understand xx either, tell them who we are in the clear if that is allowed
+	if hh.style == header.HandshakeXXPSK0 && hm.config.ixFallback && hh.counter > hm.config.retries/2 {
+		hostinfo.logger(hm.l).WithField("handshake", m{"stage": 1, "style": style}).
+			Info("No answer to the xx handshake, falling back to ix")
+		hm.metricIXFallback.Inc(1)
+
+		// Forget the index that went with the xx attempt, stage 0 will allocate a new one
+		hm.Lock()
+		delete(hm.indexes, hostinfo.localIndexId)
+		hm.Unlock()
+
+		hh.style = header.HandshakeIXPSK0
+		hh.ready = false
+		hh.fellBack = true
+		style = header.SubTypeName(header.Handshake, hh.style)
+	}
+
 	// Check if we have a handshake packet to transmit yet
 	if !hh.ready {
-		if !ixHandshakeStage0(hm.f, hh) {
+		var ok bool
+		switch hh.style {
+		case header.HandshakeXXPSK0:
+			ok = xxHandshakeStage0(hm.f, hh)
+		default:
+			ok = ixHandshakeStage0(hm.f, hh)
+		}
+
+		if !ok {
 			hm.OutboundHandshakeTimer.Add(vpnIp, hm.config.tryInterval*time.Duration(hh.counter))
 			return
 		}
@@ -234,15 +430,29 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 		hm.lightHouse.QueryServer(vpnIp)
 	}
 
+	// Give udp a head start when the host has udp remotes, tcp remotes are a fallback for when udp doesn't get through
+	skipTCP := hh.counter <= handshakeTCPHeadStart && slices.ContainsFunc(remotes, func(addr netip.AddrPort) bool {
+		return !hm.lightHouse.IsTCPRemote(addr)
+	})
+
 	// Send the handshake to all known ips, stage 2 takes care of assigning the hostinfo.remote based on the first to reply
 	var sentTo []netip.AddrPort
 	hostinfo.remotes.ForEach(hm.mainHostMap.GetPreferredRanges(), func(addr netip.AddrPort, _ bool) {
+		if skipTCP && hm.lightHouse.IsTCPRemote(addr) {
+			return
+		}
+
+		if hh.cookieAddr.IsValid() && addr != hh.cookieAddr {
+			// The cookie is only good with the responder that handed it out
+			return
+		}
+
 		hm.messageMetrics.Tx(header.Handshake, header.MessageSubType(hostinfo.HandshakePacket[0][1]), 1)
 		err := hm.outside.WriteTo(hostinfo.HandshakePacket[0], addr)
 		if err != nil {
 			hostinfo.logger(hm.l).WithField("udpAddr", addr).
 				WithField("initiatorIndex", hostinfo.localIndexId).
-				WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+				WithField("handshake", m{"stage": 1, "style": style}).
 				WithError(err).Error("Failed to send handshake message")
 
 		} else {
@@ -255,12 +465,12 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 	if remotesHaveChanged {
 		hostinfo.logger(hm.l).WithField("udpAddrs", sentTo).
 			WithField("initiatorIndex", hostinfo.localIndexId).
-			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+			WithField("handshake", m{"stage": 1, "style": style}).
 			Info("Handshake message sent")
 	} else if hm.l.Level >= logrus.DebugLevel {
 		hostinfo.logger(hm.l).WithField("udpAddrs", sentTo).
 			WithField("initiatorIndex", hostinfo.localIndexId).
-			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+			WithField("handshake", m{"stage": 1, "style": style}).
 			Debug("Handshake message sent")
 	}
 
@@ -459,6 +669,20 @@ func (hm *HandshakeManager) StartHandshake(vpnAddr netip.Addr, cacheCb func(*Han
 	hh := &HandshakeHostInfo{
 		hostinfo:  hostinfo,
 		startTime: time.Now(),
+		style:     hm.config.pattern,
+	}
+	if hm.config.postQuantum != postQuantumOff {
+		hh.style = header.HandshakeIXPSK0MLKEM768
+	}
+
+	// Don't make every handshake with an older host wait for the fall back, try the other style again now and then
+	if until, ok := hm.fallbacks[vpnAddr]; ok {
+		if time.Now().After(until) {
+			delete(hm.fallbacks, vpnAddr)
+		} else if (hh.style == header.HandshakeIXPSK0MLKEM768 && hm.config.postQuantum == postQuantumPrefer) ||
+			(hh.style == header.HandshakeXXPSK0 && hm.config.ixFallback) {
+			hh.style = header.HandshakeIXPSK0
+		}
 	}
 	hm.vpnIps[vpnAddr] = hh
 	hm.metricInitiated.Inc(1)
@@ -575,6 +799,13 @@ func (hm *HandshakeManager) Complete(hostinfo *HostInfo, f *Interface) {
 			Info("New host shadows existing host remoteIndex")
 	}
 
+	if hh := hm.indexes[hostinfo.localIndexId]; hh != nil && hh.hostinfo == hostinfo && hh.fellBack {
+		until := time.Now().Add(fallbackMemory)
+		for _, addr := range hostinfo.vpnAddrs {
+			hm.fallbacks[addr] = until
+		}
+	}
+
 	// We need to remove from the pending hostmap first to avoid undoing work when after to the main hostmap.
 	hm.unlockedDeleteHostInfo(hostinfo)
 	hm.mainHostMap.unlockedAddHostInfo(hostinfo, f)
@@ -623,6 +854,10 @@ func (hm *HandshakeManager) unlockedDeleteHostInfo(hostinfo *HostInfo) {
 		hm.vpnIps = map[netip.Addr]*HandshakeHostInfo{}
 	}
 
+	if hh := hm.indexes[hostinfo.localIndexId]; hh != nil && hh.hostinfo == hostinfo && hm.xxFirstMessages[hh.firstMessage] == hh {
+		delete(hm.xxFirstMessages, hh.firstMessage)
+	}
+
 	delete(hm.indexes, hostinfo.localIndexId)
 	if len(hm.indexes) == 0 {
 		hm.indexes = map[uint32]*HandshakeHostInfo{}
@@ -721,6 +956,21 @@ func generateIndex(l *logrus.Logger) (uint32, error) {
 	return index, nil
 }
 
+// handshakePatternFromConfig reads `handshakes.pattern` which selects the noise handshake we start with other hosts,
+// and if hosts that do not answer xx are tried with ix. Which styles are answered is up to handshakes.accept_xx.
+func handshakePatternFromConfig(c *config.C) (header.MessageSubType, bool, error) {
+	switch v := c.GetString("handshakes.pattern", "ix"); v {
+	case "ix":
+		return header.HandshakeIXPSK0, false, nil
+	case "xx":
+		return header.HandshakeXXPSK0, true, nil
+	case "xx_require":
+		return header.HandshakeXXPSK0, false, nil
+	default:
+		return 0, false, fmt.Errorf("handshakes.pattern was not understood; `%s`, expected ix, xx, or xx_require", v)
+	}
+}
+
 func hsTimeout(tries int64, interval time.Duration) time.Duration {
 	return time.Duration(tries / 2 * ((2 * int64(interval)) + (tries-1)*int64(interval)))
 }
@@ -6,10 +6,12 @@ import (
 	"time"
 
 	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/test"
 	"github.com/slackhq/nebula/udp"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_NewHandshakeManagerVpnIp(t *testing.T) {
@@ -100,3 +102,76 @@ func (mw *mockEncWriter) GetHostInfo(_ netip.Addr) *HostInfo {
 func (mw *mockEncWriter) GetCertState() *CertState {
 	return &CertState{initiatingVersion: cert.Version2}
 }
+
+func Test_handshakePatternFromConfig(t *testing.T) {
+	c := config.NewC(test.NewLogger())
+	p, fallback, err := handshakePatternFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, header.HandshakeIXPSK0, p)
+	assert.False(t, fallback)
+
+	c.Settings["handshakes"] = map[string]any{"pattern": "xx"}
+	p, fallback, err = handshakePatternFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, header.HandshakeXXPSK0, p)
+	assert.True(t, fallback)
+
+	c.Settings["handshakes"] = map[string]any{"pattern": "xx_require"}
+	p, fallback, err = handshakePatternFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, header.HandshakeXXPSK0, p)
+	assert.False(t, fallback)
+
+	c.Settings["handshakes"] = map[string]any{"pattern": "ik"}
+	_, _, err = handshakePatternFromConfig(c)
+	require.EqualError(t, err, "handshakes.pattern was not understood; `ik`, expected ix, xx, or xx_require")
+}
+
+func TestHandshakeManager_reloadLimits(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("handshakes: {rate_limit: {rate: 1}}"))
+	ml, err := newMessageLimitsFromConfig(c, "handshakes.rate_limit", "handshake_manager.rate_limit")
+	require.NoError(t, err)
+
+	hc := defaultHandshakeConfig
+	hc.limits = ml
+	hm := NewHandshakeManager(l, newHostMap(l), newTestLighthouse(), &udp.NoopConn{}, hc)
+	assert.Same(t, ml, hm.limits.Load())
+
+	// A bad change keeps the limits in use
+	require.NoError(t, c.ReloadConfigString("handshakes: {rate_limit: {rate: fast}}"))
+	hm.reloadLimits(c)
+	assert.Same(t, ml, hm.limits.Load())
+
+	require.NoError(t, c.ReloadConfigString("handshakes: {rate_limit: {rate: 5}}"))
+	hm.reloadLimits(c)
+	assert.InDelta(t, 5, hm.limits.Load().vpnAddr.rate, 0)
+
+	require.NoError(t, c.ReloadConfigString("handshakes: {rate_limit: {rate: 0}}"))
+	hm.reloadLimits(c)
+	assert.Nil(t, hm.limits.Load())
+}
+
+func TestHandshakeManager_answered(t *testing.T) {
+	l := test.NewLogger()
+	mainHM := newHostMap(l)
+	hm := NewHandshakeManager(l, mainHM, newTestLighthouse(), &udp.NoopConn{}, defaultHandshakeConfig)
+	vpnAddr := netip.MustParseAddr("10.1.1.1")
+
+	assert.False(t, hm.answered(vpnAddr, []byte("first")))
+
+	// The host we answered is found even once a newer tunnel is primary
+	for i, msg := range []string{"first", "second"} {
+		hostinfo := &HostInfo{
+			vpnAddrs:        []netip.Addr{vpnAddr},
+			localIndexId:    uint32(i + 1),
+			HandshakePacket: map[uint8][]byte{0: []byte(msg)},
+		}
+		mainHM.unlockedAddHostInfo(hostinfo, &Interface{})
+	}
+	assert.True(t, hm.answered(vpnAddr, []byte("first")))
+	assert.True(t, hm.answered(vpnAddr, []byte("second")))
+	assert.False(t, hm.answered(vpnAddr, []byte("third")))
+	assert.False(t, hm.answered(netip.MustParseAddr("10.1.1.2"), []byte("first")))
+}
@@ -0,0 +1,115 @@
+package nebula
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+)
+
+// handshakePeer is what we learned about the other host from the certificate in its handshake message
+type handshakePeer struct {
+	cert *cert.CachedCertificate
+	// vpnAddrs and networks are the vpn networks in the certificate that are within our own
+	vpnAddrs []netip.Addr
+	networks []netip.Prefix
+}
+
+// verifyHandshakePeer recombines the certificate in a handshake message with the static key noise gave us, verifies
+// it and keeps the vpn addresses we can use. Responders set refuseSelf to turn away certificates that hold one of our
+// own vpn addresses. Problems are logged on e, which carries the fields for the stage, and nil is returned.
+func (f *Interface) verifyHandshakePeer(e *logrus.Entry, ci *ConnectionState, d *NebulaHandshakeDetails, refuseSelf bool) *handshakePeer {
+	rc, err := cert.Recombine(cert.Version(d.CertVersion), d.Cert, ci.H.PeerStatic(), ci.Curve())
+	if err != nil {
+		e.WithError(err).Info("Handshake did not contain a certificate")
+		return nil
+	}
+
+	remoteCert, err := f.pki.GetCAPool().VerifyCertificate(time.Now(), rc)
+	if err != nil {
+		fp, err := rc.Fingerprint()
+		if err != nil {
+			fp = "<error generating certificate fingerprint>"
+		}
+
+		e := e.WithError(err).
+			WithField("certVpnNetworks", rc.Networks()).
+			WithField("certFingerprint", fp)
+
+		if f.l.Level >= logrus.DebugLevel {
+			e = e.WithField("cert", rc)
+		}
+
+		e.Info("Invalid certificate from host")
+		return nil
+	}
+
+	if len(remoteCert.Certificate.Networks()) == 0 {
+		e.WithField("cert", remoteCert).Info("No networks in certificate")
+		return nil
+	}
+
+	e = e.WithField("certName", remoteCert.Certificate.Name()).
+		WithField("certVersion", remoteCert.Certificate.Version()).
+		WithField("fingerprint", remoteCert.Fingerprint).
+		WithField("issuer", remoteCert.Certificate.Issuer())
+
+	p := &handshakePeer{cert: remoteCert}
+	for _, network := range remoteCert.Certificate.Networks() {
+		vpnAddr := network.Addr()
+		if refuseSelf && f.myVpnAddrsTable.Contains(vpnAddr) {
+			e.WithField("vpnAddr", vpnAddr).Error("Refusing to handshake with myself")
+			return nil
+		}
+
+		// vpnAddrs outside our vpn networks are of no use to us, filter them out
+		if !f.myVpnNetworksTable.Contains(vpnAddr) {
+			continue
+		}
+
+		p.networks = append(p.networks, network)
+		p.vpnAddrs = append(p.vpnAddrs, vpnAddr)
+	}
+
+	if len(p.vpnAddrs) == 0 {
+		e.Error("No usable vpn addresses from host, refusing handshake")
+		return nil
+	}
+
+	return p
+}
+
+// newResponderHostInfo makes the hostinfo a responder keeps for the initiator of a handshake
+func newResponderHostInfo(ci *ConnectionState, remoteIndex uint32) *HostInfo {
+	return &HostInfo{
+		ConnectionState: ci,
+		remoteIndexId:   remoteIndex,
+		HandshakePacket: make(map[uint8][]byte, 0),
+		relayState: RelayState{
+			relays:         nil,
+			relayForByAddr: map[netip.Addr]*Relay{},
+			relayForByIdx:  map[uint32]*Relay{},
+		},
+	}
+}
+
+// setHandshakePeer records the verified peer and the path its handshake took on a hostinfo that is about to complete
+func (f *Interface) setHandshakePeer(hostinfo *HostInfo, p *handshakePeer, addr netip.AddrPort, via *ViaSender) {
+	hostinfo.ConnectionState.peerCert = p.cert
+	hostinfo.vpnAddrs = p.vpnAddrs
+	if hostinfo.remotes == nil {
+		hostinfo.remotes = f.lightHouse.QueryCache(p.vpnAddrs)
+	}
+
+	if addr.IsValid() {
+		hostinfo.SetRemote(addr)
+	} else if via != nil {
+		hostinfo.relayState.InsertRelayTo(via.relayHI.vpnAddrs[0])
+		// I successfully received a handshake. Just in case I marked this tunnel as 'Disestablished', ensure
+		// it's correctly marked as working.
+		via.relayHI.relayState.UpdateRelayForByIdxState(via.remoteIdx, Established)
+	}
+
+	hostinfo.buildNetworks(p.networks, p.cert.Certificate.UnsafeNetworks())
+}
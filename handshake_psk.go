@@ -0,0 +1,44 @@
+package nebula
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/slackhq/nebula/config"
+)
+
+// handshakePSKInfo binds the derived key to its use in the handshake
+const handshakePSKInfo = "nebula handshake psk"
+
+// minHandshakePSKLen is the shortest secret accepted in handshakes.psk
+const minHandshakePSKLen = 16
+
+// loadHandshakePSKsFromConfig reads `handshakes.psk` and derives a noise pre-shared key from each secret.
+// An empty string is kept as a nil key which means the handshake is done without a psk, this allows adding or
+// removing a psk from a running network. Returns nil if no psk is configured.
+func loadHandshakePSKsFromConfig(c *config.C) ([][]byte, error) {
+	secrets := c.GetStringSlice("handshakes.psk", nil)
+	if len(secrets) == 0 {
+		return nil, nil
+	}
+
+	psks := make([][]byte, len(secrets))
+	for i, s := range secrets {
+		if s == "" {
+			continue
+		}
+
+		if len(s) < minHandshakePSKLen {
+			return nil, fmt.Errorf("handshakes.psk entry #%v must be at least %v characters", i, minHandshakePSKLen)
+		}
+
+		psk, err := hkdf.Key(sha256.New, []byte(s), nil, handshakePSKInfo, 32)
+		if err != nil {
+			return nil, fmt.Errorf("handshakes.psk entry #%v could not be derived: %w", i, err)
+		}
+		psks[i] = psk
+	}
+
+	return psks, nil
+}
@@ -0,0 +1,44 @@
+package nebula
+
+import (
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadHandshakePSKsFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	psks, err := loadHandshakePSKsFromConfig(c)
+	require.NoError(t, err)
+	assert.Nil(t, psks)
+	assert.Equal(t, [][]byte{nil}, (&CertState{psks: psks}).acceptedPSKs())
+	assert.False(t, (&CertState{psks: psks}).requiresPSK())
+
+	c.Settings["handshakes"] = map[string]any{"psk": []any{"a network secret!", "", "another network secret"}}
+	psks, err = loadHandshakePSKsFromConfig(c)
+	require.NoError(t, err)
+	require.Len(t, psks, 3)
+	assert.Len(t, psks[0], 32)
+	assert.Nil(t, psks[1])
+	assert.NotEqual(t, psks[0], psks[2])
+
+	cs := &CertState{psks: psks}
+	assert.Equal(t, psks[0], cs.initiatingPSK())
+	assert.Equal(t, psks, cs.acceptedPSKs())
+	assert.False(t, cs.requiresPSK(), "an empty secret still accepts handshakes without a psk")
+	assert.True(t, (&CertState{psks: [][]byte{psks[0], psks[2]}}).requiresPSK())
+
+	// The same secret always derives the same key
+	again, err := loadHandshakePSKsFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, psks, again)
+
+	c.Settings["handshakes"] = map[string]any{"psk": []any{"a network secret!", "short"}}
+	_, err = loadHandshakePSKsFromConfig(c)
+	require.EqualError(t, err, "handshakes.psk entry #1 must be at least 16 characters")
+}
@@ -0,0 +1,628 @@
+package nebula
+
+import (
+	"crypto/sha256"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/header"
+)
+
+// NOISE XX Handshakes
+//
+// Unlike IX the initiator does not send its certificate until the responder has proven who it is, which keeps the
+// initiators identity away from passive observers. This costs an extra message:
+//
+//	1: -> e                  initiator index and the certificate version it will use
+//	2: <- e, ee, s, es       responder index and certificate
+//	3: -> s, se              initiator certificate, both sides have keys after this message
+//
+// The responder holds pending state between messages 2 and 3 in the handshake manager, keyed by its local index.
+
+// xxMaxAmplification is how many times larger than a first message we let our answer be before the initiator has
+// proven its address with a cookie
+const xxMaxAmplification = 3
+
+// This function constructs a handshake packet, but does not actually send it
+// Sending is done by the handshake manager
+func xxHandshakeStage0(f *Interface, hh *HandshakeHostInfo) bool {
+	err := f.handshakeManager.allocateIndex(hh)
+	if err != nil {
+		f.l.WithError(err).WithField("vpnAddrs", hh.hostinfo.vpnAddrs).
+			WithField("handshake", m{"stage": 0, "style": "xx_psk0"}).Error("Failed to generate index")
+		return false
+	}
+
+	// If we're connecting to a v6 address we must use a v2 cert
+	cs := f.pki.getCertState()
+	v := cs.initiatingVersion
+	for _, a := range hh.hostinfo.vpnAddrs {
+		if a.Is6() {
+			v = cert.Version2
+			break
+		}
+	}
+
+	crt := cs.getCertificate(v)
+	if crt == nil || cs.getHandshakeBytes(v) == nil {
+		f.l.WithField("vpnAddrs", hh.hostinfo.vpnAddrs).
+			WithField("handshake", m{"stage": 0, "style": "xx_psk0"}).
+			WithField("certVersion", v).
+			Error("Unable to handshake with host because no certificate is available")
+		return false
+	}
+
+	ci, err := NewConnectionState(f.l, cs, crt, true, noise.HandshakeXX, cs.initiatingPSK(), cs.initiatingCipher())
+	if err != nil {
+		f.l.WithError(err).WithField("vpnAddrs", hh.hostinfo.vpnAddrs).
+			WithField("handshake", m{"stage": 0, "style": "xx_psk0"}).
+			WithField("certVersion", v).
+			Error("Failed to create connection state")
+		return false
+	}
+	hh.hostinfo.ConnectionState = ci
+
+	// The certificate itself is sent in stage 3, only tell the responder which version to answer with
+	hs := &NebulaHandshake{
+		Details: &NebulaHandshakeDetails{
+			InitiatorIndex: hh.hostinfo.localIndexId,
+			Time:           uint64(time.Now().UnixNano()),
+			CertVersion:    uint32(v),
+			Ciphers:        cs.acceptedCiphers(),
+			Cookie:         hh.cookie,
+			// Pad to about the size of the answer, responders ask for a cookie before answering much smaller messages
+			Padding: make([]byte, len(cs.getHandshakeBytes(v))),
+		},
+	}
+
+	hsBytes, err := hs.Marshal()
+	if err != nil {
+		f.l.WithError(err).WithField("vpnAddrs", hh.hostinfo.vpnAddrs).
+			WithField("certVersion", v).
+			WithField("handshake", m{"stage": 0, "style": "xx_psk0"}).Error("Failed to marshal handshake message")
+		return false
+	}
+
+	h := header.Encode(make([]byte, header.Len), header.Version, header.Handshake, header.HandshakeXXPSK0, 0, 1)
+
+	msg, _, _, err := ci.H.WriteMessage(h, hsBytes)
+	if err != nil {
+		f.l.WithError(err).WithField("vpnAddrs", hh.hostinfo.vpnAddrs).
+			WithField("handshake", m{"stage": 0, "style": "xx_psk0"}).Error("Failed to call noise.WriteMessage")
+		return false
+	}
+
+	// We are sending handshake packet 1, so we don't expect to receive
+	// handshake packet 1 from the responder
+	ci.window.Update(f.l, 1)
+
+	hh.hostinfo.HandshakePacket[0] = msg
+	hh.ready = true
+	return true
+}
+
+func xxHandshakeStage1(f *Interface, addr netip.AddrPort, via *ViaSender, packet []byte, h *header.H) {
+	cs := f.pki.getCertState()
+	crt := cs.GetDefaultCertificate()
+	if crt == nil {
+		f.l.WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 1, "style": "xx_psk0"}).
+			WithField("certVersion", cs.initiatingVersion).
+			Error("Unable to handshake with host because no certificate is available")
+		return
+	}
+
+	// A first message we already answered is a retransmit, answer it again instead of holding more state
+	digest := sha256.Sum256(packet[header.Len:])
+	if xxResendStage2(f, addr, via, digest) {
+		return
+	}
+
+	// The initiator may be using any of our ciphers and pre-shared keys. Message 1 carries no static key so a payload
+	// read without a psk always decrypts, require it to unmarshal and name the cipher we read it with before settling.
+	var ci *ConnectionState
+	var hs *NebulaHandshake
+	var err error
+tryKeys:
+	for _, cipher := range cs.acceptedCiphers() {
+		for _, psk := range cs.acceptedPSKs() {
+			ci, err = NewConnectionState(f.l, cs, crt, false, noise.HandshakeXX, psk, cipher)
+			if err != nil {
+				f.l.WithError(err).WithField("udpAddr", addr).
+					WithField("handshake", m{"stage": 1, "style": "xx_psk0"}).
+					Error("Failed to create connection state")
+				return
+			}
+
+			var msg []byte
+			msg, _, _, err = ci.H.ReadMessage(nil, packet[header.Len:])
+			if err != nil {
+				continue
+			}
+
+			hs = &NebulaHandshake{}
+			err = hs.Unmarshal(msg)
+			if err == nil && hs.Details != nil && hs.Details.InitiatorIndex != 0 && handshakeCipherMatches(ci, msg) {
+				break tryKeys
+			}
+			hs = nil
+		}
+	}
+
+	if hs == nil {
+		f.l.WithError(err).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 1, "style": "xx_psk0"}).
+			Error("Failed to read handshake message")
+		return
+	}
+
+	// Answer with the certificate version the initiator is going to use if we have it
+	if v := cert.Version(hs.Details.CertVersion); v != crt.Version() {
+		if rc := cs.getCertificate(v); rc != nil {
+			ci.myCert = rc
+		}
+	}
+
+	certBytes := cs.getHandshakeBytes(ci.myCert.Version())
+	if certBytes == nil {
+		f.l.WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 1, "style": "xx_psk0"}).
+			WithField("certVersion", ci.myCert.Version()).
+			Error("Unable to handshake with host because no certificate handshake bytes is available")
+		return
+	}
+
+	// Anyone can send a first message from any address, the initiator has to prove its address before we send back
+	// much more than it sent us
+	if !f.handshakeManager.admitStage1(addr, hs.Details, len(packet)*xxMaxAmplification < len(certBytes)) {
+		return
+	}
+
+	hh := &HandshakeHostInfo{
+		hostinfo:     newResponderHostInfo(ci, hs.Details.InitiatorIndex),
+		startTime:    time.Now(),
+		style:        header.HandshakeXXPSK0,
+		lastRemotes:  []netip.AddrPort{addr},
+		firstMessage: digest,
+	}
+	hostinfo := hh.hostinfo
+
+	// Hold the lock until we are done with the hostinfo, it becomes visible to stage 3 once the index is allocated
+	hh.Lock()
+	defer hh.Unlock()
+
+	err = f.handshakeManager.allocateIndex(hh)
+	if err != nil {
+		f.l.WithError(err).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 1, "style": "xx_psk0"}).Error("Failed to generate index")
+		return
+	}
+
+	hs.Details.ResponderIndex = hostinfo.localIndexId
+	hs.Details.Cert = certBytes
+	hs.Details.CertVersion = uint32(ci.myCert.Version())
+	hs.Details.Time = uint64(time.Now().UnixNano())
+	hs.Details.Padding = nil
+	if err = respondCipher(ci, cs.acceptedCiphers(), hs.Details); err != nil {
+		f.l.WithError(err).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 1, "style": "xx_psk0"}).Error("Failed to pick a cipher")
+		f.handshakeManager.DeleteHostInfo(hostinfo)
+		return
+	}
+
+	hsBytes, err := hs.Marshal()
+	if err != nil {
+		f.l.WithError(err).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 1, "style": "xx_psk0"}).Error("Failed to marshal handshake message")
+		f.handshakeManager.DeleteHostInfo(hostinfo)
+		return
+	}
+
+	nh := header.Encode(make([]byte, header.Len), header.Version, header.Handshake, header.HandshakeXXPSK0, hs.Details.InitiatorIndex, 2)
+	msg, _, _, err := ci.H.WriteMessage(nh, hsBytes)
+	if err != nil {
+		f.l.WithError(err).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 1, "style": "xx_psk0"}).Error("Failed to call noise.WriteMessage")
+		f.handshakeManager.DeleteHostInfo(hostinfo)
+		return
+	}
+
+	hostinfo.HandshakePacket[0] = make([]byte, len(packet[header.Len:]))
+	copy(hostinfo.HandshakePacket[0], packet[header.Len:])
+	hostinfo.HandshakePacket[2] = msg
+
+	// Mark packet 1 as seen so it doesn't show up as missed, we are sending packet 2
+	ci.window.Update(f.l, 1)
+	ci.window.Update(f.l, 2)
+
+	// Retransmits of the first message are answered with the same second message until the handshake is done
+	f.handshakeManager.Lock()
+	f.handshakeManager.xxFirstMessages[digest] = hh
+	f.handshakeManager.Unlock()
+
+	// Forget about this handshake if the initiator never finishes it
+	f.handshakeManager.responderTimer.Add(hostinfo.localIndexId, hsTimeout(f.handshakeManager.config.retries, f.handshakeManager.config.tryInterval))
+
+	xxSendStage2(f, addr, via, hostinfo, false)
+}
+
+// xxResendStage2 answers a retransmitted first message with the second message we already sent for it. Returns true
+// if the first message was one we answered before and there is nothing more to do with it.
+func xxResendStage2(f *Interface, addr netip.AddrPort, via *ViaSender, digest [sha256.Size]byte) bool {
+	f.handshakeManager.RLock()
+	hh := f.handshakeManager.xxFirstMessages[digest]
+	f.handshakeManager.RUnlock()
+	if hh == nil {
+		return false
+	}
+
+	hh.Lock()
+	defer hh.Unlock()
+
+	if len(hh.hostinfo.vpnAddrs) > 0 {
+		// The handshake completed while we waited for the lock, the initiator has what it needs
+		return true
+	}
+
+	if !slices.Equal(hh.lastRemotes, []netip.AddrPort{addr}) {
+		// The initiator does not move between retransmits, this is a copy from somewhere else
+		f.l.WithField("udpAddr", addr).WithField("answeredUdpAddrs", hh.lastRemotes).
+			WithField("handshake", m{"stage": 1, "style": "xx_psk0"}).
+			Debug("Ignoring a first handshake message that was already answered for another address")
+		return true
+	}
+
+	xxSendStage2(f, addr, via, hh.hostinfo, true)
+	return true
+}
+
+// xxSendStage2 sends the second message we hold for hostinfo
+func xxSendStage2(f *Interface, addr netip.AddrPort, via *ViaSender, hostinfo *HostInfo, cached bool) {
+	msg := hostinfo.HandshakePacket[2]
+	f.messageMetrics.Tx(header.Handshake, header.HandshakeXXPSK0, 1)
+	if addr.IsValid() {
+		err := f.outside.WriteTo(msg, addr)
+		if err != nil {
+			f.l.WithField("udpAddr", addr).
+				WithField("initiatorIndex", hostinfo.remoteIndexId).WithField("responderIndex", hostinfo.localIndexId).
+				WithField("handshake", m{"stage": 2, "style": "xx_psk0"}).WithField("cached", cached).
+				WithError(err).Error("Failed to send handshake")
+		} else {
+			f.l.WithField("udpAddr", addr).
+				WithField("initiatorIndex", hostinfo.remoteIndexId).WithField("responderIndex", hostinfo.localIndexId).
+				WithField("handshake", m{"stage": 2, "style": "xx_psk0"}).WithField("cached", cached).
+				Debug("Handshake message sent")
+		}
+	} else {
+		if via == nil {
+			f.l.Error("Handshake send failed: both addr and via are nil.")
+			return
+		}
+		f.SendVia(via.relayHI, via.relay, msg, make([]byte, 12), make([]byte, mtu), false)
+		f.l.WithField("relay", via.relayHI.vpnAddrs[0]).
+			WithField("initiatorIndex", hostinfo.remoteIndexId).WithField("responderIndex", hostinfo.localIndexId).
+			WithField("handshake", m{"stage": 2, "style": "xx_psk0"}).WithField("cached", cached).
+			Debug("Handshake message sent")
+	}
+}
+
+func xxHandshakeStage2(f *Interface, addr netip.AddrPort, via *ViaSender, hh *HandshakeHostInfo, packet []byte, h *header.H) bool {
+	if hh == nil {
+		// Nothing here to tear down, got a bogus stage 2 packet
+		return true
+	}
+
+	hh.Lock()
+	defer hh.Unlock()
+
+	hostinfo := hh.hostinfo
+	ci := hostinfo.ConnectionState
+	if hh.style != header.HandshakeXXPSK0 || ci == nil || !ci.initiator {
+		// Not a handshake we started with xx, leave it be
+		return false
+	}
+
+	if addr.IsValid() {
+		// The vpnAddr we know about is the one we tried to handshake with, use it to apply the remote allow list.
+		if !f.lightHouse.GetRemoteAllowList().AllowAll(hostinfo.vpnAddrs, addr.Addr()) {
+			f.l.WithField("vpnAddrs", hostinfo.vpnAddrs).WithField("udpAddr", addr).Debug("lighthouse.remote_allow_list denied incoming handshake")
+			return false
+		}
+	}
+
+	msg, _, _, err := ci.H.ReadMessage(nil, packet[header.Len:])
+	if err != nil {
+		f.l.WithError(err).WithField("vpnAddrs", hostinfo.vpnAddrs).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 2, "style": "xx_psk0"}).WithField("header", h).
+			Error("Failed to call noise.ReadMessage")
+
+		// We don't want to tear down the connection on a bad ReadMessage because it could be an attacker trying
+		// to DOS us.
+		return false
+	}
+
+	hs := &NebulaHandshake{}
+	err = hs.Unmarshal(msg)
+	if err != nil || hs.Details == nil {
+		f.l.WithError(err).WithField("vpnAddrs", hostinfo.vpnAddrs).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 2, "style": "xx_psk0"}).Error("Failed unmarshal handshake message")
+
+		// The handshake state machine has moved on, if things break now there is no chance to recover. Tear down and start again
+		return true
+	}
+
+	peer := f.verifyHandshakePeer(f.l.WithField("udpAddr", addr).WithField("vpnAddrs", hostinfo.vpnAddrs).
+		WithField("handshake", m{"stage": 2, "style": "xx_psk0"}), ci, hs.Details, false)
+	if peer == nil {
+		return true
+	}
+
+	remoteCert := peer.cert
+	vpnAddrs := peer.vpnAddrs
+	vpnNetworks := remoteCert.Certificate.Networks()
+	certName := remoteCert.Certificate.Name()
+	certVersion := remoteCert.Certificate.Version()
+	fingerprint := remoteCert.Fingerprint
+	issuer := remoteCert.Certificate.Issuer()
+
+	// Ensure the right host responded, we have not revealed who we are yet so there is nothing to close on their side
+	if !slices.Contains(vpnAddrs, hostinfo.vpnAddrs[0]) {
+		f.l.WithField("intendedVpnAddrs", hostinfo.vpnAddrs).WithField("haveVpnNetworks", vpnNetworks).
+			WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("certVersion", certVersion).
+			WithField("handshake", m{"stage": 2, "style": "xx_psk0"}).
+			Info("Incorrect host responded to handshake")
+
+		// Release our old handshake from pending, it should not continue
+		f.handshakeManager.DeleteHostInfo(hostinfo)
+
+		// Create a new hostinfo/handshake for the intended vpn ip
+		f.handshakeManager.StartHandshake(hostinfo.vpnAddrs[0], func(newHH *HandshakeHostInfo) {
+			// Block the current used address
+			newHH.hostinfo.remotes = hostinfo.remotes
+			newHH.hostinfo.remotes.BlockRemote(addr)
+
+			f.l.WithField("blockedUdpAddrs", newHH.hostinfo.remotes.CopyBlockedRemotes()).
+				WithField("vpnNetworks", vpnNetworks).
+				WithField("remotes", newHH.hostinfo.remotes.CopyAddrs(f.hostMap.GetPreferredRanges())).
+				Info("Blocked addresses for handshakes")
+
+			// Swap the packet store to benefit the original intended recipient
+			newHH.packetStore = hh.packetStore
+			hh.packetStore = []*cachedPacket{}
+		})
+
+		return true
+	}
+
+	// The responder is who we wanted, reveal ourselves
+	cs := f.pki.getCertState()
+	if err = acceptCipher(ci, cs.acceptedCiphers(), hs.Details); err != nil {
+		f.l.WithError(err).WithField("vpnAddrs", vpnAddrs).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 2, "style": "xx_psk0"}).Error("Failed to use the cipher picked by the responder")
+		return true
+	}
+
+	myHs := &NebulaHandshake{
+		Details: &NebulaHandshakeDetails{
+			InitiatorIndex: hostinfo.localIndexId,
+			ResponderIndex: hs.Details.ResponderIndex,
+			Time:           uint64(time.Now().UnixNano()),
+			Cert:           cs.getHandshakeBytes(ci.myCert.Version()),
+			CertVersion:    uint32(ci.myCert.Version()),
+		},
+	}
+
+	if myHs.Details.Cert == nil {
+		f.l.WithField("vpnAddrs", vpnAddrs).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 3, "style": "xx_psk0"}).
+			WithField("certVersion", ci.myCert.Version()).
+			Error("Unable to handshake with host because no certificate handshake bytes is available")
+		return true
+	}
+
+	hsBytes, err := myHs.Marshal()
+	if err != nil {
+		f.l.WithError(err).WithField("vpnAddrs", vpnAddrs).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 3, "style": "xx_psk0"}).Error("Failed to marshal handshake message")
+		return true
+	}
+
+	nh := header.Encode(make([]byte, header.Len), header.Version, header.Handshake, header.HandshakeXXPSK0, hs.Details.ResponderIndex, 3)
+	msg, eKey, dKey, err := ci.H.WriteMessage(nh, hsBytes)
+	if err != nil {
+		f.l.WithError(err).WithField("vpnAddrs", vpnAddrs).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 3, "style": "xx_psk0"}).Error("Failed to call noise.WriteMessage")
+		return true
+	} else if dKey == nil || eKey == nil {
+		f.l.WithField("vpnAddrs", vpnAddrs).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 3, "style": "xx_psk0"}).
+			Error("Noise did not arrive at a key")
+		return true
+	}
+
+	hostinfo.remoteIndexId = hs.Details.ResponderIndex
+	hostinfo.lastHandshakeTime = hs.Details.Time
+
+	// Store our symmetric keys
+	ci.dKey = NewNebulaCipherState(dKey, ci.cipher)
+	ci.eKey = NewNebulaCipherState(eKey, ci.cipher)
+
+	// Mark packet 2 as seen so it doesn't show up as missed, we used counter 3 for our final handshake packet
+	ci.window.Update(f.l, 2)
+	ci.messageCounter.Add(1)
+
+	f.messageMetrics.Tx(header.Handshake, header.HandshakeXXPSK0, 1)
+	if addr.IsValid() {
+		err = f.outside.WriteTo(msg, addr)
+	} else {
+		f.SendVia(via.relayHI, via.relay, msg, make([]byte, 12), make([]byte, mtu), false)
+	}
+
+	duration := time.Since(hh.startTime).Nanoseconds()
+	e := f.l.WithField("vpnAddrs", vpnAddrs).WithField("udpAddr", addr).
+		WithField("certName", certName).
+		WithField("certVersion", certVersion).
+		WithField("fingerprint", fingerprint).
+		WithField("issuer", issuer).
+		WithField("initiatorIndex", hs.Details.InitiatorIndex).WithField("responderIndex", hs.Details.ResponderIndex).
+		WithField("remoteIndex", h.RemoteIndex).WithField("handshake", m{"stage": 3, "style": "xx_psk0"}).
+		WithField("durationNs", duration).
+		WithField("sentCachedPackets", len(hh.packetStore))
+	if err != nil {
+		// The responder will tell us it has no tunnel when our traffic arrives, that tears this one down to retry
+		e.WithError(err).Error("Failed to send handshake")
+	} else {
+		e.Info("Handshake message sent")
+	}
+
+	// Build up the radix for the firewall if we have subnets in the cert, make sure the current udpAddr being used is
+	// set for responding
+	f.setHandshakePeer(hostinfo, peer, addr, via)
+
+	// Complete our handshake and update metrics, this will replace any existing tunnels for the vpnAddrs here
+	f.handshakeManager.Complete(hostinfo, f)
+	f.connectionManager.AddTrafficWatch(hostinfo)
+
+	if f.l.Level >= logrus.DebugLevel {
+		hostinfo.logger(f.l).Debugf("Sending %d stored packets", len(hh.packetStore))
+	}
+
+	if len(hh.packetStore) > 0 {
+		nb := make([]byte, 12, 12)
+		out := make([]byte, mtu)
+		for _, cp := range hh.packetStore {
+			cp.callback(cp.messageType, cp.messageSubType, hostinfo, cp.packet, nb, out)
+		}
+		f.cachedPacketMetrics.sent.Inc(int64(len(hh.packetStore)))
+	}
+
+	hostinfo.remotes.RefreshFromHandshake(vpnAddrs)
+	f.metricHandshakes.Update(duration)
+
+	return false
+}
+
+func xxHandshakeStage3(f *Interface, addr netip.AddrPort, via *ViaSender, hh *HandshakeHostInfo, packet []byte, h *header.H) bool {
+	if hh == nil {
+		// Nothing here to tear down, got a bogus stage 3 packet
+		return true
+	}
+
+	hh.Lock()
+	defer hh.Unlock()
+
+	hostinfo := hh.hostinfo
+	ci := hostinfo.ConnectionState
+	if hh.style != header.HandshakeXXPSK0 || ci == nil || ci.initiator || len(hostinfo.vpnAddrs) > 0 {
+		// Not a handshake we are responding to with xx, leave it be
+		return false
+	}
+
+	msg, dKey, eKey, err := ci.H.ReadMessage(nil, packet[header.Len:])
+	if err != nil {
+		f.l.WithError(err).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 3, "style": "xx_psk0"}).WithField("header", h).
+			Error("Failed to call noise.ReadMessage")
+
+		// Could be an attacker guessing our index, let the real final message arrive
+		return false
+	} else if dKey == nil || eKey == nil {
+		f.l.WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 3, "style": "xx_psk0"}).
+			Error("Noise did not arrive at a key")
+		return true
+	}
+
+	hs := &NebulaHandshake{}
+	err = hs.Unmarshal(msg)
+	if err != nil || hs.Details == nil {
+		f.l.WithError(err).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 3, "style": "xx_psk0"}).Error("Failed unmarshal handshake message")
+		return true
+	}
+
+	peer := f.verifyHandshakePeer(f.l.WithField("udpAddr", addr).WithField("handshake", m{"stage": 3, "style": "xx_psk0"}), ci, hs.Details, true)
+	if peer == nil {
+		return true
+	}
+
+	vpnAddrs := peer.vpnAddrs
+	certName := peer.cert.Certificate.Name()
+	certVersion := peer.cert.Certificate.Version()
+	fingerprint := peer.cert.Fingerprint
+	issuer := peer.cert.Certificate.Issuer()
+
+	if addr.IsValid() {
+		// addr can be invalid when the tunnel is being relayed.
+		// We only want to apply the remote allow list for direct tunnels here
+		if !f.lightHouse.GetRemoteAllowList().AllowAll(vpnAddrs, addr.Addr()) {
+			f.l.WithField("vpnAddrs", vpnAddrs).WithField("udpAddr", addr).Debug("lighthouse.remote_allow_list denied incoming handshake")
+			return true
+		}
+	}
+
+	if !f.handshakeManager.limits.Load().allowVpnAddrs(vpnAddrs, time.Now()) {
+		f.l.WithField("vpnAddrs", vpnAddrs).WithField("udpAddr", addr).
+			WithField("handshake", m{"stage": 3, "style": "xx_psk0"}).Debug("handshakes.rate_limit exceeded, refusing handshake")
+		return true
+	}
+
+	f.l.WithField("vpnAddrs", vpnAddrs).WithField("udpAddr", addr).
+		WithField("certName", certName).
+		WithField("certVersion", certVersion).
+		WithField("fingerprint", fingerprint).
+		WithField("issuer", issuer).
+		WithField("initiatorIndex", hs.Details.InitiatorIndex).WithField("responderIndex", hs.Details.ResponderIndex).
+		WithField("remoteIndex", h.RemoteIndex).WithField("handshake", m{"stage": 3, "style": "xx_psk0"}).
+		WithField("durationNs", time.Since(hh.startTime).Nanoseconds()).
+		Info("Handshake message received")
+
+	// Release our pending index before the vpnAddrs are known, we don't want to touch any handshake we may be
+	// initiating with this host. The hostinfo moves to the main hostmap below.
+	f.handshakeManager.DeleteHostInfo(hostinfo)
+
+	hostinfo.lastHandshakeTime = hs.Details.Time
+	ci.dKey = NewNebulaCipherState(dKey, ci.cipher)
+	ci.eKey = NewNebulaCipherState(eKey, ci.cipher)
+
+	// Mark packet 3 as seen so it doesn't show up as missed
+	ci.window.Update(f.l, 3)
+
+	f.setHandshakePeer(hostinfo, peer, addr, via)
+
+	existing, err := f.handshakeManager.CheckAndComplete(hostinfo, 0, f)
+	if err != nil {
+		// Our pending state is already gone, do not ask for it to be torn down again
+		switch err {
+		case ErrExistingHostInfo:
+			// This means there was an existing tunnel and this handshake was older than the one we are currently based on
+			f.l.WithField("vpnAddrs", vpnAddrs).WithField("udpAddr", addr).
+				WithField("certName", certName).
+				WithField("oldHandshakeTime", existing.lastHandshakeTime).
+				WithField("newHandshakeTime", hostinfo.lastHandshakeTime).
+				WithField("handshake", m{"stage": 3, "style": "xx_psk0"}).
+				Info("Handshake too old")
+
+			// Send a test packet to trigger an authenticated tunnel test, this should suss out any lingering tunnel issues
+			f.SendMessageToVpnAddr(header.Test, header.TestRequest, vpnAddrs[0], []byte(""), make([]byte, 12, 12), make([]byte, mtu))
+		default:
+			f.l.WithError(err).WithField("vpnAddrs", vpnAddrs).WithField("udpAddr", addr).
+				WithField("certName", certName).
+				WithField("localIndex", hostinfo.localIndexId).
+				WithField("handshake", m{"stage": 3, "style": "xx_psk0"}).
+				Error("Failed to add HostInfo to HostMap")
+		}
+		return false
+	}
+
+	f.connectionManager.AddTrafficWatch(hostinfo)
+	hostinfo.remotes.RefreshFromHandshake(vpnAddrs)
+
+	return false
+}
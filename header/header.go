@@ -62,6 +62,10 @@ const (
 const (
 	HandshakeIXPSK0 MessageSubType = 0
 	HandshakeXXPSK0 MessageSubType = 1
+	// HandshakeIXPSK0MLKEM768 is an IX handshake that also carries an ML-KEM-768 key exchange
+	HandshakeIXPSK0MLKEM768 MessageSubType = 2
+	// HandshakeCookie is a responder asking the initiator to repeat its first message with the cookie it carries
+	HandshakeCookie MessageSubType = 3
 )
 
 var ErrHeaderTooShort = errors.New("header is too short")
@@ -83,7 +87,10 @@ var subTypeMap = map[MessageType]*map[MessageSubType]string{
 	Test:        &subTypeTestMap,
 	CloseTunnel: &subTypeNoneMap,
 	Handshake: {
-		HandshakeIXPSK0: "ix_psk0",
+		HandshakeIXPSK0:         "ix_psk0",
+		HandshakeXXPSK0:         "xx_psk0",
+		HandshakeIXPSK0MLKEM768: "ix_psk0_mlkem768",
+		HandshakeCookie:         "cookie",
 	},
 	Control: &subTypeNoneMap,
 }
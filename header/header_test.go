@@ -96,7 +96,10 @@ func TestTypeMap(t *testing.T) {
 		Test:        &subTypeTestMap,
 		CloseTunnel: &subTypeNoneMap,
 		Handshake: {
-			HandshakeIXPSK0: "ix_psk0",
+			HandshakeIXPSK0:         "ix_psk0",
+			HandshakeXXPSK0:         "xx_psk0",
+			HandshakeIXPSK0MLKEM768: "ix_psk0_mlkem768",
+			HandshakeCookie:         "cookie",
 		},
 		Control: &subTypeNoneMap,
 	}, subTypeMap)
@@ -11,7 +11,9 @@ import (
 	"github.com/slackhq/nebula/routing"
 )
 
-func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet, nb, out []byte, q int, localCache firewall.ConntrackCache) {
+// consumeInsidePacket sends a packet read from the tun device. When batch is not nil out must come from batch.next(), the
+// packet is added to the batch instead of being sent right away.
+func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet, nb, out []byte, q int, localCache firewall.ConntrackCache, batch *sendBatch) {
 	err := newPacket(packet, false, fwPacket)
 	if err != nil {
 		if f.l.Level >= logrus.DebugLevel {
@@ -66,9 +68,9 @@ func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet
 		return
 	}
 
-	dropReason := f.firewall.Drop(*fwPacket, false, hostinfo, f.pki.GetCAPool(), localCache)
+	dropReason := f.firewall.drop(*fwPacket, false, hostinfo, f.pki.GetCAPool(), localCache, len(packet))
 	if dropReason == nil {
-		f.sendNoMetrics(header.Message, 0, hostinfo.ConnectionState, hostinfo, netip.AddrPort{}, packet, nb, out, q)
+		f.sendNoMetricsBatch(header.Message, 0, hostinfo.ConnectionState, hostinfo, netip.AddrPort{}, packet, nb, out, q, batch)
 
 	} else {
 		f.rejectInside(packet, out, q)
@@ -218,7 +220,7 @@ func (f *Interface) sendMessageNow(t header.MessageType, st header.MessageSubTyp
 	}
 
 	// check if packet is in outbound fw rules
-	dropReason := f.firewall.Drop(*fp, false, hostinfo, f.pki.GetCAPool(), nil)
+	dropReason := f.firewall.drop(*fp, false, hostinfo, f.pki.GetCAPool(), nil, len(p))
 	if dropReason != nil {
 		if f.l.Level >= logrus.DebugLevel {
 			f.l.WithField("fwPacket", fp).
@@ -286,6 +288,7 @@ func (f *Interface) SendVia(via *HostInfo,
 		via.ConnectionState.writeLock.Lock()
 	}
 	c := via.ConnectionState.messageCounter.Add(1)
+	via.ConnectionState.txBytes.Add(uint64(len(ad)))
 
 	out = header.Encode(out, header.Version, header.Message, header.MessageRelay, relay.RemoteIndex, c)
 	f.connectionManager.Out(via)
@@ -332,6 +335,12 @@ func (f *Interface) SendVia(via *HostInfo,
 }
 
 func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType, ci *ConnectionState, hostinfo *HostInfo, remote netip.AddrPort, p, nb, out []byte, q int) {
+	f.sendNoMetricsBatch(t, st, ci, hostinfo, remote, p, nb, out, q, nil)
+}
+
+// sendNoMetricsBatch is sendNoMetrics that adds the packet to batch, when it is not nil, if it is going straight to a
+// remote. out must come from batch.next().
+func (f *Interface) sendNoMetricsBatch(t header.MessageType, st header.MessageSubType, ci *ConnectionState, hostinfo *HostInfo, remote netip.AddrPort, p, nb, out []byte, q int, batch *sendBatch) {
 	if ci.eKey == nil {
 		return
 	}
@@ -353,6 +362,7 @@ func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType
 		ci.writeLock.Lock()
 	}
 	c := ci.messageCounter.Add(1)
+	ci.txBytes.Add(uint64(len(p)))
 
 	//l.WithField("trace", string(debug.Stack())).Error("out Header ", &Header{Version, t, st, 0, hostinfo.remoteIndexId, c}, p)
 	out = header.Encode(out, header.Version, t, st, hostinfo.remoteIndexId, c)
@@ -383,7 +393,12 @@ func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType
 		return
 	}
 
-	if remote.IsValid() {
+	if batch != nil && (remote.IsValid() || hostinfo.remote.IsValid()) {
+		if !remote.IsValid() {
+			remote = hostinfo.remote
+		}
+		batch.add(out, remote)
+	} else if remote.IsValid() {
 		err = f.writers[q].WriteTo(out, remote)
 		if err != nil {
 			hostinfo.logger(f.l).WithError(err).
@@ -15,6 +15,7 @@ import (
 	"github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/exitproxy"
 	"github.com/slackhq/nebula/firewall"
 	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/overlay"
@@ -26,6 +27,8 @@ const mtu = 9001
 type InterfaceConfig struct {
 	HostMap            *HostMap
 	Outside            udp.Conn
+	tcp                *udp.TCPConn
+	exitProxy          *exitproxy.Engine
 	Inside             overlay.Device
 	pki                *PKI
 	Cipher             string
@@ -53,6 +56,8 @@ type InterfaceConfig struct {
 type Interface struct {
 	hostMap               *HostMap
 	outside               udp.Conn
+	tcp                   *udp.TCPConn
+	exitProxy             *exitproxy.Engine
 	inside                overlay.Device
 	pki                   *PKI
 	firewall              *Firewall
@@ -87,6 +92,8 @@ type Interface struct {
 
 	writers []udp.Conn
 	readers []io.ReadWriteCloser
+	// tunWriters are what decrypted packets are written to the readers through, a tun with offloads coalesces them
+	tunWriters []io.Writer
 
 	metricHandshakes    metrics.Histogram
 	messageMetrics      *MessageMetrics
@@ -166,6 +173,8 @@ func NewInterface(ctx context.Context, c *InterfaceConfig) (*Interface, error) {
 		pki:                   c.pki,
 		hostMap:               c.HostMap,
 		outside:               c.Outside,
+		tcp:                   c.tcp,
+		exitProxy:             c.exitProxy,
 		inside:                c.Inside,
 		firewall:              c.Firewall,
 		serveDns:              c.ServeDns,
@@ -178,6 +187,7 @@ func NewInterface(ctx context.Context, c *InterfaceConfig) (*Interface, error) {
 		version:               c.version,
 		writers:               make([]udp.Conn, c.routines),
 		readers:               make([]io.ReadWriteCloser, c.routines),
+		tunWriters:            make([]io.Writer, c.routines),
 		myVpnNetworks:         cs.myVpnNetworks,
 		myVpnNetworksTable:    cs.myVpnNetworksTable,
 		myVpnAddrs:            cs.myVpnAddrs,
@@ -234,6 +244,7 @@ func (f *Interface) activate() {
 			}
 		}
 		f.readers[i] = reader
+		f.tunWriters[i] = overlay.NewWriter(reader)
 	}
 
 	if err := f.inside.Activate(); err != nil {
@@ -245,7 +256,20 @@ func (f *Interface) activate() {
 func (f *Interface) run() {
 	// Launch n queues to read packets from udp
 	for i := 0; i < f.routines; i++ {
-		go f.listenOut(i)
+		if i > 0 {
+			go f.listenOut(f.writers[i], i)
+		} else {
+			go f.listenOut(f.outside, i)
+		}
+	}
+
+	// Packets that arrive over tcp are read by their own routine and answered with the first writer
+	if f.tcp != nil {
+		go f.listenOut(f.tcp, 0)
+	}
+
+	if f.exitProxy != nil {
+		go f.listenExitProxy()
 	}
 
 	// Launch n queues to read packets from tun dev
@@ -254,16 +278,9 @@ func (f *Interface) run() {
 	}
 }
 
-func (f *Interface) listenOut(i int) {
+func (f *Interface) listenOut(li udp.Conn, i int) {
 	runtime.LockOSThread()
 
-	var li udp.Conn
-	if i > 0 {
-		li = f.writers[i]
-	} else {
-		li = f.outside
-	}
-
 	ctCache := firewall.NewConntrackCacheTicker(f.conntrackCacheTimeout)
 	lhh := f.lightHouse.NewRequestHandler()
 	plaintext := make([]byte, udp.MTU)
@@ -271,14 +288,28 @@ func (f *Interface) listenOut(i int) {
 	fwPacket := &firewall.Packet{}
 	nb := make([]byte, 12, 12)
 
-	li.ListenOut(func(fromUdpAddr netip.AddrPort, payload []byte) {
+	flush := func() {}
+	if fl, ok := f.tunWriters[i].(overlay.Flusher); ok {
+		flush = func() {
+			if err := fl.Flush(); err != nil {
+				f.l.WithError(err).Error("Failed to write to tun")
+			}
+		}
+	}
+
+	udp.ListenOutBatch(li, func(fromUdpAddr netip.AddrPort, payload []byte) {
 		f.readOutsidePackets(fromUdpAddr, nil, plaintext[:0], payload, h, fwPacket, lhh, nb, i, ctCache.Get(f.l))
-	})
+	}, flush)
 }
 
 func (f *Interface) listenIn(reader io.ReadWriteCloser, i int) {
 	runtime.LockOSThread()
 
+	if br, ok := reader.(overlay.BatchReader); ok {
+		f.listenInBatch(br, i)
+		return
+	}
+
 	packet := make([]byte, mtu)
 	out := make([]byte, mtu)
 	fwPacket := &firewall.Packet{}
@@ -298,12 +329,69 @@ func (f *Interface) listenIn(reader io.ReadWriteCloser, i int) {
 			os.Exit(2)
 		}
 
-		f.consumeInsidePacket(packet[:n], fwPacket, nb, out, i, conntrackCache.Get(f.l))
+		f.consumeInsidePacket(packet[:n], fwPacket, nb, out, i, conntrackCache.Get(f.l), nil)
+	}
+}
+
+// listenExitProxy sends the packets the exit proxy answers proxied flows with back to the hosts they belong to
+func (f *Interface) listenExitProxy() {
+	packet := make([]byte, mtu)
+	out := make([]byte, mtu)
+	fwPacket := &firewall.Packet{}
+	nb := make([]byte, 12, 12)
+
+	for {
+		n, err := f.exitProxy.Read(packet)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				f.l.WithError(err).Error("Error while reading from exit proxy")
+			}
+			return
+		}
+
+		f.consumeInsidePacket(packet[:n], fwPacket, nb, out, 0, nil, nil)
+	}
+}
+
+// listenInBatch reads from a tun queue that can return several packets at once, the packets of a read that go to the
+// same remote are sent together
+func (f *Interface) listenInBatch(reader overlay.BatchReader, i int) {
+	fwPacket := &firewall.Packet{}
+	nb := make([]byte, 12, 12)
+	batch := newSendBatch(f.writers[i])
+	var packets [][]byte
+
+	conntrackCache := firewall.NewConntrackCacheTicker(f.conntrackCacheTimeout)
+
+	for {
+		var err error
+		packets, err = reader.ReadBatch(packets[:0])
+		if err != nil {
+			if errors.Is(err, os.ErrClosed) && f.closed.Load() {
+				return
+			}
+
+			if errors.Is(err, overlay.ErrBadOffload) {
+				f.l.WithError(err).Warn("Dropping outbound packet")
+				continue
+			}
+
+			f.l.WithError(err).Error("Error while reading outbound packet")
+			// This only seems to happen when something fatal happens to the fd, so exit.
+			os.Exit(2)
+		}
+
+		cache := conntrackCache.Get(f.l)
+		for _, packet := range packets {
+			f.consumeInsidePacket(packet, fwPacket, nb, batch.next(), i, cache, batch)
+		}
+		batch.flush(f.l)
 	}
 }
 
 func (f *Interface) RegisterConfigChangeCallbacks(c *config.C) {
 	c.RegisterReloadCallback(f.reloadFirewall)
+	c.RegisterReloadCallback(f.firewall.flowLog.reload)
 	c.RegisterReloadCallback(f.reloadSendRecvError)
 	c.RegisterReloadCallback(f.reloadDisconnectInvalid)
 	c.RegisterReloadCallback(f.reloadMisc)
@@ -325,7 +413,8 @@ func (f *Interface) reloadDisconnectInvalid(c *config.C) {
 
 func (f *Interface) reloadFirewall(c *config.C) {
 	//TODO: need to trigger/detect if the certificate changed too
-	if c.HasChanged("firewall") == false {
+	// The flow log reloads on its own, changing only it should not flush conntrack
+	if c.HasChangedExcept("firewall", "flow_log") == false {
 		f.l.Debug("No firewall config change detected")
 		return
 	}
@@ -353,6 +442,8 @@ func (f *Interface) reloadFirewall(c *config.C) {
 		fw.Conntrack = conntrack
 	}
 
+	fw.inheritRuleStats(oldFw)
+	fw.flowLog = oldFw.flowLog
 	f.firewall = fw
 
 	oldFw.Destroy()
@@ -458,6 +549,24 @@ func (f *Interface) Close() error {
 		}
 	}
 
+	if f.tcp != nil {
+		err := f.tcp.Close()
+		if err != nil {
+			f.l.WithError(err).Error("Error while closing tcp listener")
+		}
+	}
+
+	if f.exitProxy != nil {
+		err := f.exitProxy.Close()
+		if err != nil {
+			f.l.WithError(err).Error("Error while closing exit proxy")
+		}
+	}
+
+	if err := f.firewall.flowLog.Close(); err != nil {
+		f.l.WithError(err).Error("Error while closing the firewall flow log")
+	}
+
 	// Release the tun device
 	return f.inside.Close()
 }
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 const (
@@ -11,20 +12,52 @@ const (
 	// - 20 byte ipv4 header
 	// - 8 byte icmpv4 header
 	// - 68 byte body (60 byte max orig ipv4 header + 8 byte orig icmpv4 header)
+	//
+	// The largest ipv6 reject packet is the same size:
+	// - 40 byte ipv6 header
+	// - 8 byte icmpv6 header
+	// - 48 byte body (40 byte orig ipv6 header + 8 bytes of the orig payload)
 	MaxRejectPacketSize = ipv4.HeaderLen + 8 + 60 + 8
 )
 
 func CreateRejectPacket(packet []byte, out []byte) []byte {
-	if len(packet) < ipv4.HeaderLen || int(packet[0]>>4) != ipv4.Version {
+	if len(packet) < 1 {
 		return nil
 	}
 
-	switch packet[9] {
-	case 6: // tcp
-		return ipv4CreateRejectTCPPacket(packet, out)
-	default:
-		return ipv4CreateRejectICMPPacket(packet, out)
+	switch int(packet[0] >> 4) {
+	case ipv4.Version:
+		if len(packet) < ipv4.HeaderLen {
+			return nil
+		}
+
+		switch packet[9] {
+		case 6: // tcp
+			return ipv4CreateRejectTCPPacket(packet, out)
+		default:
+			return ipv4CreateRejectICMPPacket(packet, out)
+		}
+
+	case ipv6.Version:
+		if len(packet) < ipv6.HeaderLen {
+			return nil
+		}
+
+		switch packet[6] {
+		case 6: // tcp
+			return ipv6CreateRejectTCPPacket(packet, out)
+		case 58: // icmpv6
+			// Never respond to an icmpv6 error message with another, rfc4443 section 2.4 (e)
+			if len(packet) < ipv6.HeaderLen+1 || packet[ipv6.HeaderLen] < 128 {
+				return nil
+			}
+			return ipv6CreateRejectICMPPacket(packet, out)
+		default:
+			return ipv6CreateRejectICMPPacket(packet, out)
+		}
 	}
+
+	return nil
 }
 
 func ipv4CreateRejectICMPPacket(packet []byte, out []byte) []byte {
@@ -125,8 +158,20 @@ func ipv4CreateRejectTCPPacket(packet []byte, out []byte) []byte {
 	// Calculate checksum
 	binary.BigEndian.PutUint16(ipHdr[10:], tcpipChecksum(ipHdr, 0))
 
-	// TCP RST
-	tcpIn := packet[ihl:]
+	tcpOut := out[ipv4.HeaderLen:]
+	writeRejectTCP(tcpOut, packet[ihl:])
+
+	// Calculate checksum
+	csum := ipv4PseudoheaderChecksum(ipHdr[12:16], ipHdr[16:20], 6, tcpLen)
+	binary.BigEndian.PutUint16(tcpOut[16:], tcpipChecksum(tcpOut, csum))
+
+	return out
+}
+
+// writeRejectTCP fills in a 20 byte TCP RST, with a zero checksum, in response to the TCP segment in tcpIn
+func writeRejectTCP(tcpOut []byte, tcpIn []byte) {
+	const tcpLen = 20
+
 	var ackSeq, seq uint32
 	outFlags := byte(0b00000100) // RST
 
@@ -143,7 +188,6 @@ func ipv4CreateRejectTCPPacket(packet []byte, out []byte) []byte {
 		outFlags |= 0b00010000 // ACK
 	}
 
-	tcpOut := out[ipv4.HeaderLen:]
 	// Swap dest / src ports
 	copy(tcpOut[0:2], tcpIn[2:4])
 	copy(tcpOut[2:4], tcpIn[0:2])
@@ -157,14 +201,89 @@ func ipv4CreateRejectTCPPacket(packet []byte, out []byte) []byte {
 	tcpOut[17] = 0                  //  .
 	tcpOut[18] = 0                  // URG Pointer
 	tcpOut[19] = 0                  //  .
+}
+
+func ipv6CreateRejectICMPPacket(packet []byte, out []byte) []byte {
+	// ICMPv6 reply includes the original header and first 8 bytes of the payload
+	packetLen := len(packet)
+	if packetLen > ipv6.HeaderLen+8 {
+		packetLen = ipv6.HeaderLen + 8
+	}
+
+	outLen := ipv6.HeaderLen + 8 + packetLen
+	if outLen > cap(out) {
+		return nil
+	}
+
+	out = out[:outLen]
+
+	ipHdr := out[0:ipv6.HeaderLen]
+	ipv6WriteHeader(ipHdr, packet, 58, uint16(outLen-ipv6.HeaderLen))
+
+	// ICMPv6 Destination Unreachable
+	icmpOut := out[ipv6.HeaderLen:]
+	icmpOut[0] = 1 // type (Destination unreachable)
+	icmpOut[1] = 1 // code (Communication with destination administratively prohibited)
+	icmpOut[2] = 0 // checksum
+	icmpOut[3] = 0 //  .
+	icmpOut[4] = 0 // unused
+	icmpOut[5] = 0 //  .
+	icmpOut[6] = 0 //  .
+	icmpOut[7] = 0 //  .
+
+	// Copy original IP header and first 8 bytes of the payload as body
+	copy(icmpOut[8:], packet[:packetLen])
 
 	// Calculate checksum
-	csum := ipv4PseudoheaderChecksum(ipHdr[12:16], ipHdr[16:20], 6, tcpLen)
+	csum := ipv6PseudoheaderChecksum(ipHdr[8:24], ipHdr[24:40], 58, uint32(len(icmpOut)))
+	binary.BigEndian.PutUint16(icmpOut[2:], tcpipChecksum(icmpOut, csum))
+
+	return out
+}
+
+func ipv6CreateRejectTCPPacket(packet []byte, out []byte) []byte {
+	const tcpLen = 20
+
+	outLen := ipv6.HeaderLen + tcpLen
+
+	if len(packet) < ipv6.HeaderLen+tcpLen {
+		// We need at least this many bytes for this to be a valid packet
+		return nil
+	}
+	if outLen > cap(out) {
+		return nil
+	}
+
+	out = out[:outLen]
+
+	ipHdr := out[0:ipv6.HeaderLen]
+	ipv6WriteHeader(ipHdr, packet, 6, tcpLen)
+
+	tcpOut := out[ipv6.HeaderLen:]
+	writeRejectTCP(tcpOut, packet[ipv6.HeaderLen:])
+
+	// Calculate checksum
+	csum := ipv6PseudoheaderChecksum(ipHdr[8:24], ipHdr[24:40], 6, tcpLen)
 	binary.BigEndian.PutUint16(tcpOut[16:], tcpipChecksum(tcpOut, csum))
 
 	return out
 }
 
+// ipv6WriteHeader fills in an ipv6 header addressed back to the sender of packet
+func ipv6WriteHeader(ipHdr []byte, packet []byte, nextHeader byte, payloadLen uint16) {
+	ipHdr[0] = ipv6.Version << 4                      // version, traffic class
+	ipHdr[1] = 0                                      // traffic class, flow label
+	ipHdr[2] = 0                                      // flow label
+	ipHdr[3] = 0                                      //  .
+	binary.BigEndian.PutUint16(ipHdr[4:], payloadLen) // payload length
+	ipHdr[6] = nextHeader                             // next header
+	ipHdr[7] = 64                                     // hop limit
+
+	// Swap dest / src IPs
+	copy(ipHdr[8:24], packet[24:40])
+	copy(ipHdr[24:40], packet[8:24])
+}
+
 func CreateICMPEchoResponse(packet, out []byte) []byte {
 	// Return early if this is not a simple ICMP Echo Request
 	//TODO: make constants out of these
@@ -236,3 +355,14 @@ func ipv4PseudoheaderChecksum(src, dst []byte, proto, length uint32) (csum uint3
 	csum += length >> 16
 	return csum
 }
+
+func ipv6PseudoheaderChecksum(src, dst []byte, proto, length uint32) (csum uint32) {
+	for i := 0; i < 16; i += 2 {
+		csum += uint32(src[i])<<8 + uint32(src[i+1])
+		csum += uint32(dst[i])<<8 + uint32(dst[i+1])
+	}
+	csum += proto
+	csum += length & 0xffff
+	csum += length >> 16
+	return csum
+}
@@ -4,8 +4,12 @@ import (
 	"net"
 	"testing"
 
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 func Test_CreateRejectPacket(t *testing.T) {
@@ -71,3 +75,76 @@ func Test_CreateRejectPacket(t *testing.T) {
 	assert.NotNil(t, rejectPacket)
 	assert.Len(t, rejectPacket, expectedLen)
 }
+
+func Test_CreateRejectPacket_v6(t *testing.T) {
+	src := net.ParseIP("fd00::1")
+	dst := net.ParseIP("fd00::2")
+
+	// TCP SYN
+	ip := &layers.IPv6{
+		Version:    6,
+		NextHeader: layers.IPProtocolTCP,
+		HopLimit:   64,
+		SrcIP:      src,
+		DstIP:      dst,
+	}
+	tcp := &layers.TCP{SrcPort: 30000, DstPort: 443, Seq: 1000, SYN: true, Window: 1024}
+	require.NoError(t, tcp.SetNetworkLayerForChecksum(ip))
+	b := serialize(t, ip, tcp, gopacket.Payload([]byte{1, 2, 3, 4}))
+
+	out := make([]byte, MaxRejectPacketSize)
+	rejectPacket := CreateRejectPacket(b, out)
+	assert.Len(t, rejectPacket, ipv6.HeaderLen+20)
+
+	eIp := &layers.IPv6{
+		Version:    6,
+		NextHeader: layers.IPProtocolTCP,
+		HopLimit:   64,
+		SrcIP:      dst,
+		DstIP:      src,
+	}
+	eTcp := &layers.TCP{SrcPort: 443, DstPort: 30000, Ack: 1005, RST: true, ACK: true}
+	require.NoError(t, eTcp.SetNetworkLayerForChecksum(eIp))
+	assert.Equal(t, serialize(t, eIp, eTcp), rejectPacket)
+
+	// TCP packet that is too short
+	assert.Nil(t, CreateRejectPacket(b[:ipv6.HeaderLen+10], out))
+
+	// UDP gets an ICMPv6 admin prohibited
+	ip.NextHeader = layers.IPProtocolUDP
+	udp := &layers.UDP{SrcPort: 30000, DstPort: 53}
+	require.NoError(t, udp.SetNetworkLayerForChecksum(ip))
+	b = serialize(t, ip, udp, gopacket.Payload(make([]byte, 100)))
+
+	rejectPacket = CreateRejectPacket(b, out)
+	assert.Len(t, rejectPacket, MaxRejectPacketSize)
+
+	eIp.NextHeader = layers.IPProtocolICMPv6
+	eIcmp := &layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodeAdminProhibited),
+	}
+	require.NoError(t, eIcmp.SetNetworkLayerForChecksum(eIp))
+	assert.Equal(t, serialize(t, eIp, eIcmp, gopacket.Payload(append([]byte{0, 0, 0, 0}, b[:ipv6.HeaderLen+8]...))), rejectPacket)
+
+	// Output buffer that is too small
+	assert.Nil(t, CreateRejectPacket(b, make([]byte, 0, ipv6.HeaderLen+8)))
+
+	// ICMPv6 errors are never answered
+	ip.NextHeader = layers.IPProtocolICMPv6
+	icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypePacketTooBig, 0)}
+	require.NoError(t, icmp.SetNetworkLayerForChecksum(ip))
+	b = serialize(t, ip, icmp)
+	assert.Nil(t, CreateRejectPacket(b, out))
+
+	// But informational messages are
+	icmp.TypeCode = layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoRequest, 0)
+	b = serialize(t, ip, icmp)
+	assert.Len(t, CreateRejectPacket(b, out), ipv6.HeaderLen+8+len(b))
+}
+
+func serialize(t *testing.T, l ...gopacket.SerializableLayer) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}, l...)
+	require.NoError(t, err)
+	return buf.Bytes()
+}
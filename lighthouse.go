@@ -5,10 +5,13 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"maps"
 	"net"
 	"net/netip"
+	"net/url"
 	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -63,8 +66,21 @@ type LightHouse struct {
 	updateCancel context.CancelFunc
 	ifce         EncWriter
 	nebulaPort   uint32 // 32 bits because protobuf does not have a uint16
-
-	advertiseAddrs atomic.Pointer[[]netip.AddrPort]
+	tcpPort      uint32 // 0 when we do not accept tcp connections
+
+	advertiseAddrs    atomic.Pointer[[]netip.AddrPort]
+	tcpAdvertiseAddrs atomic.Pointer[[]netip.AddrPort]
+
+	// tcpRemotes holds every tcp address a RemoteList in addrMap holds, it is read on every packet we send.
+	// tcpCounts is how many lists hold each of them, tcpLock guards both while they change.
+	tcpRemotes sync.Map
+	tcpCounts  map[netip.AddrPort]int
+	tcpLock    sync.Mutex
+	// webSocketURLs holds the url of every static host address that is reached with a websocket, it is replaced
+	// whenever static_host_map is loaded
+	webSocketURLs atomic.Pointer[map[netip.AddrPort]*url.URL]
+	// tcpTransport is set when the tcp transport that dials websockets is running, it is only started with nebula
+	tcpTransport atomic.Bool
 
 	// Addr's of relays that can be used by peers to access me
 	relaysForMe atomic.Pointer[[]netip.Addr]
@@ -73,6 +89,10 @@ type LightHouse struct {
 
 	calculatedRemotes atomic.Pointer[bart.Table[[]*calculatedRemote]] // Maps VpnAddr to []*calculatedRemote
 
+	// Rate limits for the messages a misbehaving host could flood us with, nil when not limited
+	hostQueryLimits  atomic.Pointer[messageLimits]
+	hostUpdateLimits atomic.Pointer[messageLimits]
+
 	metrics           *MessageMetrics
 	metricHolepunchTx metrics.Counter
 	l                 *logrus.Logger
@@ -96,13 +116,20 @@ func NewLightHouseFromConfig(ctx context.Context, l *logrus.Logger, c *config.C,
 		nebulaPort = uint32(uPort.Port())
 	}
 
+	var tcpPort uint32
+	if c.GetBool("listen.tcp.enabled", false) {
+		tcpPort = uint32(c.GetInt("listen.tcp.port", 0))
+	}
+
 	h := LightHouse{
 		ctx:                ctx,
 		amLighthouse:       amLighthouse,
 		myVpnNetworks:      cs.myVpnNetworks,
 		myVpnNetworksTable: cs.myVpnNetworksTable,
 		addrMap:            make(map[netip.Addr]*RemoteList),
+		tcpCounts:          make(map[netip.AddrPort]int),
 		nebulaPort:         nebulaPort,
+		tcpPort:            tcpPort,
 		punchConn:          pc,
 		punchy:             p,
 		queryChan:          make(chan netip.Addr, c.GetUint32("handshakes.query_buffer", 64)),
@@ -112,6 +139,8 @@ func NewLightHouseFromConfig(ctx context.Context, l *logrus.Logger, c *config.C,
 	h.lighthouses.Store(&lighthouses)
 	staticList := make(map[netip.Addr]struct{})
 	h.staticList.Store(&staticList)
+	webSocketURLs := make(map[netip.AddrPort]*url.URL)
+	h.webSocketURLs.Store(&webSocketURLs)
 
 	if c.GetBool("stats.lighthouse_metrics", false) {
 		h.metrics = newLighthouseMetrics()
@@ -160,6 +189,10 @@ func (lh *LightHouse) GetAdvertiseAddrs() []netip.AddrPort {
 	return *lh.advertiseAddrs.Load()
 }
 
+func (lh *LightHouse) GetTCPAdvertiseAddrs() []netip.AddrPort {
+	return *lh.tcpAdvertiseAddrs.Load()
+}
+
 func (lh *LightHouse) GetRelaysForMe() []netip.Addr {
 	return *lh.relaysForMe.Load()
 }
@@ -174,47 +207,28 @@ func (lh *LightHouse) GetUpdateInterval() int64 {
 
 func (lh *LightHouse) reload(c *config.C, initial bool) error {
 	if initial || c.HasChanged("lighthouse.advertise_addrs") {
-		rawAdvAddrs := c.GetStringSlice("lighthouse.advertise_addrs", []string{})
-		advAddrs := make([]netip.AddrPort, 0)
-
-		for i, rawAddr := range rawAdvAddrs {
-			host, sport, err := net.SplitHostPort(rawAddr)
-			if err != nil {
-				return util.NewContextualError("Unable to parse lighthouse.advertise_addrs entry", m{"addr": rawAddr, "entry": i + 1}, err)
-			}
-
-			addrs, err := net.DefaultResolver.LookupNetIP(context.Background(), "ip", host)
-			if err != nil {
-				return util.NewContextualError("Unable to lookup lighthouse.advertise_addrs entry", m{"addr": rawAddr, "entry": i + 1}, err)
-			}
-			if len(addrs) == 0 {
-				return util.NewContextualError("Unable to lookup lighthouse.advertise_addrs entry", m{"addr": rawAddr, "entry": i + 1}, nil)
-			}
-
-			port, err := strconv.Atoi(sport)
-			if err != nil {
-				return util.NewContextualError("Unable to parse port in lighthouse.advertise_addrs entry", m{"addr": rawAddr, "entry": i + 1}, err)
-			}
+		advAddrs, err := lh.parseAdvertiseAddrs(c, "lighthouse.advertise_addrs", lh.nebulaPort)
+		if err != nil {
+			return err
+		}
 
-			if port == 0 {
-				port = int(lh.nebulaPort)
-			}
+		lh.advertiseAddrs.Store(&advAddrs)
 
-			//TODO: we could technically insert all returned addrs instead of just the first one if a dns lookup was used
-			addr := addrs[0].Unmap()
-			if lh.myVpnNetworksTable.Contains(addr) {
-				lh.l.WithField("addr", rawAddr).WithField("entry", i+1).
-					Warn("Ignoring lighthouse.advertise_addrs report because it is within the nebula network range")
-				continue
-			}
+		if !initial {
+			lh.l.Info("lighthouse.advertise_addrs has changed")
+		}
+	}
 
-			advAddrs = append(advAddrs, netip.AddrPortFrom(addr, uint16(port)))
+	if initial || c.HasChanged("listen.tcp.advertise_addrs") {
+		advAddrs, err := lh.parseAdvertiseAddrs(c, "listen.tcp.advertise_addrs", lh.tcpPort)
+		if err != nil {
+			return err
 		}
 
-		lh.advertiseAddrs.Store(&advAddrs)
+		lh.tcpAdvertiseAddrs.Store(&advAddrs)
 
 		if !initial {
-			lh.l.Info("lighthouse.advertise_addrs has changed")
+			lh.l.Info("listen.tcp.advertise_addrs has changed")
 		}
 	}
 
@@ -269,8 +283,36 @@ func (lh *LightHouse) reload(c *config.C, initial bool) error {
 		}
 	}
 
+	if initial || c.HasChanged("lighthouse.rate_limit.host_query") {
+		ml, err := newMessageLimitsFromConfig(c, "lighthouse.rate_limit.host_query", "lighthouse.rate_limit.host_query")
+		if err != nil {
+			return util.NewContextualError("Invalid lighthouse.rate_limit.host_query", nil, err)
+		}
+
+		lh.hostQueryLimits.Store(ml)
+		if !initial {
+			lh.l.Info("lighthouse.rate_limit.host_query has changed")
+		}
+	}
+
+	if initial || c.HasChanged("lighthouse.rate_limit.host_update") {
+		ml, err := newMessageLimitsFromConfig(c, "lighthouse.rate_limit.host_update", "lighthouse.rate_limit.host_update")
+		if err != nil {
+			return util.NewContextualError("Invalid lighthouse.rate_limit.host_update", nil, err)
+		}
+
+		lh.hostUpdateLimits.Store(ml)
+		if !initial {
+			lh.l.Info("lighthouse.rate_limit.host_update has changed")
+		}
+	}
+
 	//NOTE: many things will get much simpler when we combine static_host_map and lighthouse.hosts in config
 	if initial || c.HasChanged("static_host_map") || c.HasChanged("static_map.cadence") || c.HasChanged("static_map.network") || c.HasChanged("static_map.lookup_timeout") {
+		if !initial && !lh.tcpTransport.Load() && staticHostMapHasWebSocket(c) {
+			return util.NewContextualError("static_host_map websocket entries require a restart when nebula was started without the tcp transport", nil, nil)
+		}
+
 		// Clean up. Entries still in the static_host_map will be re-built.
 		// Entries no longer present must have their (possible) background DNS goroutines stopped.
 		if existingStaticList := lh.staticList.Load(); existingStaticList != nil {
@@ -284,12 +326,14 @@ func (lh *LightHouse) reload(c *config.C, initial bool) error {
 		}
 		// Build a new list based on current config.
 		staticList := make(map[netip.Addr]struct{})
-		err := lh.loadStaticMap(c, staticList)
+		webSocketURLs := make(map[netip.AddrPort]*url.URL)
+		err := lh.loadStaticMap(c, staticList, webSocketURLs)
 		if err != nil {
 			return err
 		}
 
 		lh.staticList.Store(&staticList)
+		lh.webSocketURLs.Store(&webSocketURLs)
 		if !initial {
 			if c.HasChanged("static_host_map") {
 				lh.l.Info("static_host_map has changed")
@@ -405,7 +449,69 @@ func getStaticMapNetwork(c *config.C) (string, error) {
 	return network, nil
 }
 
-func (lh *LightHouse) loadStaticMap(c *config.C, staticList map[netip.Addr]struct{}) error {
+// parseAdvertiseAddrs reads a list of host:port addresses to advertise to lighthouses from key. A port of 0 is replaced
+// with defaultPort.
+func (lh *LightHouse) parseAdvertiseAddrs(c *config.C, key string, defaultPort uint32) ([]netip.AddrPort, error) {
+	rawAdvAddrs := c.GetStringSlice(key, []string{})
+	advAddrs := make([]netip.AddrPort, 0)
+
+	for i, rawAddr := range rawAdvAddrs {
+		host, sport, err := net.SplitHostPort(rawAddr)
+		if err != nil {
+			return nil, util.NewContextualError("Unable to parse "+key+" entry", m{"addr": rawAddr, "entry": i + 1}, err)
+		}
+
+		addrs, err := net.DefaultResolver.LookupNetIP(context.Background(), "ip", host)
+		if err != nil {
+			return nil, util.NewContextualError("Unable to lookup "+key+" entry", m{"addr": rawAddr, "entry": i + 1}, err)
+		}
+		if len(addrs) == 0 {
+			return nil, util.NewContextualError("Unable to lookup "+key+" entry", m{"addr": rawAddr, "entry": i + 1}, nil)
+		}
+
+		port, err := strconv.Atoi(sport)
+		if err != nil {
+			return nil, util.NewContextualError("Unable to parse port in "+key+" entry", m{"addr": rawAddr, "entry": i + 1}, err)
+		}
+
+		if port == 0 {
+			port = int(defaultPort)
+		}
+
+		//TODO: we could technically insert all returned addrs instead of just the first one if a dns lookup was used
+		addr := addrs[0].Unmap()
+		if lh.myVpnNetworksTable.Contains(addr) {
+			lh.l.WithField("addr", rawAddr).WithField("entry", i+1).
+				Warnf("Ignoring %s report because it is within the nebula network range", key)
+			continue
+		}
+
+		advAddrs = append(advAddrs, netip.AddrPortFrom(addr, uint16(port)))
+	}
+
+	return advAddrs, nil
+}
+
+// staticHostMapHasWebSocket reports if any static_host_map entry is a websocket url
+func staticHostMapHasWebSocket(c *config.C) bool {
+	for _, v := range c.GetMap("static_host_map", map[string]any{}) {
+		vals, ok := v.([]any)
+		if !ok {
+			vals = []any{v}
+		}
+		for _, v := range vals {
+			s := fmt.Sprintf("%v", v)
+			for _, scheme := range webSocketSchemes {
+				if strings.HasPrefix(s, scheme) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (lh *LightHouse) loadStaticMap(c *config.C, staticList map[netip.Addr]struct{}, webSocketURLs map[netip.AddrPort]*url.URL) error {
 	d, err := getStaticMapCadence(c)
 	if err != nil {
 		return err
@@ -443,7 +549,7 @@ func (lh *LightHouse) loadStaticMap(c *config.C, staticList map[netip.Addr]struc
 			remoteAddrs = append(remoteAddrs, fmt.Sprintf("%v", v))
 		}
 
-		err = lh.addStaticRemotes(i, d, network, lookupTimeout, vpnAddr, remoteAddrs, staticList)
+		err = lh.addStaticRemotes(i, d, network, lookupTimeout, vpnAddr, remoteAddrs, staticList, webSocketURLs)
 		if err != nil {
 			return err
 		}
@@ -541,6 +647,10 @@ func (lh *LightHouse) DeleteVpnAddrs(allVpnAddrs []netip.Addr) {
 				}
 			}
 		}
+
+		rm.Lock()
+		lh.unlockedReleaseTCPRemotes(rm)
+		rm.Unlock()
 	}
 	lh.Unlock()
 }
@@ -549,7 +659,7 @@ func (lh *LightHouse) DeleteVpnAddrs(allVpnAddrs []netip.Addr) {
 // We are the owner because we don't want a lighthouse server to advertise for static hosts it was configured with
 // And we don't want a lighthouse query reply to interfere with our learned cache if we are a client
 // NOTE: this function should not interact with any hot path objects, like lh.staticList, the caller should handle it
-func (lh *LightHouse) addStaticRemotes(i int, d time.Duration, network string, timeout time.Duration, vpnAddr netip.Addr, toAddrs []string, staticList map[netip.Addr]struct{}) error {
+func (lh *LightHouse) addStaticRemotes(i int, d time.Duration, network string, timeout time.Duration, vpnAddr netip.Addr, toAddrs []string, staticList map[netip.Addr]struct{}, webSocketURLs map[netip.AddrPort]*url.URL) error {
 	lh.Lock()
 	am := lh.unlockedGetRemoteList([]netip.Addr{vpnAddr})
 	am.Lock()
@@ -563,11 +673,14 @@ func (lh *LightHouse) addStaticRemotes(i int, d time.Duration, network string, t
 		am.Lock()
 		defer am.Unlock()
 		am.shouldRebuild = true
+		lh.unlockedSyncTCPRemotes(am)
 	})
 	if err != nil {
 		return util.NewContextualError("Static host address could not be parsed", m{"vpnAddr": vpnAddr, "entry": i + 1}, err)
 	}
 	am.unlockedSetHostnamesResults(hr)
+	lh.unlockedSyncTCPRemotes(am)
+	maps.Copy(webSocketURLs, hr.GetWebSocketURLs())
 
 	for _, addrPort := range hr.GetAddrs() {
 		if !lh.shouldAdd([]netip.Addr{vpnAddr}, addrPort.Addr()) {
@@ -877,6 +990,30 @@ func (lh *LightHouse) SendUpdate() {
 		}
 	}
 
+	var tcpV4 []*V4AddrPort
+	var tcpV6 []*V6AddrPort
+	if lh.tcpPort != 0 {
+		for _, e := range lh.GetTCPAdvertiseAddrs() {
+			if e.Addr().Is4() {
+				tcpV4 = append(tcpV4, netAddrToProtoV4AddrPort(e.Addr(), e.Port()))
+			} else {
+				tcpV6 = append(tcpV6, netAddrToProtoV6AddrPort(e.Addr(), e.Port()))
+			}
+		}
+
+		for _, e := range localAddrs(lh.l, lal) {
+			if lh.myVpnNetworksTable.Contains(e) {
+				continue
+			}
+
+			if e.Is4() {
+				tcpV4 = append(tcpV4, netAddrToProtoV4AddrPort(e, uint16(lh.tcpPort)))
+			} else {
+				tcpV6 = append(tcpV6, netAddrToProtoV6AddrPort(e, uint16(lh.tcpPort)))
+			}
+		}
+	}
+
 	nb := make([]byte, 12, 12)
 	out := make([]byte, mtu)
 
@@ -914,6 +1051,8 @@ func (lh *LightHouse) SendUpdate() {
 					Details: &NebulaMetaDetails{
 						V4AddrPorts:      v4,
 						V6AddrPorts:      v6,
+						TcpV4AddrPorts:   tcpV4,
+						TcpV6AddrPorts:   tcpV6,
 						OldRelayVpnAddrs: relays,
 						OldVpnAddr:       binary.BigEndian.Uint32(b[:]),
 					},
@@ -940,9 +1079,11 @@ func (lh *LightHouse) SendUpdate() {
 				msg := NebulaMeta{
 					Type: NebulaMeta_HostUpdateNotification,
 					Details: &NebulaMetaDetails{
-						V4AddrPorts:   v4,
-						V6AddrPorts:   v6,
-						RelayVpnAddrs: relays,
+						V4AddrPorts:    v4,
+						V6AddrPorts:    v6,
+						TcpV4AddrPorts: tcpV4,
+						TcpV6AddrPorts: tcpV6,
+						RelayVpnAddrs:  relays,
 					},
 				}
 
@@ -991,6 +1132,77 @@ func (lh *LightHouse) NewRequestHandler() *LightHouseHandler {
 	return lhh
 }
 
+// IsTCPRemote reports if addr should be reached over tcp, which is when any host we know of has it as a tcp address
+func (lh *LightHouse) IsTCPRemote(addr netip.AddrPort) bool {
+	_, ok := lh.tcpRemotes.Load(addr)
+	return ok
+}
+
+// WebSocketURL returns the url to connect to when addr is reached with a websocket
+func (lh *LightHouse) WebSocketURL(addr netip.AddrPort) (*url.URL, bool) {
+	u, ok := (*lh.webSocketURLs.Load())[addr]
+	return u, ok
+}
+
+// hasWebSocketURLs reports if any static host is reached with a websocket
+func (lh *LightHouse) hasWebSocketURLs() bool {
+	return len(*lh.webSocketURLs.Load()) > 0
+}
+
+// unlockedSyncTCPRemotes assumes you have the am lock and counts the tcp addresses am holds now in place of the ones
+// it held before
+func (lh *LightHouse) unlockedSyncTCPRemotes(am *RemoteList) {
+	addrs := am.unlockedCollectTCP()
+
+	lh.tcpLock.Lock()
+	for addr := range addrs {
+		if _, ok := am.tcpAddrs[addr]; !ok {
+			lh.tcpCounts[addr]++
+			lh.tcpRemotes.Store(addr, struct{}{})
+		}
+	}
+	for addr := range am.tcpAddrs {
+		if _, ok := addrs[addr]; !ok {
+			lh.unlockedReleaseTCPRemote(addr)
+		}
+	}
+	lh.tcpLock.Unlock()
+
+	am.tcpAddrs = addrs
+}
+
+// unlockedReleaseTCPRemotes assumes you have the am lock and stops counting the tcp addresses of a list that is
+// leaving addrMap
+func (lh *LightHouse) unlockedReleaseTCPRemotes(am *RemoteList) {
+	lh.tcpLock.Lock()
+	for addr := range am.tcpAddrs {
+		lh.unlockedReleaseTCPRemote(addr)
+	}
+	lh.tcpLock.Unlock()
+
+	am.tcpAddrs = nil
+}
+
+// unlockedReleaseTCPRemote assumes you have the tcpLock, addr is no longer a tcp remote once no list holds it
+func (lh *LightHouse) unlockedReleaseTCPRemote(addr netip.AddrPort) {
+	lh.tcpCounts[addr]--
+	if lh.tcpCounts[addr] <= 0 {
+		delete(lh.tcpCounts, addr)
+		lh.tcpRemotes.Delete(addr)
+	}
+}
+
+// limits returns the rate limits for a message type, nil when the type is not limited
+func (lh *LightHouse) limits(t NebulaMeta_MessageType) *messageLimits {
+	switch t {
+	case NebulaMeta_HostQuery:
+		return lh.hostQueryLimits.Load()
+	case NebulaMeta_HostUpdateNotification:
+		return lh.hostUpdateLimits.Load()
+	}
+	return nil
+}
+
 func (lh *LightHouse) metricRx(t NebulaMeta_MessageType, i int64) {
 	lh.metrics.Rx(header.MessageType(t), 0, i)
 }
@@ -1008,6 +1220,8 @@ func (lhh *LightHouseHandler) resetMeta() *NebulaMeta {
 	// Keep the array memory around
 	details.V4AddrPorts = details.V4AddrPorts[:0]
 	details.V6AddrPorts = details.V6AddrPorts[:0]
+	details.TcpV4AddrPorts = details.TcpV4AddrPorts[:0]
+	details.TcpV6AddrPorts = details.TcpV6AddrPorts[:0]
 	details.RelayVpnAddrs = details.RelayVpnAddrs[:0]
 	details.OldRelayVpnAddrs = details.OldRelayVpnAddrs[:0]
 	details.OldVpnAddr = 0
@@ -1034,6 +1248,14 @@ func (lhh *LightHouseHandler) HandleRequest(rAddr netip.AddrPort, fromVpnAddrs [
 
 	lhh.lh.metricRx(n.Type, 1)
 
+	if !lhh.lh.limits(n.Type).allow(rAddr, fromVpnAddrs, time.Now()) {
+		if lhh.l.Level >= logrus.DebugLevel {
+			lhh.l.WithField("vpnAddrs", fromVpnAddrs).WithField("udpAddr", rAddr).WithField("type", n.Type).
+				Debug("lighthouse.rate_limit exceeded, dropping lighthouse message")
+		}
+		return
+	}
+
 	switch n.Type {
 	case NebulaMeta_HostQuery:
 		lhh.handleHostQuery(n, fromVpnAddrs, rAddr, w)
@@ -1181,6 +1403,11 @@ func (lhh *LightHouseHandler) coalesceAnswers(v cert.Version, c *cache, n *Nebul
 		}
 	}
 
+	if c.tcp != nil {
+		n.Details.TcpV4AddrPorts = append(n.Details.TcpV4AddrPorts, c.tcp.v4...)
+		n.Details.TcpV6AddrPorts = append(n.Details.TcpV6AddrPorts, c.tcp.v6...)
+	}
+
 	if c.relay != nil {
 		if v == cert.Version1 {
 			b := [4]byte{}
@@ -1224,7 +1451,9 @@ func (lhh *LightHouseHandler) handleHostQueryReply(n *NebulaMeta, fromVpnAddrs [
 
 	am.unlockedSetV4(fromVpnAddrs[0], certVpnAddr, n.Details.V4AddrPorts, lhh.lh.unlockedShouldAddV4)
 	am.unlockedSetV6(fromVpnAddrs[0], certVpnAddr, n.Details.V6AddrPorts, lhh.lh.unlockedShouldAddV6)
+	am.unlockedSetTCP(fromVpnAddrs[0], certVpnAddr, n.Details.TcpV4AddrPorts, n.Details.TcpV6AddrPorts, lhh.lh.unlockedShouldAddV4, lhh.lh.unlockedShouldAddV6)
 	am.unlockedSetRelay(fromVpnAddrs[0], relays)
+	lhh.lh.unlockedSyncTCPRemotes(am)
 	am.Unlock()
 
 	// Non-blocking attempt to trigger, skip if it would block
@@ -1275,7 +1504,9 @@ func (lhh *LightHouseHandler) handleHostUpdateNotification(n *NebulaMeta, fromVp
 
 	am.unlockedSetV4(fromVpnAddrs[0], fromVpnAddrs[0], n.Details.V4AddrPorts, lhh.lh.unlockedShouldAddV4)
 	am.unlockedSetV6(fromVpnAddrs[0], fromVpnAddrs[0], n.Details.V6AddrPorts, lhh.lh.unlockedShouldAddV6)
+	am.unlockedSetTCP(fromVpnAddrs[0], fromVpnAddrs[0], n.Details.TcpV4AddrPorts, n.Details.TcpV6AddrPorts, lhh.lh.unlockedShouldAddV4, lhh.lh.unlockedShouldAddV6)
 	am.unlockedSetRelay(fromVpnAddrs[0], relays)
+	lhh.lh.unlockedSyncTCPRemotes(am)
 	am.Unlock()
 
 	n = lhh.resetMeta()
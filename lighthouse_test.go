@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net/netip"
+	"net/url"
 	"testing"
 
 	"github.com/gaissmai/bart"
@@ -274,6 +275,227 @@ func TestLighthouse_Memory(t *testing.T) {
 	assertIp4InArray(t, r.msg.Details.V4AddrPorts, good)
 }
 
+func TestLighthouse_RateLimit(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[string]any{
+		"am_lighthouse": true,
+		"rate_limit": map[string]any{
+			"host_query": map[string]any{"rate": 1, "burst": 2},
+		},
+	}
+	c.Settings["listen"] = map[string]any{"port": 4242}
+
+	myVpnNet := netip.MustParsePrefix("10.128.0.1/24")
+	nt := new(bart.Lite)
+	nt.Insert(myVpnNet)
+	cs := &CertState{
+		myVpnNetworks:      []netip.Prefix{myVpnNet},
+		myVpnNetworksTable: nt,
+	}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, cs, nil, nil)
+	require.NoError(t, err)
+	lh.ifce = &mockEncWriter{}
+	lhh := lh.NewRequestHandler()
+
+	myUdpAddr := netip.MustParseAddrPort("10.0.0.2:4242")
+	myVpnIp := netip.MustParseAddr("10.128.0.2")
+	theirUdpAddr := netip.MustParseAddrPort("10.0.0.3:4242")
+	theirVpnIp := netip.MustParseAddr("10.128.0.3")
+
+	// Updates are not limited
+	for range 5 {
+		newLHHostUpdate(myUdpAddr, myVpnIp, []netip.AddrPort{myUdpAddr}, lhh)
+	}
+
+	// The burst is answered, the query after it is not
+	assert.NotNil(t, newLHHostRequest(myUdpAddr, myVpnIp, myVpnIp, lhh).msg)
+	assert.NotNil(t, newLHHostRequest(myUdpAddr, myVpnIp, myVpnIp, lhh).msg)
+	assert.Nil(t, newLHHostRequest(myUdpAddr, myVpnIp, myVpnIp, lhh).msg)
+
+	// Moving to a new udp address doesn't get around the limit for the vpn address
+	assert.Nil(t, newLHHostRequest(theirUdpAddr, myVpnIp, myVpnIp, lhh).msg)
+
+	// Nor does using another vpn address from the same udp address
+	assert.Nil(t, newLHHostRequest(myUdpAddr, theirVpnIp, myVpnIp, lhh).msg)
+
+	// Other hosts are unaffected
+	assert.NotNil(t, newLHHostRequest(theirUdpAddr, theirVpnIp, myVpnIp, lhh).msg)
+
+	// Turning the limit off takes effect on reload
+	rc, err := yaml.Marshal(map[string]any{"lighthouse": map[string]any{"am_lighthouse": true}, "listen": map[string]any{"port": 4242}})
+	require.NoError(t, err)
+	require.NoError(t, c.ReloadConfigString(string(rc)))
+	require.NoError(t, lh.reload(c, false))
+	assert.NotNil(t, newLHHostRequest(myUdpAddr, myVpnIp, myVpnIp, lhh).msg)
+}
+
+func TestLighthouse_TCPRemotes(t *testing.T) {
+	l := test.NewLogger()
+	myVpnNet := netip.MustParsePrefix("10.128.0.1/24")
+	nt := new(bart.Lite)
+	nt.Insert(myVpnNet)
+	cs := &CertState{
+		myVpnNetworks:      []netip.Prefix{myVpnNet},
+		myVpnNetworksTable: nt,
+	}
+
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[string]any{"am_lighthouse": true}
+	c.Settings["listen"] = map[string]any{"port": 4242}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, cs, nil, nil)
+	require.NoError(t, err)
+	lhh := lh.NewRequestHandler()
+
+	theirVpnIp := netip.MustParseAddr("10.128.0.3")
+	theirUdpAddr := netip.MustParseAddrPort("24.15.0.3:4242")
+	theirTcpAddr := netip.MustParseAddrPort("24.15.0.3:443")
+
+	// The lighthouse keeps the tcp addresses a host reports
+	update := &NebulaMeta{
+		Type: NebulaMeta_HostUpdateNotification,
+		Details: &NebulaMetaDetails{
+			VpnAddr:        netAddrToProtoAddr(theirVpnIp),
+			V4AddrPorts:    []*V4AddrPort{netAddrToProtoV4AddrPort(theirUdpAddr.Addr(), theirUdpAddr.Port())},
+			TcpV4AddrPorts: []*V4AddrPort{netAddrToProtoV4AddrPort(theirTcpAddr.Addr(), theirTcpAddr.Port())},
+		},
+	}
+	b, err := update.Marshal()
+	require.NoError(t, err)
+	lhh.HandleRequest(theirUdpAddr, []netip.Addr{theirVpnIp}, b, &testEncWriter{})
+	assert.True(t, lh.IsTCPRemote(theirTcpAddr))
+	assert.False(t, lh.IsTCPRemote(theirUdpAddr))
+
+	// And hands them out separately from the udp addresses
+	r := newLHHostRequest(netip.MustParseAddrPort("10.0.0.2:4242"), netip.MustParseAddr("10.128.0.2"), theirVpnIp, lhh)
+	require.NotNil(t, r.msg)
+	assertIp4InArray(t, r.msg.Details.V4AddrPorts, theirUdpAddr)
+	assertIp4InArray(t, r.msg.Details.TcpV4AddrPorts, theirTcpAddr)
+
+	// A host that asked learns they are tcp remotes, static tcp remotes are known from the start
+	c = config.NewC(l)
+	c.Settings["lighthouse"] = map[string]any{"hosts": []any{"10.128.0.1"}}
+	c.Settings["static_host_map"] = map[string]any{"10.128.0.1": []any{"1.1.1.1:4242", "tcp://1.1.1.1:443"}}
+	client, err := NewLightHouseFromConfig(context.Background(), l, c, cs, nil, nil)
+	require.NoError(t, err)
+	assert.True(t, client.IsTCPRemote(netip.MustParseAddrPort("1.1.1.1:443")))
+	assert.False(t, client.IsTCPRemote(netip.MustParseAddrPort("1.1.1.1:4242")))
+
+	reply, err := r.msg.Marshal()
+	require.NoError(t, err)
+	client.NewRequestHandler().HandleRequest(netip.MustParseAddrPort("1.1.1.1:4242"), []netip.Addr{netip.MustParseAddr("10.128.0.1")}, reply, &testEncWriter{})
+	assert.True(t, client.IsTCPRemote(theirTcpAddr))
+	assert.Contains(t, client.QueryCache([]netip.Addr{theirVpnIp}).CopyAddrs(nil), theirTcpAddr)
+}
+
+func TestLighthouse_TCPRemotesFollowRemoteLists(t *testing.T) {
+	l := test.NewLogger()
+	myVpnNet := netip.MustParsePrefix("10.128.0.1/24")
+	nt := new(bart.Lite)
+	nt.Insert(myVpnNet)
+	cs := &CertState{
+		myVpnNetworks:      []netip.Prefix{myVpnNet},
+		myVpnNetworksTable: nt,
+	}
+
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[string]any{
+		"am_lighthouse":     true,
+		"remote_allow_list": map[string]any{"24.15.1.0/24": false},
+	}
+	c.Settings["listen"] = map[string]any{"port": 4242}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, cs, nil, nil)
+	require.NoError(t, err)
+	lhh := lh.NewRequestHandler()
+
+	sharedAddr := netip.MustParseAddrPort("24.15.0.3:443")
+	deniedAddr := netip.MustParseAddrPort("24.15.1.3:443")
+	ownAddr := netip.MustParseAddrPort("10.128.0.9:443")
+
+	update := func(vpnIp netip.Addr, tcp ...netip.AddrPort) {
+		n := &NebulaMeta{
+			Type:    NebulaMeta_HostUpdateNotification,
+			Details: &NebulaMetaDetails{VpnAddr: netAddrToProtoAddr(vpnIp)},
+		}
+		for _, addr := range tcp {
+			n.Details.TcpV4AddrPorts = append(n.Details.TcpV4AddrPorts, netAddrToProtoV4AddrPort(addr.Addr(), addr.Port()))
+		}
+		b, err := n.Marshal()
+		require.NoError(t, err)
+		lhh.HandleRequest(netip.MustParseAddrPort("24.15.0.3:4242"), []netip.Addr{vpnIp}, b, &testEncWriter{})
+	}
+
+	// Addresses the remote allow list or our own networks rule out are not tcp remotes
+	first := netip.MustParseAddr("10.128.0.3")
+	update(first, sharedAddr, deniedAddr, ownAddr)
+	assert.True(t, lh.IsTCPRemote(sharedAddr))
+	assert.False(t, lh.IsTCPRemote(deniedAddr))
+	assert.False(t, lh.IsTCPRemote(ownAddr))
+
+	// An address stays a tcp remote while any host has it
+	second := netip.MustParseAddr("10.128.0.4")
+	update(second, sharedAddr)
+	update(first)
+	assert.True(t, lh.IsTCPRemote(sharedAddr))
+
+	// And is dropped when the last one goes away
+	lh.DeleteVpnAddrs([]netip.Addr{second})
+	assert.False(t, lh.IsTCPRemote(sharedAddr))
+	assert.Empty(t, lh.tcpCounts)
+}
+
+func TestLighthouse_WebSocketRemotes(t *testing.T) {
+	l := test.NewLogger()
+	myVpnNet := netip.MustParsePrefix("10.128.0.1/24")
+	nt := new(bart.Lite)
+	nt.Insert(myVpnNet)
+	cs := &CertState{
+		myVpnNetworks:      []netip.Prefix{myVpnNet},
+		myVpnNetworksTable: nt,
+	}
+
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[string]any{"hosts": []any{"10.128.0.1"}}
+	c.Settings["static_host_map"] = map[string]any{"10.128.0.1": []any{"1.1.1.1:4242", "wss://relay.example.com/nebula"}}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, cs, nil, nil)
+	require.NoError(t, err)
+	assert.True(t, lh.hasWebSocketURLs())
+
+	u, err := url.Parse("wss://relay.example.com/nebula")
+	require.NoError(t, err)
+	addr := webSocketAddr(u)
+
+	// The websocket is a tcp remote of the static host, the tcp transport asks for its url
+	found, ok := lh.WebSocketURL(addr)
+	require.True(t, ok)
+	assert.Equal(t, u, found)
+	assert.True(t, lh.IsTCPRemote(addr))
+	assert.Contains(t, lh.QueryCache([]netip.Addr{netip.MustParseAddr("10.128.0.1")}).CopyAddrs(nil), addr)
+
+	_, ok = lh.WebSocketURL(netip.MustParseAddrPort("1.1.1.1:4242"))
+	assert.False(t, ok)
+
+	// Removing the websocket on reload forgets its url
+	lh.tcpTransport.Store(true)
+	require.NoError(t, c.ReloadConfigString("lighthouse: {hosts: [10.128.0.1]}\nstatic_host_map: {10.128.0.1: [1.1.1.1:4242]}"))
+	require.NoError(t, lh.reload(c, false))
+	assert.False(t, lh.hasWebSocketURLs())
+	_, ok = lh.WebSocketURL(addr)
+	assert.False(t, ok)
+
+	// Adding one back is refused when there is no tcp transport to dial it with
+	lh.tcpTransport.Store(false)
+	require.NoError(t, c.ReloadConfigString("lighthouse: {hosts: [10.128.0.1]}\nstatic_host_map: {10.128.0.1: [1.1.1.1:4242, wss://relay.example.com/nebula]}"))
+	require.EqualError(t, lh.reload(c, false), "static_host_map websocket entries require a restart when nebula was started without the tcp transport")
+	assert.False(t, lh.hasWebSocketURLs())
+
+	lh.tcpTransport.Store(true)
+	require.NoError(t, lh.reload(c, false))
+	found, ok = lh.WebSocketURL(addr)
+	require.True(t, ok)
+	assert.Equal(t, u, found)
+}
+
 func TestLighthouse_reload(t *testing.T) {
 	l := test.NewLogger()
 	c := config.NewC(l)
@@ -9,6 +9,8 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/exitproxy"
+	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/overlay"
 	"github.com/slackhq/nebula/sshd"
 	"github.com/slackhq/nebula/udp"
@@ -64,6 +66,11 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 	if err != nil {
 		return nil, util.ContextualizeIfNeeded("Error while loading firewall rules", err)
 	}
+
+	fw.flowLog, err = newFlowLoggerFromConfig(l, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Error while loading the firewall flow log", err)
+	}
 	l.WithField("firewallHashes", fw.GetRuleHashes()).Info("Firewall started")
 
 	ssh, err := sshd.NewSSHServer(l.WithField("subsystem", "sshd"))
@@ -79,6 +86,11 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		}
 	}
 
+	controlServer, err := newControlServerFromConfig(ctx, l, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Error while configuring the control server", err)
+	}
+
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 	// All non system modifying configuration consumption should live above this line
 	// tun config, listeners, anything modifying the computer should be below
@@ -143,10 +155,10 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 	// set up our UDP listener
 	udpConns := make([]udp.Conn, routines)
 	port := c.GetInt("listen.port", 0)
+	var listenHost netip.Addr
 
 	if !configTest {
 		rawListenHost := c.GetString("listen.host", "0.0.0.0")
-		var listenHost netip.Addr
 		if rawListenHost == "[::]" {
 			// Old guidance was to provide the literal `[::]` in `listen.host` but that won't resolve.
 			listenHost = netip.IPv6Unspecified()
@@ -191,6 +203,42 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		return nil, util.ContextualizeIfNeeded("Failed to initialize lighthouse handler", err)
 	}
 
+	// The lighthouse keeps punching over udp, everything else can also reach tcp remotes
+	var tcpConn *udp.TCPConn
+	if !configTest {
+		tcpConn, err = newTCPConnFromConfig(l, c, listenHost, lightHouse)
+		if err != nil {
+			return nil, util.ContextualizeIfNeeded("Failed to start tcp transport", err)
+		}
+
+		if tcpConn != nil {
+			lightHouse.tcpTransport.Store(true)
+			for i := range udpConns {
+				udpConns[i] = udp.WithTCP(udpConns[i], tcpConn)
+			}
+		}
+	}
+
+	exitProxyConfig, err := exitProxyConfigFromConfig(l, c, pki.getCertState())
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load exit_proxy", err)
+	}
+
+	var exitProxy *exitproxy.Engine
+	if !configTest && len(exitProxyConfig.Routes) > 0 {
+		exitProxy, err = exitproxy.New(l, exitProxyConfig)
+		if err != nil {
+			return nil, util.ContextualizeIfNeeded("Failed to start exit_proxy", err)
+		}
+		l.WithField("routes", exitProxyConfig.Routes).Info("Proxying tcp and udp flows routed through this host")
+
+		defer func() {
+			if reterr != nil {
+				exitProxy.Close()
+			}
+		}()
+	}
+
 	var messageMetrics *MessageMetrics
 	if c.GetBool("stats.message_metrics", false) {
 		messageMetrics = newMessageMetrics()
@@ -200,16 +248,42 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 
 	useRelays := c.GetBool("relay.use_relays", DefaultUseRelays) && !c.GetBool("relay.am_relay", false)
 
+	handshakePattern, ixFallback, err := handshakePatternFromConfig(c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load handshake pattern", err)
+	}
+
+	postQuantum, err := postQuantumModeFromConfig(c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load handshake post quantum mode", err)
+	}
+
+	if postQuantum != postQuantumOff && handshakePattern != header.HandshakeIXPSK0 {
+		return nil, util.NewContextualError("handshakes.post_quantum is only supported with the ix pattern", nil, nil)
+	}
+
+	handshakeLimits, err := newMessageLimitsFromConfig(c, "handshakes.rate_limit", "handshake_manager.rate_limit")
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load handshakes.rate_limit", err)
+	}
+
 	handshakeConfig := HandshakeConfig{
-		tryInterval:   c.GetDuration("handshakes.try_interval", DefaultHandshakeTryInterval),
-		retries:       int64(c.GetInt("handshakes.retries", DefaultHandshakeRetries)),
-		triggerBuffer: c.GetInt("handshakes.trigger_buffer", DefaultHandshakeTriggerBuffer),
-		useRelays:     useRelays,
+		tryInterval:     c.GetDuration("handshakes.try_interval", DefaultHandshakeTryInterval),
+		retries:         int64(c.GetInt("handshakes.retries", DefaultHandshakeRetries)),
+		triggerBuffer:   c.GetInt("handshakes.trigger_buffer", DefaultHandshakeTriggerBuffer),
+		useRelays:       useRelays,
+		pattern:         handshakePattern,
+		ixFallback:      ixFallback,
+		acceptXX:        c.GetBool("handshakes.accept_xx", handshakePattern == header.HandshakeXXPSK0),
+		postQuantum:     postQuantum,
+		cookieThreshold: c.GetInt("handshakes.cookie_threshold", 0),
+		limits:          handshakeLimits,
 
 		messageMetrics: messageMetrics,
 	}
 
 	handshakeManager := NewHandshakeManager(l, hostMap, lightHouse, udpConns[0], handshakeConfig)
+	c.RegisterReloadCallback(handshakeManager.reloadLimits)
 	lightHouse.handshakeTrigger = handshakeManager.trigger
 
 	serveDns := false
@@ -225,6 +299,8 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		HostMap:               hostMap,
 		Inside:                tun,
 		Outside:               udpConns[0],
+		tcp:                   tcpConn,
+		exitProxy:             exitProxy,
 		pki:                   pki,
 		Firewall:              fw,
 		ServeDns:              serveDns,
@@ -272,6 +348,11 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		return nil, nil
 	}
 
+	err = fw.flowLog.start()
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to start the firewall flow log", err)
+	}
+
 	go ifce.emitStats(ctx, c.GetDuration("stats.interval", time.Second*10))
 
 	attachCommands(l, c, ssh, ifce)
@@ -293,5 +374,7 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		dnsStart,
 		lightHouse.StartUpdateWorker,
 		connManager.Start,
+		controlServer.Start,
+		controlServer.Stop,
 	}, nil
 }
@@ -187,6 +187,8 @@ type NebulaMetaDetails struct {
 	V4AddrPorts      []*V4AddrPort `protobuf:"bytes,2,rep,name=V4AddrPorts,proto3" json:"V4AddrPorts,omitempty"`
 	V6AddrPorts      []*V6AddrPort `protobuf:"bytes,4,rep,name=V6AddrPorts,proto3" json:"V6AddrPorts,omitempty"`
 	Counter          uint32        `protobuf:"varint,3,opt,name=counter,proto3" json:"counter,omitempty"`
+	TcpV4AddrPorts   []*V4AddrPort `protobuf:"bytes,8,rep,name=TcpV4AddrPorts,proto3" json:"TcpV4AddrPorts,omitempty"`
+	TcpV6AddrPorts   []*V6AddrPort `protobuf:"bytes,9,rep,name=TcpV6AddrPorts,proto3" json:"TcpV6AddrPorts,omitempty"`
 }
 
 func (m *NebulaMetaDetails) Reset()         { *m = NebulaMetaDetails{} }
@@ -273,6 +275,20 @@ func (m *NebulaMetaDetails) GetCounter() uint32 {
 	return 0
 }
 
+func (m *NebulaMetaDetails) GetTcpV4AddrPorts() []*V4AddrPort {
+	if m != nil {
+		return m.TcpV4AddrPorts
+	}
+	return nil
+}
+
+func (m *NebulaMetaDetails) GetTcpV6AddrPorts() []*V6AddrPort {
+	if m != nil {
+		return m.TcpV6AddrPorts
+	}
+	return nil
+}
+
 type Addr struct {
 	Hi uint64 `protobuf:"varint,1,opt,name=Hi,proto3" json:"Hi,omitempty"`
 	Lo uint64 `protobuf:"varint,2,opt,name=Lo,proto3" json:"Lo,omitempty"`
@@ -542,12 +558,17 @@ func (m *NebulaHandshake) GetHmac() []byte {
 }
 
 type NebulaHandshakeDetails struct {
-	Cert           []byte `protobuf:"bytes,1,opt,name=Cert,proto3" json:"Cert,omitempty"`
-	InitiatorIndex uint32 `protobuf:"varint,2,opt,name=InitiatorIndex,proto3" json:"InitiatorIndex,omitempty"`
-	ResponderIndex uint32 `protobuf:"varint,3,opt,name=ResponderIndex,proto3" json:"ResponderIndex,omitempty"`
-	Cookie         uint64 `protobuf:"varint,4,opt,name=Cookie,proto3" json:"Cookie,omitempty"`
-	Time           uint64 `protobuf:"varint,5,opt,name=Time,proto3" json:"Time,omitempty"`
-	CertVersion    uint32 `protobuf:"varint,8,opt,name=CertVersion,proto3" json:"CertVersion,omitempty"`
+	Cert           []byte   `protobuf:"bytes,1,opt,name=Cert,proto3" json:"Cert,omitempty"`
+	InitiatorIndex uint32   `protobuf:"varint,2,opt,name=InitiatorIndex,proto3" json:"InitiatorIndex,omitempty"`
+	ResponderIndex uint32   `protobuf:"varint,3,opt,name=ResponderIndex,proto3" json:"ResponderIndex,omitempty"`
+	Cookie         uint64   `protobuf:"varint,4,opt,name=Cookie,proto3" json:"Cookie,omitempty"`
+	Time           uint64   `protobuf:"varint,5,opt,name=Time,proto3" json:"Time,omitempty"`
+	CertVersion    uint32   `protobuf:"varint,8,opt,name=CertVersion,proto3" json:"CertVersion,omitempty"`
+	KemKey         []byte   `protobuf:"bytes,9,opt,name=KemKey,proto3" json:"KemKey,omitempty"`
+	KemCiphertext  []byte   `protobuf:"bytes,10,opt,name=KemCiphertext,proto3" json:"KemCiphertext,omitempty"`
+	Ciphers        []string `protobuf:"bytes,11,rep,name=Ciphers,proto3" json:"Ciphers,omitempty"`
+	Cipher         string   `protobuf:"bytes,12,opt,name=Cipher,proto3" json:"Cipher,omitempty"`
+	Padding        []byte   `protobuf:"bytes,13,opt,name=Padding,proto3" json:"Padding,omitempty"`
 }
 
 func (m *NebulaHandshakeDetails) Reset()         { *m = NebulaHandshakeDetails{} }
@@ -625,6 +646,41 @@ func (m *NebulaHandshakeDetails) GetCertVersion() uint32 {
 	return 0
 }
 
+func (m *NebulaHandshakeDetails) GetKemKey() []byte {
+	if m != nil {
+		return m.KemKey
+	}
+	return nil
+}
+
+func (m *NebulaHandshakeDetails) GetKemCiphertext() []byte {
+	if m != nil {
+		return m.KemCiphertext
+	}
+	return nil
+}
+
+func (m *NebulaHandshakeDetails) GetCiphers() []string {
+	if m != nil {
+		return m.Ciphers
+	}
+	return nil
+}
+
+func (m *NebulaHandshakeDetails) GetCipher() string {
+	if m != nil {
+		return m.Cipher
+	}
+	return ""
+}
+
+func (m *NebulaHandshakeDetails) GetPadding() []byte {
+	if m != nil {
+		return m.Padding
+	}
+	return nil
+}
+
 type NebulaControl struct {
 	Type                NebulaControl_MessageType `protobuf:"varint,1,opt,name=Type,proto3,enum=nebula.NebulaControl_MessageType" json:"Type,omitempty"`
 	InitiatorRelayIndex uint32                    `protobuf:"varint,2,opt,name=InitiatorRelayIndex,proto3" json:"InitiatorRelayIndex,omitempty"`
@@ -737,57 +793,62 @@ func init() {
 func init() { proto.RegisterFile("nebula.proto", fileDescriptor_2d65afa7693df5ef) }
 
 var fileDescriptor_2d65afa7693df5ef = []byte{
-	// 785 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x55, 0xcd, 0x6e, 0xeb, 0x44,
-	0x14, 0x8e, 0x1d, 0x27, 0x4e, 0x4f, 0x7e, 0xae, 0x39, 0x15, 0xc1, 0x41, 0x22, 0x0a, 0x5e, 0x54,
-	0x57, 0x2c, 0x72, 0x51, 0x5a, 0xae, 0x58, 0x72, 0x1b, 0x84, 0xd2, 0xaa, 0x3f, 0x61, 0x54, 0x8a,
-	0xc4, 0x06, 0xb9, 0xf6, 0xd0, 0x58, 0x71, 0x3c, 0xa9, 0x3d, 0x41, 0xcd, 0x5b, 0xf0, 0x30, 0x3c,
-	0x04, 0xec, 0xba, 0x42, 0x2c, 0x51, 0xbb, 0x64, 0xc9, 0x0b, 0xa0, 0x19, 0xff, 0x27, 0x86, 0xbb,
-	0x9b, 0x73, 0xbe, 0xef, 0x3b, 0x73, 0xe6, 0xf3, 0x9c, 0x31, 0x74, 0x02, 0x7a, 0xb7, 0xf1, 0xed,
-	0xf1, 0x3a, 0x64, 0x9c, 0x61, 0x33, 0x8e, 0xac, 0xbf, 0x55, 0x80, 0x2b, 0xb9, 0xbc, 0xa4, 0xdc,
-	0xc6, 0x09, 0x68, 0x37, 0xdb, 0x35, 0x35, 0x95, 0x91, 0xf2, 0xba, 0x37, 0x19, 0x8e, 0x13, 0x4d,
-	0xce, 0x18, 0x5f, 0xd2, 0x28, 0xb2, 0xef, 0xa9, 0x60, 0x11, 0xc9, 0xc5, 0x63, 0xd0, 0xbf, 0xa6,
-	0xdc, 0xf6, 0xfc, 0xc8, 0x54, 0x47, 0xca, 0xeb, 0xf6, 0x64, 0xb0, 0x2f, 0x4b, 0x08, 0x24, 0x65,
-	0x5a, 0xff, 0x28, 0xd0, 0x2e, 0x94, 0xc2, 0x16, 0x68, 0x57, 0x2c, 0xa0, 0x46, 0x0d, 0xbb, 0x70,
-	0x30, 0x63, 0x11, 0xff, 0x76, 0x43, 0xc3, 0xad, 0xa1, 0x20, 0x42, 0x2f, 0x0b, 0x09, 0x5d, 0xfb,
-	0x5b, 0x43, 0xc5, 0x8f, 0xa1, 0x2f, 0x72, 0xdf, 0xad, 0x5d, 0x9b, 0xd3, 0x2b, 0xc6, 0xbd, 0x9f,
-	0x3c, 0xc7, 0xe6, 0x1e, 0x0b, 0x8c, 0x3a, 0x0e, 0xe0, 0x43, 0x81, 0x5d, 0xb2, 0x9f, 0xa9, 0x5b,
-	0x82, 0xb4, 0x14, 0x9a, 0x6f, 0x02, 0x67, 0x51, 0x82, 0x1a, 0xd8, 0x03, 0x10, 0xd0, 0xf7, 0x0b,
-	0x66, 0xaf, 0x3c, 0xa3, 0x89, 0x87, 0xf0, 0x2a, 0x8f, 0xe3, 0x6d, 0x75, 0xd1, 0xd9, 0xdc, 0xe6,
-	0x8b, 0xe9, 0x82, 0x3a, 0x4b, 0xa3, 0x25, 0x3a, 0xcb, 0xc2, 0x98, 0x72, 0x80, 0x9f, 0xc0, 0xa0,
-	0xba, 0xb3, 0x77, 0xce, 0xd2, 0x00, 0xeb, 0x77, 0x15, 0x3e, 0xd8, 0x33, 0x05, 0x2d, 0x80, 0x6b,
-	0xdf, 0xbd, 0x5d, 0x07, 0xef, 0x5c, 0x37, 0x94, 0xd6, 0x77, 0x4f, 0x55, 0x53, 0x21, 0x85, 0x2c,
-	0x1e, 0x81, 0x9e, 0x12, 0x9a, 0xd2, 0xe4, 0x4e, 0x6a, 0xb2, 0xc8, 0x91, 0x14, 0xc4, 0x31, 0x18,
-	0xd7, 0xbe, 0x4b, 0xa8, 0x6f, 0x6f, 0x93, 0x54, 0x64, 0x36, 0x46, 0xf5, 0xa4, 0xe2, 0x1e, 0x86,
-	0x13, 0xe8, 0x96, 0xc9, 0xfa, 0xa8, 0xbe, 0x57, 0xbd, 0x4c, 0xc1, 0x13, 0x68, 0xdf, 0x9e, 0x88,
-	0xe5, 0x9c, 0x85, 0x5c, 0x7c, 0x74, 0xa1, 0xc0, 0x54, 0x91, 0x43, 0xa4, 0x48, 0x93, 0xaa, 0xb7,
-	0xb9, 0x4a, 0xdb, 0x51, 0xbd, 0x2d, 0xa8, 0x72, 0x1a, 0x9a, 0xa0, 0x3b, 0x6c, 0x13, 0x70, 0x1a,
-	0x9a, 0x75, 0x61, 0x0c, 0x49, 0x43, 0xeb, 0x08, 0x34, 0x79, 0xe2, 0x1e, 0xa8, 0x33, 0x4f, 0xba,
-	0xa6, 0x11, 0x75, 0xe6, 0x89, 0xf8, 0x82, 0xc9, 0x9b, 0xa8, 0x11, 0xf5, 0x82, 0x59, 0x27, 0x00,
-	0x79, 0x1b, 0x88, 0xb1, 0x2a, 0x76, 0x99, 0xc4, 0x15, 0x10, 0x34, 0x81, 0x49, 0x4d, 0x97, 0xc8,
-	0xb5, 0xf5, 0x15, 0x40, 0xde, 0xc6, 0xfb, 0xf6, 0xc8, 0x2a, 0xd4, 0x0b, 0x15, 0x1e, 0xd3, 0xc1,
-	0x9a, 0x7b, 0xc1, 0xfd, 0xff, 0x0f, 0x96, 0x60, 0x54, 0x0c, 0x16, 0x82, 0x76, 0xe3, 0xad, 0x68,
-	0xb2, 0x8f, 0x5c, 0x5b, 0xd6, 0xde, 0xd8, 0x08, 0xb1, 0x51, 0xc3, 0x03, 0x68, 0xc4, 0x97, 0x50,
-	0xb1, 0x7e, 0x84, 0x57, 0x71, 0xdd, 0x99, 0x1d, 0xb8, 0xd1, 0xc2, 0x5e, 0x52, 0xfc, 0x32, 0x9f,
-	0x51, 0x45, 0x5e, 0x9f, 0x9d, 0x0e, 0x32, 0xe6, 0xee, 0xa0, 0x8a, 0x26, 0x66, 0x2b, 0xdb, 0x91,
-	0x4d, 0x74, 0x88, 0x5c, 0x5b, 0x7f, 0x28, 0xd0, 0xaf, 0xd6, 0x09, 0xfa, 0x94, 0x86, 0x5c, 0xee,
-	0xd2, 0x21, 0x72, 0x8d, 0x47, 0xd0, 0x3b, 0x0b, 0x3c, 0xee, 0xd9, 0x9c, 0x85, 0x67, 0x81, 0x4b,
-	0x1f, 0x13, 0xa7, 0x77, 0xb2, 0x82, 0x47, 0x68, 0xb4, 0x66, 0x81, 0x4b, 0x13, 0x5e, 0xec, 0xe7,
-	0x4e, 0x16, 0xfb, 0xd0, 0x9c, 0x32, 0xb6, 0xf4, 0xa8, 0xa9, 0x49, 0x67, 0x92, 0x28, 0xf3, 0xab,
-	0x91, 0xfb, 0x85, 0x23, 0x68, 0x8b, 0x1e, 0x6e, 0x69, 0x18, 0x79, 0x2c, 0x30, 0x5b, 0xb2, 0x60,
-	0x31, 0x75, 0xae, 0xb5, 0x9a, 0x86, 0x7e, 0xae, 0xb5, 0x74, 0xa3, 0x65, 0xfd, 0x5a, 0x87, 0x6e,
-	0x7c, 0xb0, 0x29, 0x0b, 0x78, 0xc8, 0x7c, 0xfc, 0xa2, 0xf4, 0xdd, 0x3e, 0x2d, 0xbb, 0x96, 0x90,
-	0x2a, 0x3e, 0xdd, 0xe7, 0x70, 0x98, 0x1d, 0x4e, 0x0e, 0x4f, 0xf1, 0xdc, 0x55, 0x90, 0x50, 0x64,
-	0xc7, 0x2c, 0x28, 0x62, 0x07, 0xaa, 0x20, 0xfc, 0x0c, 0x7a, 0xe9, 0x38, 0xdf, 0x30, 0x79, 0xa9,
-	0xb5, 0xec, 0xe9, 0xd8, 0x41, 0x8a, 0xcf, 0xc2, 0x37, 0x21, 0x5b, 0x49, 0x76, 0x23, 0x63, 0xef,
-	0x61, 0x38, 0x86, 0x76, 0xb1, 0x70, 0xd5, 0x93, 0x53, 0x24, 0x64, 0xcf, 0x48, 0x56, 0x5c, 0xaf,
-	0x50, 0x94, 0x29, 0xd6, 0xec, 0xbf, 0xfe, 0x00, 0x7d, 0xc0, 0x69, 0x48, 0x6d, 0x4e, 0x25, 0x9f,
-	0xd0, 0x87, 0x0d, 0x8d, 0xb8, 0xa1, 0xe0, 0x47, 0x70, 0x58, 0xca, 0x0b, 0x4b, 0x22, 0x6a, 0xa8,
-	0xa7, 0xc7, 0xbf, 0x3d, 0x0f, 0x95, 0xa7, 0xe7, 0xa1, 0xf2, 0xd7, 0xf3, 0x50, 0xf9, 0xe5, 0x65,
-	0x58, 0x7b, 0x7a, 0x19, 0xd6, 0xfe, 0x7c, 0x19, 0xd6, 0x7e, 0x18, 0xdc, 0x7b, 0x7c, 0xb1, 0xb9,
-	0x1b, 0x3b, 0x6c, 0xf5, 0x26, 0xf2, 0x6d, 0x67, 0xb9, 0x78, 0x78, 0x13, 0xb7, 0x74, 0xd7, 0x94,
-	0x3f, 0xc2, 0xe3, 0x7f, 0x03, 0x00, 0x00, 0xff, 0xff, 0xea, 0x6f, 0xbc, 0x50, 0x18, 0x07, 0x00,
-	0x00,
+	// 872 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x56, 0xcd, 0x6e, 0x23, 0x45,
+	0x10, 0xf6, 0x8c, 0xc7, 0x7f, 0xe5, 0x9f, 0x1d, 0x2a, 0x22, 0x4c, 0x90, 0xb0, 0xcc, 0x08, 0x45,
+	0x11, 0x07, 0x2f, 0x4a, 0xc2, 0x0a, 0x71, 0x62, 0xd7, 0x08, 0x79, 0x37, 0x9b, 0xac, 0x69, 0x85,
+	0x20, 0x71, 0x41, 0x93, 0x99, 0xc2, 0x1e, 0xd9, 0x9e, 0xf6, 0xce, 0xb4, 0x51, 0xfc, 0x16, 0x3c,
+	0x0c, 0x2f, 0xc0, 0x8d, 0xe3, 0x1e, 0x39, 0xae, 0x92, 0x23, 0x47, 0x5e, 0x00, 0x75, 0xcf, 0xbf,
+	0xed, 0xc0, 0xad, 0xab, 0xea, 0xfb, 0xaa, 0x3f, 0x7d, 0x3d, 0x55, 0x36, 0x74, 0x02, 0xba, 0x5d,
+	0x2f, 0x9c, 0xe1, 0x2a, 0xe4, 0x82, 0x63, 0x3d, 0x8e, 0xec, 0xbf, 0x75, 0x80, 0x2b, 0x75, 0xbc,
+	0x24, 0xe1, 0xe0, 0x29, 0x18, 0xd7, 0x9b, 0x15, 0x59, 0xda, 0x40, 0x3b, 0xe9, 0x9d, 0xf6, 0x87,
+	0x09, 0x27, 0x47, 0x0c, 0x2f, 0x29, 0x8a, 0x9c, 0x29, 0x49, 0x14, 0x53, 0x58, 0x3c, 0x83, 0xc6,
+	0xb7, 0x24, 0x1c, 0x7f, 0x11, 0x59, 0xfa, 0x40, 0x3b, 0x69, 0x9f, 0x1e, 0xed, 0xd2, 0x12, 0x00,
+	0x4b, 0x91, 0xf6, 0x3f, 0x1a, 0xb4, 0x0b, 0xad, 0xb0, 0x09, 0xc6, 0x15, 0x0f, 0xc8, 0xac, 0x60,
+	0x17, 0x5a, 0x63, 0x1e, 0x89, 0xef, 0xd7, 0x14, 0x6e, 0x4c, 0x0d, 0x11, 0x7a, 0x59, 0xc8, 0x68,
+	0xb5, 0xd8, 0x98, 0x3a, 0x7e, 0x0c, 0x87, 0x32, 0xf7, 0xc3, 0xca, 0x73, 0x04, 0x5d, 0x71, 0xe1,
+	0xff, 0xe2, 0xbb, 0x8e, 0xf0, 0x79, 0x60, 0x56, 0xf1, 0x08, 0x3e, 0x94, 0xb5, 0x4b, 0xfe, 0x2b,
+	0x79, 0xa5, 0x92, 0x91, 0x96, 0x26, 0xeb, 0xc0, 0x9d, 0x95, 0x4a, 0x35, 0xec, 0x01, 0xc8, 0xd2,
+	0x8f, 0x33, 0xee, 0x2c, 0x7d, 0xb3, 0x8e, 0x07, 0xf0, 0x24, 0x8f, 0xe3, 0x6b, 0x1b, 0x52, 0xd9,
+	0xc4, 0x11, 0xb3, 0xd1, 0x8c, 0xdc, 0xb9, 0xd9, 0x94, 0xca, 0xb2, 0x30, 0x86, 0xb4, 0xf0, 0x13,
+	0x38, 0xda, 0xaf, 0xec, 0xb9, 0x3b, 0x37, 0xc1, 0xfe, 0xa3, 0x0a, 0x1f, 0xec, 0x98, 0x82, 0x36,
+	0xc0, 0x9b, 0x85, 0x77, 0xb3, 0x0a, 0x9e, 0x7b, 0x5e, 0xa8, 0xac, 0xef, 0xbe, 0xd0, 0x2d, 0x8d,
+	0x15, 0xb2, 0x78, 0x0c, 0x8d, 0x14, 0x50, 0x57, 0x26, 0x77, 0x52, 0x93, 0x65, 0x8e, 0xa5, 0x45,
+	0x1c, 0x82, 0xf9, 0x66, 0xe1, 0x31, 0x5a, 0x38, 0x9b, 0x24, 0x15, 0x59, 0xb5, 0x41, 0x35, 0xe9,
+	0xb8, 0x53, 0xc3, 0x53, 0xe8, 0x96, 0xc1, 0x8d, 0x41, 0x75, 0xa7, 0x7b, 0x19, 0x82, 0xe7, 0xd0,
+	0xbe, 0x39, 0x97, 0xc7, 0x09, 0x0f, 0x85, 0x7c, 0x74, 0xc9, 0xc0, 0x94, 0x91, 0x97, 0x58, 0x11,
+	0xa6, 0x58, 0xcf, 0x72, 0x96, 0xb1, 0xc5, 0x7a, 0x56, 0x60, 0xe5, 0x30, 0xb4, 0xa0, 0xe1, 0xf2,
+	0x75, 0x20, 0x28, 0xb4, 0xaa, 0xd2, 0x18, 0x96, 0x86, 0xf8, 0x35, 0xf4, 0xae, 0xdd, 0x55, 0x51,
+	0x48, 0xf3, 0x51, 0x21, 0x5b, 0xc8, 0x94, 0x5b, 0x90, 0xd3, 0x7a, 0x54, 0xce, 0x16, 0xd2, 0x3e,
+	0x06, 0x43, 0x06, 0xd8, 0x03, 0x7d, 0xec, 0xab, 0xd7, 0x32, 0x98, 0x3e, 0xf6, 0x65, 0xfc, 0x9a,
+	0xab, 0x09, 0x30, 0x98, 0xfe, 0x9a, 0xdb, 0xe7, 0x00, 0xf9, 0x95, 0x88, 0x31, 0x2b, 0x7e, 0x5d,
+	0x16, 0x77, 0x40, 0x30, 0x64, 0x4d, 0x71, 0xba, 0x4c, 0x9d, 0xed, 0x6f, 0x00, 0xf2, 0xcb, 0xfe,
+	0xef, 0x8e, 0xac, 0x43, 0xb5, 0xd0, 0xe1, 0x2e, 0x1d, 0xe8, 0x89, 0x1f, 0x4c, 0xff, 0x7b, 0xa0,
+	0x25, 0x62, 0xcf, 0x40, 0x23, 0x18, 0xd7, 0xfe, 0x92, 0x92, 0x7b, 0xd4, 0xd9, 0xb6, 0x77, 0xc6,
+	0x55, 0x92, 0xcd, 0x0a, 0xb6, 0xa0, 0x16, 0x7f, 0xfc, 0x9a, 0xfd, 0x33, 0x3c, 0x89, 0xfb, 0x8e,
+	0x9d, 0xc0, 0x8b, 0x66, 0xce, 0x9c, 0xf0, 0xab, 0x7c, 0x37, 0x68, 0xea, 0xb3, 0xdd, 0x52, 0x90,
+	0x21, 0xb7, 0x17, 0x84, 0x14, 0x31, 0x5e, 0x3a, 0xae, 0x12, 0xd1, 0x61, 0xea, 0x6c, 0xbf, 0xd7,
+	0xe1, 0x70, 0x3f, 0x4f, 0xc2, 0x47, 0x14, 0x0a, 0x75, 0x4b, 0x87, 0xa9, 0x33, 0x1e, 0x43, 0xef,
+	0x65, 0xe0, 0x0b, 0xdf, 0x11, 0x3c, 0x7c, 0x19, 0x78, 0x74, 0x97, 0x38, 0xbd, 0x95, 0x95, 0x38,
+	0x46, 0xd1, 0x8a, 0x07, 0x1e, 0x25, 0xb8, 0xd8, 0xcf, 0xad, 0x2c, 0x1e, 0x42, 0x7d, 0xc4, 0xf9,
+	0xdc, 0x27, 0xcb, 0x50, 0xce, 0x24, 0x51, 0xe6, 0x57, 0x2d, 0xf7, 0x0b, 0x07, 0xd0, 0x96, 0x1a,
+	0x6e, 0x28, 0x8c, 0x7c, 0x1e, 0x58, 0x4d, 0xd5, 0xb0, 0x98, 0x92, 0xdd, 0x2e, 0x68, 0x79, 0x41,
+	0x1b, 0xab, 0xa5, 0x34, 0x27, 0x11, 0x7e, 0x06, 0xdd, 0x0b, 0x5a, 0x8e, 0xfc, 0xd5, 0x8c, 0x42,
+	0x41, 0x77, 0xc2, 0x02, 0x55, 0x2e, 0x27, 0xe5, 0x5c, 0xc4, 0x51, 0x64, 0xb5, 0x07, 0xd5, 0x93,
+	0x16, 0x4b, 0x43, 0xa5, 0x52, 0x1d, 0xad, 0xce, 0x40, 0x3b, 0x69, 0xb1, 0x24, 0x92, 0x8c, 0x89,
+	0xe3, 0x79, 0x7e, 0x30, 0xb5, 0xba, 0xaa, 0x63, 0x1a, 0xbe, 0x32, 0x9a, 0x75, 0xb3, 0xf1, 0xca,
+	0x68, 0x36, 0xcc, 0xa6, 0xfd, 0x7b, 0x15, 0xba, 0xb1, 0xc5, 0x23, 0x1e, 0x88, 0x90, 0x2f, 0xf0,
+	0xcb, 0xd2, 0x17, 0xf4, 0x69, 0xf9, 0xfd, 0x12, 0xd0, 0x9e, 0x8f, 0xe8, 0x0b, 0x38, 0xc8, 0x6c,
+	0x56, 0xeb, 0xa3, 0xf8, 0x02, 0xfb, 0x4a, 0x92, 0x91, 0x19, 0x5e, 0x60, 0xc4, 0x6f, 0xb1, 0xaf,
+	0x84, 0x9f, 0x43, 0x2f, 0x5d, 0x68, 0xd7, 0x5c, 0x8d, 0x97, 0x91, 0x2d, 0xcf, 0xad, 0x4a, 0x71,
+	0x31, 0x7e, 0x17, 0xf2, 0xa5, 0x42, 0xd7, 0x32, 0xf4, 0x4e, 0x0d, 0x87, 0xd0, 0x2e, 0x36, 0xde,
+	0xb7, 0x74, 0x8b, 0x80, 0x6c, 0x91, 0x66, 0xcd, 0x1b, 0x7b, 0x18, 0x65, 0x88, 0x3d, 0x7e, 0xec,
+	0x37, 0xf0, 0x10, 0x70, 0x14, 0x92, 0x23, 0x48, 0xe1, 0x19, 0xbd, 0x5d, 0x53, 0x24, 0x4c, 0x0d,
+	0x3f, 0x82, 0x83, 0x52, 0x5e, 0x5a, 0x12, 0x91, 0xa9, 0xbf, 0x38, 0xfb, 0xf3, 0xbe, 0xaf, 0xbd,
+	0xbb, 0xef, 0x6b, 0xef, 0xef, 0xfb, 0xda, 0x6f, 0x0f, 0xfd, 0xca, 0xbb, 0x87, 0x7e, 0xe5, 0xaf,
+	0x87, 0x7e, 0xe5, 0xa7, 0xa3, 0xa9, 0x2f, 0x66, 0xeb, 0xdb, 0xa1, 0xcb, 0x97, 0x4f, 0xa3, 0x85,
+	0xe3, 0xce, 0x67, 0x6f, 0x9f, 0xc6, 0x92, 0x6e, 0xeb, 0xea, 0xaf, 0xc0, 0xd9, 0xbf, 0x03, 0x00,
+	0x33, 0xb6, 0x45, 0x6e, 0x1a, 0x08, 0x00, 0x00,
 }
 
 func (m *NebulaMeta) Marshal() (dAtA []byte, err error) {
@@ -850,6 +911,34 @@ func (m *NebulaMetaDetails) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if len(m.TcpV6AddrPorts) > 0 {
+		for iNdEx := len(m.TcpV6AddrPorts) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.TcpV6AddrPorts[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintNebula(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x4a
+		}
+	}
+	if len(m.TcpV4AddrPorts) > 0 {
+		for iNdEx := len(m.TcpV4AddrPorts) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.TcpV4AddrPorts[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintNebula(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x42
+		}
+	}
 	if len(m.RelayVpnAddrs) > 0 {
 		for iNdEx := len(m.RelayVpnAddrs) - 1; iNdEx >= 0; iNdEx-- {
 			{
@@ -1134,6 +1223,43 @@ func (m *NebulaHandshakeDetails) MarshalToSizedBuffer(dAtA []byte) (int, error)
 	_ = i
 	var l int
 	_ = l
+	if len(m.Padding) > 0 {
+		i -= len(m.Padding)
+		copy(dAtA[i:], m.Padding)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.Padding)))
+		i--
+		dAtA[i] = 0x6a
+	}
+	if len(m.Cipher) > 0 {
+		i -= len(m.Cipher)
+		copy(dAtA[i:], m.Cipher)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.Cipher)))
+		i--
+		dAtA[i] = 0x62
+	}
+	if len(m.Ciphers) > 0 {
+		for iNdEx := len(m.Ciphers) - 1; iNdEx >= 0; iNdEx-- {
+			i -= len(m.Ciphers[iNdEx])
+			copy(dAtA[i:], m.Ciphers[iNdEx])
+			i = encodeVarintNebula(dAtA, i, uint64(len(m.Ciphers[iNdEx])))
+			i--
+			dAtA[i] = 0x5a
+		}
+	}
+	if len(m.KemCiphertext) > 0 {
+		i -= len(m.KemCiphertext)
+		copy(dAtA[i:], m.KemCiphertext)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.KemCiphertext)))
+		i--
+		dAtA[i] = 0x52
+	}
+	if len(m.KemKey) > 0 {
+		i -= len(m.KemKey)
+		copy(dAtA[i:], m.KemKey)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.KemKey)))
+		i--
+		dAtA[i] = 0x4a
+	}
 	if m.CertVersion != 0 {
 		i = encodeVarintNebula(dAtA, i, uint64(m.CertVersion))
 		i--
@@ -1309,6 +1435,18 @@ func (m *NebulaMetaDetails) Size() (n int) {
 			n += 1 + l + sovNebula(uint64(l))
 		}
 	}
+	if len(m.TcpV4AddrPorts) > 0 {
+		for _, e := range m.TcpV4AddrPorts {
+			l = e.Size()
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
+	if len(m.TcpV6AddrPorts) > 0 {
+		for _, e := range m.TcpV6AddrPorts {
+			l = e.Size()
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
 	return n
 }
 
@@ -1417,6 +1555,28 @@ func (m *NebulaHandshakeDetails) Size() (n int) {
 	if m.CertVersion != 0 {
 		n += 1 + sovNebula(uint64(m.CertVersion))
 	}
+	l = len(m.KemKey)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	l = len(m.KemCiphertext)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	if len(m.Ciphers) > 0 {
+		for _, s := range m.Ciphers {
+			l = len(s)
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
+	l = len(m.Cipher)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	l = len(m.Padding)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
 	return n
 }
 
@@ -1844,6 +2004,74 @@ func (m *NebulaMetaDetails) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 8:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field TcpV4AddrPorts", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.TcpV4AddrPorts = append(m.TcpV4AddrPorts, &V4AddrPort{})
+			if err := m.TcpV4AddrPorts[len(m.TcpV4AddrPorts)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 9:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field TcpV6AddrPorts", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.TcpV6AddrPorts = append(m.TcpV6AddrPorts, &V6AddrPort{})
+			if err := m.TcpV6AddrPorts[len(m.TcpV6AddrPorts)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipNebula(dAtA[iNdEx:])
@@ -2514,6 +2742,172 @@ func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 9:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field KemKey", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.KemKey = append(m.KemKey[:0], dAtA[iNdEx:postIndex]...)
+			if m.KemKey == nil {
+				m.KemKey = []byte{}
+			}
+			iNdEx = postIndex
+		case 10:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field KemCiphertext", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.KemCiphertext = append(m.KemCiphertext[:0], dAtA[iNdEx:postIndex]...)
+			if m.KemCiphertext == nil {
+				m.KemCiphertext = []byte{}
+			}
+			iNdEx = postIndex
+		case 11:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Ciphers", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Ciphers = append(m.Ciphers, string(dAtA[iNdEx:postIndex]))
+			iNdEx = postIndex
+		case 12:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Cipher", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Cipher = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 13:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Padding", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Padding = append(m.Padding[:0], dAtA[iNdEx:postIndex]...)
+			if m.Padding == nil {
+				m.Padding = []byte{}
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipNebula(dAtA[iNdEx:])
@@ -16,7 +16,8 @@ import (
 )
 
 const (
-	minFwPacketLen = 4
+	minFwPacketLen   = 4
+	minICMPPacketLen = 2
 )
 
 func (f *Interface) readOutsidePackets(ip netip.AddrPort, via *ViaSender, out []byte, packet []byte, h *header.H, fwPacket *firewall.Packet, lhf *LightHouseHandler, nb []byte, q int, localCache firewall.ConntrackCache) {
@@ -286,6 +287,10 @@ func newPacket(data []byte, incoming bool, fp *firewall.Packet) error {
 		return ErrPacketTooShort
 	}
 
+	// Only set for icmp, fp is reused and these are part of the conntrack key
+	fp.ICMPType = 0
+	fp.ICMPCode = 0
+
 	version := int((data[0] >> 4) & 0x0f)
 	switch version {
 	case ipv4.Version:
@@ -320,7 +325,20 @@ func parseV6(data []byte, incoming bool, fp *firewall.Packet) error {
 		proto := layers.IPProtocol(data[protoAt])
 
 		switch proto {
-		case layers.IPProtocolICMPv6, layers.IPProtocolESP, layers.IPProtocolNoNextHeader:
+		case layers.IPProtocolICMPv6:
+			if dataLen < offset+2 {
+				return ErrIPv6PacketTooShort
+			}
+
+			fp.Protocol = uint8(proto)
+			fp.RemotePort = 0
+			fp.LocalPort = 0
+			fp.ICMPType = data[offset]
+			fp.ICMPCode = data[offset+1]
+			fp.Fragment = false
+			return nil
+
+		case layers.IPProtocolESP, layers.IPProtocolNoNextHeader:
 			fp.Protocol = uint8(proto)
 			fp.RemotePort = 0
 			fp.LocalPort = 0
@@ -416,13 +434,22 @@ func parseV4(data []byte, incoming bool, fp *firewall.Packet) error {
 
 	// Accounting for a variable header length, do we have enough data for our src/dst tuples?
 	minLen := ihl
-	if !fp.Fragment && fp.Protocol != firewall.ProtoICMP {
-		minLen += minFwPacketLen
+	if !fp.Fragment {
+		if fp.Protocol == firewall.ProtoICMP {
+			minLen += minICMPPacketLen
+		} else {
+			minLen += minFwPacketLen
+		}
 	}
 	if len(data) < minLen {
 		return ErrIPv4InvalidHeaderLength
 	}
 
+	if !fp.Fragment && fp.Protocol == firewall.ProtoICMP {
+		fp.ICMPType = data[ihl]
+		fp.ICMPCode = data[ihl+1]
+	}
+
 	// Firewall packets are locally oriented
 	if incoming {
 		fp.RemoteAddr, _ = netip.AddrFromSlice(data[12:16])
@@ -487,7 +514,7 @@ func (f *Interface) decryptToTun(hostinfo *HostInfo, messageCounter uint64, out
 		return false
 	}
 
-	dropReason := f.firewall.Drop(*fwPacket, true, hostinfo, f.pki.GetCAPool(), localCache)
+	dropReason := f.firewall.drop(*fwPacket, true, hostinfo, f.pki.GetCAPool(), localCache, len(out))
 	if dropReason != nil {
 		// NOTE: We give `packet` as the `out` here since we already decrypted from it and we don't need it anymore
 		// This gives us a buffer to build the reject packet in
@@ -501,7 +528,15 @@ func (f *Interface) decryptToTun(hostinfo *HostInfo, messageCounter uint64, out
 	}
 
 	f.connectionManager.In(hostinfo)
-	_, err = f.readers[q].Write(out)
+	if f.exitProxy != nil && f.exitProxy.Handles(fwPacket.LocalAddr) {
+		_, err = f.exitProxy.Write(out)
+		if err != nil {
+			hostinfo.logger(f.l).WithError(err).Debug("Failed to write to exit proxy")
+		}
+		return true
+	}
+
+	_, err = f.tunWriters[q].Write(out)
 	if err != nil {
 		f.l.WithError(err).Error("Failed to write to tun")
 	}
@@ -14,6 +14,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 func Test_newPacket(t *testing.T) {
@@ -93,6 +94,38 @@ func Test_newPacket(t *testing.T) {
 	assert.Equal(t, uint16(6), p.RemotePort)
 	assert.Equal(t, uint16(5), p.LocalPort)
 	assert.False(t, p.Fragment)
+
+	// icmp type and code
+	h = ipv4.Header{
+		Version:  1,
+		Protocol: firewall.ProtoICMP,
+		Len:      20,
+		Src:      net.IPv4(10, 0, 0, 1),
+		Dst:      net.IPv4(10, 0, 0, 2),
+	}
+
+	b, _ = h.Marshal()
+	err = newPacket(append(b, 8), true, p)
+	require.ErrorIs(t, err, ErrIPv4InvalidHeaderLength)
+
+	b = append(b, []byte{8, 1, 0, 0}...)
+	err = newPacket(b, true, p)
+
+	require.NoError(t, err)
+	assert.Equal(t, uint8(firewall.ProtoICMP), p.Protocol)
+	assert.Equal(t, uint8(8), p.ICMPType)
+	assert.Equal(t, uint8(1), p.ICMPCode)
+	assert.Equal(t, uint16(0), p.RemotePort)
+	assert.Equal(t, uint16(0), p.LocalPort)
+
+	// a fragment does not carry the icmp header
+	binary.BigEndian.PutUint16(b[6:8], 10)
+	err = newPacket(b[:20], true, p)
+
+	require.NoError(t, err)
+	assert.True(t, p.Fragment)
+	assert.Equal(t, uint8(0), p.ICMPType)
+	assert.Equal(t, uint8(0), p.ICMPCode)
 }
 
 func Test_newPacket_v6(t *testing.T) {
@@ -165,7 +198,9 @@ func Test_newPacket_v6(t *testing.T) {
 		DstIP:      net.IPv6linklocalallnodes,
 	}
 
-	icmp := layers.ICMPv6{}
+	icmp := layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodeAdminProhibited),
+	}
 
 	buffer.Clear()
 	err = gopacket.SerializeLayers(buffer, opt, &ip, &icmp)
@@ -180,8 +215,14 @@ func Test_newPacket_v6(t *testing.T) {
 	assert.Equal(t, netip.MustParseAddr("ff02::1"), p.LocalAddr)
 	assert.Equal(t, uint16(0), p.RemotePort)
 	assert.Equal(t, uint16(0), p.LocalPort)
+	assert.Equal(t, uint8(layers.ICMPv6TypeDestinationUnreachable), p.ICMPType)
+	assert.Equal(t, uint8(layers.ICMPv6CodeAdminProhibited), p.ICMPCode)
 	assert.False(t, p.Fragment)
 
+	// An ICMP packet without a type and code
+	err = newPacket(buffer.Bytes()[:ipv6.HeaderLen+1], true, p)
+	require.ErrorIs(t, err, ErrIPv6PacketTooShort)
+
 	// A good ESP packet
 	b := buffer.Bytes()
 	b[6] = byte(layers.IPProtocolESP)
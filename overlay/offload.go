@@ -0,0 +1,430 @@
+package overlay
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// BatchReader is implemented by tun queues that may hand over several packets with a single read, like a linux tun
+// with offloads that reads tcp segments larger than the mtu and splits them up
+type BatchReader interface {
+	// ReadBatch reads the next packets and appends them to pkts. The packets are only valid until the next read.
+	ReadBatch(pkts [][]byte) ([][]byte, error)
+}
+
+// Flusher is implemented by writers that hold on to packets, like a Coalescer, until they are flushed
+type Flusher interface {
+	Flush() error
+}
+
+// vnetWriter is a tun queue that takes a virtio net header with every packet when it has offloads
+type vnetWriter interface {
+	offloads() bool
+	writeVnet(hdr virtioNetHdr, pkt []byte) error
+}
+
+// NewWriter returns what packets should be written to the tun queue w through. Queues with offloads get a Coalescer,
+// which must be flushed, everything else gets w back.
+func NewWriter(w io.Writer) io.Writer {
+	if vw, ok := w.(vnetWriter); ok && vw.offloads() {
+		return newCoalescer(vw)
+	}
+	return w
+}
+
+const (
+	virtioNetHdrLen = 10
+
+	virtioNetHdrFNeedsCsum = 1
+
+	virtioNetHdrGSONone  = 0
+	virtioNetHdrGSOTCPv4 = 1
+	virtioNetHdrGSOTCPv6 = 4
+	virtioNetHdrGSOECN   = 0x80
+
+	// maxOffloadLen is the largest packet the kernel hands over or takes with offloads
+	maxOffloadLen = 65535
+
+	tcpFlagFIN = 0x01
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+	tcpFlagCWR = 0x80
+)
+
+// ErrBadOffload is returned by ReadBatch for a read that can not be split into packets, the read is dropped
+var ErrBadOffload = errors.New("packet does not match its offload header")
+
+// virtioNetHdr is struct virtio_net_hdr, it describes the offloads a packet read from or written to a tun needs
+type virtioNetHdr struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+func (h *virtioNetHdr) decode(b []byte) {
+	h.flags = b[0]
+	h.gsoType = b[1]
+	h.hdrLen = binary.NativeEndian.Uint16(b[2:])
+	h.gsoSize = binary.NativeEndian.Uint16(b[4:])
+	h.csumStart = binary.NativeEndian.Uint16(b[6:])
+	h.csumOffset = binary.NativeEndian.Uint16(b[8:])
+}
+
+func (h *virtioNetHdr) encode(b []byte) {
+	b[0] = h.flags
+	b[1] = h.gsoType
+	binary.NativeEndian.PutUint16(b[2:], h.hdrLen)
+	binary.NativeEndian.PutUint16(b[4:], h.gsoSize)
+	binary.NativeEndian.PutUint16(b[6:], h.csumStart)
+	binary.NativeEndian.PutUint16(b[8:], h.csumOffset)
+}
+
+// checksumAdd adds b to a ones complement sum
+func checksumAdd(sum uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+func checksumFold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return uint16(sum)
+}
+
+// pseudoHeaderSum is the sum of the ip pseudo header that starts a tcp or udp checksum
+func pseudoHeaderSum(pkt []byte, proto uint8, length int) uint32 {
+	var sum uint32
+	if pkt[0]>>4 == 4 {
+		sum = checksumAdd(sum, pkt[12:20])
+	} else {
+		sum = checksumAdd(sum, pkt[8:40])
+	}
+	return sum + uint32(proto) + uint32(length)
+}
+
+func setIPv4Checksum(pkt []byte, ihl int) {
+	pkt[10], pkt[11] = 0, 0
+	binary.BigEndian.PutUint16(pkt[10:], ^checksumFold(checksumAdd(0, pkt[:ihl])))
+}
+
+// setIPLength sets the length of an ipv4 or ipv6 packet, fixing the ipv4 header checksum
+func setIPLength(pkt []byte, ihl int) {
+	if pkt[0]>>4 == 4 {
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		setIPv4Checksum(pkt, ihl)
+	} else {
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(pkt)-40))
+	}
+}
+
+// appendSegments appends the packets pkt was offloaded from to pkts. A tcp segment larger than the mtu is split into
+// packets written to arena, and a checksum the kernel left for us to finish is finished.
+func appendSegments(pkts [][]byte, hdr virtioNetHdr, pkt []byte, arena []byte) ([][]byte, error) {
+	gsoType := hdr.gsoType &^ virtioNetHdrGSOECN
+	if gsoType == virtioNetHdrGSONone {
+		if hdr.flags&virtioNetHdrFNeedsCsum != 0 {
+			start, field := int(hdr.csumStart), int(hdr.csumStart)+int(hdr.csumOffset)
+			if field+2 > len(pkt) {
+				return pkts, ErrBadOffload
+			}
+			// The field holds the pseudo header sum, the rest of the packet is summed over it
+			binary.BigEndian.PutUint16(pkt[field:], ^checksumFold(checksumAdd(0, pkt[start:])))
+		}
+		return append(pkts, pkt), nil
+	}
+
+	if gsoType != virtioNetHdrGSOTCPv4 && gsoType != virtioNetHdrGSOTCPv6 {
+		return pkts, ErrBadOffload
+	}
+
+	ihl := int(hdr.csumStart)
+	if ihl < 20 || ihl+20 > len(pkt) || hdr.gsoSize == 0 {
+		return pkts, ErrBadOffload
+	}
+	hdrLen := ihl + int(pkt[ihl+12]>>4)*4
+	if hdrLen > len(pkt) {
+		return pkts, ErrBadOffload
+	}
+
+	mss := int(hdr.gsoSize)
+	payload := pkt[hdrLen:]
+	seq := binary.BigEndian.Uint32(pkt[ihl+4:])
+	flags := pkt[ihl+13]
+	var id uint16
+	if gsoType == virtioNetHdrGSOTCPv4 {
+		id = binary.BigEndian.Uint16(pkt[4:])
+	}
+
+	for i := 0; len(payload) > 0; i++ {
+		n := min(mss, len(payload))
+		if hdrLen+n > len(arena) {
+			return pkts, ErrBadOffload
+		}
+
+		seg := arena[:hdrLen+n]
+		arena = arena[hdrLen+n:]
+		copy(seg, pkt[:hdrLen])
+		copy(seg[hdrLen:], payload[:n])
+		payload = payload[n:]
+
+		if gsoType == virtioNetHdrGSOTCPv4 {
+			binary.BigEndian.PutUint16(seg[4:], id+uint16(i))
+		}
+		setIPLength(seg, ihl)
+
+		tcp := seg[ihl:]
+		binary.BigEndian.PutUint32(tcp[4:], seq+uint32(i*mss))
+		segFlags := flags
+		if i > 0 {
+			segFlags &^= tcpFlagCWR
+		}
+		if len(payload) > 0 {
+			segFlags &^= tcpFlagFIN | tcpFlagPSH
+		}
+		tcp[13] = segFlags
+
+		tcp[16], tcp[17] = 0, 0
+		sum := checksumAdd(pseudoHeaderSum(seg, 6, len(tcp)), tcp)
+		binary.BigEndian.PutUint16(tcp[16:], ^checksumFold(sum))
+
+		pkts = append(pkts, seg)
+	}
+
+	return pkts, nil
+}
+
+// coalescerMaxItems is how many packets or merged runs of segments a Coalescer holds before it flushes on its own
+const coalescerMaxItems = 64
+
+// Coalescer merges tcp segments of the same flow written to a tun queue with offloads into a single large segment that
+// the kernel splits up again, so a run of segments costs one write. Packets are held until Flush is called.
+type Coalescer struct {
+	sync.Mutex
+	w     vnetWriter
+	items []*coalesceItem
+	n     int
+}
+
+// coalesceItem is a packet waiting to be written, more tcp segments may be appended to it
+type coalesceItem struct {
+	buf []byte
+	// tcp is set when buf is a tcp segment that can be merged with others, open while more can be appended to it
+	tcp  bool
+	open bool
+	// ihl and hdrLen are the length of the ip header and of the ip and tcp headers
+	ihl     int
+	hdrLen  int
+	segSize int
+	segs    int
+	nextSeq uint32
+}
+
+func newCoalescer(w vnetWriter) *Coalescer {
+	return &Coalescer{w: w}
+}
+
+// Write queues a copy of b
+func (c *Coalescer) Write(b []byte) (int, error) {
+	if len(b) > maxOffloadLen {
+		return 0, errors.New("packet is too large")
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	ihl, hdrLen, ok := coalescableTCP(b)
+	if ok {
+		// Only the newest packet of a flow can be appended to, an older one would reorder the flow
+		for i := c.n - 1; i >= 0; i-- {
+			it := c.items[i]
+			if !it.tcp || !sameFlow(it.buf, b, it.ihl, ihl) {
+				continue
+			}
+			if it.open && it.append(b, ihl, hdrLen) {
+				return len(b), nil
+			}
+			break
+		}
+	} else {
+		// b may belong to a flow that has a run waiting, appending to the run after b would reorder the flow
+		for _, it := range c.items[:c.n] {
+			it.open = false
+		}
+	}
+
+	if c.n == coalescerMaxItems {
+		if err := c.flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	if c.n == len(c.items) {
+		c.items = append(c.items, &coalesceItem{buf: make([]byte, 0, maxOffloadLen)})
+	}
+	it := c.items[c.n]
+	c.n++
+
+	it.buf = append(it.buf[:0], b...)
+	it.segs = 1
+	it.tcp = ok
+	// A push ends the run
+	it.open = ok && b[ihl+13]&tcpFlagPSH == 0
+	if ok {
+		it.ihl = ihl
+		it.hdrLen = hdrLen
+		it.segSize = len(b) - hdrLen
+		it.nextSeq = binary.BigEndian.Uint32(b[ihl+4:]) + uint32(it.segSize)
+	}
+
+	return len(b), nil
+}
+
+// Flush writes every queued packet, merged segments are written as one
+func (c *Coalescer) Flush() error {
+	c.Lock()
+	defer c.Unlock()
+	return c.flush()
+}
+
+func (c *Coalescer) flush() error {
+	var firstErr error
+	for _, it := range c.items[:c.n] {
+		var hdr virtioNetHdr
+		if it.segs > 1 {
+			setIPLength(it.buf, it.ihl)
+
+			// The kernel finishes the checksum of every segment from the pseudo header sum of the whole packet
+			tcp := it.buf[it.ihl:]
+			binary.BigEndian.PutUint16(tcp[16:], checksumFold(pseudoHeaderSum(it.buf, 6, len(tcp))))
+
+			hdr = virtioNetHdr{
+				flags:      virtioNetHdrFNeedsCsum,
+				gsoType:    virtioNetHdrGSOTCPv4,
+				hdrLen:     uint16(it.hdrLen),
+				gsoSize:    uint16(it.segSize),
+				csumStart:  uint16(it.ihl),
+				csumOffset: 16,
+			}
+			if it.buf[0]>>4 == 6 {
+				hdr.gsoType = virtioNetHdrGSOTCPv6
+			}
+		}
+
+		if err := c.w.writeVnet(hdr, it.buf); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	c.n = 0
+	return firstErr
+}
+
+// append adds the payload of the tcp segment b if it continues the run, it reports false if b must be written on its own
+func (it *coalesceItem) append(b []byte, ihl, hdrLen int) bool {
+	payload := len(b) - hdrLen
+	if ihl != it.ihl || hdrLen != it.hdrLen || payload > it.segSize || len(it.buf)+payload > maxOffloadLen {
+		return false
+	}
+
+	tcp, itTCP := b[ihl:], it.buf[it.ihl:]
+	if binary.BigEndian.Uint32(tcp[4:]) != it.nextSeq {
+		return false
+	}
+
+	// Everything but the sequence number, push flag, and checksum must match, including the options
+	if tcp[13]&^tcpFlagPSH != itTCP[13] || string(tcp[8:13]) != string(itTCP[8:13]) ||
+		string(tcp[14:16]) != string(itTCP[14:16]) || string(tcp[18:hdrLen-ihl]) != string(itTCP[18:hdrLen-ihl]) {
+		return false
+	}
+	if !sameIPHeader(it.buf, b, ihl) {
+		return false
+	}
+
+	it.buf = append(it.buf, b[hdrLen:]...)
+	it.segs++
+	it.nextSeq += uint32(payload)
+	if payload < it.segSize || tcp[13]&tcpFlagPSH != 0 {
+		// Only the last segment may be short and a push ends the run
+		itTCP[13] |= tcp[13] & tcpFlagPSH
+		it.open = false
+	}
+	return true
+}
+
+// coalescableTCP reports if pkt is a tcp segment that carries data and only has the ack or push flags set, along with
+// the length of its ip header and of its ip and tcp headers
+func coalescableTCP(pkt []byte) (int, int, bool) {
+	if len(pkt) < 20 {
+		return 0, 0, false
+	}
+
+	var ihl int
+	switch pkt[0] >> 4 {
+	case 4:
+		ihl = int(pkt[0]&0x0f) * 4
+		// No options, not a fragment
+		if ihl != 20 || pkt[9] != 6 || binary.BigEndian.Uint16(pkt[6:])&0x3fff != 0 {
+			return 0, 0, false
+		}
+		if int(binary.BigEndian.Uint16(pkt[2:])) != len(pkt) {
+			return 0, 0, false
+		}
+	case 6:
+		ihl = 40
+		// No extension headers
+		if len(pkt) < ihl || pkt[6] != 6 || int(binary.BigEndian.Uint16(pkt[4:]))+40 != len(pkt) {
+			return 0, 0, false
+		}
+	default:
+		return 0, 0, false
+	}
+
+	if len(pkt) < ihl+20 {
+		return 0, 0, false
+	}
+	hdrLen := ihl + int(pkt[ihl+12]>>4)*4
+	if hdrLen < ihl+20 || hdrLen >= len(pkt) {
+		return 0, 0, false
+	}
+	if pkt[ihl+13]&^tcpFlagPSH != tcpFlagACK {
+		return 0, 0, false
+	}
+
+	return ihl, hdrLen, true
+}
+
+// sameFlow reports if two tcp segments have the same addresses and ports
+func sameFlow(a, b []byte, aihl, bihl int) bool {
+	if a[0]>>4 != b[0]>>4 || aihl != bihl {
+		return false
+	}
+	if a[0]>>4 == 4 {
+		if string(a[12:20]) != string(b[12:20]) {
+			return false
+		}
+	} else if string(a[8:40]) != string(b[8:40]) {
+		return false
+	}
+	return string(a[aihl:aihl+4]) == string(b[bihl:bihl+4])
+}
+
+// sameIPHeader reports if the ip headers of two segments of a flow only differ in length, id, and checksum
+func sameIPHeader(a, b []byte, ihl int) bool {
+	if a[0]>>4 == 4 {
+		// version, tos, flags, ttl, and protocol
+		return a[1] == b[1] && a[6] == b[6] && a[8] == b[8] && a[9] == b[9]
+	}
+	// version, traffic class, flow label, next header, and hop limit
+	return string(a[0:4]) == string(b[0:4]) && a[6] == b[6] && a[7] == b[7]
+}
@@ -0,0 +1,322 @@
+package overlay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTCP makes a tcp segment from 10.0.0.1:1000 to 10.0.0.2:2000, or between fd00::1 and fd00::2, with valid checksums
+func testTCP(v6 bool, seq uint32, flags uint8, payload []byte) []byte {
+	ihl := 20
+	if v6 {
+		ihl = 40
+	}
+	pkt := make([]byte, ihl+20+len(payload))
+
+	if v6 {
+		pkt[0] = 0x60
+		pkt[6] = 6
+		pkt[7] = 64
+		pkt[23], pkt[39] = 1, 2
+		pkt[8], pkt[9], pkt[24], pkt[25] = 0xfd, 0, 0xfd, 0
+	} else {
+		pkt[0] = 0x45
+		binary.BigEndian.PutUint16(pkt[4:], 100)
+		pkt[6] = 0x40
+		pkt[8] = 64
+		pkt[9] = 6
+		copy(pkt[12:], []byte{10, 0, 0, 1, 10, 0, 0, 2})
+	}
+
+	tcp := pkt[ihl:]
+	binary.BigEndian.PutUint16(tcp[0:], 1000)
+	binary.BigEndian.PutUint16(tcp[2:], 2000)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], 7)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 512)
+	copy(tcp[20:], payload)
+
+	setIPLength(pkt, ihl)
+	binary.BigEndian.PutUint16(tcp[16:], ^checksumFold(checksumAdd(pseudoHeaderSum(pkt, 6, len(tcp)), tcp)))
+	return pkt
+}
+
+func testPayload(n int, fill byte) []byte {
+	return bytes.Repeat([]byte{fill}, n)
+}
+
+func assertChecksums(t *testing.T, pkt []byte) {
+	ihl := 40
+	if pkt[0]>>4 == 4 {
+		ihl = 20
+		assert.Equal(t, uint16(0xffff), checksumFold(checksumAdd(0, pkt[:ihl])), "ip checksum")
+	}
+	tcp := pkt[ihl:]
+	assert.Equal(t, uint16(0xffff), checksumFold(checksumAdd(pseudoHeaderSum(pkt, 6, len(tcp)), tcp)), "tcp checksum")
+}
+
+type testVnetWriter struct {
+	hdrs []virtioNetHdr
+	pkts [][]byte
+}
+
+func (w *testVnetWriter) Write(b []byte) (int, error) {
+	return len(b), w.writeVnet(virtioNetHdr{}, b)
+}
+
+func (w *testVnetWriter) offloads() bool {
+	return true
+}
+
+func (w *testVnetWriter) writeVnet(hdr virtioNetHdr, pkt []byte) error {
+	w.hdrs = append(w.hdrs, hdr)
+	w.pkts = append(w.pkts, append([]byte(nil), pkt...))
+	return nil
+}
+
+func TestVirtioNetHdr(t *testing.T) {
+	h := virtioNetHdr{flags: 1, gsoType: 4, hdrLen: 60, gsoSize: 1400, csumStart: 40, csumOffset: 16}
+	b := make([]byte, virtioNetHdrLen)
+	h.encode(b)
+
+	var got virtioNetHdr
+	got.decode(b)
+	assert.Equal(t, h, got)
+}
+
+func TestAppendSegments(t *testing.T) {
+	for _, v6 := range []bool{false, true} {
+		ihl := 20
+		gsoType := uint8(virtioNetHdrGSOTCPv4)
+		if v6 {
+			ihl = 40
+			gsoType = virtioNetHdrGSOTCPv6
+		}
+
+		// 2.5 segments worth of payload, with a push and cwr that only belong on the last and first segment
+		payload := append(testPayload(1000, 1), append(testPayload(1000, 2), testPayload(500, 3)...)...)
+		pkt := testTCP(v6, 5000, tcpFlagACK|tcpFlagPSH|tcpFlagCWR, payload)
+		hdr := virtioNetHdr{
+			flags:      virtioNetHdrFNeedsCsum,
+			gsoType:    gsoType,
+			hdrLen:     uint16(ihl + 20),
+			gsoSize:    1000,
+			csumStart:  uint16(ihl),
+			csumOffset: 16,
+		}
+
+		pkts, err := appendSegments(nil, hdr, pkt, make([]byte, 2*maxOffloadLen))
+		require.NoError(t, err)
+		require.Len(t, pkts, 3)
+
+		for i, seg := range pkts {
+			assertChecksums(t, seg)
+			tcp := seg[ihl:]
+			assert.Equal(t, uint32(5000+i*1000), binary.BigEndian.Uint32(tcp[4:]))
+			assert.Equal(t, payload[i*1000:min((i+1)*1000, len(payload))], tcp[20:])
+			if !v6 {
+				assert.Equal(t, uint16(100+i), binary.BigEndian.Uint16(seg[4:]))
+				assert.Equal(t, len(seg), int(binary.BigEndian.Uint16(seg[2:])))
+			} else {
+				assert.Equal(t, len(seg)-40, int(binary.BigEndian.Uint16(seg[4:])))
+			}
+		}
+		assert.Equal(t, uint8(tcpFlagACK|tcpFlagCWR), pkts[0][ihl+13])
+		assert.Equal(t, uint8(tcpFlagACK), pkts[1][ihl+13])
+		assert.Equal(t, uint8(tcpFlagACK|tcpFlagPSH), pkts[2][ihl+13])
+	}
+}
+
+func TestAppendSegments_NeedsCsum(t *testing.T) {
+	pkt := testTCP(false, 1, tcpFlagACK, testPayload(101, 9))
+	want := append([]byte(nil), pkt...)
+
+	// The kernel leaves the pseudo header sum in the checksum field
+	binary.BigEndian.PutUint16(pkt[36:], checksumFold(pseudoHeaderSum(pkt, 6, len(pkt)-20)))
+	hdr := virtioNetHdr{flags: virtioNetHdrFNeedsCsum, csumStart: 20, csumOffset: 16}
+
+	pkts, err := appendSegments(nil, hdr, pkt, nil)
+	require.NoError(t, err)
+	require.Len(t, pkts, 1)
+	assert.Equal(t, want, pkts[0])
+}
+
+func TestAppendSegments_Bad(t *testing.T) {
+	pkt := testTCP(false, 1, tcpFlagACK, testPayload(3000, 1))
+	arena := make([]byte, 2*maxOffloadLen)
+
+	// udp segmentation is not asked for
+	_, err := appendSegments(nil, virtioNetHdr{gsoType: 3, gsoSize: 1000, csumStart: 20}, pkt, arena)
+	assert.ErrorIs(t, err, ErrBadOffload)
+
+	_, err = appendSegments(nil, virtioNetHdr{gsoType: virtioNetHdrGSOTCPv4, csumStart: 20}, pkt, arena)
+	assert.ErrorIs(t, err, ErrBadOffload)
+
+	_, err = appendSegments(nil, virtioNetHdr{flags: virtioNetHdrFNeedsCsum, csumStart: 20, csumOffset: 5000}, pkt, arena)
+	assert.ErrorIs(t, err, ErrBadOffload)
+
+	// The segments don't fit the arena
+	_, err = appendSegments(nil, virtioNetHdr{gsoType: virtioNetHdrGSOTCPv4, gsoSize: 1000, csumStart: 20}, pkt, arena[:2000])
+	assert.ErrorIs(t, err, ErrBadOffload)
+}
+
+func TestNewWriter(t *testing.T) {
+	w := &testVnetWriter{}
+	assert.IsType(t, &Coalescer{}, NewWriter(w))
+
+	var b bytes.Buffer
+	assert.Equal(t, &b, NewWriter(&b))
+}
+
+func TestCoalescer(t *testing.T) {
+	for _, v6 := range []bool{false, true} {
+		ihl := 20
+		if v6 {
+			ihl = 40
+		}
+
+		w := &testVnetWriter{}
+		c := newCoalescer(w)
+
+		var segs [][]byte
+		for i := 0; i < 4; i++ {
+			flags := uint8(tcpFlagACK)
+			if i == 3 {
+				flags |= tcpFlagPSH
+			}
+			segs = append(segs, testTCP(v6, uint32(1+i*1000), flags, testPayload(1000, byte(i))))
+		}
+		for _, seg := range segs {
+			_, err := c.Write(seg)
+			require.NoError(t, err)
+		}
+		assert.Empty(t, w.pkts, "nothing is written before a flush")
+
+		require.NoError(t, c.Flush())
+		require.Len(t, w.pkts, 1)
+
+		hdr := w.hdrs[0]
+		assert.Equal(t, uint8(virtioNetHdrFNeedsCsum), hdr.flags)
+		assert.Equal(t, uint16(ihl+20), hdr.hdrLen)
+		assert.Equal(t, uint16(1000), hdr.gsoSize)
+		assert.Equal(t, uint16(ihl), hdr.csumStart)
+		assert.Equal(t, uint16(16), hdr.csumOffset)
+
+		// Splitting the merged packet the way the kernel would gives back the original segments
+		merged := w.pkts[0]
+		assert.Equal(t, ihl+20+4000, len(merged))
+		assert.Equal(t, uint8(tcpFlagACK|tcpFlagPSH), merged[ihl+13])
+		pkts, err := appendSegments(nil, hdr, merged, make([]byte, 2*maxOffloadLen))
+		require.NoError(t, err)
+		require.Len(t, pkts, 4)
+		for i := range pkts {
+			if !v6 {
+				// The kernel numbers the ids the same way, the originals all had the same one
+				binary.BigEndian.PutUint16(pkts[i][4:], 100)
+				setIPv4Checksum(pkts[i], 20)
+			}
+			assert.Equal(t, segs[i], pkts[i], "segment %d", i)
+		}
+
+		require.NoError(t, c.Flush())
+		assert.Len(t, w.pkts, 1, "a flush with nothing queued writes nothing")
+	}
+}
+
+func TestCoalescer_Order(t *testing.T) {
+	w := &testVnetWriter{}
+	c := newCoalescer(w)
+
+	write := func(pkt []byte) {
+		_, err := c.Write(pkt)
+		require.NoError(t, err)
+	}
+
+	write(testTCP(false, 1, tcpFlagACK, testPayload(100, 1)))
+	write(testTCP(false, 101, tcpFlagACK, testPayload(100, 2)))
+	// A fin can't be merged, it closes the run so the next segment can't jump ahead of it
+	fin := testTCP(false, 201, tcpFlagACK|tcpFlagFIN, testPayload(100, 3))
+	write(fin)
+	write(testTCP(false, 301, tcpFlagACK, testPayload(100, 4)))
+	// A gap in the sequence starts a new run
+	write(testTCP(false, 501, tcpFlagACK, testPayload(100, 5)))
+	// A segment longer than the run can't be appended
+	write(testTCP(false, 601, tcpFlagACK, testPayload(200, 6)))
+	// A segment that isn't tcp is written as is
+	other := []byte{0x45, 0, 0, 20, 0, 0, 0, 0, 64, 17, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2}
+	write(other)
+
+	require.NoError(t, c.Flush())
+	require.Len(t, w.pkts, 6)
+	assert.Equal(t, 20+20+200, len(w.pkts[0]))
+	assert.Equal(t, uint16(100), w.hdrs[0].gsoSize)
+	assert.Equal(t, fin, w.pkts[1])
+	assert.Equal(t, virtioNetHdr{}, w.hdrs[1])
+	assert.Equal(t, uint32(301), binary.BigEndian.Uint32(w.pkts[2][24:]))
+	assert.Equal(t, uint32(501), binary.BigEndian.Uint32(w.pkts[3][24:]))
+	assert.Equal(t, uint32(601), binary.BigEndian.Uint32(w.pkts[4][24:]))
+	assert.Equal(t, other, w.pkts[5])
+}
+
+func TestCoalescer_Full(t *testing.T) {
+	w := &testVnetWriter{}
+	c := newCoalescer(w)
+
+	// Segments with a push are never merged, so every one takes an item
+	for i := 0; i < coalescerMaxItems+1; i++ {
+		_, err := c.Write(testTCP(false, uint32(1+i*10), tcpFlagACK|tcpFlagPSH, testPayload(10, byte(i))))
+		require.NoError(t, err)
+	}
+	assert.Len(t, w.pkts, coalescerMaxItems)
+
+	require.NoError(t, c.Flush())
+	assert.Len(t, w.pkts, coalescerMaxItems+1)
+
+	_, err := c.Write(make([]byte, maxOffloadLen+1))
+	assert.Error(t, err)
+}
+
+func BenchmarkCoalescer(b *testing.B) {
+	w := &testVnetWriter{}
+	c := newCoalescer(w)
+
+	segs := make([][]byte, 44)
+	for i := range segs {
+		segs[i] = testTCP(false, uint32(1+i*1400), tcpFlagACK, testPayload(1400, byte(i)))
+	}
+
+	b.SetBytes(int64(len(segs) * 1400))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, seg := range segs {
+			_, _ = c.Write(seg)
+		}
+		_ = c.Flush()
+		w.hdrs, w.pkts = w.hdrs[:0], w.pkts[:0]
+	}
+}
+
+func BenchmarkAppendSegments(b *testing.B) {
+	pkt := testTCP(false, 1, tcpFlagACK, testPayload(44*1400, 1))
+	hdr := virtioNetHdr{gsoType: virtioNetHdrGSOTCPv4, hdrLen: 40, gsoSize: 1400, csumStart: 20, csumOffset: 16}
+	arena := make([]byte, 2*maxOffloadLen)
+	var pkts [][]byte
+
+	b.SetBytes(int64(len(pkt)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		pkts, err = appendSegments(pkts[:0], hdr, pkt, arena)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -21,6 +21,9 @@ func NewDeviceFromConfig(c *config.C, l *logrus.Logger, vpnNetworks []netip.Pref
 		tun := newDisabledTun(vpnNetworks, c.GetInt("tun.tx_queue", 500), c.GetBool("stats.message_metrics", false), l)
 		return tun, nil
 
+	case c.GetBool("tun.user", false):
+		return NewUserDevice(vpnNetworks)
+
 	default:
 		return newTun(c, l, vpnNetworks, routines > 1)
 	}
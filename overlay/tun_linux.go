@@ -4,6 +4,7 @@
 package overlay
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -34,6 +35,11 @@ type tun struct {
 	deviceIndex int
 	ioctlFd     uintptr
 
+	// vnetHdr is set when the device was opened with offloads, its queues are offloadQueues
+	vnetHdr bool
+	// rbuf is read into by ReadBatch when the device has no offloads
+	rbuf []byte
+
 	Routes                    atomic.Pointer[[]Route]
 	routeTree                 atomic.Pointer[bart.Table[routing.Gateways]]
 	routeChan                 chan struct{}
@@ -101,17 +107,29 @@ func newTun(c *config.C, l *logrus.Logger, vpnNetworks []netip.Prefix, multiqueu
 		}
 	}
 
+	vnetHdr := c.GetBool("tun.offload", false)
+
 	var req ifReq
 	req.Flags = uint16(unix.IFF_TUN | unix.IFF_NO_PI)
 	if multiqueue {
 		req.Flags |= unix.IFF_MULTI_QUEUE
 	}
+	if vnetHdr {
+		req.Flags |= unix.IFF_VNET_HDR
+	}
 	copy(req.Name[:], c.GetString("tun.dev", ""))
 	if err = ioctl(uintptr(fd), uintptr(unix.TUNSETIFF), uintptr(unsafe.Pointer(&req))); err != nil {
 		return nil, err
 	}
 	name := strings.Trim(string(req.Name[:]), "\x00")
 
+	if vnetHdr {
+		// Without the offloads the kernel still takes coalesced writes, it just hands over one packet at a time
+		if err = setOffloads(fd); err != nil {
+			l.WithError(err).Warn("Failed to enable tun offloads, tcp segments will be read one packet at a time")
+		}
+	}
+
 	file := os.NewFile(uintptr(fd), "/dev/net/tun")
 	t, err := newTunGeneric(c, l, file, vpnNetworks)
 	if err != nil {
@@ -119,6 +137,10 @@ func newTun(c *config.C, l *logrus.Logger, vpnNetworks []netip.Prefix, multiqueu
 	}
 
 	t.Device = name
+	if vnetHdr {
+		t.vnetHdr = true
+		t.ReadWriteCloser = newOffloadQueue(file)
+	}
 
 	return t, nil
 }
@@ -224,22 +246,49 @@ func (t *tun) NewMultiQueueReader() (io.ReadWriteCloser, error) {
 
 	var req ifReq
 	req.Flags = uint16(unix.IFF_TUN | unix.IFF_NO_PI | unix.IFF_MULTI_QUEUE)
+	if t.vnetHdr {
+		req.Flags |= unix.IFF_VNET_HDR
+	}
 	copy(req.Name[:], t.Device)
 	if err = ioctl(uintptr(fd), uintptr(unix.TUNSETIFF), uintptr(unsafe.Pointer(&req))); err != nil {
 		return nil, err
 	}
 
 	file := os.NewFile(uintptr(fd), "/dev/net/tun")
+	if t.vnetHdr {
+		return newOffloadQueue(file), nil
+	}
 
 	return file, nil
 }
 
+// ReadBatch reads the next packets, which is more than one only when the device was opened with offloads
+func (t *tun) ReadBatch(pkts [][]byte) ([][]byte, error) {
+	if q, ok := t.ReadWriteCloser.(*offloadQueue); ok {
+		return q.ReadBatch(pkts)
+	}
+
+	if t.rbuf == nil {
+		// Large enough for any mtu the device may be reloaded with
+		t.rbuf = make([]byte, maxOffloadLen)
+	}
+	n, err := t.Read(t.rbuf)
+	if err != nil {
+		return pkts, err
+	}
+	return append(pkts, t.rbuf[:n]), nil
+}
+
 func (t *tun) RoutesFor(ip netip.Addr) routing.Gateways {
 	r, _ := t.routeTree.Load().Lookup(ip)
 	return r
 }
 
 func (t *tun) Write(b []byte) (int, error) {
+	if t.vnetHdr {
+		return t.ReadWriteCloser.Write(b)
+	}
+
 	var nn int
 	maximum := len(b)
 
@@ -262,6 +311,18 @@ func (t *tun) Write(b []byte) (int, error) {
 	}
 }
 
+func (t *tun) offloads() bool {
+	return t.vnetHdr
+}
+
+func (t *tun) writeVnet(hdr virtioNetHdr, pkt []byte) error {
+	q, ok := t.ReadWriteCloser.(*offloadQueue)
+	if !ok {
+		return errors.New("tun was not opened with offloads")
+	}
+	return q.writeVnet(hdr, pkt)
+}
+
 func (t *tun) deviceBytes() (o [16]byte) {
 	for i, c := range t.Device {
 		o[i] = byte(c)
@@ -0,0 +1,104 @@
+//go:build !android && !e2e_testing
+// +build !android,!e2e_testing
+
+package overlay
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Offloads a tun opened with IFF_VNET_HDR can be asked for with TUNSETOFFLOAD, from linux/if_tun.h
+const (
+	tunFCsum = 0x01
+	tunFTSO4 = 0x02
+	tunFTSO6 = 0x04
+)
+
+// offloadQueue is a tun queue opened with IFF_VNET_HDR, every packet read or written starts with a virtio net header.
+// The kernel may hand over tcp segments of up to 64KiB which are split into packets that fit the mtu, and it takes
+// segments that were merged by a Coalescer the same way.
+type offloadQueue struct {
+	*os.File
+	fd int
+
+	// rbuf, arena, and pending are only used by the routine reading the queue
+	rbuf    []byte
+	arena   []byte
+	pending [][]byte
+}
+
+func newOffloadQueue(file *os.File) *offloadQueue {
+	return &offloadQueue{
+		File:  file,
+		fd:    int(file.Fd()),
+		rbuf:  make([]byte, virtioNetHdrLen+maxOffloadLen),
+		arena: make([]byte, 2*maxOffloadLen),
+	}
+}
+
+// setOffloads asks the kernel to hand over tcp segments larger than the mtu with their checksums left to us
+func setOffloads(fd int) error {
+	return ioctl(uintptr(fd), uintptr(unix.TUNSETOFFLOAD), uintptr(tunFCsum|tunFTSO4|tunFTSO6))
+}
+
+func (q *offloadQueue) ReadBatch(pkts [][]byte) ([][]byte, error) {
+	n, err := q.File.Read(q.rbuf)
+	if err != nil {
+		return pkts, err
+	}
+	if n < virtioNetHdrLen {
+		return pkts, io.ErrUnexpectedEOF
+	}
+
+	var hdr virtioNetHdr
+	hdr.decode(q.rbuf)
+	return appendSegments(pkts, hdr, q.rbuf[virtioNetHdrLen:n], q.arena)
+}
+
+// Read returns one packet at a time, ReadBatch is cheaper since a read can hold many
+func (q *offloadQueue) Read(b []byte) (int, error) {
+	for len(q.pending) == 0 {
+		var err error
+		q.pending, err = q.ReadBatch(q.pending[:0])
+		if err != nil {
+			if errors.Is(err, ErrBadOffload) {
+				continue
+			}
+			return 0, err
+		}
+	}
+
+	n := copy(b, q.pending[0])
+	q.pending = q.pending[1:]
+	return n, nil
+}
+
+// Write sends a single packet that needs no offloads
+func (q *offloadQueue) Write(b []byte) (int, error) {
+	if err := q.writeVnet(virtioNetHdr{}, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (q *offloadQueue) offloads() bool {
+	return true
+}
+
+func (q *offloadQueue) writeVnet(hdr virtioNetHdr, pkt []byte) error {
+	var hb [virtioNetHdrLen]byte
+	hdr.encode(hb[:])
+
+	n, err := unix.Writev(q.fd, [][]byte{hb[:], pkt})
+	if err != nil {
+		return err
+	}
+	if n != virtioNetHdrLen+len(pkt) {
+		return io.ErrShortWrite
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package overlay
 import (
 	"io"
 	"net/netip"
+	"os"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/config"
@@ -62,6 +63,7 @@ func (d *UserDevice) Write(p []byte) (n int, err error) {
 }
 func (d *UserDevice) Close() error {
 	d.inboundWriter.Close()
-	d.outboundWriter.Close()
+	// Reading a closed device must look like reading a closed tun, so nebula knows it was shut down
+	d.outboundWriter.CloseWithError(os.ErrClosed)
 	return nil
 }
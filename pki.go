@@ -36,7 +36,13 @@ type CertState struct {
 	initiatingVersion cert.Version
 	privateKey        []byte
 	pkcs11Backed      bool
-	cipher            string
+
+	// ciphers are the tunnel ciphers from `cipher` in order of preference, the first is used to initiate handshakes
+	ciphers []string
+
+	// psks are the handshake pre-shared keys from handshakes.psk, the first is used to initiate handshakes
+	// and all are accepted. A nil entry means no psk.
+	psks [][]byte
 
 	myVpnNetworks            []netip.Prefix
 	myVpnNetworksTable       *bart.Lite
@@ -62,6 +68,40 @@ func NewPKIFromConfig(l *logrus.Logger, c *config.C) (*PKI, error) {
 	return pki, nil
 }
 
+// initiatingPSK returns the pre-shared key to use for handshakes we initiate, nil if there is none
+func (cs *CertState) initiatingPSK() []byte {
+	if len(cs.psks) == 0 {
+		return nil
+	}
+	return cs.psks[0]
+}
+
+// initiatingCipher returns the cipher to start handshakes with
+func (cs *CertState) initiatingCipher() string {
+	return cs.acceptedCiphers()[0]
+}
+
+// acceptedCiphers returns every cipher a tunnel may use in order of preference
+func (cs *CertState) acceptedCiphers() []string {
+	if len(cs.ciphers) == 0 {
+		return []string{"aes"}
+	}
+	return cs.ciphers
+}
+
+// acceptedPSKs returns every pre-shared key a handshake may use, a nil entry means no psk
+func (cs *CertState) acceptedPSKs() [][]byte {
+	if len(cs.psks) == 0 {
+		return [][]byte{nil}
+	}
+	return cs.psks
+}
+
+// requiresPSK reports whether every handshake has to prove it knows one of our pre-shared keys
+func (cs *CertState) requiresPSK() bool {
+	return len(cs.psks) > 0 && !slices.ContainsFunc(cs.psks, func(psk []byte) bool { return psk == nil })
+}
+
 func (p *PKI) GetCAPool() *cert.CAPool {
 	return p.caPool.Load()
 }
@@ -96,6 +136,16 @@ func (p *PKI) reloadCerts(c *config.C, initial bool) *util.ContextualError {
 		return util.NewContextualError("Could not load client cert", nil, err)
 	}
 
+	newState.psks, err = loadHandshakePSKsFromConfig(c)
+	if err != nil {
+		return util.NewContextualError("Could not load handshake pre-shared keys", nil, err)
+	}
+
+	newState.ciphers, err = ciphersFromConfig(c)
+	if err != nil {
+		return util.NewContextualError("unknown cipher", m{"cipher": c.Get("cipher")}, err)
+	}
+
 	if !initial {
 		currentState := p.cs.Load()
 		if newState.v1Cert != nil {
@@ -150,25 +200,6 @@ func (p *PKI) reloadCerts(c *config.C, initial bool) *util.ContextualError {
 		} else if currentState.v2Cert != nil {
 			return util.NewContextualError("v2 certificate was removed, restart required", nil, err)
 		}
-
-		// Cipher cant be hot swapped so just leave it at what it was before
-		newState.cipher = currentState.cipher
-
-	} else {
-		newState.cipher = c.GetString("cipher", "aes")
-		//TODO: this sucks and we should make it not a global
-		switch newState.cipher {
-		case "aes":
-			noiseEndianness = binary.BigEndian
-		case "chachapoly":
-			noiseEndianness = binary.LittleEndian
-		default:
-			return util.NewContextualError(
-				"unknown cipher",
-				m{"cipher": newState.cipher},
-				nil,
-			)
-		}
 	}
 
 	p.cs.Store(newState)
@@ -0,0 +1,168 @@
+package nebula
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+)
+
+const (
+	// sourceLimitMaxBuckets is how many sources are tracked on their own, sources beyond that share a bucket
+	sourceLimitMaxBuckets = 65536
+	// sourceLimitPruneBatch is how many buckets each message checks for having refilled
+	sourceLimitPruneBatch = 2
+)
+
+// sourceLimits keeps a token bucket per source of a message type, the source being a remote udp address or a vpn
+// address. A bucket that has had time to refill is no different from a new one, so it is dropped to keep the map from
+// growing with every address a flood is sent from. Sources that arrive while the map is full share one bucket.
+type sourceLimits[K comparable] struct {
+	sync.Mutex
+
+	rate     float64
+	burst    float64
+	refill   time.Duration
+	max      int
+	buckets  map[K]*tokenBucket
+	overflow *tokenBucket
+
+	metricDropped metrics.Counter
+}
+
+func newSourceLimits[K comparable](name string, rate, burst float64) *sourceLimits[K] {
+	return &sourceLimits[K]{
+		rate:          rate,
+		burst:         burst,
+		refill:        time.Duration(burst / rate * float64(time.Second)),
+		max:           sourceLimitMaxBuckets,
+		buckets:       map[K]*tokenBucket{},
+		overflow:      newTokenBucket(rate, burst),
+		metricDropped: metrics.GetOrRegisterCounter(name+".dropped", nil),
+	}
+}
+
+func (sl *sourceLimits[K]) allow(k K, now time.Time) bool {
+	sl.Lock()
+	defer sl.Unlock()
+
+	// Map iteration starts at a random spot so checking a few buckets per message covers the whole map over time
+	// without stopping for a full sweep
+	checked := 0
+	for bk, b := range sl.buckets {
+		if checked == sourceLimitPruneBatch {
+			break
+		}
+		if now.Sub(b.last) >= sl.refill {
+			delete(sl.buckets, bk)
+		}
+		checked++
+	}
+
+	b, ok := sl.buckets[k]
+	if !ok {
+		if len(sl.buckets) >= sl.max {
+			b = sl.overflow
+		} else {
+			b = newTokenBucket(sl.rate, sl.burst)
+			sl.buckets[k] = b
+		}
+	}
+
+	if b.take(now) {
+		return true
+	}
+
+	sl.metricDropped.Inc(1)
+	return false
+}
+
+// messageLimits limits a message type per remote udp address and per vpn address. A nil messageLimits allows
+// everything.
+type messageLimits struct {
+	udpAddr *sourceLimits[netip.AddrPort]
+	vpnAddr *sourceLimits[netip.Addr]
+}
+
+// newMessageLimitsFromConfig reads `<key>.rate`, the messages per second allowed from a single source, and
+// `<key>.burst`, how many messages a source may send at once. A rate of 0 disables the limits and returns nil.
+// Drops are counted in `<metric>.udp_addr.dropped` and `<metric>.vpn_addr.dropped`.
+func newMessageLimitsFromConfig(c *config.C, key, metric string) (*messageLimits, error) {
+	rate, err := strconv.ParseFloat(c.GetString(key+".rate", "0"), 64)
+	if err != nil || rate < 0 || math.IsInf(rate, 0) {
+		return nil, fmt.Errorf("%s.rate was not understood; `%s`, expected a number of messages per second", key, c.GetString(key+".rate", ""))
+	}
+
+	if rate == 0 {
+		return nil, nil
+	}
+
+	burst := c.GetInt(key+".burst", int(math.Ceil(rate)))
+	if burst < 1 {
+		return nil, fmt.Errorf("%s.burst was not understood; `%d`, expected 1 or more", key, burst)
+	}
+
+	return &messageLimits{
+		udpAddr: newSourceLimits[netip.AddrPort](metric+".udp_addr", rate, float64(burst)),
+		vpnAddr: newSourceLimits[netip.Addr](metric+".vpn_addr", rate, float64(burst)),
+	}, nil
+}
+
+// allowUdpAddr reports if a message from addr is within the limits, relayed messages have no udp address and are
+// always allowed
+func (ml *messageLimits) allowUdpAddr(addr netip.AddrPort, now time.Time) bool {
+	if ml == nil || !addr.IsValid() {
+		return true
+	}
+	return ml.udpAddr.allow(addr, now)
+}
+
+// allowVpnAddrs reports if a message from a host is within the limits, the host is known by its first vpn address
+func (ml *messageLimits) allowVpnAddrs(vpnAddrs []netip.Addr, now time.Time) bool {
+	if ml == nil || len(vpnAddrs) == 0 {
+		return true
+	}
+	return ml.vpnAddr.allow(vpnAddrs[0], now)
+}
+
+// allow checks both the udp address and the vpn address, the vpn address is only charged when the udp address is within
+// its limit
+func (ml *messageLimits) allow(addr netip.AddrPort, vpnAddrs []netip.Addr, now time.Time) bool {
+	return ml.allowUdpAddr(addr, now) && ml.allowVpnAddrs(vpnAddrs, now)
+}
+
+// tokenBucket allows rate events per second on average with bursts of up to burst events. It is not safe for
+// concurrent use.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst}
+}
+
+// take consumes a token if one is available at now
+func (tb *tokenBucket) take(now time.Time) bool {
+	if !tb.last.IsZero() {
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+		if tb.tokens > tb.burst {
+			tb.tokens = tb.burst
+		}
+	}
+	tb.last = now
+
+	if tb.tokens < 1 {
+		return false
+	}
+
+	tb.tokens--
+	return true
+}
@@ -0,0 +1,91 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_newMessageLimitsFromConfig(t *testing.T) {
+	c := config.NewC(test.NewLogger())
+
+	ml, err := newMessageLimitsFromConfig(c, "test", "test")
+	require.NoError(t, err)
+	assert.Nil(t, ml)
+	assert.True(t, ml.allow(netip.MustParseAddrPort("1.2.3.4:4242"), []netip.Addr{netip.MustParseAddr("10.0.0.1")}, time.Now()))
+
+	c.Settings["test"] = map[string]any{"rate": 0.5}
+	ml, err = newMessageLimitsFromConfig(c, "test", "test")
+	require.NoError(t, err)
+	assert.InDelta(t, 0.5, ml.udpAddr.rate, 0)
+	assert.InDelta(t, 1, ml.udpAddr.burst, 0)
+
+	c.Settings["test"] = map[string]any{"rate": 10, "burst": 50}
+	ml, err = newMessageLimitsFromConfig(c, "test", "test")
+	require.NoError(t, err)
+	assert.InDelta(t, 10, ml.vpnAddr.rate, 0)
+	assert.InDelta(t, 50, ml.vpnAddr.burst, 0)
+
+	c.Settings["test"] = map[string]any{"rate": "fast"}
+	_, err = newMessageLimitsFromConfig(c, "test", "test")
+	require.EqualError(t, err, "test.rate was not understood; `fast`, expected a number of messages per second")
+
+	c.Settings["test"] = map[string]any{"rate": -1}
+	_, err = newMessageLimitsFromConfig(c, "test", "test")
+	require.Error(t, err)
+
+	c.Settings["test"] = map[string]any{"rate": 1, "burst": 0}
+	_, err = newMessageLimitsFromConfig(c, "test", "test")
+	require.EqualError(t, err, "test.burst was not understood; `0`, expected 1 or more")
+}
+
+func Test_sourceLimits(t *testing.T) {
+	a := netip.MustParseAddr("10.0.0.1")
+	b := netip.MustParseAddr("10.0.0.2")
+	now := time.Now()
+
+	sl := newSourceLimits[netip.Addr]("test.source_limits", 1, 2)
+	dropped := sl.metricDropped.Count()
+
+	assert.True(t, sl.allow(a, now))
+	assert.True(t, sl.allow(a, now))
+	assert.False(t, sl.allow(a, now))
+	assert.Equal(t, dropped+1, sl.metricDropped.Count())
+
+	// Sources have their own bucket
+	assert.True(t, sl.allow(b, now))
+
+	// The bucket refills at the rate
+	now = now.Add(time.Second)
+	assert.True(t, sl.allow(a, now))
+	assert.False(t, sl.allow(a, now))
+
+	// Sources that have refilled are forgotten
+	now = now.Add(time.Minute)
+	assert.True(t, sl.allow(b, now))
+	assert.Len(t, sl.buckets, 1)
+}
+
+func Test_sourceLimits_max(t *testing.T) {
+	now := time.Now()
+	sl := newSourceLimits[netip.Addr]("test.source_limits", 1, 1)
+	sl.max = 2
+
+	assert.True(t, sl.allow(netip.MustParseAddr("10.0.0.1"), now))
+	assert.True(t, sl.allow(netip.MustParseAddr("10.0.0.2"), now))
+
+	// Once the map is full new sources share a bucket
+	assert.True(t, sl.allow(netip.MustParseAddr("10.0.0.3"), now))
+	assert.False(t, sl.allow(netip.MustParseAddr("10.0.0.4"), now))
+	assert.Len(t, sl.buckets, 2)
+
+	// Tracked sources keep their own
+	now = now.Add(500 * time.Millisecond)
+	assert.False(t, sl.allow(netip.MustParseAddr("10.0.0.1"), now))
+	assert.Len(t, sl.buckets, 2)
+}
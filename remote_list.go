@@ -2,11 +2,16 @@ package nebula
 
 import (
 	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
 	"net"
 	"net/netip"
+	"net/url"
 	"slices"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -30,6 +35,7 @@ type CacheMap map[string]*Cache
 type Cache struct {
 	Learned  []netip.AddrPort `json:"learned,omitempty"`
 	Reported []netip.AddrPort `json:"reported,omitempty"`
+	TCP      []netip.AddrPort `json:"tcp,omitempty"`
 	Relay    []netip.Addr     `json:"relay"`
 }
 
@@ -37,6 +43,7 @@ type Cache struct {
 type cache struct {
 	v4    *cacheV4
 	v6    *cacheV6
+	tcp   *cacheTCP
 	relay *cacheRelay
 }
 
@@ -44,6 +51,12 @@ type cacheRelay struct {
 	relay []netip.Addr
 }
 
+// cacheTCP stores reported tcp records under cache, they are never learned
+type cacheTCP struct {
+	v4 []*V4AddrPort
+	v6 []*V6AddrPort
+}
+
 // cacheV4 stores learned and reported ipv4 records under cache
 type cacheV4 struct {
 	learned  *V4AddrPort
@@ -59,6 +72,46 @@ type cacheV6 struct {
 type hostnamePort struct {
 	name string
 	port uint16
+	tcp  bool
+}
+
+// tcpScheme marks a static host that is reached over tcp
+const tcpScheme = "tcp://"
+
+// webSocketSchemes mark a static host that is reached with a websocket, the entry is the url to connect to
+var webSocketSchemes = []string{"ws://", "wss://"}
+
+// webSocketPrefix is a discard only prefix (RFC 6666) that websocket urls are given addresses from, the addresses never
+// reach the network since the tcp transport owns them
+var webSocketPrefix = netip.MustParsePrefix("100::/64")
+
+// webSocketAddr returns the address a websocket url is known by. The address is made from a hash of the url so the
+// same url always has the same address.
+func webSocketAddr(u *url.URL) netip.AddrPort {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(u.String()))
+
+	b := webSocketPrefix.Addr().As16()
+	binary.BigEndian.PutUint64(b[8:], h.Sum64())
+
+	port := 80
+	if u.Scheme == "wss" {
+		port = 443
+	}
+	if p, err := strconv.Atoi(u.Port()); err == nil {
+		port = p
+	}
+
+	return netip.AddrPortFrom(netip.AddrFrom16(b), uint16(port))
+}
+
+func isWebSocketEntry(hostPort string) bool {
+	for _, scheme := range webSocketSchemes {
+		if strings.HasPrefix(hostPort, scheme) {
+			return true
+		}
+	}
+	return false
 }
 
 type hostnamesResults struct {
@@ -68,21 +121,43 @@ type hostnamesResults struct {
 	cancelFn      func()
 	l             *logrus.Logger
 	ips           atomic.Pointer[map[netip.AddrPort]struct{}]
+	tcpIps        atomic.Pointer[map[netip.AddrPort]struct{}]
+	webSockets    map[netip.AddrPort]*url.URL
 }
 
 func NewHostnameResults(ctx context.Context, l *logrus.Logger, d time.Duration, network string, timeout time.Duration, hostPorts []string, onUpdate func()) (*hostnamesResults, error) {
 	r := &hostnamesResults{
-		hostnames:     make([]hostnamePort, len(hostPorts)),
 		network:       network,
 		lookupTimeout: timeout,
 		l:             l,
+		webSockets:    map[netip.AddrPort]*url.URL{},
 	}
 
 	// Fastrack IP addresses to ensure they're immediately available for use.
 	// DNS lookups for hostnames that aren't hardcoded IP's will happen in a background goroutine.
 	performBackgroundLookup := false
 	ips := map[netip.AddrPort]struct{}{}
-	for idx, hostPort := range hostPorts {
+	tcpIps := map[netip.AddrPort]struct{}{}
+	for _, hostPort := range hostPorts {
+		if isWebSocketEntry(hostPort) {
+			u, err := url.Parse(hostPort)
+			if err != nil {
+				return nil, err
+			}
+			if u.Host == "" {
+				return nil, fmt.Errorf("websocket url %s has no host", hostPort)
+			}
+
+			// Websockets are reached through the tcp transport, which resolves the host itself when it connects
+			addr := webSocketAddr(u)
+			r.webSockets[addr] = u
+			ips[addr] = struct{}{}
+			tcpIps[addr] = struct{}{}
+			continue
+		}
+
+		tcp := strings.HasPrefix(hostPort, tcpScheme)
+		hostPort = strings.TrimPrefix(hostPort, tcpScheme)
 
 		rIp, sPort, err := net.SplitHostPort(hostPort)
 		if err != nil {
@@ -94,7 +169,7 @@ func NewHostnameResults(ctx context.Context, l *logrus.Logger, d time.Duration,
 			return nil, err
 		}
 
-		r.hostnames[idx] = hostnamePort{name: rIp, port: uint16(iPort)}
+		r.hostnames = append(r.hostnames, hostnamePort{name: rIp, port: uint16(iPort), tcp: tcp})
 		addr, err := netip.ParseAddr(rIp)
 		if err != nil {
 			// This address is a hostname, not an IP address
@@ -104,8 +179,12 @@ func NewHostnameResults(ctx context.Context, l *logrus.Logger, d time.Duration,
 
 		// Save the IP address immediately
 		ips[netip.AddrPortFrom(addr, uint16(iPort))] = struct{}{}
+		if tcp {
+			tcpIps[netip.AddrPortFrom(addr, uint16(iPort))] = struct{}{}
+		}
 	}
 	r.ips.Store(&ips)
+	r.tcpIps.Store(&tcpIps)
 
 	// Time for the DNS lookup goroutine
 	if performBackgroundLookup {
@@ -116,6 +195,11 @@ func NewHostnameResults(ctx context.Context, l *logrus.Logger, d time.Duration,
 			defer ticker.Stop()
 			for {
 				netipAddrs := map[netip.AddrPort]struct{}{}
+				tcpAddrs := map[netip.AddrPort]struct{}{}
+				for addr := range r.webSockets {
+					netipAddrs[addr] = struct{}{}
+					tcpAddrs[addr] = struct{}{}
+				}
 				for _, hostPort := range r.hostnames {
 					timeoutCtx, timeoutCancel := context.WithTimeout(ctx, r.lookupTimeout)
 					addrs, err := net.DefaultResolver.LookupNetIP(timeoutCtx, r.network, hostPort.name)
@@ -126,6 +210,9 @@ func NewHostnameResults(ctx context.Context, l *logrus.Logger, d time.Duration,
 					}
 					for _, a := range addrs {
 						netipAddrs[netip.AddrPortFrom(a.Unmap(), hostPort.port)] = struct{}{}
+						if hostPort.tcp {
+							tcpAddrs[netip.AddrPortFrom(a.Unmap(), hostPort.port)] = struct{}{}
+						}
 					}
 				}
 				origSet := r.ips.Load()
@@ -146,6 +233,7 @@ func NewHostnameResults(ctx context.Context, l *logrus.Logger, d time.Duration,
 				}
 				if different {
 					l.WithFields(logrus.Fields{"origSet": origSet, "newSet": netipAddrs}).Info("DNS results changed for host list")
+					r.tcpIps.Store(&tcpAddrs)
 					r.ips.Store(&netipAddrs)
 					onUpdate()
 				}
@@ -181,6 +269,28 @@ func (hr *hostnamesResults) GetAddrs() []netip.AddrPort {
 	return retSlice
 }
 
+// GetTCPAddrs returns the addresses of the hosts that are reached over tcp
+func (hr *hostnamesResults) GetTCPAddrs() []netip.AddrPort {
+	var retSlice []netip.AddrPort
+	if hr != nil {
+		p := hr.tcpIps.Load()
+		if p != nil {
+			for k := range *p {
+				retSlice = append(retSlice, k)
+			}
+		}
+	}
+	return retSlice
+}
+
+// GetWebSocketURLs returns the urls of the hosts that are reached with a websocket by the address they are known by
+func (hr *hostnamesResults) GetWebSocketURLs() map[netip.AddrPort]*url.URL {
+	if hr == nil {
+		return nil
+	}
+	return hr.webSockets
+}
+
 // RemoteList is a unifying concept for lighthouse servers and clients as well as hostinfos.
 // It serves as a local cache of query replies, host update notifications, and locally learned addresses
 type RemoteList struct {
@@ -212,6 +322,9 @@ type RemoteList struct {
 
 	// A flag that the cache may have changed and addrs needs to be rebuilt
 	shouldRebuild bool
+
+	// The tcp addresses this list was last counted for in the lighthouse, see LightHouse.unlockedSyncTCPRemotes
+	tcpAddrs map[netip.AddrPort]struct{}
 }
 
 // NewRemoteList creates a new empty RemoteList
@@ -297,6 +410,7 @@ func (r *RemoteList) CopyCache() *CacheMap {
 			c = &Cache{
 				Learned:  make([]netip.AddrPort, 0),
 				Reported: make([]netip.AddrPort, 0),
+				TCP:      make([]netip.AddrPort, 0),
 				Relay:    make([]netip.Addr, 0),
 			}
 			cm[vpnIp] = c
@@ -327,6 +441,16 @@ func (r *RemoteList) CopyCache() *CacheMap {
 			}
 		}
 
+		if mc.tcp != nil {
+			for _, a := range mc.tcp.v4 {
+				c.TCP = append(c.TCP, protoV4AddrPortToNetAddrPort(a))
+			}
+
+			for _, a := range mc.tcp.v6 {
+				c.TCP = append(c.TCP, protoV6AddrPortToNetAddrPort(a))
+			}
+		}
+
 		if mc.relay != nil {
 			for _, a := range mc.relay.relay {
 				c.Relay = append(c.Relay, a)
@@ -436,6 +560,36 @@ func (r *RemoteList) unlockedSetV4(ownerVpnIp, vpnIp netip.Addr, to []*V4AddrPor
 	}
 }
 
+// unlockedSetTCP assumes you have the write lock and resets the reported list of tcp addresses for this owner to the
+// lists provided and marks the deduplicated address list as dirty
+func (r *RemoteList) unlockedSetTCP(ownerVpnIp, vpnIp netip.Addr, v4 []*V4AddrPort, v6 []*V6AddrPort, checkV4 checkFuncV4, checkV6 checkFuncV6) {
+	am := r.cache[ownerVpnIp]
+	if len(v4) == 0 && len(v6) == 0 && (am == nil || am.tcp == nil) {
+		// Avoid occupying memory for tcp if we never have any
+		return
+	}
+
+	r.shouldRebuild = true
+	c := r.unlockedGetOrMakeTCP(ownerVpnIp)
+
+	// Reset the slices
+	c.v4 = c.v4[:0]
+	c.v6 = c.v6[:0]
+
+	// We can't take their array but we can take their pointers
+	for _, v := range v4[:minInt(len(v4), MaxRemotes)] {
+		if checkV4(vpnIp, v) {
+			c.v4 = append(c.v4, v)
+		}
+	}
+
+	for _, v := range v6[:minInt(len(v6), MaxRemotes)] {
+		if checkV6(vpnIp, v) {
+			c.v6 = append(c.v6, v)
+		}
+	}
+}
+
 func (r *RemoteList) unlockedSetRelay(ownerVpnIp netip.Addr, to []netip.Addr) {
 	r.shouldRebuild = true
 	c := r.unlockedGetOrMakeRelay(ownerVpnIp)
@@ -510,6 +664,18 @@ func (r *RemoteList) unlockedGetOrMakeRelay(ownerVpnIp netip.Addr) *cacheRelay {
 	return am.relay
 }
 
+func (r *RemoteList) unlockedGetOrMakeTCP(ownerVpnIp netip.Addr) *cacheTCP {
+	am := r.cache[ownerVpnIp]
+	if am == nil {
+		am = &cache{}
+		r.cache[ownerVpnIp] = am
+	}
+	if am.tcp == nil {
+		am.tcp = &cacheTCP{}
+	}
+	return am.tcp
+}
+
 // unlockedGetOrMakeV4 assumes you have the write lock and builds the cache and owner entry. Only the v4 pointer is established.
 // The caller must dirty the learned address cache if required
 func (r *RemoteList) unlockedGetOrMakeV4(ownerVpnIp netip.Addr) *cacheV4 {
@@ -540,6 +706,34 @@ func (r *RemoteList) unlockedGetOrMakeV6(ownerVpnIp netip.Addr) *cacheV6 {
 	return am.v6
 }
 
+// unlockedCollectTCP assumes you have the lock and returns the tcp addresses held by the cache and the static host
+// results. Reported addresses were already filtered by unlockedSetTCP, static ones go through shouldAdd like they do
+// in unlockedCollect.
+func (r *RemoteList) unlockedCollectTCP() map[netip.AddrPort]struct{} {
+	addrs := map[netip.AddrPort]struct{}{}
+	for _, c := range r.cache {
+		if c.tcp == nil {
+			continue
+		}
+
+		for _, v := range c.tcp.v4 {
+			addrs[protoV4AddrPortToNetAddrPort(v)] = struct{}{}
+		}
+
+		for _, v := range c.tcp.v6 {
+			addrs[protoV6AddrPortToNetAddrPort(v)] = struct{}{}
+		}
+	}
+
+	for _, addr := range r.hr.GetTCPAddrs() {
+		if r.shouldAdd == nil || r.shouldAdd(r.vpnAddrs, addr.Addr()) {
+			addrs[addr] = struct{}{}
+		}
+	}
+
+	return addrs
+}
+
 // unlockedCollect assumes you have the write lock and collects/transforms the cache into the deduped address list.
 // The result of this function can contain duplicates. unlockedSort handles cleaning it.
 func (r *RemoteList) unlockedCollect() {
@@ -579,6 +773,22 @@ func (r *RemoteList) unlockedCollect() {
 			}
 		}
 
+		if c.tcp != nil {
+			for _, v := range c.tcp.v4 {
+				u := protoV4AddrPortToNetAddrPort(v)
+				if !r.unlockedIsBad(u) {
+					addrs = append(addrs, u)
+				}
+			}
+
+			for _, v := range c.tcp.v6 {
+				u := protoV6AddrPortToNetAddrPort(v)
+				if !r.unlockedIsBad(u) {
+					addrs = append(addrs, u)
+				}
+			}
+		}
+
 		if c.relay != nil {
 			for _, v := range c.relay.relay {
 				relays = append(relays, v)
@@ -1,11 +1,15 @@
 package nebula
 
 import (
+	"context"
 	"encoding/binary"
 	"net/netip"
 	"testing"
+	"time"
 
+	"github.com/slackhq/nebula/test"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestRemoteList_Rebuild(t *testing.T) {
@@ -257,3 +261,72 @@ func newIp6AndPortFromString(s string) *V6AddrPort {
 		Port: uint32(a.Port()),
 	}
 }
+
+func TestRemoteList_TCP(t *testing.T) {
+	owner := netip.MustParseAddr("0.0.0.1")
+	rl := NewRemoteList([]netip.Addr{netip.MustParseAddr("0.0.0.0")}, nil)
+	rl.unlockedSetV4(owner, owner, []*V4AddrPort{newIp4AndPortFromString("70.199.182.92:4242")}, func(netip.Addr, *V4AddrPort) bool { return true })
+
+	// No tcp addresses, no memory for them
+	rl.unlockedSetTCP(owner, owner, nil, nil, func(netip.Addr, *V4AddrPort) bool { return true }, func(netip.Addr, *V6AddrPort) bool { return true })
+	assert.Nil(t, rl.cache[owner].tcp)
+
+	rl.unlockedSetTCP(
+		owner,
+		owner,
+		[]*V4AddrPort{newIp4AndPortFromString("70.199.182.92:443"), newIp4AndPortFromString("10.0.0.1:443")},
+		[]*V6AddrPort{newIp6AndPortFromString("[1::1]:443")},
+		func(_ netip.Addr, a *V4AddrPort) bool { return !protoV4AddrPortToNetAddrPort(a).Addr().IsPrivate() },
+		func(netip.Addr, *V6AddrPort) bool { return true },
+	)
+
+	rl.Rebuild([]netip.Prefix{})
+	assert.Equal(t, []netip.AddrPort{
+		netip.MustParseAddrPort("[1::1]:443"),
+		netip.MustParseAddrPort("70.199.182.92:443"),
+		netip.MustParseAddrPort("70.199.182.92:4242"),
+	}, rl.addrs)
+
+	c := (*rl.CopyCache())[owner.String()]
+	assert.ElementsMatch(t, []netip.AddrPort{
+		netip.MustParseAddrPort("70.199.182.92:443"),
+		netip.MustParseAddrPort("[1::1]:443"),
+	}, c.TCP)
+}
+
+func TestNewHostnameResults_TCP(t *testing.T) {
+	hr, err := NewHostnameResults(context.Background(), test.NewLogger(), time.Minute, "ip", time.Second, []string{"1.2.3.4:4242", "tcp://1.2.3.4:443"}, func() {})
+	require.NoError(t, err)
+	defer hr.Cancel()
+
+	assert.ElementsMatch(t, []netip.AddrPort{
+		netip.MustParseAddrPort("1.2.3.4:4242"),
+		netip.MustParseAddrPort("1.2.3.4:443"),
+	}, hr.GetAddrs())
+	assert.Equal(t, []netip.AddrPort{netip.MustParseAddrPort("1.2.3.4:443")}, hr.GetTCPAddrs())
+}
+
+func TestNewHostnameResults_WebSocket(t *testing.T) {
+	hr, err := NewHostnameResults(context.Background(), test.NewLogger(), time.Minute, "ip", time.Second, []string{"1.2.3.4:4242", "wss://relay.example.com/nebula", "ws://relay.example.com:8080"}, func() {})
+	require.NoError(t, err)
+	defer hr.Cancel()
+
+	urls := hr.GetWebSocketURLs()
+	require.Len(t, urls, 2)
+	for addr, u := range urls {
+		// Websockets are known by an address from the discard prefix, which is always a tcp remote
+		assert.True(t, webSocketPrefix.Contains(addr.Addr()))
+		assert.Equal(t, webSocketAddr(u), addr)
+		assert.Contains(t, hr.GetAddrs(), addr)
+		assert.Contains(t, hr.GetTCPAddrs(), addr)
+		if u.Scheme == "wss" {
+			assert.Equal(t, uint16(443), addr.Port())
+		} else {
+			assert.Equal(t, uint16(8080), addr.Port())
+		}
+	}
+	assert.Len(t, hr.GetAddrs(), 3)
+
+	_, err = NewHostnameResults(context.Background(), test.NewLogger(), time.Minute, "ip", time.Second, []string{"wss:///nebula"}, func() {})
+	require.Error(t, err)
+}
@@ -0,0 +1,56 @@
+package nebula
+
+import (
+	"net/netip"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/udp"
+)
+
+// sendBatch holds the packets encrypted from a single read of the tun device, a read with offloads can hold many
+// segments of the same flow. Runs of packets to the same remote are sent with one udp.WriteBatch when it is flushed.
+// A sendBatch belongs to a single routine.
+type sendBatch struct {
+	conn udp.Conn
+
+	// bufs are the buffers handed out by next, pkts and addrs the packets that were added and where they go
+	bufs  [][]byte
+	pkts  [][]byte
+	addrs []netip.AddrPort
+}
+
+func newSendBatch(conn udp.Conn) *sendBatch {
+	return &sendBatch{conn: conn}
+}
+
+// next returns the buffer the next packet should be encrypted into
+func (b *sendBatch) next() []byte {
+	if len(b.pkts) == len(b.bufs) {
+		b.bufs = append(b.bufs, make([]byte, mtu))
+	}
+	return b.bufs[len(b.pkts)]
+}
+
+// add queues p, which must have been encrypted into the buffer returned by next
+func (b *sendBatch) add(p []byte, addr netip.AddrPort) {
+	b.pkts = append(b.pkts, p)
+	b.addrs = append(b.addrs, addr)
+}
+
+// flush sends every queued packet
+func (b *sendBatch) flush(l *logrus.Logger) {
+	for i := 0; i < len(b.pkts); {
+		j := i + 1
+		for j < len(b.pkts) && b.addrs[j] == b.addrs[i] {
+			j++
+		}
+
+		if err := udp.WriteBatch(b.conn, b.pkts[i:j], b.addrs[i]); err != nil {
+			l.WithError(err).WithField("udpAddr", b.addrs[i]).Error("Failed to write outgoing packets")
+		}
+		i = j
+	}
+
+	b.pkts = b.pkts[:0]
+	b.addrs = b.addrs[:0]
+}
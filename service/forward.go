@@ -0,0 +1,325 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+// forwardUDPTimeout is how long a udp flow is kept without a packet in either direction
+const forwardUDPTimeout = 2 * time.Minute
+
+// forwardMaxUDPFlows is how many senders a udp forward keeps a flow for at once, packets from new senders beyond it are
+// dropped until a flow goes idle
+var forwardMaxUDPFlows = 1024
+
+// forward is an entry in `forwards`
+type forward struct {
+	// proto is tcp or udp
+	proto string
+	// fromOverlay is set when listen is on the overlay and dial is on the host, otherwise it is the other way around
+	fromOverlay bool
+	listen      string
+	dial        string
+}
+
+func (fw forward) String() string {
+	from, to := "host", "overlay"
+	if fw.fromOverlay {
+		from, to = to, from
+	}
+	return fmt.Sprintf("%s %s %s to %s %s", fw.proto, from, fw.listen, to, fw.dial)
+}
+
+// Forwarder relays connections between ports on the host and addresses on the overlay through a Service, which
+// exposes a single service to or from the overlay on a host without a tun device
+type Forwarder struct {
+	l *logrus.Logger
+	s *Service
+
+	listeners   []net.Listener
+	packetConns []net.PacketConn
+	wg          sync.WaitGroup
+}
+
+// NewForwarderFromConfig starts the forwards configured under `forwards`, it returns nil if there are none. None of the
+// settings are reloadable.
+func NewForwarderFromConfig(l *logrus.Logger, c *config.C, s *Service) (*Forwarder, error) {
+	forwards, err := parseForwards(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(forwards) == 0 {
+		return nil, nil
+	}
+
+	f := &Forwarder{l: l, s: s}
+	for i, fw := range forwards {
+		if err := f.start(fw); err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("entry %v in forwards failed to listen: %w", i+1, err)
+		}
+		l.WithField("forward", fw).Info("Forwarding")
+	}
+
+	go func() {
+		<-s.control.Context().Done()
+		_ = f.Close()
+	}()
+
+	return f, nil
+}
+
+func parseForwards(c *config.C) ([]forward, error) {
+	r := c.Get("forwards")
+	if r == nil {
+		return nil, nil
+	}
+
+	rawForwards, ok := r.([]any)
+	if !ok {
+		return nil, fmt.Errorf("forwards is not an array")
+	}
+
+	forwards := make([]forward, len(rawForwards))
+	for i, r := range rawForwards {
+		m, ok := r.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("entry %v in forwards is invalid", i+1)
+		}
+
+		fw := &forwards[i]
+		fw.proto = forwardOption(m, "proto", "tcp")
+		if fw.proto != "tcp" && fw.proto != "udp" {
+			return nil, fmt.Errorf("entry %v.proto in forwards was not understood; `%s`, expected tcp or udp", i+1, fw.proto)
+		}
+
+		switch from := forwardOption(m, "from", "host"); from {
+		case "host":
+		case "overlay":
+			fw.fromOverlay = true
+		default:
+			return nil, fmt.Errorf("entry %v.from in forwards was not understood; `%s`, expected host or overlay", i+1, from)
+		}
+
+		for _, a := range []struct {
+			key string
+			dst *string
+		}{{"listen", &fw.listen}, {"dial", &fw.dial}} {
+			v, ok := m[a.key].(string)
+			if !ok || v == "" {
+				return nil, fmt.Errorf("entry %v.%s in forwards is not present", i+1, a.key)
+			}
+			if _, _, err := net.SplitHostPort(v); err != nil {
+				return nil, fmt.Errorf("entry %v.%s in forwards is not an address: %v", i+1, a.key, err)
+			}
+			*a.dst = v
+		}
+	}
+
+	return forwards, nil
+}
+
+// forwardOption returns the setting key of a forward entry as a string, def if it is not set
+func forwardOption(m map[string]any, key, def string) string {
+	v, ok := m[key]
+	if !ok || v == nil {
+		return def
+	}
+	return fmt.Sprint(v)
+}
+
+// Close stops accepting connections and ends every udp flow, tcp connections already forwarded are left alone
+func (f *Forwarder) Close() error {
+	var err error
+	for _, ln := range f.listeners {
+		err = errors.Join(err, ln.Close())
+	}
+	for _, pc := range f.packetConns {
+		err = errors.Join(err, pc.Close())
+	}
+	f.wg.Wait()
+	return err
+}
+
+func (f *Forwarder) start(fw forward) error {
+	if fw.proto == "udp" {
+		var pc net.PacketConn
+		var err error
+		if fw.fromOverlay {
+			pc, err = f.s.ListenPacket("udp", fw.listen)
+		} else {
+			pc, err = net.ListenPacket("udp", fw.listen)
+		}
+		if err != nil {
+			return err
+		}
+		f.packetConns = append(f.packetConns, pc)
+		f.wg.Add(1)
+		go f.serveUDP(pc, fw)
+		return nil
+	}
+
+	var ln net.Listener
+	var err error
+	if fw.fromOverlay {
+		ln, err = f.s.Listen("tcp", fw.listen)
+	} else {
+		ln, err = net.Listen("tcp", fw.listen)
+	}
+	if err != nil {
+		return err
+	}
+	f.listeners = append(f.listeners, ln)
+	f.wg.Add(1)
+	go f.serveTCP(ln, fw)
+	return nil
+}
+
+func (f *Forwarder) dial(fw forward) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), proxyDialTimeout)
+	defer cancel()
+	if fw.fromOverlay {
+		var d net.Dialer
+		return d.DialContext(ctx, fw.proto, fw.dial)
+	}
+	return f.s.DialContext(ctx, fw.proto, fw.dial)
+}
+
+func (f *Forwarder) serveTCP(ln net.Listener, fw forward) {
+	defer f.wg.Done()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				f.l.WithError(err).WithField("forward", fw).Error("Forward stopped accepting connections")
+			}
+			return
+		}
+
+		go func() {
+			dst, err := f.dial(fw)
+			if err != nil {
+				f.l.WithError(err).WithField("forward", fw).WithField("from", c.RemoteAddr()).
+					Info("Failed to dial forward destination")
+				_ = c.Close()
+				return
+			}
+			pipe(c, dst)
+		}()
+	}
+}
+
+// udpFlow is the connection to the forward destination for one sender
+type udpFlow struct {
+	conn net.Conn
+	// lastSeen is when a packet last went through the flow in either direction, in unix nanoseconds
+	lastSeen atomic.Int64
+}
+
+func (fl *udpFlow) touch() {
+	fl.lastSeen.Store(time.Now().UnixNano())
+}
+
+func (f *Forwarder) serveUDP(pc net.PacketConn, fw forward) {
+	defer f.wg.Done()
+
+	var mu sync.Mutex
+	flows := map[string]*udpFlow{}
+	var wg sync.WaitGroup
+	defer func() {
+		mu.Lock()
+		for _, fl := range flows {
+			_ = fl.conn.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				f.l.WithError(err).WithField("forward", fw).Error("Forward stopped reading packets")
+			}
+			return
+		}
+
+		key := addr.String()
+		mu.Lock()
+		fl := flows[key]
+		full := len(flows) >= forwardMaxUDPFlows
+		mu.Unlock()
+
+		if fl == nil {
+			if full {
+				f.l.WithField("forward", fw).WithField("from", addr).
+					Debug("Dropping packet, the forward has too many udp flows")
+				continue
+			}
+
+			conn, err := f.dial(fw)
+			if err != nil {
+				f.l.WithError(err).WithField("forward", fw).WithField("from", addr).
+					Info("Failed to dial forward destination")
+				continue
+			}
+
+			fl = &udpFlow{conn: conn}
+			fl.touch()
+			mu.Lock()
+			flows[key] = fl
+			mu.Unlock()
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				f.replyUDP(pc, addr, fl)
+
+				mu.Lock()
+				if flows[key] == fl {
+					delete(flows, key)
+				}
+				mu.Unlock()
+				_ = fl.conn.Close()
+			}()
+		}
+
+		fl.touch()
+		_, _ = fl.conn.Write(buf[:n])
+	}
+}
+
+// replyUDP sends packets from a flow's destination back to addr until the flow has been idle for forwardUDPTimeout
+// or is closed
+func (f *Forwarder) replyUDP(pc net.PacketConn, addr net.Addr, fl *udpFlow) {
+	buf := make([]byte, 65535)
+	for {
+		idle := time.Since(time.Unix(0, fl.lastSeen.Load()))
+		if idle >= forwardUDPTimeout {
+			return
+		}
+		_ = fl.conn.SetReadDeadline(time.Now().Add(forwardUDPTimeout - idle))
+
+		n, err := fl.conn.Read(buf)
+		if err != nil {
+			// A timeout only means the flow may be idle, the sender may have kept it alive meanwhile
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return
+		}
+
+		fl.touch()
+		_, _ = pc.WriteTo(buf[:n], addr)
+	}
+}
@@ -0,0 +1,212 @@
+package service
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/cert_test"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwarder(t *testing.T) {
+	defer func(max int) { forwardMaxUDPFlows = max }(forwardMaxUDPFlows)
+	forwardMaxUDPFlows = 1
+
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	a := newSimpleService(ca, caKey, "a", netip.MustParseAddr("10.0.4.1"), m{
+		"static_host_map": m{},
+		"lighthouse":      m{"am_lighthouse": true},
+		"listen":          m{"host": "0.0.0.0", "port": 4247},
+	})
+	defer a.Close()
+	b := newSimpleService(ca, caKey, "b", netip.MustParseAddr("10.0.4.2"), m{
+		"static_host_map": m{"10.0.4.1": []string{"localhost:4247"}},
+		"lighthouse":      m{"hosts": []string{"10.0.4.1"}, "interval": 1},
+	})
+	defer b.Close()
+
+	// Servers on the overlay address of a and on the host, each prefixes what it sends back with its name
+	overlayTCP, err := a.Listen("tcp", ":7000")
+	require.NoError(t, err)
+	defer overlayTCP.Close()
+	go echoTCP(overlayTCP, "overlay")
+
+	overlayUDP, err := a.ListenPacket("udp", ":7000")
+	require.NoError(t, err)
+	defer overlayUDP.Close()
+	go echoUDP(overlayUDP, "overlay")
+
+	hostTCP, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer hostTCP.Close()
+	go echoTCP(hostTCP, "host")
+
+	hostUDP, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer hostUDP.Close()
+	go echoUDP(hostUDP, "host")
+
+	// b forwards host ports to a over the overlay, a forwards overlay ports to its host
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["forwards"] = []any{
+		m{"listen": "127.0.0.1:0", "dial": "10.0.4.1:7000"},
+		m{"listen": "127.0.0.1:0", "dial": "10.0.4.1:7000", "proto": "udp"},
+	}
+	bf, err := NewForwarderFromConfig(l, c, b)
+	require.NoError(t, err)
+	defer bf.Close()
+
+	c.Settings["forwards"] = []any{
+		m{"from": "overlay", "listen": ":7001", "dial": hostTCP.Addr().String()},
+		m{"from": "overlay", "listen": ":7001", "dial": hostUDP.LocalAddr().String(), "proto": "udp"},
+	}
+	af, err := NewForwarderFromConfig(l, c, a)
+	require.NoError(t, err)
+	defer af.Close()
+
+	t.Run("tcp from host", func(t *testing.T) {
+		conn, err := net.Dial("tcp", bf.listeners[0].Addr().String())
+		require.NoError(t, err)
+		assert.Equal(t, "overlay hello", askTCP(t, conn, "hello"))
+	})
+
+	t.Run("udp from host", func(t *testing.T) {
+		conn, err := net.Dial("udp", bf.packetConns[0].LocalAddr().String())
+		require.NoError(t, err)
+		assert.Equal(t, "overlay hello", askUDP(t, conn, "hello"))
+	})
+
+	t.Run("udp flows are capped", func(t *testing.T) {
+		// The sender above still has the only flow, so another sender is not answered
+		conn, err := net.Dial("udp", bf.packetConns[0].LocalAddr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		_, err = conn.Read(make([]byte, 1500))
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+
+	t.Run("tcp from overlay", func(t *testing.T) {
+		conn, err := b.Dial("tcp", "10.0.4.1:7001")
+		require.NoError(t, err)
+		assert.Equal(t, "host hello", askTCP(t, conn, "hello"))
+	})
+
+	t.Run("udp from overlay", func(t *testing.T) {
+		conn, err := b.Dial("udp", "10.0.4.1:7001")
+		require.NoError(t, err)
+		assert.Equal(t, "host hello", askUDP(t, conn, "hello"))
+	})
+
+	t.Run("closed listener", func(t *testing.T) {
+		require.NoError(t, overlayTCP.Close())
+		_, err := overlayTCP.Accept()
+		assert.ErrorIs(t, err, net.ErrClosed)
+		assert.ErrorIs(t, overlayTCP.Close(), net.ErrClosed)
+	})
+}
+
+func TestParseForwards(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	forwards, err := parseForwards(c)
+	require.NoError(t, err)
+	assert.Empty(t, forwards)
+
+	c.Settings["forwards"] = []any{
+		m{"listen": "127.0.0.1:5432", "dial": "10.1.0.5:5432"},
+		m{"from": "overlay", "listen": ":53", "dial": "127.0.0.1:53", "proto": "udp"},
+	}
+	forwards, err = parseForwards(c)
+	require.NoError(t, err)
+	assert.Equal(t, []forward{
+		{proto: "tcp", listen: "127.0.0.1:5432", dial: "10.1.0.5:5432"},
+		{proto: "udp", fromOverlay: true, listen: ":53", dial: "127.0.0.1:53"},
+	}, forwards)
+
+	tests := []struct {
+		forwards any
+		err      string
+	}{
+		{m{}, "forwards is not an array"},
+		{[]any{"a"}, "entry 1 in forwards is invalid"},
+		{[]any{m{"listen": ":1", "dial": "a:1", "proto": "icmp"}}, "entry 1.proto in forwards was not understood; `icmp`, expected tcp or udp"},
+		{[]any{m{"listen": ":1", "dial": "a:1", "from": "there"}}, "entry 1.from in forwards was not understood; `there`, expected host or overlay"},
+		{[]any{m{"dial": "a:1"}}, "entry 1.listen in forwards is not present"},
+		{[]any{m{"listen": ":1"}}, "entry 1.dial in forwards is not present"},
+		{[]any{m{"listen": ":1", "dial": "a"}}, "entry 1.dial in forwards is not an address: address a: missing port in address"},
+	}
+	for _, tt := range tests {
+		c.Settings["forwards"] = tt.forwards
+		_, err := parseForwards(c)
+		assert.EqualError(t, err, tt.err)
+	}
+}
+
+func echoTCP(ln net.Listener, name string) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			buf := make([]byte, 1500)
+			n, err := c.Read(buf)
+			if err != nil {
+				return
+			}
+			_, _ = c.Write([]byte(name + " " + string(buf[:n])))
+		}()
+	}
+}
+
+func echoUDP(pc net.PacketConn, name string) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		_, _ = pc.WriteTo([]byte(name+" "+string(buf[:n])), addr)
+	}
+}
+
+func askTCP(t *testing.T, conn net.Conn, msg string) string {
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(20*time.Second)))
+	_, err := conn.Write([]byte(msg))
+	require.NoError(t, err)
+	b, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func askUDP(t *testing.T, conn net.Conn, msg string) string {
+	defer conn.Close()
+	buf := make([]byte, 1500)
+	// The first packets may be lost while the tunnel is made
+	for i := 0; i < 20; i++ {
+		_, err := conn.Write([]byte(msg))
+		require.NoError(t, err)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(500*time.Millisecond)))
+		n, err := conn.Read(buf)
+		if err == nil {
+			return string(buf[:n])
+		}
+	}
+	t.Fatal("no answer")
+	return ""
+}
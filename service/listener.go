@@ -1,29 +1,36 @@
 package service
 
 import (
-	"io"
 	"net"
+	"net/netip"
+
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
 )
 
 type tcpListener struct {
-	port   uint16
+	key    netip.AddrPort
 	s      *Service
 	addr   *net.TCPAddr
 	accept chan net.Conn
 }
 
+// Accept waits for the next connection, it returns net.ErrClosed once the listener is closed.
 func (l *tcpListener) Accept() (net.Conn, error) {
 	conn, ok := <-l.accept
 	if !ok {
-		return nil, io.EOF
+		return nil, net.ErrClosed
 	}
 	return conn, nil
 }
 
+// Close stops the listener, closing it again returns net.ErrClosed.
 func (l *tcpListener) Close() error {
 	l.s.mu.Lock()
 	defer l.s.mu.Unlock()
-	delete(l.s.mu.listeners, uint16(l.addr.Port))
+	if l.s.mu.listeners[l.key] != l {
+		return net.ErrClosed
+	}
+	delete(l.s.mu.listeners, l.key)
 
 	close(l.accept)
 
@@ -34,3 +41,36 @@ func (l *tcpListener) Close() error {
 func (l *tcpListener) Addr() net.Addr {
 	return l.addr
 }
+
+// UDPConn is a udp socket on the overlay
+type UDPConn struct {
+	*gonet.UDPConn
+	// v6 is set on an ipv6 socket, which takes ipv4 addresses in their ipv4 mapped form
+	v6 bool
+}
+
+// ReadFrom reads a packet, the address it came from is always in its shortest form
+func (c *UDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.UDPConn.ReadFrom(b)
+	if ua, ok := addr.(*net.UDPAddr); ok {
+		if ip4 := ua.IP.To4(); ip4 != nil {
+			ua.IP = ip4
+		}
+	}
+	return n, addr, err
+}
+
+// WriteTo writes a packet to addr, which must be a *net.UDPAddr
+func (c *UDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if ua, ok := addr.(*net.UDPAddr); ok {
+		ip := ua.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			if c.v6 {
+				ip = ip4.To16()
+			}
+		}
+		addr = &net.UDPAddr{IP: ip, Port: ua.Port, Zone: ua.Zone}
+	}
+	return c.UDPConn.WriteTo(b, addr)
+}
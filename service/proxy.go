@@ -0,0 +1,454 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+// proxyDialTimeout is how long a proxy waits for a connection through the overlay before giving up on it
+const proxyDialTimeout = 15 * time.Second
+
+// Proxy serves SOCKS5 and HTTP proxies on the host that connect to overlay addresses through a Service, which lets
+// programs on a host without a tun device reach the overlay
+type Proxy struct {
+	l *logrus.Logger
+	s *Service
+
+	// username and password are required from clients when username is set
+	username string
+	password string
+
+	listeners []net.Listener
+	wg        sync.WaitGroup
+}
+
+// NewProxyFromConfig starts the proxies configured under `proxy`, it returns nil if none are. None of the settings are
+// reloadable.
+func NewProxyFromConfig(l *logrus.Logger, c *config.C, s *Service) (*Proxy, error) {
+	socksListen := c.GetString("proxy.socks5.listen", "")
+	httpListen := c.GetString("proxy.http.listen", "")
+	if socksListen == "" && httpListen == "" {
+		return nil, nil
+	}
+
+	p := &Proxy{
+		l:        l,
+		s:        s,
+		username: c.GetString("proxy.username", ""),
+		password: c.GetString("proxy.password", ""),
+	}
+	if p.username == "" && p.password != "" {
+		return nil, errors.New("proxy.password is set without a proxy.username")
+	}
+
+	if socksListen != "" {
+		ln, err := net.Listen("tcp", socksListen)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen for proxy.socks5: %w", err)
+		}
+		p.serve(ln, p.serveSOCKS5)
+		l.WithField("listen", ln.Addr()).Info("SOCKS5 proxy listening")
+	}
+
+	if httpListen != "" {
+		ln, err := net.Listen("tcp", httpListen)
+		if err != nil {
+			_ = p.Close()
+			return nil, fmt.Errorf("failed to listen for proxy.http: %w", err)
+		}
+		p.serveHTTP(ln)
+		l.WithField("listen", ln.Addr()).Info("HTTP proxy listening")
+	}
+
+	go func() {
+		<-s.control.Context().Done()
+		_ = p.Close()
+	}()
+
+	return p, nil
+}
+
+// Close stops accepting connections, connections already proxied are left alone
+func (p *Proxy) Close() error {
+	var err error
+	for _, ln := range p.listeners {
+		err = errors.Join(err, ln.Close())
+	}
+	p.wg.Wait()
+	return err
+}
+
+func (p *Proxy) serve(ln net.Listener, handle func(net.Conn)) {
+	p.listeners = append(p.listeners, ln)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					p.l.WithError(err).WithField("listen", ln.Addr()).Error("Proxy stopped accepting connections")
+				}
+				return
+			}
+			go handle(c)
+		}
+	}()
+}
+
+func (p *Proxy) dial(ctx context.Context, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, proxyDialTimeout)
+	defer cancel()
+	return p.s.DialContext(ctx, "tcp", address)
+}
+
+func (p *Proxy) authorized(username, password string) bool {
+	if p.username == "" {
+		return true
+	}
+	// Compare both, even when the username is wrong
+	u := subtle.ConstantTimeCompare([]byte(username), []byte(p.username))
+	pw := subtle.ConstantTimeCompare([]byte(password), []byte(p.password))
+	return u&pw == 1
+}
+
+// pipe copies between two connections until both sides are done sending
+func pipe(a, b net.Conn) {
+	var wg sync.WaitGroup
+	half := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		} else {
+			_ = dst.Close()
+		}
+	}
+
+	wg.Add(2)
+	go half(a, b)
+	go half(b, a)
+	wg.Wait()
+	_ = a.Close()
+	_ = b.Close()
+}
+
+// SOCKS5 constants from rfc 1928 and rfc 1929
+const (
+	socks5Version = 5
+
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthUnacceptable = 0xff
+
+	socks5CmdConnect = 1
+
+	socks5AddrIPv4   = 1
+	socks5AddrDomain = 3
+	socks5AddrIPv6   = 4
+
+	socks5Succeeded          = 0
+	socks5GeneralFailure     = 1
+	socks5HostUnreachable    = 4
+	socks5CmdNotSupported    = 7
+	socks5AddrTypeNotSupport = 8
+)
+
+func (p *Proxy) serveSOCKS5(c net.Conn) {
+	l := p.l.WithField("proxy", "socks5").WithField("from", c.RemoteAddr())
+
+	// Only the negotiation has a deadline, a proxied connection can be idle for as long as it likes
+	_ = c.SetDeadline(time.Now().Add(proxyDialTimeout))
+	r := bufio.NewReader(c)
+
+	if err := p.socks5Auth(c, r); err != nil {
+		l.WithError(err).Debug("SOCKS5 negotiation failed")
+		_ = c.Close()
+		return
+	}
+
+	address, reply, err := readSOCKS5Request(r)
+	if err != nil {
+		l.WithError(err).Debug("Bad SOCKS5 request")
+		_ = writeSOCKS5Reply(c, reply, nil)
+		_ = c.Close()
+		return
+	}
+
+	out, err := p.dial(context.Background(), address)
+	if err != nil {
+		l.WithError(err).WithField("to", address).Info("Failed to connect through the overlay")
+		_ = writeSOCKS5Reply(c, socks5HostUnreachable, nil)
+		_ = c.Close()
+		return
+	}
+
+	if err := writeSOCKS5Reply(c, socks5Succeeded, out.LocalAddr()); err != nil {
+		_ = out.Close()
+		_ = c.Close()
+		return
+	}
+	_ = c.SetDeadline(time.Time{})
+
+	// The client may have sent data right behind its request
+	pipe(&bufferedConn{Conn: c, r: r}, out)
+}
+
+func (p *Proxy) socks5Auth(c net.Conn, r *bufio.Reader) error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != socks5Version {
+		return fmt.Errorf("unsupported socks version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return err
+	}
+
+	want := byte(socks5AuthNone)
+	if p.username != "" {
+		want = socks5AuthPassword
+	}
+	if !strings.Contains(string(methods), string([]byte{want})) {
+		_, _ = c.Write([]byte{socks5Version, socks5AuthUnacceptable})
+		return errors.New("client does not offer an acceptable authentication method")
+	}
+	if _, err := c.Write([]byte{socks5Version, want}); err != nil {
+		return err
+	}
+	if want == socks5AuthNone {
+		return nil
+	}
+
+	// Username and password auth has its own version, 1
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	username := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, username); err != nil {
+		return err
+	}
+	plen, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	password := make([]byte, plen)
+	if _, err := io.ReadFull(r, password); err != nil {
+		return err
+	}
+
+	if hdr[0] != 1 || !p.authorized(string(username), string(password)) {
+		_, _ = c.Write([]byte{1, 1})
+		return errors.New("bad credentials")
+	}
+	_, err = c.Write([]byte{1, 0})
+	return err
+}
+
+// readSOCKS5Request reads a CONNECT request and returns the address it asks for. When it fails the reply code is what
+// the client should be told.
+func readSOCKS5Request(r *bufio.Reader) (string, byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return "", socks5GeneralFailure, err
+	}
+	if hdr[0] != socks5Version {
+		return "", socks5GeneralFailure, fmt.Errorf("unsupported socks version %d", hdr[0])
+	}
+	if hdr[1] != socks5CmdConnect {
+		return "", socks5CmdNotSupported, fmt.Errorf("unsupported command %d", hdr[1])
+	}
+
+	var host string
+	switch hdr[3] {
+	case socks5AddrIPv4:
+		var b [4]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return "", socks5GeneralFailure, err
+		}
+		host = netip.AddrFrom4(b).String()
+	case socks5AddrIPv6:
+		var b [16]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return "", socks5GeneralFailure, err
+		}
+		host = netip.AddrFrom16(b).String()
+	case socks5AddrDomain:
+		n, err := r.ReadByte()
+		if err != nil {
+			return "", socks5GeneralFailure, err
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", socks5GeneralFailure, err
+		}
+		host = string(b)
+	default:
+		return "", socks5AddrTypeNotSupport, fmt.Errorf("unsupported address type %d", hdr[3])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", socks5GeneralFailure, err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), socks5Succeeded, nil
+}
+
+func writeSOCKS5Reply(c net.Conn, reply byte, bound net.Addr) error {
+	b := []byte{socks5Version, reply, 0}
+
+	var ap netip.AddrPort
+	if tcpAddr, ok := bound.(*net.TCPAddr); ok {
+		ap = tcpAddr.AddrPort()
+	}
+	if addr := ap.Addr().Unmap(); addr.Is6() {
+		b = append(b, socks5AddrIPv6)
+		b = append(b, addr.AsSlice()...)
+	} else {
+		if !addr.IsValid() {
+			addr = netip.IPv4Unspecified()
+		}
+		b = append(b, socks5AddrIPv4)
+		b = append(b, addr.AsSlice()...)
+	}
+	b = binary.BigEndian.AppendUint16(b, ap.Port())
+
+	_, err := c.Write(b)
+	return err
+}
+
+// bufferedConn is a connection whose first bytes were already read into r
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+func (p *Proxy) serveHTTP(ln net.Listener) {
+	forward := &httputil.ReverseProxy{
+		// The request already holds the absolute url it wants and hop by hop headers, like Proxy-Authorization, are
+		// always removed
+		Rewrite: func(*httputil.ProxyRequest) {},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, address string) (net.Conn, error) {
+				return p.dial(ctx, address)
+			},
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			p.l.WithError(err).WithField("proxy", "http").WithField("to", r.URL.Host).Info("Failed to forward request through the overlay")
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !p.httpAuthorized(r) {
+				w.Header().Set("Proxy-Authenticate", `Basic realm="nebula"`)
+				w.WriteHeader(http.StatusProxyAuthRequired)
+				return
+			}
+
+			if r.Method == http.MethodConnect {
+				p.serveConnect(w, r)
+				return
+			}
+
+			if !r.URL.IsAbs() {
+				http.Error(w, "this is a proxy, requests must hold an absolute url", http.StatusBadRequest)
+				return
+			}
+			forward.ServeHTTP(w, r)
+		}),
+		ReadHeaderTimeout: proxyDialTimeout,
+	}
+
+	p.listeners = append(p.listeners, ln)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, net.ErrClosed) {
+			p.l.WithError(err).WithField("listen", ln.Addr()).Error("Proxy stopped accepting connections")
+		}
+	}()
+}
+
+func (p *Proxy) httpAuthorized(r *http.Request) bool {
+	if p.username == "" {
+		return true
+	}
+
+	auth, ok := strings.CutPrefix(r.Header.Get("Proxy-Authorization"), "Basic ")
+	if !ok {
+		return false
+	}
+	b, err := base64.StdEncoding.DecodeString(auth)
+	if err != nil {
+		return false
+	}
+	username, password, _ := strings.Cut(string(b), ":")
+	return p.authorized(username, password)
+}
+
+func (p *Proxy) serveConnect(w http.ResponseWriter, r *http.Request) {
+	l := p.l.WithField("proxy", "http").WithField("from", r.RemoteAddr).WithField("to", r.Host)
+
+	out, err := p.dial(r.Context(), r.Host)
+	if err != nil {
+		l.WithError(err).Info("Failed to connect through the overlay")
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		_ = out.Close()
+		http.Error(w, "connection can not be hijacked", http.StatusInternalServerError)
+		return
+	}
+	c, rw, err := hj.Hijack()
+	if err != nil {
+		_ = out.Close()
+		l.WithError(err).Error("Failed to hijack the connection")
+		return
+	}
+
+	if _, err := io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		_ = out.Close()
+		_ = c.Close()
+		return
+	}
+
+	pipe(&bufferedConn{Conn: c, r: rw.Reader}, out)
+}
@@ -0,0 +1,162 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/cert_test"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy(t *testing.T) {
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	a := newSimpleService(ca, caKey, "a", netip.MustParseAddr("10.0.1.1"), m{
+		"static_host_map": m{},
+		"lighthouse":      m{"am_lighthouse": true},
+		"listen":          m{"host": "0.0.0.0", "port": 4244},
+	})
+	defer a.Close()
+	b := newSimpleService(ca, caKey, "b", netip.MustParseAddr("10.0.1.2"), m{
+		"static_host_map": m{"10.0.1.1": []string{"localhost:4244"}},
+		"lighthouse":      m{"hosts": []string{"10.0.1.1"}, "interval": 1},
+	})
+	defer b.Close()
+
+	ln, err := a.Listen("tcp", ":8080")
+	require.NoError(t, err)
+	go func() {
+		_ = http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprintf(w, "hello %s", r.URL.Path)
+		}))
+	}()
+
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["proxy"] = m{
+		"socks5":   m{"listen": "127.0.0.1:0"},
+		"http":     m{"listen": "127.0.0.1:0"},
+		"username": "user",
+		"password": "pass",
+	}
+	p, err := NewProxyFromConfig(l, c, b)
+	require.NoError(t, err)
+	require.Len(t, p.listeners, 2)
+	defer p.Close()
+	socksAddr, httpAddr := p.listeners[0].Addr().String(), p.listeners[1].Addr().String()
+
+	get := func(proxyURL *url.URL) (int, string, error) {
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 20 * time.Second}
+		resp, err := client.Get("http://10.0.1.1:8080/there")
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body), err
+	}
+
+	t.Run("socks5", func(t *testing.T) {
+		code, body, err := get(&url.URL{Scheme: "socks5", Host: socksAddr, User: url.UserPassword("user", "pass")})
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "hello /there", body)
+
+		_, _, err = get(&url.URL{Scheme: "socks5", Host: socksAddr, User: url.UserPassword("user", "wrong")})
+		assert.Error(t, err)
+		_, _, err = get(&url.URL{Scheme: "socks5", Host: socksAddr})
+		assert.Error(t, err)
+	})
+
+	t.Run("http", func(t *testing.T) {
+		code, body, err := get(&url.URL{Scheme: "http", Host: httpAddr, User: url.UserPassword("user", "pass")})
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "hello /there", body)
+
+		code, _, err = get(&url.URL{Scheme: "http", Host: httpAddr, User: url.UserPassword("user", "wrong")})
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusProxyAuthRequired, code)
+	})
+
+	t.Run("http connect", func(t *testing.T) {
+		conn, err := net.Dial("tcp", httpAddr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = io.WriteString(conn, "CONNECT 10.0.1.1:8080 HTTP/1.1\r\nHost: 10.0.1.1:8080\r\n"+
+			"Proxy-Authorization: Basic dXNlcjpwYXNz\r\n\r\n")
+		require.NoError(t, err)
+
+		r := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(r, nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		// The tunnel now goes straight to the server on a
+		_, err = io.WriteString(conn, "GET /tunnel HTTP/1.1\r\nHost: 10.0.1.1:8080\r\n\r\n")
+		require.NoError(t, err)
+		resp, err = http.ReadResponse(r, nil)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "hello /tunnel", string(body))
+	})
+}
+
+func TestNewProxyFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	p, err := NewProxyFromConfig(l, c, nil)
+	require.NoError(t, err)
+	assert.Nil(t, p)
+
+	c.Settings["proxy"] = m{"socks5": m{"listen": "127.0.0.1:0"}, "password": "pass"}
+	_, err = NewProxyFromConfig(l, c, nil)
+	require.EqualError(t, err, "proxy.password is set without a proxy.username")
+
+	c.Settings["proxy"] = m{"http": m{"listen": "not an address"}}
+	_, err = NewProxyFromConfig(l, c, nil)
+	require.ErrorContains(t, err, "failed to listen for proxy.http")
+}
+
+func TestReadSOCKS5Request(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     []byte
+		address string
+		reply   byte
+	}{
+		{"ipv4", []byte{5, 1, 0, 1, 10, 0, 0, 1, 0, 80}, "10.0.0.1:80", socks5Succeeded},
+		{"ipv6", append(append([]byte{5, 1, 0, 4}, netip.MustParseAddr("fd00::1").AsSlice()...), 1, 187), "[fd00::1]:443", socks5Succeeded},
+		{"domain", append(append([]byte{5, 1, 0, 3, 4}, "host"...), 0x1f, 0x90), "host:8080", socks5Succeeded},
+		{"bind", []byte{5, 2, 0, 1, 10, 0, 0, 1, 0, 80}, "", socks5CmdNotSupported},
+		{"bad address type", []byte{5, 1, 0, 9}, "", socks5AddrTypeNotSupport},
+		{"short", []byte{5, 1, 0, 1, 10}, "", socks5GeneralFailure},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address, reply, err := readSOCKS5Request(bufio.NewReader(bytes.NewReader(tt.req)))
+			assert.Equal(t, tt.reply, reply)
+			assert.Equal(t, tt.address, address)
+			if tt.reply == socks5Succeeded {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
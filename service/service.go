@@ -9,6 +9,7 @@ import (
 	"math"
 	"net"
 	"net/netip"
+	"slices"
 	"strings"
 	"sync"
 
@@ -35,11 +36,15 @@ type Service struct {
 	eg      *errgroup.Group
 	control *nebula.Control
 	ipstack *stack.Stack
+	// addrs are the overlay addresses of this host, one for each network in its certificate
+	addrs []netip.Addr
 
 	mu struct {
 		sync.Mutex
 
-		listeners map[uint16]*tcpListener
+		// listeners are keyed by the address they listen on, an unspecified address listens on every address of that
+		// family and the zero address listens on every address
+		listeners map[netip.AddrPort]*tcpListener
 	}
 }
 
@@ -52,7 +57,7 @@ func New(control *nebula.Control) (*Service, error) {
 		eg:      eg,
 		control: control,
 	}
-	s.mu.listeners = map[uint16]*tcpListener{}
+	s.mu.listeners = map[netip.AddrPort]*tcpListener{}
 
 	device, ok := control.Device().(*overlay.UserDevice)
 	if !ok {
@@ -73,23 +78,31 @@ func New(control *nebula.Control) (*Service, error) {
 		return nil, fmt.Errorf("could not create netstack NIC: %v", tcpipProblem)
 	}
 	ipv4Subnet, _ := tcpip.NewSubnet(tcpip.AddrFrom4([4]byte{0x00, 0x00, 0x00, 0x00}), tcpip.MaskFrom(strings.Repeat("\x00", 4)))
+	ipv6Subnet, _ := tcpip.NewSubnet(tcpip.AddrFrom16([16]byte{}), tcpip.MaskFrom(strings.Repeat("\x00", 16)))
 	s.ipstack.SetRouteTable([]tcpip.Route{
 		{
 			Destination: ipv4Subnet,
 			NIC:         nicID,
 		},
+		{
+			Destination: ipv6Subnet,
+			NIC:         nicID,
+		},
 	})
 
-	ipNet := device.Networks()
-	pa := tcpip.ProtocolAddress{
-		AddressWithPrefix: tcpip.AddrFromSlice(ipNet[0].Addr().AsSlice()).WithPrefix(),
-		Protocol:          ipv4.ProtocolNumber,
-	}
-	if err := s.ipstack.AddProtocolAddress(nicID, pa, stack.AddressProperties{
-		PEB:        stack.CanBePrimaryEndpoint, // zero value default
-		ConfigType: stack.AddressConfigStatic,  // zero value default
-	}); err != nil {
-		return nil, fmt.Errorf("error creating IP: %s", err)
+	for _, network := range device.Networks() {
+		addr := network.Addr()
+		pa := tcpip.ProtocolAddress{
+			AddressWithPrefix: tcpip.AddrFromSlice(addr.AsSlice()).WithPrefix(),
+			Protocol:          getProtocolNumber(addr),
+		}
+		if err := s.ipstack.AddProtocolAddress(nicID, pa, stack.AddressProperties{
+			PEB:        stack.CanBePrimaryEndpoint, // zero value default
+			ConfigType: stack.AddressConfigStatic,  // zero value default
+		}); err != nil {
+			return nil, fmt.Errorf("error creating IP: %s", err)
+		}
+		s.addrs = append(s.addrs, addr)
 	}
 
 	const tcpReceiveBufferSize = 0
@@ -101,8 +114,8 @@ func New(control *nebula.Control) (*Service, error) {
 
 	go func() {
 		<-ctx.Done()
+		// writer is left for nebula to close with the device, so it knows the device was shut down on purpose
 		reader.Close()
-		writer.Close()
 	}()
 
 	// create Goroutines to forward packets between Nebula and Gvisor
@@ -114,10 +127,17 @@ func New(control *nebula.Control) (*Service, error) {
 			if err != nil {
 				return err
 			}
+			if n == 0 {
+				continue
+			}
+			proto := header.IPv4ProtocolNumber
+			if header.IPVersion(buf[:n]) == header.IPv6Version {
+				proto = header.IPv6ProtocolNumber
+			}
 			packetBuf := stack.NewPacketBuffer(stack.PacketBufferOptions{
 				Payload: buffer.MakeWithData(bytes.Clone(buf[:n])),
 			})
-			linkEP.InjectInbound(header.IPv4ProtocolNumber, packetBuf)
+			linkEP.InjectInbound(proto, packetBuf)
 
 			if err := ctx.Err(); err != nil {
 				return err
@@ -188,29 +208,31 @@ func (s *Service) Dial(network, address string) (net.Conn, error) {
 	return s.DialContext(context.Background(), network, address)
 }
 
-// Listen listens on the provided address. Currently only TCP with wildcard
-// addresses are supported.
+// Listen listens on the provided address. Only TCP is supported, on a wildcard
+// address or one of this host's overlay addresses.
 func (s *Service) Listen(network, address string) (net.Listener, error) {
-	if network != "tcp" && network != "tcp4" {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
 		return nil, errors.New("only tcp is supported")
 	}
 	addr, err := net.ResolveTCPAddr(network, address)
 	if err != nil {
 		return nil, err
 	}
-	if addr.IP != nil && !bytes.Equal(addr.IP, []byte{0, 0, 0, 0}) {
-		return nil, fmt.Errorf("only wildcard address supported, got %q %v", address, addr.IP)
-	}
 	if addr.Port == 0 {
 		return nil, errors.New("specific port required, got 0")
 	}
 	if addr.Port < 0 || addr.Port >= math.MaxUint16 {
 		return nil, fmt.Errorf("invalid port %d", addr.Port)
 	}
-	port := uint16(addr.Port)
+
+	ip, err := s.listenAddr(network, addr.IP)
+	if err != nil {
+		return nil, err
+	}
+	key := netip.AddrPortFrom(ip, uint16(addr.Port))
 
 	l := &tcpListener{
-		port:   port,
+		key:    key,
 		s:      s,
 		addr:   addr,
 		accept: make(chan net.Conn),
@@ -219,14 +241,100 @@ func (s *Service) Listen(network, address string) (net.Listener, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if _, ok := s.mu.listeners[port]; ok {
-		return nil, fmt.Errorf("already listening on port %d", port)
+	if _, ok := s.mu.listeners[key]; ok {
+		return nil, fmt.Errorf("already listening on %s", address)
 	}
-	s.mu.listeners[port] = l
+	s.mu.listeners[key] = l
 
 	return l, nil
 }
 
+// ListenUDP listens for udp packets on laddr, which is either a wildcard
+// address or one of this host's overlay addresses. A nil laddr or a port of 0
+// picks a free port.
+func (s *Service) ListenUDP(network string, laddr *net.UDPAddr) (*UDPConn, error) {
+	if network != "udp" && network != "udp4" && network != "udp6" {
+		return nil, errors.New("only udp is supported")
+	}
+	if laddr == nil {
+		laddr = &net.UDPAddr{}
+	}
+	if laddr.Port < 0 || laddr.Port > math.MaxUint16 {
+		return nil, fmt.Errorf("invalid port %d", laddr.Port)
+	}
+
+	ip, err := s.listenAddr(network, laddr.IP)
+	if err != nil {
+		return nil, err
+	}
+
+	// A wildcard listener on both families is an ipv6 endpoint that also takes ipv4, when there is any ipv6 to take
+	proto := ipv4.ProtocolNumber
+	if ip.Is6() || (!ip.IsValid() && s.hasIPv6()) {
+		proto = ipv6.ProtocolNumber
+	}
+
+	fullAddr := tcpip.FullAddress{NIC: nicID, Port: uint16(laddr.Port)}
+	if ip.IsValid() && !ip.IsUnspecified() {
+		fullAddr.Addr = tcpip.AddrFromSlice(ip.AsSlice())
+	}
+
+	c, err := gonet.DialUDP(s.ipstack, &fullAddr, nil, proto)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPConn{UDPConn: c, v6: proto == ipv6.ProtocolNumber}, nil
+}
+
+// ListenPacket listens for packets on the provided address, only udp is
+// supported. See ListenUDP.
+func (s *Service) ListenPacket(network, address string) (net.PacketConn, error) {
+	if network != "udp" && network != "udp4" && network != "udp6" {
+		return nil, errors.New("only udp is supported")
+	}
+	addr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return s.ListenUDP(network, addr)
+}
+
+// listenAddr checks that ip can be listened on with network and returns the
+// address to listen on. An ip that is nil or unspecified returns the
+// unspecified address of the network's family, or the zero address when the
+// network takes both.
+func (s *Service) listenAddr(network string, ip net.IP) (netip.Addr, error) {
+	addr, _ := netip.AddrFromSlice(ip)
+	addr = addr.Unmap()
+
+	family := network[len(network)-1]
+	if addr.IsValid() {
+		if (family == '4' && !addr.Is4()) || (family == '6' && !addr.Is6()) {
+			return netip.Addr{}, fmt.Errorf("%s is not a %s address", addr, network)
+		}
+	}
+
+	if !addr.IsValid() || addr.IsUnspecified() {
+		switch family {
+		case '4':
+			return netip.IPv4Unspecified(), nil
+		case '6':
+			return netip.IPv6Unspecified(), nil
+		default:
+			return netip.Addr{}, nil
+		}
+	}
+
+	if !slices.Contains(s.addrs, addr) {
+		return netip.Addr{}, fmt.Errorf("%s is not an address of this host", addr)
+	}
+	return addr, nil
+}
+
+func (s *Service) hasIPv6() bool {
+	return slices.ContainsFunc(s.addrs, netip.Addr.Is6)
+}
+
 func (s *Service) Wait() error {
 	return s.eg.Wait()
 }
@@ -242,8 +350,9 @@ func (s *Service) tcpHandler(r *tcp.ForwarderRequest) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	l, ok := s.mu.listeners[endpointID.LocalPort]
-	if !ok {
+	local, _ := netip.AddrFromSlice(endpointID.LocalAddress.AsSlice())
+	l := s.tcpListener(netip.AddrPortFrom(local, endpointID.LocalPort))
+	if l == nil {
 		r.Complete(true)
 		return
 	}
@@ -261,3 +370,21 @@ func (s *Service) tcpHandler(r *tcp.ForwarderRequest) {
 	conn := gonet.NewTCPConn(&wq, ep)
 	l.accept <- conn
 }
+
+// tcpListener returns the listener for a connection to local, a listener on the exact address wins over the wildcards.
+// s.mu must be held.
+func (s *Service) tcpListener(local netip.AddrPort) *tcpListener {
+	if l, ok := s.mu.listeners[local]; ok {
+		return l
+	}
+
+	unspecified := netip.IPv4Unspecified()
+	if local.Addr().Is6() {
+		unspecified = netip.IPv6Unspecified()
+	}
+	if l, ok := s.mu.listeners[netip.AddrPortFrom(unspecified, local.Port())]; ok {
+		return l
+	}
+
+	return s.mu.listeners[netip.AddrPortFrom(netip.Addr{}, local.Port())]
+}
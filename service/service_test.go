@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"io"
+	"net"
 	"net/netip"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -16,6 +19,8 @@ import (
 	"github.com/slackhq/nebula/cert_test"
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/overlay"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/sync/errgroup"
 	"gopkg.in/yaml.v3"
 )
@@ -23,7 +28,11 @@ import (
 type m = map[string]any
 
 func newSimpleService(caCrt cert.Certificate, caKey []byte, name string, udpIp netip.Addr, overrides m) *Service {
-	_, _, myPrivKey, myPEM := cert_test.NewTestCert(cert.Version2, cert.Curve_CURVE25519, caCrt, caKey, "a", time.Now(), time.Now().Add(5*time.Minute), []netip.Prefix{netip.PrefixFrom(udpIp, 24)}, nil, []string{})
+	return newService(caCrt, caKey, name, []netip.Prefix{netip.PrefixFrom(udpIp, 24)}, overrides)
+}
+
+func newService(caCrt cert.Certificate, caKey []byte, name string, networks []netip.Prefix, overrides m) *Service {
+	_, _, myPrivKey, myPEM := cert_test.NewTestCert(cert.Version2, cert.Curve_CURVE25519, caCrt, caKey, "a", time.Now(), time.Now().Add(5*time.Minute), networks, nil, []string{})
 	caB, err := caCrt.MarshalPEM()
 	if err != nil {
 		panic(err)
@@ -171,3 +180,206 @@ func TestService(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestService_Listen(t *testing.T) {
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	a := newService(ca, caKey, "a", []netip.Prefix{netip.MustParsePrefix("10.0.2.1/24"), netip.MustParsePrefix("fd00:2::1/64")}, m{
+		"static_host_map": m{},
+		"lighthouse":      m{"am_lighthouse": true},
+		"listen":          m{"host": "0.0.0.0", "port": 4245},
+	})
+	defer a.Close()
+	b := newService(ca, caKey, "b", []netip.Prefix{netip.MustParsePrefix("10.0.2.2/24"), netip.MustParsePrefix("fd00:2::2/64")}, m{
+		"static_host_map": m{"10.0.2.1": []string{"localhost:4245"}},
+		"lighthouse":      m{"hosts": []string{"10.0.2.1"}, "interval": 1},
+	})
+	defer b.Close()
+
+	// Every listener says who it is to the connections it accepts
+	listen := func(network, address, name string) {
+		ln, err := a.Listen(network, address)
+		require.NoError(t, err)
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				_, _ = io.WriteString(c, name)
+				_ = c.Close()
+			}
+		}()
+	}
+	listen("tcp", "10.0.2.1:80", "specific")
+	listen("tcp6", "[::]:80", "ipv6")
+	listen("tcp", ":80", "any")
+	listen("tcp4", ":81", "ipv4")
+
+	_, err := a.Listen("tcp", "0.0.0.0:80")
+	require.EqualError(t, err, "already listening on 0.0.0.0:80")
+	_, err = a.Listen("tcp6", "[fd00:2::3]:80")
+	require.EqualError(t, err, "fd00:2::3 is not an address of this host")
+
+	dial := func(address string) string {
+		c, err := b.DialContext(context.Background(), "tcp", address)
+		require.NoError(t, err)
+		defer c.Close()
+		got, err := io.ReadAll(c)
+		require.NoError(t, err)
+		return string(got)
+	}
+	assert.Equal(t, "specific", dial("10.0.2.1:80"))
+	assert.Equal(t, "ipv6", dial("[fd00:2::1]:80"))
+	assert.Equal(t, "ipv4", dial("10.0.2.1:81"))
+
+	c, err := b.DialContext(context.Background(), "tcp", "[fd00:2::1]:81")
+	if err == nil {
+		c.Close()
+	}
+	assert.Error(t, err, "only ipv4 is listened on")
+}
+
+func TestService_ListenUDP(t *testing.T) {
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	a := newService(ca, caKey, "a", []netip.Prefix{netip.MustParsePrefix("10.0.3.1/24"), netip.MustParsePrefix("fd00:3::1/64")}, m{
+		"static_host_map": m{},
+		"lighthouse":      m{"am_lighthouse": true},
+		"listen":          m{"host": "0.0.0.0", "port": 4246},
+	})
+	defer a.Close()
+	b := newService(ca, caKey, "b", []netip.Prefix{netip.MustParsePrefix("10.0.3.2/24"), netip.MustParsePrefix("fd00:3::2/64")}, m{
+		"static_host_map": m{"10.0.3.1": []string{"localhost:4246"}},
+		"lighthouse":      m{"hosts": []string{"10.0.3.1"}, "interval": 1},
+	})
+	defer b.Close()
+
+	// Echo servers that prefix what they send back with their name
+	echo := func(pc net.PacketConn, name string) {
+		go func() {
+			buf := make([]byte, 1500)
+			for {
+				n, addr, err := pc.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				_, _ = pc.WriteTo([]byte(name+" "+addr.String()+" "+string(buf[:n])), addr)
+			}
+		}()
+	}
+
+	pc, err := a.ListenPacket("udp", ":53")
+	require.NoError(t, err)
+	defer pc.Close()
+	echo(pc, "any")
+
+	uc, err := a.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("10.0.3.1"), Port: 54})
+	require.NoError(t, err)
+	defer uc.Close()
+	echo(uc, "specific")
+
+	_, err = a.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("fd00:3::1"), Port: 54})
+	require.EqualError(t, err, "fd00:3::1 is not a udp4 address")
+
+	ask := func(address, msg string) string {
+		c, err := b.DialContext(context.Background(), "udp", address)
+		require.NoError(t, err)
+		defer c.Close()
+
+		buf := make([]byte, 1500)
+		// The first packets may be lost while the tunnel is made
+		for i := 0; i < 20; i++ {
+			_, err = c.Write([]byte(msg))
+			require.NoError(t, err)
+			require.NoError(t, c.SetReadDeadline(time.Now().Add(500*time.Millisecond)))
+			n, err := c.Read(buf)
+			if err == nil {
+				// Drop the port the answer was sent to, it is picked by the dialer
+				fields := strings.SplitN(string(buf[:n]), " ", 3)
+				host, _, err := net.SplitHostPort(fields[1])
+				require.NoError(t, err)
+				return fields[0] + " " + host + " " + fields[2]
+			}
+		}
+		t.Fatalf("no answer from %s", address)
+		return ""
+	}
+
+	assert.Equal(t, "any 10.0.3.2 hello", ask("10.0.3.1:53", "hello"))
+	assert.Equal(t, "any fd00:3::2 hello6", ask("[fd00:3::1]:53", "hello6"))
+	assert.Equal(t, "specific 10.0.3.2 hi", ask("10.0.3.1:54", "hi"))
+
+	// A free port is picked when none is asked for
+	free, err := a.ListenUDP("udp", nil)
+	require.NoError(t, err)
+	defer free.Close()
+	assert.NotZero(t, free.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func TestService_listenAddr(t *testing.T) {
+	s := &Service{addrs: []netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("fd00::1")}}
+
+	tests := []struct {
+		network string
+		ip      string
+		want    netip.Addr
+		err     string
+	}{
+		{"tcp", "", netip.Addr{}, ""},
+		{"tcp", "0.0.0.0", netip.Addr{}, ""},
+		{"tcp", "::", netip.Addr{}, ""},
+		{"tcp4", "", netip.IPv4Unspecified(), ""},
+		{"udp6", "", netip.IPv6Unspecified(), ""},
+		{"tcp", "10.0.0.1", netip.MustParseAddr("10.0.0.1"), ""},
+		{"udp6", "fd00::1", netip.MustParseAddr("fd00::1"), ""},
+		{"tcp", "10.0.0.2", netip.Addr{}, "10.0.0.2 is not an address of this host"},
+		{"tcp6", "10.0.0.1", netip.Addr{}, "10.0.0.1 is not a tcp6 address"},
+		{"udp4", "fd00::1", netip.Addr{}, "fd00::1 is not a udp4 address"},
+	}
+
+	for _, tt := range tests {
+		got, err := s.listenAddr(tt.network, net.ParseIP(tt.ip))
+		if tt.err != "" {
+			assert.EqualError(t, err, tt.err, "%s %s", tt.network, tt.ip)
+			continue
+		}
+		assert.NoError(t, err, "%s %s", tt.network, tt.ip)
+		assert.Equal(t, tt.want, got, "%s %s", tt.network, tt.ip)
+	}
+}
+
+func TestService_CloseLeavesDeviceToNebula(t *testing.T) {
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	a := newSimpleService(ca, caKey, "a", netip.MustParseAddr("10.0.5.1"), m{
+		"static_host_map": m{},
+		"lighthouse":      m{"am_lighthouse": true},
+		"listen":          m{"host": "0.0.0.0", "port": 4248},
+	})
+	b := newSimpleService(ca, caKey, "b", netip.MustParseAddr("10.0.5.2"), m{
+		"static_host_map": m{"10.0.5.1": []string{"localhost:4248"}},
+		"lighthouse":      m{"hosts": []string{"10.0.5.1"}, "interval": 1},
+	})
+	defer a.Close()
+
+	// A tunnel makes nebula send a close for it before closing the device, which gives the service time to run
+	// its own shutdown first
+	ln, err := a.Listen("tcp", ":1234")
+	require.NoError(t, err)
+	go func() {
+		c, err := ln.Accept()
+		if err == nil {
+			_ = c.Close()
+		}
+	}()
+	c, err := b.DialContext(context.Background(), "tcp", "10.0.5.1:1234")
+	require.NoError(t, err)
+	_ = c.Close()
+
+	device := b.control.Device().(*overlay.UserDevice)
+	require.NoError(t, b.Close())
+	_ = b.Wait()
+
+	// Nebula stops reading the device when it sees the error its own close leaves, a plain end of file from the
+	// service closing the device first looks like a broken device and exits the process
+	_, err = device.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrClosed)
+}
@@ -15,6 +15,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/config"
@@ -55,6 +56,17 @@ type sshDeviceInfoFlags struct {
 	Pretty bool
 }
 
+type sshListFirewallRulesFlags struct {
+	Json   bool
+	Pretty bool
+}
+
+type sshTestFirewallFlags struct {
+	FirewallCheckFlags
+	Tunnel string
+	Json   bool
+}
+
 func wireSSHReload(l *logrus.Logger, ssh *sshd.SSHServer, c *config.C) {
 	c.RegisterReloadCallback(func(c *config.C) {
 		if c.GetBool("sshd.enabled", false) {
@@ -234,6 +246,37 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 		},
 	})
 
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "list-firewall-rules",
+		ShortDescription: "List all firewall rules with their id and the traffic they have allowed",
+		Flags: func() (*flag.FlagSet, any) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshListFirewallRulesFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			return fl, &s
+		},
+		Callback: func(fs any, a []string, w sshd.StringWriter) error {
+			return sshListFirewallRules(f.firewall, fs, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "test-firewall",
+		ShortDescription: "Prints if the firewall would allow a packet and which rule matched, without sending it",
+		Flags: func() (*flag.FlagSet, any) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshTestFirewallFlags{}
+			s.Register(fl, "")
+			fl.StringVar(&s.Tunnel, "tunnel", "", "Use the certificate of the tunnel with this vpn addr as the peer")
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			return fl, &s
+		},
+		Callback: func(fs any, a []string, w sshd.StringWriter) error {
+			return sshTestFirewall(f, fs, w)
+		},
+	})
+
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "reload",
 		ShortDescription: "Reloads configuration from disk, same as sending HUP to the process",
@@ -457,26 +500,7 @@ func sshListLighthouseMap(lightHouse *LightHouse, a any, w sshd.StringWriter) er
 		return nil
 	}
 
-	type lighthouseInfo struct {
-		VpnAddr string    `json:"vpnAddr"`
-		Addrs   *CacheMap `json:"addrs"`
-	}
-
-	lightHouse.RLock()
-	addrMap := make([]lighthouseInfo, len(lightHouse.addrMap))
-	x := 0
-	for k, v := range lightHouse.addrMap {
-		addrMap[x] = lighthouseInfo{
-			VpnAddr: k.String(),
-			Addrs:   v.CopyCache(),
-		}
-		x++
-	}
-	lightHouse.RUnlock()
-
-	sort.Slice(addrMap, func(i, j int) bool {
-		return strings.Compare(addrMap[i].VpnAddr, addrMap[j].VpnAddr) < 0
-	})
+	addrMap := listLighthouseAddrMap(lightHouse)
 
 	if fs.Json || fs.Pretty {
 		js := json.NewEncoder(w.GetWriter())
@@ -505,26 +529,60 @@ func sshListLighthouseMap(lightHouse *LightHouse, a any, w sshd.StringWriter) er
 	return nil
 }
 
+type lighthouseInfo struct {
+	VpnAddr string    `json:"vpnAddr"`
+	Addrs   *CacheMap `json:"addrs"`
+}
+
+// listLighthouseAddrMap returns a sorted copy of all lighthouse map entries
+func listLighthouseAddrMap(lightHouse *LightHouse) []lighthouseInfo {
+	lightHouse.RLock()
+	addrMap := make([]lighthouseInfo, len(lightHouse.addrMap))
+	x := 0
+	for k, v := range lightHouse.addrMap {
+		addrMap[x] = lighthouseInfo{
+			VpnAddr: k.String(),
+			Addrs:   v.CopyCache(),
+		}
+		x++
+	}
+	lightHouse.RUnlock()
+
+	sort.Slice(addrMap, func(i, j int) bool {
+		return strings.Compare(addrMap[i].VpnAddr, addrMap[j].VpnAddr) < 0
+	})
+
+	return addrMap
+}
+
 func sshStartCpuProfile(fs any, a []string, w sshd.StringWriter) error {
 	if len(a) == 0 {
 		err := w.WriteLine("No path to write profile provided")
 		return err
 	}
 
-	file, err := os.Create(a[0])
+	err := startCpuProfile(a[0])
 	if err != nil {
-		err = w.WriteLine(fmt.Sprintf("Unable to create profile file: %s", err))
-		return err
+		return w.WriteLine(err.Error())
+	}
+
+	err = w.WriteLine(fmt.Sprintf("Started cpu profile, issue stop-cpu-profile to write the output to %s", a))
+	return err
+}
+
+func startCpuProfile(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("Unable to create profile file: %s", err)
 	}
 
 	err = pprof.StartCPUProfile(file)
 	if err != nil {
-		err = w.WriteLine(fmt.Sprintf("Unable to start cpu profile: %s", err))
-		return err
+		file.Close()
+		return fmt.Errorf("Unable to start cpu profile: %s", err)
 	}
 
-	err = w.WriteLine(fmt.Sprintf("Started cpu profile, issue stop-cpu-profile to write the output to %s", a))
-	return err
+	return nil
 }
 
 func sshVersion(ifce *Interface, fs any, a []string, w sshd.StringWriter) error {
@@ -680,20 +738,28 @@ func sshGetHeapProfile(fs any, a []string, w sshd.StringWriter) error {
 		return w.WriteLine("No path to write profile provided")
 	}
 
-	file, err := os.Create(a[0])
+	err := saveHeapProfile(a[0])
 	if err != nil {
-		err = w.WriteLine(fmt.Sprintf("Unable to create profile file: %s", err))
-		return err
+		return w.WriteLine(err.Error())
 	}
 
+	err = w.WriteLine(fmt.Sprintf("Mem profile created at %s", a))
+	return err
+}
+
+func saveHeapProfile(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("Unable to create profile file: %s", err)
+	}
+	defer file.Close()
+
 	err = pprof.WriteHeapProfile(file)
 	if err != nil {
-		err = w.WriteLine(fmt.Sprintf("Unable to write profile: %s", err))
-		return err
+		return fmt.Errorf("Unable to write profile: %s", err)
 	}
 
-	err = w.WriteLine(fmt.Sprintf("Mem profile created at %s", a))
-	return err
+	return nil
 }
 
 func sshMutexProfileFraction(fs any, a []string, w sshd.StringWriter) error {
@@ -716,23 +782,32 @@ func sshGetMutexProfile(fs any, a []string, w sshd.StringWriter) error {
 		return w.WriteLine("No path to write profile provided")
 	}
 
-	file, err := os.Create(a[0])
+	err := saveMutexProfile(a[0])
 	if err != nil {
-		return w.WriteLine(fmt.Sprintf("Unable to create profile file: %s", err))
+		return w.WriteLine(err.Error())
+	}
+
+	return w.WriteLine(fmt.Sprintf("Mutex profile created at %s", a))
+}
+
+func saveMutexProfile(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("Unable to create profile file: %s", err)
 	}
 	defer file.Close()
 
 	mutexProfile := pprof.Lookup("mutex")
 	if mutexProfile == nil {
-		return w.WriteLine("Unable to get pprof.Lookup(\"mutex\")")
+		return errors.New("Unable to get pprof.Lookup(\"mutex\")")
 	}
 
 	err = mutexProfile.WriteTo(file, 0)
 	if err != nil {
-		return w.WriteLine(fmt.Sprintf("Unable to write profile: %s", err))
+		return fmt.Errorf("Unable to write profile: %s", err)
 	}
 
-	return w.WriteLine(fmt.Sprintf("Mutex profile created at %s", a))
+	return nil
 }
 
 func sshLogLevel(l *logrus.Logger, fs any, a []string, w sshd.StringWriter) error {
@@ -754,7 +829,15 @@ func sshLogFormat(l *logrus.Logger, fs any, a []string, w sshd.StringWriter) err
 		return w.WriteLine(fmt.Sprintf("Log format is: %s", reflect.TypeOf(l.Formatter)))
 	}
 
-	logFormat := strings.ToLower(a[0])
+	if err := setLogFormat(l, a[0]); err != nil {
+		return err
+	}
+
+	return w.WriteLine(fmt.Sprintf("Log format is: %s", reflect.TypeOf(l.Formatter)))
+}
+
+func setLogFormat(l *logrus.Logger, format string) error {
+	logFormat := strings.ToLower(format)
 	switch logFormat {
 	case "text":
 		l.Formatter = &logrus.TextFormatter{}
@@ -764,7 +847,7 @@ func sshLogFormat(l *logrus.Logger, fs any, a []string, w sshd.StringWriter) err
 		return fmt.Errorf("unknown log format `%s`. possible formats: %s", logFormat, []string{"text", "json"})
 	}
 
-	return w.WriteLine(fmt.Sprintf("Log format is: %s", reflect.TypeOf(l.Formatter)))
+	return nil
 }
 
 func sshPrintCert(ifce *Interface, fs any, a []string, w sshd.StringWriter) error {
@@ -829,50 +912,60 @@ func sshPrintRelays(ifce *Interface, fs any, a []string, w sshd.StringWriter) er
 		return nil
 	}
 
-	relays := map[uint32]*HostInfo{}
-	ifce.hostMap.Lock()
-	for k, v := range ifce.hostMap.Relays {
-		relays[k] = v
-	}
-	ifce.hostMap.Unlock()
+	enc := json.NewEncoder(w.GetWriter())
 
-	type RelayFor struct {
-		Error          error
-		Type           string
-		State          string
-		PeerAddr       netip.Addr
-		LocalIndex     uint32
-		RemoteIndex    uint32
-		RelayedThrough []netip.Addr
+	if args.Pretty {
+		enc.SetIndent("", "    ")
 	}
 
-	type RelayOutput struct {
-		NebulaAddr    netip.Addr
-		RelayForAddrs []RelayFor
+	co := listRelays(ifce)
+	err := enc.Encode(co)
+	if err != nil {
+		return err
 	}
+	return nil
+}
 
-	type CmdOutput struct {
-		Relays []*RelayOutput
-	}
+type relayFor struct {
+	Error          error
+	Type           string
+	State          string
+	PeerAddr       netip.Addr
+	LocalIndex     uint32
+	RemoteIndex    uint32
+	RelayedThrough []netip.Addr
+}
 
-	co := CmdOutput{}
+type relayOutput struct {
+	NebulaAddr    netip.Addr
+	RelayForAddrs []relayFor
+}
 
-	enc := json.NewEncoder(w.GetWriter())
+type relaysOutput struct {
+	Relays []*relayOutput
+}
 
-	if args.Pretty {
-		enc.SetIndent("", "    ")
+// listRelays returns details about every relay this host is using or providing
+func listRelays(ifce *Interface) relaysOutput {
+	relays := map[uint32]*HostInfo{}
+	ifce.hostMap.Lock()
+	for k, v := range ifce.hostMap.Relays {
+		relays[k] = v
 	}
+	ifce.hostMap.Unlock()
+
+	co := relaysOutput{}
 
 	for k, v := range relays {
-		ro := RelayOutput{NebulaAddr: v.vpnAddrs[0]}
+		ro := relayOutput{NebulaAddr: v.vpnAddrs[0]}
 		co.Relays = append(co.Relays, &ro)
 		relayHI := ifce.hostMap.QueryVpnAddr(v.vpnAddrs[0])
 		if relayHI == nil {
-			ro.RelayForAddrs = append(ro.RelayForAddrs, RelayFor{Error: errors.New("could not find hostinfo")})
+			ro.RelayForAddrs = append(ro.RelayForAddrs, relayFor{Error: errors.New("could not find hostinfo")})
 			continue
 		}
 		for _, vpnAddr := range relayHI.relayState.CopyRelayForIps() {
-			rf := RelayFor{Error: nil}
+			rf := relayFor{Error: nil}
 			r, ok := relayHI.relayState.GetRelayForByAddr(vpnAddr)
 			if ok {
 				t := ""
@@ -912,11 +1005,8 @@ func sshPrintRelays(ifce *Interface, fs any, a []string, w sshd.StringWriter) er
 			ro.RelayForAddrs = append(ro.RelayForAddrs, rf)
 		}
 	}
-	err := enc.Encode(co)
-	if err != nil {
-		return err
-	}
-	return nil
+
+	return co
 }
 
 func sshPrintTunnel(ifce *Interface, fs any, a []string, w sshd.StringWriter) error {
@@ -951,17 +1041,23 @@ func sshPrintTunnel(ifce *Interface, fs any, a []string, w sshd.StringWriter) er
 	return enc.Encode(copyHostInfo(hostInfo, ifce.hostMap.GetPreferredRanges()))
 }
 
-func sshDeviceInfo(ifce *Interface, fs any, w sshd.StringWriter) error {
+type deviceInfo struct {
+	Name string         `json:"name"`
+	Cidr []netip.Prefix `json:"cidr"`
+}
 
-	data := struct {
-		Name string         `json:"name"`
-		Cidr []netip.Prefix `json:"cidr"`
-	}{
+func getDeviceInfo(ifce *Interface) deviceInfo {
+	data := deviceInfo{
 		Name: ifce.inside.Name(),
 		Cidr: make([]netip.Prefix, len(ifce.inside.Networks())),
 	}
 
 	copy(data.Cidr, ifce.inside.Networks())
+	return data
+}
+
+func sshDeviceInfo(ifce *Interface, fs any, w sshd.StringWriter) error {
+	data := getDeviceInfo(ifce)
 
 	flags, ok := fs.(*sshDeviceInfoFlags)
 	if !ok {
@@ -980,6 +1076,75 @@ func sshDeviceInfo(ifce *Interface, fs any, w sshd.StringWriter) error {
 	}
 }
 
+func sshListFirewallRules(fw *Firewall, fs any, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshListFirewallRulesFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshListFirewallRulesFlags but was %+v", fs)
+	}
+
+	rules := fw.ListRules()
+
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
+
+		return js.Encode(rules)
+	}
+
+	for _, r := range rules {
+		lastMatch := "never"
+		if r.LastMatch != nil {
+			lastMatch = r.LastMatch.Format(time.RFC3339)
+		}
+
+		err := w.WriteLine(fmt.Sprintf("%s %s %s packets=%v bytes=%v last_match=%s: %s", r.ID, r.Action, r.Direction, r.Packets, r.Bytes, lastMatch, r.Rule))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func sshTestFirewall(ifce *Interface, fs any, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshTestFirewallFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshTestFirewallFlags but was %+v", fs)
+	}
+
+	var fc FirewallCheck
+	var err error
+	if flags.Tunnel != "" {
+		vpnAddr, perr := netip.ParseAddr(flags.Tunnel)
+		if perr != nil {
+			return w.WriteLine(fmt.Sprintf("The provided vpn addr could not be parsed: %s", flags.Tunnel))
+		}
+
+		hostInfo := ifce.hostMap.QueryVpnAddr(vpnAddr)
+		if hostInfo == nil || hostInfo.ConnectionState.peerCert == nil {
+			return w.WriteLine(fmt.Sprintf("Could not find tunnel for vpn addr: %v", vpnAddr))
+		}
+
+		fc.Packet, fc.Incoming, err = flags.packet()
+		fc.Peer = hostInfo.ConnectionState.peerCert.Certificate
+	} else {
+		fc, err = flags.Check()
+	}
+
+	if err != nil {
+		return w.WriteLine(fmt.Sprintf("Invalid packet: %s", err))
+	}
+
+	res := ifce.firewall.Check(fc, ifce.pki.GetCAPool())
+	if flags.Json {
+		return json.NewEncoder(w.GetWriter()).Encode(res)
+	}
+
+	return w.WriteLine(res.String())
+}
+
 func sshReload(c *config.C, w sshd.StringWriter) error {
 	err := w.WriteLine("Reloading config")
 	c.ReloadConfig()
@@ -0,0 +1,115 @@
+package nebula
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/netip"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/udp"
+	"github.com/slackhq/nebula/util"
+)
+
+// handshakeTCPHeadStart is how many handshake attempts only go to udp remotes when a host also has tcp remotes, so
+// tcp is only used when udp is not getting through
+const handshakeTCPHeadStart = 2
+
+// newTCPConnFromConfig starts the tcp transport when `listen.tcp.enabled` is set or a static host is reached with a
+// websocket, it returns nil otherwise
+func newTCPConnFromConfig(l *logrus.Logger, c *config.C, listenHost netip.Addr, lh *LightHouse) (*udp.TCPConn, error) {
+	if !c.GetBool("listen.tcp.enabled", false) && !lh.hasWebSocketURLs() {
+		return nil, nil
+	}
+
+	cfg := udp.TCPConfig{
+		TLS:          c.GetBool("listen.tcp.tls", false),
+		ServerName:   c.GetString("listen.tcp.tls_server_name", ""),
+		IsRemote:     lh.IsTCPRemote,
+		WebSocketURL: lh.WebSocketURL,
+	}
+
+	port := 0
+	if c.GetBool("listen.tcp.enabled", false) {
+		port = c.GetInt("listen.tcp.port", 0)
+	}
+	if port < 0 || port > 65535 {
+		return nil, util.NewContextualError("listen.tcp.port is not a valid port", m{"port": port}, nil)
+	}
+
+	if port != 0 {
+		cfg.Listen = netip.AddrPortFrom(listenHost, uint16(port))
+
+		cfg.MaxConns = c.GetInt("listen.tcp.max_connections", udp.DefaultTCPMaxConns)
+		if cfg.MaxConns < 1 {
+			return nil, util.NewContextualError("listen.tcp.max_connections must be at least 1", m{"maxConnections": cfg.MaxConns}, nil)
+		}
+
+		if cfg.TLS {
+			crt, err := tcpCertificateFromConfig(c)
+			if err != nil {
+				return nil, err
+			}
+			cfg.Certificate = crt
+		}
+	}
+
+	tc, err := udp.NewTCPConn(l, cfg)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to open tcp listener", m{"listen": cfg.Listen}, err)
+	}
+
+	if cfg.Listen.IsValid() {
+		l.WithField("tls", cfg.TLS).Infof("listening on tcp %v", cfg.Listen)
+	}
+
+	return tc, nil
+}
+
+// tcpCertificateFromConfig loads `listen.tcp.tls_cert` and `listen.tcp.tls_key`. Without them a self signed certificate
+// is made, peers do not verify it since nebula authenticates them in its own handshake.
+func tcpCertificateFromConfig(c *config.C) (*tls.Certificate, error) {
+	certFile := c.GetString("listen.tcp.tls_cert", "")
+	keyFile := c.GetString("listen.tcp.tls_key", "")
+
+	if certFile != "" || keyFile != "" {
+		crt, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, util.NewContextualError("Failed to load listen.tcp.tls_cert and listen.tcp.tls_key", nil, err)
+		}
+		return &crt, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: c.GetString("listen.tcp.tls_server_name", "nebula")},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -22,6 +22,45 @@ type Conn interface {
 	Close() error
 }
 
+// BatchWriter is implemented by a Conn that can send several packets to the same address with one call
+type BatchWriter interface {
+	WriteBatch(bufs [][]byte, addr netip.AddrPort) error
+}
+
+// BatchListener is implemented by a Conn that can say when it is done handing over the packets of a read, so whatever
+// they caused can be flushed together
+type BatchListener interface {
+	// ListenOutBatch is ListenOut that calls flush after every read
+	ListenOutBatch(r EncReader, flush func())
+}
+
+// ListenOutBatch calls ListenOutBatch when c is a BatchListener, without it flush is called after every packet
+func ListenOutBatch(c Conn, r EncReader, flush func()) {
+	if bl, ok := c.(BatchListener); ok {
+		bl.ListenOutBatch(r, flush)
+		return
+	}
+
+	c.ListenOut(func(addr netip.AddrPort, payload []byte) {
+		r(addr, payload)
+		flush()
+	})
+}
+
+// WriteBatch sends bufs to addr in a single call when c is a BatchWriter, and with a WriteTo per packet when it is not
+func WriteBatch(c Conn, bufs [][]byte, addr netip.AddrPort) error {
+	if bw, ok := c.(BatchWriter); ok {
+		return bw.WriteBatch(bufs, addr)
+	}
+
+	for _, b := range bufs {
+		if err := c.WriteTo(b, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type NoopConn struct{}
 
 func (NoopConn) Rebind() error {
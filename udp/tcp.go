@@ -0,0 +1,583 @@
+package udp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+// TCPConn carries nebula packets over tcp connections, optionally wrapped in tls, for networks that do not let udp
+// through. Each packet is sent with its length as a 2 byte big endian prefix, or as a single message on connections
+// that are websockets. A connection is dialed the first time a packet is written to an address that should be reached
+// over tcp, and connections accepted by the listener are used to answer the address they came from.
+type TCPConn struct {
+	l   *logrus.Logger
+	cfg TCPConfig
+
+	ln net.Listener
+	// conns has a slot for every accepted connection being served
+	conns chan struct{}
+	peers sync.Map // netip.AddrPort -> *tcpPeer
+	in    chan tcpFrame
+	bufs  sync.Pool
+	done  chan struct{}
+	once  sync.Once
+}
+
+type TCPConfig struct {
+	// Listen is the address to accept connections on, nothing is accepted if it is not valid
+	Listen netip.AddrPort
+	// MaxConns is how many accepted connections are served at once, more are closed right away.
+	// DefaultTCPMaxConns is used when it is 0.
+	MaxConns int
+
+	// TLS wraps every connection in tls. Nebula authenticates both ends in its own handshake, tls only makes the
+	// connection look like any other https connection so certificates are not verified when dialing.
+	TLS bool
+	// Certificate is presented to hosts that connect to us over tls
+	Certificate *tls.Certificate
+	// ServerName is sent as the SNI when dialing over tls
+	ServerName string
+
+	// IsRemote reports if an address that we have no connection with should be dialed over tcp
+	IsRemote func(netip.AddrPort) bool
+
+	// WebSocketURL returns the url to dial for addresses that are reached with a websocket instead of a plain tcp
+	// connection
+	WebSocketURL func(netip.AddrPort) (*url.URL, bool)
+	// Proxy returns the http proxy to reach a websocket url through, http.ProxyFromEnvironment is used when it is nil
+	Proxy func(*http.Request) (*url.URL, error)
+}
+
+const (
+	// DefaultTCPMaxConns is how many accepted connections are served at once by default
+	DefaultTCPMaxConns = 1024
+
+	// tcpQueueLen is how many packets may wait for a connection before new ones are dropped
+	tcpQueueLen = 128
+	// tcpDialTimeout bounds how long we wait for a connection and its tls handshake
+	tcpDialTimeout = 5 * time.Second
+	// tcpAcceptTimeout bounds how long an accepted connection has to finish its tls or websocket handshake and send
+	// its first packet, until then it does not answer for its address
+	tcpAcceptTimeout = 5 * time.Second
+	// tcpAcceptMaxDelay is the longest we wait before accepting again after the listener failed
+	tcpAcceptMaxDelay = time.Second
+	// tcpWriteTimeout bounds how long a single packet may take to write before the connection is dropped
+	tcpWriteTimeout = 10 * time.Second
+	// tcpIdleTimeout closes connections that have not carried a packet for this long
+	tcpIdleTimeout = 5 * time.Minute
+)
+
+var ErrNotTCPRemote = errors.New("remote is not reachable over tcp")
+
+type tcpFrame struct {
+	addr netip.AddrPort
+	buf  *[]byte
+	n    int
+}
+
+type tcpPeer struct {
+	addr netip.AddrPort
+	out  chan []byte
+	done chan struct{}
+
+	// mu guards conn, which is nil until a dialed connection is ready
+	mu     sync.Mutex
+	conn   packetStream
+	closed bool
+}
+
+// packetStream sends and receives whole packets over a connection
+type packetStream interface {
+	// readPacket reads the next packet into b and returns its length
+	readPacket(b []byte) (int, error)
+	writePacket(b []byte) error
+	SetReadDeadline(time.Time) error
+	SetWriteDeadline(time.Time) error
+	Close() error
+}
+
+// framedStream is a packetStream that prefixes every packet with its length
+type framedStream struct {
+	net.Conn
+	r *bufio.Reader
+	// wb holds the packet being written, only the peer's write routine uses it
+	wb []byte
+}
+
+var _ Conn = &TCPConn{}
+
+func NewTCPConn(l *logrus.Logger, cfg TCPConfig) (*TCPConn, error) {
+	if cfg.TLS && cfg.Listen.IsValid() && cfg.Certificate == nil {
+		return nil, errors.New("a certificate is required to accept tls connections")
+	}
+
+	tc := &TCPConn{
+		l:    l,
+		cfg:  cfg,
+		in:   make(chan tcpFrame, tcpQueueLen),
+		done: make(chan struct{}),
+		bufs: sync.Pool{New: func() any {
+			b := make([]byte, MTU)
+			return &b
+		}},
+	}
+
+	if cfg.Listen.IsValid() {
+		ln, err := net.Listen("tcp", cfg.Listen.String())
+		if err != nil {
+			return nil, err
+		}
+		tc.ln = ln
+
+		maxConns := cfg.MaxConns
+		if maxConns == 0 {
+			maxConns = DefaultTCPMaxConns
+		}
+		tc.conns = make(chan struct{}, maxConns)
+		go tc.accept()
+	}
+
+	return tc, nil
+}
+
+// Owns reports if packets to addr should be sent over tcp, either because we have a connection with it or because it
+// is known to be a tcp remote
+func (tc *TCPConn) Owns(addr netip.AddrPort) bool {
+	if _, ok := tc.peers.Load(addr); ok {
+		return true
+	}
+	return tc.cfg.IsRemote != nil && tc.cfg.IsRemote(addr)
+}
+
+func (tc *TCPConn) Rebind() error {
+	return nil
+}
+
+func (tc *TCPConn) LocalAddr() (netip.AddrPort, error) {
+	if tc.ln == nil {
+		return netip.AddrPort{}, nil
+	}
+	return tc.ln.Addr().(*net.TCPAddr).AddrPort(), nil
+}
+
+func (tc *TCPConn) ListenOut(r EncReader) {
+	tc.ListenOutBatch(r, func() {})
+}
+
+// ListenOutBatch flushes whenever no more packets are waiting
+func (tc *TCPConn) ListenOutBatch(r EncReader, flush func()) {
+	for {
+		select {
+		case f := <-tc.in:
+			r(f.addr, (*f.buf)[:f.n])
+			tc.bufs.Put(f.buf)
+			if len(tc.in) == 0 {
+				flush()
+			}
+		case <-tc.done:
+			return
+		}
+	}
+}
+
+// WriteTo queues b to be sent to addr. Like udp the packet is dropped if it can not be sent soon, b may be reused as
+// soon as WriteTo returns.
+func (tc *TCPConn) WriteTo(b []byte, addr netip.AddrPort) error {
+	if len(b) > MTU {
+		return fmt.Errorf("packet of %d bytes is too large for tcp", len(b))
+	}
+
+	var p *tcpPeer
+	if v, ok := tc.peers.Load(addr); ok {
+		p = v.(*tcpPeer)
+	} else {
+		if tc.cfg.IsRemote == nil || !tc.cfg.IsRemote(addr) {
+			return ErrNotTCPRemote
+		}
+
+		p = newTCPPeer(addr, nil)
+		if v, loaded := tc.peers.LoadOrStore(addr, p); loaded {
+			p = v.(*tcpPeer)
+		} else {
+			go tc.dial(p)
+		}
+	}
+
+	select {
+	case p.out <- append([]byte(nil), b...):
+	default:
+		// The connection can't keep up, drop the packet like a full udp socket would
+	}
+	return nil
+}
+
+func (tc *TCPConn) ReloadConfig(*config.C) {}
+
+func (tc *TCPConn) Close() error {
+	var err error
+	tc.once.Do(func() {
+		close(tc.done)
+		if tc.ln != nil {
+			err = tc.ln.Close()
+		}
+		tc.peers.Range(func(_, v any) bool {
+			v.(*tcpPeer).close()
+			return true
+		})
+	})
+	return err
+}
+
+func newTCPPeer(addr netip.AddrPort, conn packetStream) *tcpPeer {
+	return &tcpPeer{
+		addr: addr,
+		conn: conn,
+		out:  make(chan []byte, tcpQueueLen),
+		done: make(chan struct{}),
+	}
+}
+
+func (p *tcpPeer) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.done)
+	if p.conn != nil {
+		_ = p.conn.Close()
+	}
+}
+
+// setConn gives a dialed peer its connection, it returns false if the peer was closed while dialing
+func (p *tcpPeer) setConn(c packetStream) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	p.conn = c
+	return true
+}
+
+// remove closes the peer and forgets it, the next packet for its address will dial a new connection
+func (tc *TCPConn) remove(p *tcpPeer) {
+	tc.peers.CompareAndDelete(p.addr, p)
+	p.close()
+}
+
+func (tc *TCPConn) accept() {
+	var delay time.Duration
+	for {
+		c, err := tc.ln.Accept()
+		if err != nil {
+			select {
+			case <-tc.done:
+				return
+			default:
+			}
+
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+
+			// Running out of file descriptors and the like can pass, back off like net/http does and try again
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else {
+				delay = min(2*delay, tcpAcceptMaxDelay)
+			}
+			tc.l.WithError(err).WithField("retryIn", delay).Error("Failed to accept tcp connection")
+
+			select {
+			case <-tc.done:
+				return
+			case <-time.After(delay):
+			}
+			continue
+		}
+		delay = 0
+
+		addr := c.RemoteAddr().(*net.TCPAddr).AddrPort()
+		addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+
+		select {
+		case tc.conns <- struct{}{}:
+		default:
+			if tc.l.Level >= logrus.DebugLevel {
+				tc.l.WithField("tcpAddr", addr).WithField("maxConns", cap(tc.conns)).
+					Debug("Too many tcp connections, closing new connection")
+			}
+			_ = c.Close()
+			continue
+		}
+
+		if tc.cfg.TLS {
+			c = tls.Server(c, &tls.Config{
+				Certificates: []tls.Certificate{*tc.cfg.Certificate},
+				MinVersion:   tls.VersionTLS12,
+			})
+		}
+
+		go tc.serve(addr, c)
+	}
+}
+
+// serve works out if an accepted connection is a websocket or carries length prefixed packets and runs it until it
+// closes. A length prefix never exceeds MTU so its first byte is always below the 'G' that starts a websocket's http
+// GET request.
+func (tc *TCPConn) serve(addr netip.AddrPort, c net.Conn) {
+	defer func() { <-tc.conns }()
+	defer c.Close()
+
+	r := bufio.NewReaderSize(c, 2+MTU)
+	_ = c.SetDeadline(time.Now().Add(tcpAcceptTimeout))
+	b, err := r.Peek(1)
+	if err != nil {
+		if tc.l.Level >= logrus.DebugLevel {
+			tc.l.WithError(err).WithField("tcpAddr", addr).Debug("Closing tcp connection")
+		}
+		return
+	}
+
+	if b[0] == 'G' {
+		err = serveWebSocket(c, r, func(s packetStream) {
+			tc.run(addr, s, "Accepted websocket connection")
+		})
+		if err != nil && tc.l.Level >= logrus.DebugLevel {
+			tc.l.WithError(err).WithField("tcpAddr", addr).Debug("Closing websocket connection")
+		}
+		return
+	}
+
+	tc.run(addr, newFramedStream(c, r), "Accepted tcp connection")
+}
+
+// run makes s the connection for addr once its first packet arrives within the accept deadline, and carries packets
+// over it until it closes. A connection that never sends anything does not take over from one that works.
+func (tc *TCPConn) run(addr netip.AddrPort, s packetStream, msg string) {
+	buf := tc.bufs.Get().(*[]byte)
+	n, err := s.readPacket(*buf)
+	if err != nil {
+		tc.bufs.Put(buf)
+		if tc.l.Level >= logrus.DebugLevel {
+			tc.l.WithError(err).WithField("tcpAddr", addr).Debug("Closing tcp connection")
+		}
+		return
+	}
+
+	p := newTCPPeer(addr, s)
+	if old, loaded := tc.peers.Swap(addr, p); loaded {
+		old.(*tcpPeer).close()
+	}
+
+	if tc.l.Level >= logrus.DebugLevel {
+		tc.l.WithField("tcpAddr", addr).Debug(msg)
+	}
+
+	go tc.write(p, s)
+	select {
+	case tc.in <- tcpFrame{addr: addr, buf: buf, n: n}:
+	case <-tc.done:
+		tc.bufs.Put(buf)
+		tc.remove(p)
+		return
+	}
+	tc.read(p, s)
+}
+
+func (tc *TCPConn) dial(p *tcpPeer) {
+	var c packetStream
+	var err error
+	if u, ok := tc.webSocketURL(p.addr); ok {
+		c, err = dialWebSocket(u, tc.cfg.Proxy)
+		if err != nil {
+			tc.l.WithError(err).WithField("tcpAddr", p.addr).WithField("url", u.Redacted()).Info("Failed to connect over websocket")
+			tc.remove(p)
+			return
+		}
+	} else {
+		c, err = tc.dialTCP(p.addr)
+		if err != nil {
+			tc.l.WithError(err).WithField("tcpAddr", p.addr).Info("Failed to connect over tcp")
+			tc.remove(p)
+			return
+		}
+	}
+
+	if !p.setConn(c) {
+		_ = c.Close()
+		return
+	}
+
+	tc.l.WithField("tcpAddr", p.addr).Info("Connected over tcp")
+
+	go tc.read(p, c)
+	tc.write(p, c)
+}
+
+func (tc *TCPConn) webSocketURL(addr netip.AddrPort) (*url.URL, bool) {
+	if tc.cfg.WebSocketURL == nil {
+		return nil, false
+	}
+	return tc.cfg.WebSocketURL(addr)
+}
+
+func (tc *TCPConn) dialTCP(addr netip.AddrPort) (packetStream, error) {
+	d := net.Dialer{Timeout: tcpDialTimeout}
+	c, err := d.Dial("tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if tc.cfg.TLS {
+		tlsConn := tls.Client(c, &tls.Config{
+			ServerName:         tc.cfg.ServerName,
+			InsecureSkipVerify: true,
+			MinVersion:         tls.VersionTLS12,
+		})
+		_ = tlsConn.SetDeadline(time.Now().Add(tcpDialTimeout))
+		err = tlsConn.Handshake()
+		_ = tlsConn.SetDeadline(time.Time{})
+		if err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+		c = tlsConn
+	}
+
+	return newFramedStream(c, bufio.NewReaderSize(c, 2+MTU)), nil
+}
+
+func (tc *TCPConn) write(p *tcpPeer, c packetStream) {
+	defer tc.remove(p)
+	for {
+		select {
+		case b := <-p.out:
+			_ = c.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+			if err := c.writePacket(b); err != nil {
+				if tc.l.Level >= logrus.DebugLevel {
+					tc.l.WithError(err).WithField("tcpAddr", p.addr).Debug("Failed to write to tcp connection")
+				}
+				return
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (tc *TCPConn) read(p *tcpPeer, c packetStream) {
+	defer tc.remove(p)
+
+	for {
+		_ = c.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		buf := tc.bufs.Get().(*[]byte)
+		n, err := c.readPacket(*buf)
+		if err != nil {
+			tc.bufs.Put(buf)
+			if tc.l.Level >= logrus.DebugLevel {
+				tc.l.WithError(err).WithField("tcpAddr", p.addr).Debug("Closing tcp connection")
+			}
+			return
+		}
+
+		select {
+		case tc.in <- tcpFrame{addr: p.addr, buf: buf, n: n}:
+		case <-p.done:
+			tc.bufs.Put(buf)
+			return
+		case <-tc.done:
+			tc.bufs.Put(buf)
+			return
+		}
+	}
+}
+
+func newFramedStream(c net.Conn, r *bufio.Reader) *framedStream {
+	return &framedStream{Conn: c, r: r, wb: make([]byte, 2+MTU)}
+}
+
+func (s *framedStream) readPacket(b []byte) (int, error) {
+	var lb [2]byte
+	if _, err := io.ReadFull(s.r, lb[:]); err != nil {
+		return 0, err
+	}
+
+	n := int(binary.BigEndian.Uint16(lb[:]))
+	if n > len(b) {
+		return 0, fmt.Errorf("packet of %d bytes is too large", n)
+	}
+
+	return io.ReadFull(s.r, b[:n])
+}
+
+func (s *framedStream) writePacket(b []byte) error {
+	binary.BigEndian.PutUint16(s.wb, uint16(len(b)))
+	n := copy(s.wb[2:], b)
+	_, err := s.Conn.Write(s.wb[:2+n])
+	return err
+}
+
+// WithTCP returns a Conn that sends packets over tcp for the remotes tcp owns and over conn for everything else.
+// Packets received over tcp are read by calling ListenOut on tcp.
+func WithTCP(conn Conn, tcp *TCPConn) Conn {
+	return &tcpMux{Conn: conn, tcp: tcp}
+}
+
+type tcpMux struct {
+	Conn
+	tcp *TCPConn
+}
+
+func (m *tcpMux) WriteTo(b []byte, addr netip.AddrPort) error {
+	if m.tcp.Owns(addr) {
+		return m.tcp.WriteTo(b, addr)
+	}
+	return m.Conn.WriteTo(b, addr)
+}
+
+func (m *tcpMux) WriteBatch(bufs [][]byte, addr netip.AddrPort) error {
+	if m.tcp.Owns(addr) {
+		return WriteBatch(m.tcp, bufs, addr)
+	}
+	return WriteBatch(m.Conn, bufs, addr)
+}
+
+func (m *tcpMux) ListenOutBatch(r EncReader, flush func()) {
+	ListenOutBatch(m.Conn, r, flush)
+}
+
+func (m *tcpMux) Unwrap() Conn {
+	return m.Conn
+}
+
+// Unwrap returns the Conn that c sends udp packets with
+func Unwrap(c Conn) Conn {
+	for {
+		w, ok := c.(interface{ Unwrap() Conn })
+		if !ok {
+			return c
+		}
+		c = w.Unwrap()
+	}
+}
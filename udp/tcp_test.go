@@ -0,0 +1,235 @@
+package udp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type tcpPacket struct {
+	addr netip.AddrPort
+	b    []byte
+}
+
+func listenTCP(t *testing.T, tc *TCPConn) chan tcpPacket {
+	ch := make(chan tcpPacket, 10)
+	go tc.ListenOut(func(addr netip.AddrPort, payload []byte) {
+		ch <- tcpPacket{addr: addr, b: append([]byte(nil), payload...)}
+	})
+	t.Cleanup(func() { _ = tc.Close() })
+	return ch
+}
+
+func recvTCP(t *testing.T, ch chan tcpPacket) tcpPacket {
+	select {
+	case p := <-ch:
+		return p
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a packet")
+		return tcpPacket{}
+	}
+}
+
+func testTCPConn(t *testing.T, useTLS bool) {
+	l := test.NewLogger()
+
+	serverCfg := TCPConfig{Listen: netip.MustParseAddrPort("127.0.0.1:0"), TLS: useTLS}
+	if useTLS {
+		serverCfg.Certificate = testTLSCertificate(t)
+	}
+	server, err := NewTCPConn(l, serverCfg)
+	require.NoError(t, err)
+	serverIn := listenTCP(t, server)
+
+	serverAddr, err := server.LocalAddr()
+	require.NoError(t, err)
+
+	client, err := NewTCPConn(l, TCPConfig{
+		TLS:      useTLS,
+		IsRemote: func(addr netip.AddrPort) bool { return addr == serverAddr },
+	})
+	require.NoError(t, err)
+	clientIn := listenTCP(t, client)
+
+	// Only tcp remotes are dialed
+	assert.True(t, client.Owns(serverAddr))
+	assert.False(t, client.Owns(netip.MustParseAddrPort("127.0.0.1:1")))
+	require.ErrorIs(t, client.WriteTo([]byte("hi"), netip.MustParseAddrPort("127.0.0.1:1")), ErrNotTCPRemote)
+
+	// Packets keep their boundaries
+	require.NoError(t, client.WriteTo([]byte("hello"), serverAddr))
+	require.NoError(t, client.WriteTo([]byte("world!"), serverAddr))
+	p := recvTCP(t, serverIn)
+	assert.Equal(t, []byte("hello"), p.b)
+	assert.Equal(t, []byte("world!"), recvTCP(t, serverIn).b)
+
+	// The server answers over the connection the client made
+	assert.True(t, server.Owns(p.addr))
+	require.NoError(t, server.WriteTo([]byte("hey"), p.addr))
+	reply := recvTCP(t, clientIn)
+	assert.Equal(t, serverAddr, reply.addr)
+	assert.Equal(t, []byte("hey"), reply.b)
+
+	// The largest packet fits, anything larger is refused
+	large := make([]byte, MTU)
+	large[MTU-1] = 1
+	require.NoError(t, client.WriteTo(large, serverAddr))
+	assert.Equal(t, large, recvTCP(t, serverIn).b)
+	require.Error(t, client.WriteTo(make([]byte, MTU+1), serverAddr))
+}
+
+func TestTCPConn(t *testing.T) {
+	testTCPConn(t, false)
+}
+
+func TestTCPConn_TLS(t *testing.T) {
+	testTCPConn(t, true)
+}
+
+func TestTCPConn_TLSRequiresCertificate(t *testing.T) {
+	_, err := NewTCPConn(test.NewLogger(), TCPConfig{Listen: netip.MustParseAddrPort("127.0.0.1:0"), TLS: true})
+	require.Error(t, err)
+}
+
+// dialFramed connects to tc without a TCPConn of our own and sends a packet when hello is set
+func dialFramed(t *testing.T, tc *TCPConn, hello bool) (net.Conn, netip.AddrPort) {
+	addr, err := tc.LocalAddr()
+	require.NoError(t, err)
+	c, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = c.Close() })
+
+	if hello {
+		_, err = c.Write([]byte{0, 2, 'h', 'i'})
+		require.NoError(t, err)
+	}
+	return c, c.LocalAddr().(*net.TCPAddr).AddrPort()
+}
+
+func TestTCPConn_MaxConns(t *testing.T) {
+	server, err := NewTCPConn(test.NewLogger(), TCPConfig{Listen: netip.MustParseAddrPort("127.0.0.1:0"), MaxConns: 1})
+	require.NoError(t, err)
+	in := listenTCP(t, server)
+
+	first, _ := dialFramed(t, server, true)
+	recvTCP(t, in)
+
+	// The second connection is closed without being served
+	second, _ := dialFramed(t, server, false)
+	require.NoError(t, second.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = second.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Closing the first makes room
+	require.NoError(t, first.Close())
+	assert.Eventually(t, func() bool { return len(server.conns) == 0 }, 5*time.Second, 10*time.Millisecond)
+	dialFramed(t, server, true)
+	recvTCP(t, in)
+}
+
+func TestTCPConn_FirstPacket(t *testing.T) {
+	server, err := NewTCPConn(test.NewLogger(), TCPConfig{Listen: netip.MustParseAddrPort("127.0.0.1:0")})
+	require.NoError(t, err)
+	in := listenTCP(t, server)
+
+	// A connection only answers for its address once it has sent a packet
+	c, addr := dialFramed(t, server, false)
+	assert.Never(t, func() bool { return server.Owns(addr) }, 200*time.Millisecond, 10*time.Millisecond)
+
+	_, err = c.Write([]byte{0, 2, 'h', 'i'})
+	require.NoError(t, err)
+	p := recvTCP(t, in)
+	assert.Equal(t, addr, p.addr)
+	assert.Equal(t, []byte("hi"), p.b)
+	assert.True(t, server.Owns(addr))
+}
+
+// failingListener fails to accept a few times before it is closed
+type failingListener struct {
+	net.Listener
+	failures int
+	accepts  atomic.Int32
+}
+
+func (fl *failingListener) Accept() (net.Conn, error) {
+	if int(fl.accepts.Add(1)) <= fl.failures {
+		return nil, errors.New("too many open files")
+	}
+	return nil, net.ErrClosed
+}
+
+func TestTCPConn_acceptKeepsGoing(t *testing.T) {
+	fl := &failingListener{failures: 3}
+	tc := &TCPConn{l: test.NewLogger(), ln: fl, conns: make(chan struct{}, 1), done: make(chan struct{})}
+
+	done := make(chan struct{})
+	go func() {
+		tc.accept()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("accept did not return once the listener was closed")
+	}
+	assert.Equal(t, int32(4), fl.accepts.Load())
+}
+
+func TestWithTCP(t *testing.T) {
+	tcpRemote := netip.MustParseAddrPort("127.0.0.1:1")
+	udpRemote := netip.MustParseAddrPort("127.0.0.1:2")
+
+	tc, err := NewTCPConn(test.NewLogger(), TCPConfig{
+		IsRemote: func(addr netip.AddrPort) bool { return addr == tcpRemote },
+	})
+	require.NoError(t, err)
+	defer tc.Close()
+
+	uc := &recordingConn{}
+	c := WithTCP(uc, tc)
+
+	require.NoError(t, c.WriteTo([]byte("udp"), udpRemote))
+	require.NoError(t, c.WriteTo([]byte("tcp"), tcpRemote))
+	assert.Equal(t, []netip.AddrPort{udpRemote}, uc.sent)
+	assert.Same(t, uc, Unwrap(c))
+}
+
+type recordingConn struct {
+	NoopConn
+	sent []netip.AddrPort
+}
+
+func (c *recordingConn) WriteTo(_ []byte, addr netip.AddrPort) error {
+	c.sent = append(c.sent, addr)
+	return nil
+}
+
+func testTLSCertificate(t *testing.T) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
@@ -5,9 +5,11 @@ package udp
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"net/netip"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 
@@ -22,8 +24,30 @@ type StdConn struct {
 	isV4  bool
 	l     *logrus.Logger
 	batch int
+
+	// gro is set when the kernel may hand us several packets from the same sender in one read, it can not change once
+	// ListenOut has sized its buffers
+	gro bool
+	// gsoSupported is set when the kernel understands UDP_SEGMENT, gso is cleared if a send with it fails
+	gsoSupported bool
+	gso          atomic.Bool
+	// closed is set before the socket is shut down so a reader woken by it exits instead of reading from whatever
+	// socket is handed the descriptor next
+	closed atomic.Bool
 }
 
+const (
+	// groBufferSize fits the largest udp payload, which is as large as a read with gro can be
+	groBufferSize = 65535
+	// gsoMaxSegments is how many packets the kernel will split a single send into
+	gsoMaxSegments = 64
+	// gsoMaxBytes keeps a send within the largest udp payload over ipv4
+	gsoMaxBytes = 65507
+)
+
+// groControlLen fits the UDP_GRO control message, which holds the size of the packets in a read
+var groControlLen = unix.CmsgSpace(4)
+
 func maybeIPV4(ip net.IP) (net.IP, bool) {
 	ip4 := ip.To4()
 	if ip4 != nil {
@@ -69,7 +93,10 @@ func NewListener(l *logrus.Logger, ip netip.Addr, port int, multi bool, batch in
 		return nil, fmt.Errorf("unable to bind to socket: %s", err)
 	}
 
-	return &StdConn{sysFd: fd, isV4: ip.Is4(), l: l, batch: batch}, err
+	// A kernel that knows UDP_SEGMENT answers for it even when it is not set
+	_, gsoErr := unix.GetsockoptInt(fd, unix.IPPROTO_UDP, unix.UDP_SEGMENT)
+
+	return &StdConn{sysFd: fd, isV4: ip.Is4(), l: l, batch: batch, gsoSupported: gsoErr == nil}, err
 }
 
 func (u *StdConn) Rebind() error {
@@ -119,6 +146,10 @@ func (u *StdConn) LocalAddr() (netip.AddrPort, error) {
 }
 
 func (u *StdConn) ListenOut(r EncReader) {
+	u.ListenOutBatch(r, func() {})
+}
+
+func (u *StdConn) ListenOutBatch(r EncReader, flush func()) {
 	var ip netip.Addr
 
 	msgs, buffers, names := u.PrepareRawMessages(u.batch)
@@ -127,9 +158,18 @@ func (u *StdConn) ListenOut(r EncReader) {
 		read = u.ReadSingle
 	}
 
+	n := len(msgs)
 	for {
-		n, err := read(msgs)
-		if err != nil {
+		if u.gro {
+			// The kernel overwrites the control length with what it wrote
+			for i := 0; i < n; i++ {
+				msgs[i].Hdr.setControllen(groControlLen)
+			}
+		}
+
+		var err error
+		n, err = read(msgs)
+		if err != nil || u.closed.Load() {
 			u.l.WithError(err).Debug("udp socket is closed, exiting read loop")
 			return
 		}
@@ -141,9 +181,52 @@ func (u *StdConn) ListenOut(r EncReader) {
 			} else {
 				ip, _ = netip.AddrFromSlice(names[i][8:24])
 			}
-			r(netip.AddrPortFrom(ip.Unmap(), binary.BigEndian.Uint16(names[i][2:4])), buffers[i][:msgs[i].Len])
+			addr := netip.AddrPortFrom(ip.Unmap(), binary.BigEndian.Uint16(names[i][2:4]))
+			payload := buffers[i][:msgs[i].Len]
+
+			size := 0
+			if u.gro {
+				size = groSegmentSize(msgs[i].Hdr.control())
+			}
+
+			if size <= 0 || size >= len(payload) {
+				r(addr, payload)
+				continue
+			}
+
+			// Every packet is the gro size except the last, which may be shorter
+			for len(payload) > 0 {
+				seg := min(size, len(payload))
+				r(addr, payload[:seg])
+				payload = payload[seg:]
+			}
+		}
+		flush()
+	}
+}
+
+// groSegmentSize returns the size of the packets that were coalesced into a read, 0 if the read is a single packet
+func groSegmentSize(control []byte) int {
+	for len(control) > 0 {
+		h, data, rest, err := unix.ParseOneSocketControlMessage(control)
+		if err != nil {
+			return 0
+		}
+
+		if h.Level == unix.IPPROTO_UDP && h.Type == unix.UDP_GRO && len(data) >= 4 {
+			return int(binary.NativeEndian.Uint32(data))
 		}
+		control = rest
 	}
+	return 0
+}
+
+// readBufferSize is how large each buffer handed to the kernel for a read must be
+func (u *StdConn) readBufferSize() int {
+	if u.gro {
+		return groBufferSize
+	}
+	return MTU
 }
 
 func (u *StdConn) ReadSingle(msgs []rawMessage) (int, error) {
@@ -219,6 +302,73 @@ func (u *StdConn) writeTo6(b []byte, ip netip.AddrPort) error {
 	}
 }
 
+// WriteBatch sends bufs to addr. With gso every run of packets of the same size, the last of which may be shorter, is
+// sent with a single syscall that the kernel splits back into the individual packets.
+func (u *StdConn) WriteBatch(bufs [][]byte, addr netip.AddrPort) error {
+	if len(bufs) < 2 || !u.gso.Load() {
+		for _, b := range bufs {
+			if err := u.WriteTo(b, addr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if u.isV4 && !addr.Addr().Is4() {
+		return ErrInvalidIPv6RemoteForSocket
+	}
+
+	var sa unix.Sockaddr
+	if u.isV4 {
+		sa = &unix.SockaddrInet4{Addr: addr.Addr().As4(), Port: int(addr.Port())}
+	} else {
+		sa = &unix.SockaddrInet6{Addr: addr.Addr().As16(), Port: int(addr.Port())}
+	}
+
+	oob := make([]byte, unix.CmsgSpace(2))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = unix.IPPROTO_UDP
+	h.Type = unix.UDP_SEGMENT
+	h.SetLen(unix.CmsgLen(2))
+
+	for i := 0; i < len(bufs); {
+		size := len(bufs[i])
+		total := size
+		j := i + 1
+		for j < len(bufs) && j-i < gsoMaxSegments && len(bufs[j]) <= size && total+len(bufs[j]) <= gsoMaxBytes {
+			total += len(bufs[j])
+			j++
+			if len(bufs[j-1]) < size {
+				// Only the last packet of a run may be shorter
+				break
+			}
+		}
+
+		if j-i == 1 {
+			if err := u.WriteTo(bufs[i], addr); err != nil {
+				return err
+			}
+			i = j
+			continue
+		}
+
+		binary.NativeEndian.PutUint16(oob[unix.CmsgLen(0):], uint16(size))
+		_, err := unix.SendmsgBuffers(u.sysFd, bufs[i:j], oob, sa, 0)
+		if errors.Is(err, unix.EIO) {
+			// The device the packets leave by can't checksum segments, send them one at a time from here on
+			u.l.WithError(err).Warn("udp gso failed, disabling listen.gso")
+			u.gso.Store(false)
+			return u.WriteBatch(bufs[i:], addr)
+		}
+		if err != nil {
+			return &net.OpError{Op: "sendmsg", Err: err}
+		}
+		i = j
+	}
+
+	return nil
+}
+
 func (u *StdConn) writeTo4(b []byte, ip netip.AddrPort) error {
 	if !ip.Addr().Is4() {
 		return ErrInvalidIPv6RemoteForSocket
@@ -249,6 +399,23 @@ func (u *StdConn) writeTo4(b []byte, ip netip.AddrPort) error {
 }
 
 func (u *StdConn) ReloadConfig(c *config.C) {
+	if c.InitialLoad() && c.GetBool("listen.gro", true) {
+		if err := unix.SetsockoptInt(u.sysFd, unix.IPPROTO_UDP, unix.UDP_GRO, 1); err == nil {
+			u.gro = true
+		} else {
+			u.l.WithError(err).Info("udp gro is not supported, packets will be received one at a time")
+		}
+	}
+
+	gso := c.GetBool("listen.gso", true)
+	if gso && !u.gsoSupported {
+		if c.InitialLoad() {
+			u.l.Info("udp gso is not supported, packets will be sent one at a time")
+		}
+		gso = false
+	}
+	u.gso.Store(gso)
+
 	b := c.GetInt("listen.read_buffer", 0)
 	if b > 0 {
 		err := u.SetRecvBuffer(b)
@@ -306,6 +473,9 @@ func (u *StdConn) getMemInfo(meminfo *[unix.SK_MEMINFO_VARS]uint32) error {
 }
 
 func (u *StdConn) Close() error {
+	u.closed.Store(true)
+	// Closing the descriptor does not wake a reader blocked on it, shutting the socket down does
+	_ = unix.Shutdown(u.sysFd, unix.SHUT_RDWR)
 	return syscall.Close(u.sysFd)
 }
 
@@ -313,7 +483,7 @@ func NewUDPStatsEmitter(udpConns []Conn) func() {
 	// Check if our kernel supports SO_MEMINFO before registering the gauges
 	var udpGauges [][unix.SK_MEMINFO_VARS]metrics.Gauge
 	var meminfo [unix.SK_MEMINFO_VARS]uint32
-	if err := udpConns[0].(*StdConn).getMemInfo(&meminfo); err == nil {
+	if err := Unwrap(udpConns[0]).(*StdConn).getMemInfo(&meminfo); err == nil {
 		udpGauges = make([][unix.SK_MEMINFO_VARS]metrics.Gauge, len(udpConns))
 		for i := range udpConns {
 			udpGauges[i] = [unix.SK_MEMINFO_VARS]metrics.Gauge{
@@ -332,7 +502,7 @@ func NewUDPStatsEmitter(udpConns []Conn) func() {
 
 	return func() {
 		for i, gauges := range udpGauges {
-			if err := udpConns[i].(*StdConn).getMemInfo(&meminfo); err == nil {
+			if err := Unwrap(udpConns[i]).(*StdConn).getMemInfo(&meminfo); err == nil {
 				for j := 0; j < unix.SK_MEMINFO_VARS; j++ {
 					gauges[j].Update(int64(meminfo[j]))
 				}
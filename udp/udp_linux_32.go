@@ -7,6 +7,8 @@
 package udp
 
 import (
+	"unsafe"
+
 	"golang.org/x/sys/unix"
 )
 
@@ -36,7 +38,7 @@ func (u *StdConn) PrepareRawMessages(n int) ([]rawMessage, [][]byte, [][]byte) {
 	names := make([][]byte, n)
 
 	for i := range msgs {
-		buffers[i] = make([]byte, MTU)
+		buffers[i] = make([]byte, u.readBufferSize())
 		names[i] = make([]byte, unix.SizeofSockaddrInet6)
 
 		vs := []iovec{
@@ -48,7 +50,25 @@ func (u *StdConn) PrepareRawMessages(n int) ([]rawMessage, [][]byte, [][]byte) {
 
 		msgs[i].Hdr.Name = &names[i][0]
 		msgs[i].Hdr.Namelen = uint32(len(names[i]))
+
+		if u.gro {
+			control := make([]byte, groControlLen)
+			msgs[i].Hdr.Control = &control[0]
+			msgs[i].Hdr.setControllen(len(control))
+		}
 	}
 
 	return msgs, buffers, names
 }
+
+func (h *msghdr) setControllen(n int) {
+	h.Controllen = uint32(n)
+}
+
+// control returns the control messages the kernel wrote with the last read
+func (h *msghdr) control() []byte {
+	if h.Control == nil {
+		return nil
+	}
+	return unsafe.Slice(h.Control, h.Controllen)
+}
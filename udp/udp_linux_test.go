@@ -0,0 +1,192 @@
+//go:build linux && !android && !e2e_testing
+// +build linux,!android,!e2e_testing
+
+package udp
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func newTestStdConn(t testing.TB, gro, gso bool) (*StdConn, netip.AddrPort) {
+	l := test.NewLogger()
+	c, err := NewListener(l, netip.MustParseAddr("127.0.0.1"), 0, false, 64)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = c.Close() })
+
+	cfg := config.NewC(l)
+	cfg.Settings["listen"] = map[string]any{"gro": gro, "gso": gso}
+	c.ReloadConfig(cfg)
+
+	addr, err := c.LocalAddr()
+	require.NoError(t, err)
+	return c.(*StdConn), addr
+}
+
+// testBatch makes n packets of size bytes, each filled with its index
+func testBatch(n, size int) [][]byte {
+	bufs := make([][]byte, n)
+	for i := range bufs {
+		bufs[i] = make([]byte, size)
+		for j := range bufs[i] {
+			bufs[i][j] = byte(i)
+		}
+	}
+	return bufs
+}
+
+func TestStdConn_WriteBatch(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		gro, gso bool
+	}{
+		{"plain", false, false},
+		{"gso", false, true},
+		{"gro", true, false},
+		{"gso and gro", true, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recv, recvAddr := newTestStdConn(t, tc.gro, false)
+			send, _ := newTestStdConn(t, false, tc.gso)
+
+			ch := make(chan []byte, 100)
+			go recv.ListenOut(func(_ netip.AddrPort, payload []byte) {
+				ch <- append([]byte(nil), payload...)
+			})
+
+			// A run of full packets ending in a short one, then a run of a different size, then a lone packet
+			var bufs [][]byte
+			bufs = append(bufs, testBatch(10, 1200)...)
+			bufs = append(bufs, make([]byte, 500))
+			bufs = append(bufs, testBatch(3, 800)...)
+			bufs = append(bufs, make([]byte, 1300))
+			for i := range bufs {
+				bufs[i][0] = byte(i)
+			}
+
+			require.NoError(t, WriteBatch(send, bufs, recvAddr))
+
+			for i, want := range bufs {
+				select {
+				case got := <-ch:
+					assert.Equal(t, want, got, "packet %d", i)
+				case <-time.After(5 * time.Second):
+					t.Fatalf("timed out waiting for packet %d", i)
+				}
+			}
+		})
+	}
+}
+
+func TestGroSegmentSize(t *testing.T) {
+	assert.Equal(t, 0, groSegmentSize(nil))
+	assert.Equal(t, 0, groSegmentSize([]byte{1, 2, 3}))
+
+	control := make([]byte, groControlLen)
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&control[0]))
+	h.Level = unix.IPPROTO_UDP
+	h.Type = unix.UDP_GRO
+	h.SetLen(unix.CmsgLen(4))
+	binary.NativeEndian.PutUint32(control[unix.CmsgLen(0):], 1200)
+	assert.Equal(t, 1200, groSegmentSize(control))
+
+	h.Type = unix.UDP_SEGMENT
+	assert.Equal(t, 0, groSegmentSize(control))
+}
+
+func TestStdConn_CloseWakesListenOut(t *testing.T) {
+	c, _ := newTestStdConn(t, false, false)
+
+	done := make(chan struct{})
+	go func() {
+		c.ListenOut(func(_ netip.AddrPort, _ []byte) {})
+		close(done)
+	}()
+
+	// Give the reader time to block on the socket
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, c.Close())
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ListenOut did not return after Close")
+	}
+}
+
+func benchmarkWrite(b *testing.B, gso bool) {
+	_, recvAddr := newTestStdConn(b, false, false)
+	send, _ := newTestStdConn(b, false, gso)
+	if gso && !send.gso.Load() {
+		b.Skip("udp gso is not supported")
+	}
+
+	bufs := testBatch(64, 1400)
+	b.SetBytes(int64(len(bufs) * 1400))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := send.WriteBatch(bufs, recvAddr); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStdConn_WriteTo(b *testing.B) {
+	benchmarkWrite(b, false)
+}
+
+func BenchmarkStdConn_WriteBatchGSO(b *testing.B) {
+	benchmarkWrite(b, true)
+}
+
+func benchmarkListenOut(b *testing.B, gro bool) {
+	recv, recvAddr := newTestStdConn(b, gro, false)
+	send, _ := newTestStdConn(b, false, true)
+	if gro && !recv.gro {
+		b.Skip("udp gro is not supported")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		bufs := testBatch(64, 1400)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			_ = send.WriteBatch(bufs, recvAddr)
+		}
+	}()
+
+	b.SetBytes(1400)
+	b.ReportAllocs()
+	b.ResetTimer()
+	count := 0
+	recv.ListenOut(func(_ netip.AddrPort, _ []byte) {
+		count++
+		if count == b.N {
+			// Closing the socket ends ListenOut at its next read
+			close(done)
+			_ = recv.Close()
+		}
+	})
+}
+
+func BenchmarkStdConn_ListenOut(b *testing.B) {
+	benchmarkListenOut(b, false)
+}
+
+func BenchmarkStdConn_ListenOutGRO(b *testing.B) {
+	benchmarkListenOut(b, true)
+}
@@ -0,0 +1,210 @@
+package udp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// webSocketStream is a packetStream that sends every packet as a single binary websocket message
+type webSocketStream struct {
+	*websocket.Conn
+}
+
+func newWebSocketStream(ws *websocket.Conn) *webSocketStream {
+	ws.PayloadType = websocket.BinaryFrame
+	ws.MaxPayloadBytes = MTU
+	return &webSocketStream{Conn: ws}
+}
+
+func (s *webSocketStream) readPacket(b []byte) (int, error) {
+	var msg []byte
+	if err := websocket.Message.Receive(s.Conn, &msg); err != nil {
+		return 0, err
+	}
+
+	if len(msg) > len(b) {
+		return 0, fmt.Errorf("packet of %d bytes is too large", len(msg))
+	}
+
+	return copy(b, msg), nil
+}
+
+func (s *webSocketStream) writePacket(b []byte) error {
+	return websocket.Message.Send(s.Conn, b)
+}
+
+// serveWebSocket reads the http request that starts a websocket from r and completes the handshake. serve is called
+// with the websocket and it is closed once serve returns.
+func serveWebSocket(c net.Conn, r *bufio.Reader, serve func(packetStream)) error {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return err
+	}
+
+	served := false
+	websocket.Server{
+		// Any origin is fine, nebula authenticates the host in its own handshake
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			served = true
+			serve(newWebSocketStream(ws))
+		},
+	}.ServeHTTP(&hijackedResponse{c: c, rw: bufio.NewReadWriter(r, bufio.NewWriter(c))}, req)
+
+	if !served {
+		return fmt.Errorf("websocket handshake failed for %s", req.URL)
+	}
+	return nil
+}
+
+// hijackedResponse hands an accepted connection to websocket.Server, which hijacks it before writing anything
+type hijackedResponse struct {
+	c  net.Conn
+	rw *bufio.ReadWriter
+}
+
+func (h *hijackedResponse) Header() http.Header {
+	return http.Header{}
+}
+
+func (h *hijackedResponse) Write(b []byte) (int, error) {
+	return h.c.Write(b)
+}
+
+func (h *hijackedResponse) WriteHeader(int) {}
+
+func (h *hijackedResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return h.c, h.rw, nil
+}
+
+// dialWebSocket connects to a ws:// or wss:// url, through an http proxy if proxy returns one for it. Like the tcp
+// transport the certificate of a wss:// server is not verified since nebula authenticates the host itself.
+func dialWebSocket(u *url.URL, proxy func(*http.Request) (*url.URL, error)) (packetStream, error) {
+	secure := false
+	origin := url.URL{Scheme: "http", Host: u.Host}
+	switch u.Scheme {
+	case "ws":
+	case "wss":
+		secure = true
+		origin.Scheme = "https"
+	default:
+		return nil, fmt.Errorf("websocket url scheme %q is not ws or wss", u.Scheme)
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if secure {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+
+	// The proxy is picked for the url as if it were http, that is what HTTP_PROXY, HTTPS_PROXY, and NO_PROXY describe
+	proxyURL, err := proxy(&http.Request{URL: &url.URL{Scheme: origin.Scheme, Host: u.Host, Path: u.Path}})
+	if err != nil {
+		return nil, err
+	}
+
+	var c net.Conn
+	if proxyURL != nil {
+		c, err = dialProxyConnect(proxyURL, host)
+	} else {
+		d := net.Dialer{Timeout: tcpDialTimeout}
+		c, err = d.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_ = c.SetDeadline(time.Now().Add(tcpDialTimeout))
+	if secure {
+		tlsConn := tls.Client(c, &tls.Config{
+			ServerName:         u.Hostname(),
+			InsecureSkipVerify: true,
+			MinVersion:         tls.VersionTLS12,
+		})
+		if err = tlsConn.Handshake(); err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+		c = tlsConn
+	}
+
+	cfg, err := websocket.NewConfig(u.String(), origin.String())
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+
+	ws, err := websocket.NewClient(cfg, c)
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	_ = c.SetDeadline(time.Time{})
+
+	return newWebSocketStream(ws), nil
+}
+
+// dialProxyConnect opens a tunnel to host with an http CONNECT request to the proxy
+func dialProxyConnect(proxyURL *url.URL, host string) (net.Conn, error) {
+	if proxyURL.Scheme != "http" {
+		return nil, fmt.Errorf("proxy url scheme %q is not supported, only http proxies are", proxyURL.Scheme)
+	}
+
+	proxyHost := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyHost = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+
+	d := net.Dialer{Timeout: tcpDialTimeout}
+	c, err := d.Dial("tcp", proxyHost)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: host},
+		Host:   host,
+		Header: http.Header{},
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	_ = c.SetDeadline(time.Now().Add(tcpDialTimeout))
+	if err = req.Write(c); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+
+	// Nothing is sent through the tunnel until we speak, so the reader can not buffer past the response
+	resp, err := http.ReadResponse(bufio.NewReader(c), req)
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = c.Close()
+		return nil, fmt.Errorf("proxy %s refused to connect to %s: %s", proxyURL.Redacted(), host, resp.Status)
+	}
+	_ = c.SetDeadline(time.Time{})
+
+	return c, nil
+}
@@ -0,0 +1,141 @@
+package udp
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testTCPConnWebSocket(t *testing.T, useTLS bool, proxy func(*http.Request) (*url.URL, error)) {
+	l := test.NewLogger()
+
+	serverCfg := TCPConfig{Listen: netip.MustParseAddrPort("127.0.0.1:0"), TLS: useTLS}
+	if useTLS {
+		serverCfg.Certificate = testTLSCertificate(t)
+	}
+	server, err := NewTCPConn(l, serverCfg)
+	require.NoError(t, err)
+	serverIn := listenTCP(t, server)
+
+	serverAddr, err := server.LocalAddr()
+	require.NoError(t, err)
+
+	u := &url.URL{Scheme: "ws", Host: serverAddr.String(), Path: "/nebula"}
+	if useTLS {
+		u.Scheme = "wss"
+	}
+
+	// The address the websocket is known by has nothing to do with where it goes
+	wsAddr := netip.MustParseAddrPort("[100::1]:443")
+	client, err := NewTCPConn(l, TCPConfig{
+		IsRemote: func(addr netip.AddrPort) bool { return addr == wsAddr },
+		WebSocketURL: func(addr netip.AddrPort) (*url.URL, bool) {
+			return u, addr == wsAddr
+		},
+		Proxy: proxy,
+	})
+	require.NoError(t, err)
+	clientIn := listenTCP(t, client)
+
+	require.NoError(t, client.WriteTo([]byte("hello"), wsAddr))
+	require.NoError(t, client.WriteTo([]byte("world!"), wsAddr))
+	p := recvTCP(t, serverIn)
+	assert.Equal(t, []byte("hello"), p.b)
+	assert.Equal(t, []byte("world!"), recvTCP(t, serverIn).b)
+
+	// The server answers over the websocket
+	require.NoError(t, server.WriteTo([]byte("hey"), p.addr))
+	reply := recvTCP(t, clientIn)
+	assert.Equal(t, wsAddr, reply.addr)
+	assert.Equal(t, []byte("hey"), reply.b)
+
+	large := make([]byte, MTU)
+	large[MTU-1] = 1
+	require.NoError(t, client.WriteTo(large, wsAddr))
+	assert.Equal(t, large, recvTCP(t, serverIn).b)
+}
+
+func TestTCPConn_WebSocket(t *testing.T) {
+	testTCPConnWebSocket(t, false, noProxy)
+}
+
+func TestTCPConn_WebSocketTLS(t *testing.T) {
+	testTCPConnWebSocket(t, true, noProxy)
+}
+
+func TestTCPConn_WebSocketProxy(t *testing.T) {
+	proxyURL, connects := testConnectProxy(t)
+	testTCPConnWebSocket(t, true, http.ProxyURL(proxyURL))
+	assert.Equal(t, int32(1), connects.Load())
+}
+
+func TestDialProxyConnect_Refused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = http.ReadRequest(bufio.NewReader(c))
+		_, _ = io.WriteString(c, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+	}()
+
+	_, err = dialProxyConnect(&url.URL{Scheme: "http", Host: ln.Addr().String()}, "127.0.0.1:1")
+	require.ErrorContains(t, err, "403")
+}
+
+func noProxy(*http.Request) (*url.URL, error) {
+	return nil, nil
+}
+
+// testConnectProxy runs an http proxy that only understands CONNECT, it counts the tunnels it has made
+func testConnectProxy(t *testing.T) (*url.URL, *atomic.Int32) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+
+	connects := &atomic.Int32{}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer c.Close()
+				req, err := http.ReadRequest(bufio.NewReader(c))
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					_, _ = io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+
+				connects.Add(1)
+				_, _ = io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go func() { _, _ = io.Copy(target, c) }()
+				_, _ = io.Copy(c, target)
+			}()
+		}
+	}()
+
+	return &url.URL{Scheme: "http", Host: ln.Addr().String()}, connects
+}